@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jfperren/Peerster/common"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A subcommand of the capture tool
+type subcommand struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+var subcommands = map[string]*subcommand{
+	"show":   {"show [-json] [-direction <in|out>] [-peer <address>] [-type <type>] <file>", "Print the packets of a capture", runShow},
+	"replay": {"replay -to <address> [-from <address>] [-speed <factor>] [-direction <in|out>] [-peer <address>] <file>", "Send the packets of a capture to a node over UDP", runReplay},
+}
+
+func main() {
+
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	subcommand, found := subcommands[args[0]]
+
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown command %v\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := subcommand.run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+
+	fmt.Fprintf(os.Stderr, "Usage: capture <command> [arguments]\n\nCommands:\n")
+
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %v\n      %v\n", subcommands[name].usage, subcommands[name].description)
+	}
+}
+
+//
+//  SUBCOMMANDS
+//
+
+func runShow(args []string) error {
+
+	flags := newFlagSet("show")
+	jsonOutput := flags.Bool("json", false, "print one JSON object per packet")
+	filter := addFilterFlags(flags, "")
+	flags.Parse(args)
+
+	packets, err := readCapture(flags)
+	if err != nil {
+		return err
+	}
+
+	for _, captured := range packets {
+
+		packet, err := captured.Decode()
+
+		if !filter.matches(captured, packet) {
+			continue
+		}
+
+		view := newPacketView(captured, packet, err)
+
+		if *jsonOutput {
+			bytes, _ := json.Marshal(view)
+			fmt.Println(string(bytes))
+		} else {
+			fmt.Printf("%v %-3v %-21v %-13v %v\n", captured.Timestamp().Format("15:04:05.000000"), view.Direction,
+				view.Peer, view.Type, describe(packet, err))
+		}
+	}
+
+	return nil
+}
+
+// Send the packets to a node with their original spacing, divided by speed
+func runReplay(args []string) error {
+
+	flags := newFlagSet("replay")
+	to := flags.String("to", "", "gossip address of the node receiving the packets")
+	from := flags.String("from", "127.0.0.1:0", "UDP address from which packets are sent, seen by the node as their source")
+	speed := flags.Float64("speed", 1, "speed of the replay relative to the capture, 0 to send packets without waiting")
+	filter := addFilterFlags(flags, common.CaptureIncoming)
+	flags.Parse(args)
+
+	if *to == "" {
+		return fmt.Errorf("replay expects the address of a node with -to")
+	}
+
+	packets, err := readCapture(flags)
+	if err != nil {
+		return err
+	}
+
+	source, err := net.ResolveUDPAddr("udp4", *from)
+	if err != nil {
+		return err
+	}
+
+	destination, err := net.ResolveUDPAddr("udp4", *to)
+	if err != nil {
+		return err
+	}
+
+	connection, err := net.ListenUDP("udp4", source)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	var previous *common.CapturedPacket
+	sent := 0
+
+	for _, captured := range packets {
+
+		packet, _ := captured.Decode()
+
+		if !filter.matches(captured, packet) {
+			continue
+		}
+
+		if len(captured.Bytes) > common.SocketBufferSize {
+			fmt.Fprintf(os.Stderr, "Skipping %v packet of %v bytes, too big for a datagram\n", typeOf(packet), len(captured.Bytes))
+			continue
+		}
+
+		if previous != nil && *speed > 0 {
+			time.Sleep(time.Duration(float64(captured.Time-previous.Time) / *speed))
+		}
+
+		if _, err := connection.WriteToUDP(captured.Bytes, destination); err != nil {
+			return err
+		}
+
+		previous = captured
+		sent++
+	}
+
+	fmt.Printf("Replayed %v packets to %v\n", sent, *to)
+	return nil
+}
+
+func readCapture(flags *flag.FlagSet) ([]*common.CapturedPacket, error) {
+
+	if flags.NArg() != 1 {
+		return nil, fmt.Errorf("%v expects one capture file", flags.Name())
+	}
+
+	return common.ReadCapture(flags.Arg(0))
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+//
+//  FILTERS
+//
+
+// Packets selected by the flags of a subcommand
+type filter struct {
+	direction *string
+	peer      *string
+	kind      *string
+}
+
+func addFilterFlags(flags *flag.FlagSet, direction string) *filter {
+	return &filter{
+		direction: flags.String("direction", direction, "only packets received (in) or sent (out) by the node, both if empty"),
+		peer:      flags.String("peer", "", "only packets exchanged with this address"),
+		kind:      flags.String("type", "", "only packets of this type, e.g. rumor, status or dataReply"),
+	}
+}
+
+func (filter *filter) matches(captured *common.CapturedPacket, packet *common.GossipPacket) bool {
+	return (*filter.direction == "" || captured.Direction == *filter.direction) &&
+		(*filter.peer == "" || captured.Peer == *filter.peer) &&
+		(*filter.kind == "" || typeOf(packet) == *filter.kind)
+}
+
+//
+//  OUTPUT
+//
+
+type packetView struct {
+	Time      string
+	Direction string
+	Peer      string
+	Type      string
+	Size      int
+	Packet    *common.GossipPacket `json:",omitempty"`
+	Error     string               `json:",omitempty"` // Why the packet could not be decoded
+}
+
+func newPacketView(captured *common.CapturedPacket, packet *common.GossipPacket, err error) *packetView {
+
+	view := &packetView{
+		Time:      captured.Timestamp().Format(time.RFC3339Nano),
+		Direction: captured.Direction,
+		Peer:      captured.Peer,
+		Type:      typeOf(packet),
+		Size:      len(captured.Bytes),
+		Packet:    packet,
+	}
+
+	if err != nil {
+		view.Error = err.Error()
+	}
+
+	return view
+}
+
+func typeOf(packet *common.GossipPacket) string {
+
+	if packet == nil || !packet.IsValid() {
+		return "invalid"
+	}
+
+	return packet.Type()
+}
+
+// One-line summary of the content of a packet
+func describe(packet *common.GossipPacket, err error) string {
+
+	if err != nil {
+		return fmt.Sprintf("could not decode: %v", err)
+	}
+
+	if !packet.IsValid() {
+		return "not exactly one kind of message"
+	}
+
+	summary := ""
+
+	switch {
+
+	case packet.Simple != nil:
+		summary = fmt.Sprintf("%v via %v %q", packet.Simple.OriginalName, packet.Simple.RelayPeerAddr, packet.Simple.Contents)
+
+	case packet.Rumor != nil:
+		summary = fmt.Sprintf("%v #%v %q", packet.Rumor.Origin, packet.Rumor.ID, packet.Rumor.Text)
+
+	case packet.Status != nil:
+
+		want := make([]string, 0)
+		for _, status := range packet.Status.Want {
+			want = append(want, fmt.Sprintf("%v:%v", status.Identifier, status.NextID))
+		}
+
+		summary = "want " + strings.Join(want, " ")
+
+	case packet.Private != nil:
+		summary = fmt.Sprintf("%v -> %v hop %v %q", packet.Private.Origin, packet.Private.Destination,
+			packet.Private.HopLimit, packet.Private.Text)
+
+	case packet.DataRequest != nil:
+		summary = fmt.Sprintf("%v -> %v hop %v hash %v", packet.DataRequest.Origin, packet.DataRequest.Destination,
+			packet.DataRequest.HopLimit, hex.EncodeToString(packet.DataRequest.HashValue))
+
+	case packet.DataReply != nil:
+		summary = fmt.Sprintf("%v -> %v hop %v hash %v (%v bytes)", packet.DataReply.Origin, packet.DataReply.Destination,
+			packet.DataReply.HopLimit, hex.EncodeToString(packet.DataReply.HashValue), len(packet.DataReply.Data))
+
+	case packet.SearchRequest != nil:
+		summary = fmt.Sprintf("%v budget %v keywords %v", packet.SearchRequest.Origin, packet.SearchRequest.Budget,
+			strings.Join(packet.SearchRequest.Keywords, ","))
+
+	case packet.SearchReply != nil:
+		summary = fmt.Sprintf("%v -> %v hop %v (%v results)", packet.SearchReply.Origin, packet.SearchReply.Destination,
+			packet.SearchReply.HopLimit, len(packet.SearchReply.Results))
+
+	case packet.TxPublish != nil:
+		summary = fmt.Sprintf("%v #%v hop %v file %v user %v", packet.TxPublish.Origin, packet.TxPublish.ID,
+			packet.TxPublish.HopLimit, packet.TxPublish.File.Name, packet.TxPublish.User.Name)
+
+	case packet.BlockPublish != nil:
+		block := &packet.BlockPublish.Block
+		hash := block.Hash()
+		summary = fmt.Sprintf("%v #%v hop %v block %v prev %v (%v transactions)", packet.BlockPublish.Origin,
+			packet.BlockPublish.ID, packet.BlockPublish.HopLimit, hex.EncodeToString(hash[:]),
+			hex.EncodeToString(block.PrevHash[:]), len(block.Transactions))
+
+	case packet.Cyphered != nil:
+		summary = fmt.Sprintf("-> %v hop %v (%v bytes)", packet.Cyphered.Destination, packet.Cyphered.HopLimit,
+			len(packet.Cyphered.Payload))
+
+	case packet.Onion != nil:
+		summary = fmt.Sprintf("-> %v hop %v", packet.Onion.Destination, packet.Onion.HopLimit)
+
+	case packet.Fragment != nil:
+		summary = fmt.Sprintf("packet %v fragment %v/%v (%v bytes)", packet.Fragment.ID, packet.Fragment.Index+1,
+			packet.Fragment.Count, len(packet.Fragment.Data))
+
+	case packet.PeerExchange != nil:
+		summary = fmt.Sprintf("peers %v", strings.Join(packet.PeerExchange.Peers, ","))
+
+		if packet.PeerExchange.Reply {
+			summary += " (reply)"
+		}
+	}
+
+	if packet.Signature != nil {
+		summary += fmt.Sprintf(" signed by %v", packet.Signature.Origin)
+	}
+
+	return summary
+}
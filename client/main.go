@@ -1,69 +1,636 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"flag"
-	"github.com/dedis/protobuf"
+	"fmt"
 	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/peerster"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func main() {
+// A subcommand of the client
+type subcommand struct {
+	usage       string
+	description string
+	run         func(client *peerster.Client, args []string) error
+}
+
+var subcommands = map[string]*subcommand{
+	"send":      {"send <text>", "Gossip a rumor", runSend},
+	"dm":        {"dm -to <name> <text>", "Send a private message", runPrivateMessage},
+	"share":     {"share <file>", "Share a file of the shared files folder and print its hash", runShare},
+	"get":       {"get [-from <name>] <hash> <file>", "Download a file, from the nodes found by searches if -from is not given", runGet},
+	"search":    {"search [-budget <n>] [-wait <duration>] <keyword,...>", "Search the network for files and print the matches", runSearch},
+	"downloads": {"downloads", "List downloads and their progress", runDownloads},
+	"pause":     {"pause <hash>", "Pause a download", runPause},
+	"resume":    {"resume <hash>", "Resume a paused or failed download", runResume},
+	"cancel":    {"cancel <hash>", "Cancel a download", runCancel},
+	"peers":     {"peers", "List the neighbors of the node", runPeers},
+	"routes":    {"routes", "Print the routing table of the node", runRoutes},
+	"chain":     {"chain", "Print the latest blocks of the longest chain", runChain},
+	"status":    {"status", "Print the name and the vector clock of the node", runStatus},
+	"files":     {"files", "List the files shared or downloaded by the node", runFiles},
+	"results":   {"results [<keyword,...>]", "List the search results received so far, or those matching keywords", runResults},
+}
 
-	// Define Flags
+// Print results as JSON instead of text
+var jsonOutput bool
+
+func main() {
 
 	uiPort := flag.String("UIPort", "8080", "port for the UI client")
-	message := flag.String("msg", "Test message", "message to be sent")
+	flag.BoolVar(&jsonOutput, "json", false, "print results as JSON")
+	timeout := flag.Duration("timeout", common.ClientTimeout, "how long to wait for the node to respond")
+
+	// Flags of the previous versions of the client, used when no subcommand is given
+	message := flag.String("msg", "", "message to be sent")
 	dest := flag.String("dest", "", "destination for the private message")
 	file := flag.String("file", "", "file to be indexed by the gossiper, or filename of the requested file")
 	request := flag.String("request", "", "request a chunk or metafile of this hash")
 	keywords := flag.String("keywords", "", "comma-separated list of keywords for search")
 	budget := flag.Uint64("budget", common.SearchNoBudget, "budget for file search (optional)")
+	downloads := flag.Bool("downloads", false, "list downloads and their progress")
+	pause := flag.String("pause", "", "pause the download of the file with this hash")
+	resume := flag.String("resume", "", "resume the download of the file with this hash")
+	cancel := flag.String("cancel", "", "cancel the download of the file with this hash")
 
+	flag.Usage = usage
 	flag.Parse()
 
-	// Packet to send
-	var command *common.Command
-	var commandError error
+	args := flag.Args()
+
+	if len(args) == 0 {
+
+		switch {
+		case *downloads:
+			args = []string{"downloads"}
+		case *pause != "":
+			args = []string{"pause", *pause}
+		case *resume != "":
+			args = []string{"resume", *resume}
+		case *cancel != "":
+			args = []string{"cancel", *cancel}
+		case *keywords != "":
+			args = []string{"search", "-budget", strconv.FormatUint(*budget, 10), "-wait", "0", *keywords}
+		case *request != "":
+			args = []string{"get", "-from", *dest, *request, *file}
+		case *file != "":
+			args = []string{"share", *file}
+		case *dest != "":
+			args = []string{"dm", "-to", *dest, *message}
+		case *message != "":
+			args = []string{"send", *message}
+		default:
+			usage()
+			os.Exit(2)
+		}
+	}
+
+	subcommand, found := subcommands[args[0]]
+
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown command %v\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+
+	client, err := peerster.Dial(":" + *uiPort)
+	if err != nil {
+		fail(err)
+	}
 
-	switch {
+	client.Timeout = *timeout
+	defer client.Close()
 
-	case *keywords != "":
+	if err := subcommand.run(client, args[1:]); err != nil {
+		client.Close()
+		fail(err)
+	}
+}
 
-		command, commandError = common.NewSearchCommand(*keywords, *budget)
+func usage() {
 
-	case *request != "":
+	fmt.Fprintf(os.Stderr, "Usage: client [-UIPort <port>] [-json] [-timeout <duration>] <command> [arguments]\n\nCommands:\n")
 
-		command, commandError = common.NewDownloadCommand(*request, *file, *dest)
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	case *file != "":
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-55v %v\n", subcommands[name].usage, subcommands[name].description)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
 
-		command, commandError = common.NewUploadCommand(*file)
+// Report an error and exit
+func fail(err error) {
 
-	case *dest != "":
+	if jsonOutput {
+		code := ""
+		if e, ok := err.(*common.ResponseError); ok {
+			code = e.Code
+		}
 
-		command, commandError = common.NewPrivateMessageCommand(*message, *dest)
+		printJSON(&result{false, code, err.Error()})
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
 
-	case *message != "":
+	os.Exit(1)
+}
 
-		command, commandError = common.NewMessageCommand(*message)
+//
+//  SUBCOMMANDS
+//
 
-	default:
+func runSend(client *peerster.Client, args []string) error {
 
-		panic("No message specified, unclear instructions.")
+	command, err := common.NewMessageCommand(strings.Join(args, " "))
+	if err != nil {
+		return err
 	}
 
-	if commandError != nil {
-		panic(commandError)
+	return sendAndAcknowledge(client, command)
+}
+
+func runPrivateMessage(client *peerster.Client, args []string) error {
+
+	flags := newFlagSet("dm")
+	to := flags.String("to", "", "name of the destination")
+	flags.Parse(args)
+
+	command, err := common.NewPrivateMessageCommand(strings.Join(flags.Args(), " "), *to)
+	if err != nil {
+		return err
 	}
 
-	// Encodes message
-	bytes, encodeError := protobuf.Encode(command)
-	if encodeError != nil {
-		panic(encodeError)
+	return sendAndAcknowledge(client, command)
+}
+
+func runShare(client *peerster.Client, args []string) error {
+
+	if len(args) != 1 {
+		return fmt.Errorf("share expects one file name")
+	}
+
+	command, err := common.NewUploadCommand(args[0])
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Send(command)
+	if err != nil {
+		return err
+	}
+
+	file := &fileView{Name: args[0], Hash: hex.EncodeToString(response.MetaHash)}
+
+	if jsonOutput {
+		printJSON(file)
+	} else {
+		fmt.Printf("%v %v\n", file.Hash, file.Name)
+	}
+
+	return nil
+}
+
+func runGet(client *peerster.Client, args []string) error {
+
+	flags := newFlagSet("get")
+	from := flags.String("from", "", "name of the node to download from")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return fmt.Errorf("get expects a hash and a file name")
+	}
+
+	command, err := common.NewDownloadCommand(flags.Arg(0), flags.Arg(1), *from)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Send(command)
+	if err != nil {
+		return err
+	}
+
+	if len(response.Downloads) != 1 {
+		return fmt.Errorf("the node did not report the download")
+	}
+
+	download := newDownloadView(response.Downloads[0])
+
+	if jsonOutput {
+		printJSON(download)
+	} else {
+		download.print()
+	}
+
+	return nil
+}
+
+// Start a search, then poll the matches until the wait duration is over. In text mode, matches are printed
+// as they arrive.
+func runSearch(client *peerster.Client, args []string) error {
+
+	flags := newFlagSet("search")
+	budget := flags.Uint64("budget", common.SearchNoBudget, "budget of the search, 0 to increase it until enough matches are found")
+	wait := flags.Duration("wait", 5*time.Second, "how long to wait for matches")
+	flags.Parse(args)
+
+	query := strings.Join(flags.Args(), common.SearchKeywordSeparator)
+
+	command, err := common.NewSearchCommand(query, *budget)
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.Send(command); err != nil {
+		return err
+	}
+
+	list, _ := common.NewListMatchesCommand(query)
+	deadline := time.Now().Add(*wait)
+	matches := make([]*matchView, 0)
+	seen := make(map[string]bool)
+
+	for {
+
+		response, err := client.Send(list)
+		if err != nil {
+			return err
+		}
+
+		for _, found := range response.Matches {
+
+			match := newMatchView(found)
+
+			if seen[match.Name+match.Hash] {
+				continue
+			}
+
+			seen[match.Name+match.Hash] = true
+			matches = append(matches, match)
+
+			if !jsonOutput {
+				match.print()
+			}
+		}
+
+		if !time.Now().Before(deadline) {
+			break
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	if jsonOutput {
+		printJSON(matches)
+	}
+
+	return nil
+}
+
+func runDownloads(client *peerster.Client, args []string) error {
+
+	command, _ := common.NewListDownloadsCommand()
+
+	response, err := client.Send(command)
+	if err != nil {
+		return err
+	}
+
+	downloads := make([]*downloadView, 0)
+
+	for _, download := range response.Downloads {
+		downloads = append(downloads, newDownloadView(download))
+	}
+
+	if jsonOutput {
+		printJSON(downloads)
+		return nil
+	}
+
+	for _, download := range downloads {
+		download.print()
+	}
+
+	return nil
+}
+
+func runPause(client *peerster.Client, args []string) error {
+	return controlDownload(client, args, common.NewPauseDownloadCommand)
+}
+
+func runResume(client *peerster.Client, args []string) error {
+	return controlDownload(client, args, common.NewResumeDownloadCommand)
+}
+
+func runCancel(client *peerster.Client, args []string) error {
+	return controlDownload(client, args, common.NewCancelDownloadCommand)
+}
+
+func controlDownload(client *peerster.Client, args []string, newCommand func(string) (*common.Command, error)) error {
+
+	if len(args) != 1 {
+		return fmt.Errorf("expected the hash of a download")
+	}
+
+	command, err := newCommand(args[0])
+	if err != nil {
+		return err
+	}
+
+	return sendAndAcknowledge(client, command)
+}
+
+func runPeers(client *peerster.Client, args []string) error {
+
+	command, _ := common.NewListPeersCommand()
+
+	response, err := client.Send(command)
+	if err != nil {
+		return err
+	}
+
+	peers := make([]string, 0)
+
+	for _, peer := range response.Peers {
+		if peer != "" {
+			peers = append(peers, peer)
+		}
 	}
 
-	// Send
-	socket := common.NewUDPSocket(":5050")
-	socket.Send(bytes, ":"+*uiPort)
-	socket.Unbind()
+	if jsonOutput {
+		printJSON(peers)
+		return nil
+	}
+
+	for _, peer := range peers {
+		fmt.Println(peer)
+	}
+
+	return nil
+}
+
+func runRoutes(client *peerster.Client, args []string) error {
+
+	command, _ := common.NewListRoutesCommand()
+
+	response, err := client.Send(command)
+	if err != nil {
+		return err
+	}
+
+	routes := response.Routes
+	if routes == nil {
+		routes = make([]*common.Route, 0)
+	}
+
+	if jsonOutput {
+		printJSON(routes)
+		return nil
+	}
+
+	for _, route := range routes {
+		fmt.Printf("%v via %v\n", route.Origin, route.Address)
+	}
+
+	return nil
+}
+
+func runChain(client *peerster.Client, args []string) error {
+
+	command, _ := common.NewListBlocksCommand()
+
+	response, err := client.Send(command)
+	if err != nil {
+		return err
+	}
+
+	blocks := make([]*blockView, 0)
+
+	for _, block := range response.Blocks {
+
+		view := &blockView{
+			Hash:     hex.EncodeToString(block.Hash),
+			PrevHash: hex.EncodeToString(block.PrevHash),
+			Files:    make([]*fileView, 0),
+			Users:    block.Users,
+		}
+
+		for _, file := range block.Files {
+			view.Files = append(view.Files, &fileView{file.Name, hex.EncodeToString(file.MetafileHash), file.Size})
+		}
+
+		if view.Users == nil {
+			view.Users = make([]string, 0)
+		}
+
+		blocks = append(blocks, view)
+	}
+
+	if jsonOutput {
+		printJSON(blocks)
+		return nil
+	}
+
+	for _, block := range blocks {
+
+		fmt.Printf("%v\n", block.Hash)
+
+		for _, file := range block.Files {
+			fmt.Printf("  file %v %v\n", file.Hash, file.Name)
+		}
+
+		for _, user := range block.Users {
+			fmt.Printf("  user %v\n", user)
+		}
+	}
+
+	return nil
+}
+
+func runStatus(client *peerster.Client, args []string) error {
+
+	command, _ := common.NewStatusCommand()
+
+	response, err := client.Send(command)
+	if err != nil {
+		return err
+	}
+
+	status := &statusView{response.Name, make(map[string]uint32)}
+
+	for _, peerStatus := range response.Status {
+		status.NextIDs[peerStatus.Identifier] = peerStatus.NextID
+	}
+
+	if jsonOutput {
+		printJSON(status)
+		return nil
+	}
+
+	fmt.Println(status.Name)
+
+	for _, peerStatus := range response.Status {
+		fmt.Printf("  %v %v\n", peerStatus.Identifier, peerStatus.NextID)
+	}
+
+	return nil
+}
+
+func runFiles(client *peerster.Client, args []string) error {
+
+	command, _ := common.NewListFilesCommand()
+
+	response, err := client.Send(command)
+	if err != nil {
+		return err
+	}
+
+	files := make([]*fileView, 0)
+
+	for _, file := range response.Files {
+		files = append(files, &fileView{file.Name, hex.EncodeToString(file.MetafileHash), file.Size})
+	}
+
+	if jsonOutput {
+		printJSON(files)
+		return nil
+	}
+
+	for _, file := range files {
+		fmt.Printf("%v %v %v\n", file.Hash, file.Name, file.Size)
+	}
+
+	return nil
+}
+
+func runResults(client *peerster.Client, args []string) error {
+
+	command, _ := common.NewListMatchesCommand(strings.Join(args, common.SearchKeywordSeparator))
+
+	response, err := client.Send(command)
+	if err != nil {
+		return err
+	}
+
+	matches := make([]*matchView, 0)
+
+	for _, found := range response.Matches {
+		matches = append(matches, newMatchView(found))
+	}
+
+	if jsonOutput {
+		printJSON(matches)
+		return nil
+	}
+
+	for _, match := range matches {
+		match.print()
+	}
+
+	return nil
+}
+
+//
+//  OUTPUT
+//
+
+// Outcome of a command that has no other result
+type result struct {
+	OK    bool
+	Code  string `json:",omitempty"` // Code of the error reported by the node, see common.ResponseError
+	Error string `json:",omitempty"`
+}
+
+type fileView struct {
+	Name string
+	Hash string
+	Size int64 `json:",omitempty"`
+}
+
+type matchView struct {
+	Name       string
+	Hash       string
+	Chunks     int    // Number of chunks available from the node that answered
+	ChunkCount uint64 // Number of chunks of the file
+}
+
+type downloadView struct {
+	Name    string
+	Hash    string
+	State   string
+	Done    uint32
+	Total   uint32
+	Seeders []string
+}
+
+type statusView struct {
+	Name    string
+	NextIDs map[string]uint32 // Next rumor ID expected from each origin
+}
+
+type blockView struct {
+	Hash     string
+	PrevHash string
+	Files    []*fileView
+	Users    []string
+}
+
+func newMatchView(result *common.SearchResult) *matchView {
+	return &matchView{result.FileName, hex.EncodeToString(result.MetafileHash), len(result.ChunkMap), result.ChunkCount}
+}
+
+func (match *matchView) print() {
+	fmt.Printf("%v %v (%v/%v chunks)\n", match.Hash, match.Name, match.Chunks, match.ChunkCount)
+}
+
+func newDownloadView(download *common.DownloadInfo) *downloadView {
+	return &downloadView{
+		Name:    download.Name,
+		Hash:    hex.EncodeToString(download.MetaHash),
+		State:   download.State,
+		Done:    download.Done,
+		Total:   download.Total,
+		Seeders: download.Seeders,
+	}
+}
+
+func (download *downloadView) print() {
+	fmt.Printf("%v %v %v %v/%v\n", download.Hash, download.Name, download.State, download.Done, download.Total)
+}
+
+// Send a command that has no result and report that it succeeded
+func sendAndAcknowledge(client *peerster.Client, command *common.Command) error {
+
+	if _, err := client.Send(command); err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		printJSON(&result{OK: true})
+	}
+
+	return nil
+}
+
+func printJSON(value interface{}) {
+	bytes, _ := json.MarshalIndent(value, "", "  ")
+	fmt.Println(string(bytes))
+}
 
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ExitOnError)
 }
@@ -0,0 +1,154 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/dedis/protobuf"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Capture records the raw GossipPackets a node sends and receives into a file, so that traffic can be
+// inspected and replayed offline, e.g. to reproduce an interoperability bug with another implementation.
+//
+// The file starts with CaptureMagic, followed by CapturedPackets. As in the journals of DiskStorage, each
+// one is protobuf-encoded and prefixed by its length. A packet that was only partially written (e.g. the
+// node crashed) is ignored when reading.
+type Capture struct {
+	file *os.File
+	lock *sync.Mutex
+}
+
+// A packet as it was sent or received by a node
+type CapturedPacket struct {
+	Time      int64  // Unix time in nanoseconds
+	Direction string // CaptureIncoming or CaptureOutgoing
+	Peer      string // Address of the neighbor that sent or received the packet
+	Bytes     []byte // Encoded GossipPacket
+}
+
+// Directions of captured packets
+const (
+	CaptureIncoming = "in"
+	CaptureOutgoing = "out"
+)
+
+// First bytes of a capture file
+const CaptureMagic = "PEERSTER CAPTURE 1\n"
+
+// Error returned when reading a file that is not a capture
+var ErrNotCapture = errors.New("not a capture file")
+
+// Create a capture file, or truncate it if it exists
+func NewCapture(path string) (*Capture, error) {
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.WriteString(CaptureMagic); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Capture{file: file, lock: &sync.Mutex{}}, nil
+}
+
+// Append a packet to the capture. Errors are logged, as they should not stop the node.
+func (capture *Capture) Record(direction, peer string, bytes []byte) {
+
+	data, err := protobuf.Encode(&CapturedPacket{time.Now().UnixNano(), direction, peer, bytes})
+	if err != nil {
+		DebugCaptureError(err)
+		return
+	}
+
+	record := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+	n := binary.PutUvarint(record, uint64(len(data)))
+	record = append(record[:n], data...)
+
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+
+	if capture.file == nil {
+		return
+	}
+
+	if _, err := capture.file.Write(record); err != nil {
+		DebugCaptureError(err)
+	}
+}
+
+// Close the file. Packets recorded afterwards are ignored.
+func (capture *Capture) Close() {
+
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+
+	if capture.file != nil {
+		capture.file.Close()
+		capture.file = nil
+	}
+}
+
+// Read all the packets of a capture file, in the order they were recorded
+func ReadCapture(path string) ([]*CapturedPacket, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	magic := make([]byte, len(CaptureMagic))
+
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != CaptureMagic {
+		return nil, ErrNotCapture
+	}
+
+	packets := make([]*CapturedPacket, 0)
+
+	for {
+
+		size, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return packets, nil
+		}
+
+		data := make([]byte, size)
+
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return packets, nil
+		}
+
+		var packet CapturedPacket
+
+		if err := protobuf.Decode(data, &packet); err != nil {
+			return packets, nil
+		}
+
+		packets = append(packets, &packet)
+	}
+}
+
+// Time at which the packet was sent or received
+func (packet *CapturedPacket) Timestamp() time.Time {
+	return time.Unix(0, packet.Time)
+}
+
+// Decode the GossipPacket, which may be invalid if the peer sent garbage
+func (packet *CapturedPacket) Decode() (*GossipPacket, error) {
+
+	var gossipPacket GossipPacket
+
+	if err := protobuf.Decode(packet.Bytes, &gossipPacket); err != nil {
+		return nil, err
+	}
+
+	return &gossipPacket, nil
+}
@@ -10,13 +10,26 @@ import (
 //
 
 // Aggregate of all other fields, should be used as top-level
-// entity for internal communication with client.
+// entity for internal communication with client. ID is chosen by
+// the client and copied into the Response, NoRequestID if the client
+// does not expect one.
 type Command struct {
     Message         *MessageCommand
     PrivateMessage  *PrivateMessageCommand
     Upload          *UploadCommand
     Download        *DownloadCommand
     Search          *SearchCommand
+    ListDownloads   *ListDownloadsCommand
+    PauseDownload   *DownloadControlCommand
+    ResumeDownload  *DownloadControlCommand
+    CancelDownload  *DownloadControlCommand
+    ListPeers       *ListPeersCommand
+    ListRoutes      *ListRoutesCommand
+    ListBlocks      *ListBlocksCommand
+    ListMatches     *ListMatchesCommand
+    ListFiles       *ListFilesCommand
+    Status          *StatusCommand
+    ID              uint32
 }
 
 // A command to send a message or rumor.
@@ -47,6 +60,35 @@ type SearchCommand struct {
     Keywords    []string
 }
 
+// A command to list all downloads along with their progress
+type ListDownloadsCommand struct {}
+
+// A command to list the neighbors of the node
+type ListPeersCommand struct {}
+
+// A command to list the routing table of the node
+type ListRoutesCommand struct {}
+
+// A command to list the latest blocks of the longest chain
+type ListBlocksCommand struct {}
+
+// A command to list the search results whose file name matches some keywords,
+// or all of them if there are no keywords
+type ListMatchesCommand struct {
+    Keywords    []string
+}
+
+// A command to list the files shared or downloaded by the node
+type ListFilesCommand struct {}
+
+// A command to get the name and the vector clock of the node
+type StatusCommand struct {}
+
+// A command to pause, resume or cancel the download of a file
+type DownloadControlCommand struct {
+    Hash        []byte
+}
+
 //
 //  ERRORS
 //
@@ -70,6 +112,8 @@ const (
     downloadInvalidHash
 
     searchNoKeywords
+
+    downloadControlNoHash
 )
 
 func (e *CommandError) Error() string {
@@ -89,6 +133,8 @@ func (e *CommandError) Error() string {
     case downloadInvalidHash:       return "Error decoding hash specified in 'request'"
 
     case searchNoKeywords:          return "Cannot search without providing keywords"
+
+    case downloadControlNoHash:     return "Cannot control a download without giving a hash"
     default:                        return "Unexpected error"
     }
 }
@@ -168,13 +214,105 @@ func NewSearchCommand(query string, budget uint64) (*Command, error) {
     return &Command{Search: searchCommand}, nil
 }
 
+func NewListDownloadsCommand() (*Command, error) {
+    return &Command{ListDownloads: &ListDownloadsCommand{}}, nil
+}
+
+func NewListPeersCommand() (*Command, error) {
+    return &Command{ListPeers: &ListPeersCommand{}}, nil
+}
+
+func NewListRoutesCommand() (*Command, error) {
+    return &Command{ListRoutes: &ListRoutesCommand{}}, nil
+}
+
+func NewListBlocksCommand() (*Command, error) {
+    return &Command{ListBlocks: &ListBlocksCommand{}}, nil
+}
+
+func NewListMatchesCommand(query string) (*Command, error) {
+
+    keywords := make([]string, 0)
+
+    if query != "" {
+        keywords = strings.Split(query, SearchKeywordSeparator)
+    }
+
+    return &Command{ListMatches: &ListMatchesCommand{keywords}}, nil
+}
+
+func NewListFilesCommand() (*Command, error) {
+    return &Command{ListFiles: &ListFilesCommand{}}, nil
+}
+
+func NewStatusCommand() (*Command, error) {
+    return &Command{Status: &StatusCommand{}}, nil
+}
+
+func NewPauseDownloadCommand(request string) (*Command, error) {
+
+    controlCommand, err := newDownloadControlCommand(request)
+    if err != nil {
+        return nil, err
+    }
+
+    return &Command{PauseDownload: controlCommand}, nil
+}
+
+func NewResumeDownloadCommand(request string) (*Command, error) {
+
+    controlCommand, err := newDownloadControlCommand(request)
+    if err != nil {
+        return nil, err
+    }
+
+    return &Command{ResumeDownload: controlCommand}, nil
+}
+
+func NewCancelDownloadCommand(request string) (*Command, error) {
+
+    controlCommand, err := newDownloadControlCommand(request)
+    if err != nil {
+        return nil, err
+    }
+
+    return &Command{CancelDownload: controlCommand}, nil
+}
+
+func newDownloadControlCommand(request string) (*DownloadControlCommand, error) {
+
+    if request == "" {
+        return nil, &CommandError{downloadControlNoHash}
+    }
+
+    hash, err := hex.DecodeString(request)
+
+    if err != nil {
+        return nil, &CommandError{downloadInvalidHash}
+    }
+
+    return &DownloadControlCommand{hash}, nil
+}
+
 //
 //  SANITY CHECK
 //
 
+// Check if a command only reads the state of the node
+func (command *Command) IsQuery() bool {
+    return command.ListDownloads != nil || command.ListPeers != nil || command.ListRoutes != nil ||
+        command.ListBlocks != nil || command.ListMatches != nil || command.ListFiles != nil ||
+        command.Status != nil
+}
+
 // Check if a given command is valid (i.e. only contains one non-nil field).
 func (command *Command) IsValid() bool {
     return boolCount(command.Message != nil)+boolCount(command.PrivateMessage != nil)+
         boolCount(command.Upload != nil)+boolCount(command.Download != nil)+
-        boolCount(command.Search != nil) == 1
+        boolCount(command.Search != nil)+boolCount(command.ListDownloads != nil)+
+        boolCount(command.PauseDownload != nil)+boolCount(command.ResumeDownload != nil)+
+        boolCount(command.CancelDownload != nil)+boolCount(command.ListPeers != nil)+
+        boolCount(command.ListRoutes != nil)+boolCount(command.ListBlocks != nil)+
+        boolCount(command.ListMatches != nil)+boolCount(command.ListFiles != nil)+
+        boolCount(command.Status != nil) == 1
 }
@@ -0,0 +1,382 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Config holds the settings read from a configuration file. The file is written in a subset of TOML:
+//
+//	# Settings of the node, named after the command-line flags
+//	name = "Alice"
+//	gossipAddr = "127.0.0.1:5000"
+//	peers = ["127.0.0.1:5001", "127.0.0.1:5002"]
+//	rtimer = 5
+//	cypher-if-possible = true
+//
+//	# Settings of Tunables
+//	[tuning]
+//	antiEntropy = "2s"
+//	miningDifficulty = 8
+//
+// Values are strings, integers, booleans or arrays of strings, each on a single line. Durations are
+// strings such as "500ms" or "2s".
+type Config struct {
+	Path     string
+	Settings []*Setting // In the order of the file
+}
+
+// One key = value line of a configuration file
+type Setting struct {
+	Section string // "" for the settings of the node, "tuning" for Tunables
+	Key     string
+	Value   string // Strings are unquoted, arrays are joined with commas
+	Line    int
+}
+
+// Sections allowed in a configuration file
+const (
+	ConfigNodeSection   = ""
+	ConfigTuningSection = "tuning"
+)
+
+// Settings that can be changed in the [tuning] section of a configuration file, by key
+var Tunables = map[string]interface{}{
+	"statusTimeout":        &StatusTimeout,
+	"downloadTimeout":      &DownloadTimeout,
+	"antiEntropy":          &AntiEntropyDT,
+	"tcpDialTimeout":       &TCPDialTimeout,
+	"tcpWriteTimeout":      &TCPWriteTimeout,
+	"tcpRetryDelay":        &TCPRetryDelay,
+	"fragmentTimeout":      &FragmentTimeout,
+	"maxDownloadRequests":  &MaxDownloadRequests,
+	"defaultSearchBudget":  &DefaultSearchBudget,
+	"maxSearchBudget":      &MaxSearchBudget,
+	"searchBudgetIncrease": &SearchRequestBudgetIncreaseDT,
+	"transactionHopLimit":  &TransactionHopLimit,
+	"blockHopLimit":        &BlockHopLimit,
+	"initialMiningSleep":   &InitialMiningSleepTime,
+	"miningDifficulty":     &MiningDifficulty,
+	"mixerBufferSize":      &MixerNodeBufferSize,
+	"peerSuspectTimeouts":  &PeerSuspectTimeouts,
+	"peerEvictTime":        &PeerEvictTime,
+	"peerExchange":         &PeerExchangeDT,
+	"peerExchangeSize":     &PeerExchangeSize,
+	"maxPeers":             &MaxPeers,
+	"passiveViewSize":      &PassiveViewSize,
+}
+
+//
+//  ERRORS
+//
+
+// Error in a configuration file, at a given line
+type ConfigError struct {
+	path    string
+	line    int
+	message string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%v:%v: %v", e.path, e.line, e.message)
+}
+
+//
+//  PARSING
+//
+
+// Read and parse a configuration file
+func LoadConfig(path string) (*Config, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfig(path, string(data))
+}
+
+// Parse the contents of a configuration file. Path is only used in errors.
+func ParseConfig(path, contents string) (*Config, error) {
+
+	config := &Config{Path: path, Settings: make([]*Setting, 0)}
+	section := ConfigNodeSection
+	keys := make(map[string]bool)
+
+	for i, line := range strings.Split(contents, "\n") {
+
+		fail := func(message string) (*Config, error) {
+			return nil, &ConfigError{path, i + 1, message}
+		}
+
+		line = strings.TrimSpace(stripComment(line))
+
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+
+			if !strings.HasSuffix(line, "]") {
+				return fail("unterminated section header")
+			}
+
+			section = strings.TrimSpace(line[1 : len(line)-1])
+
+			if section != ConfigTuningSection {
+				return fail("unknown section " + section)
+			}
+
+			continue
+		}
+
+		separator := strings.Index(line, "=")
+		if separator < 0 {
+			return fail("expected key = value")
+		}
+
+		key := strings.TrimSpace(line[:separator])
+		value, err := parseConfigValue(strings.TrimSpace(line[separator+1:]))
+
+		if key == "" {
+			return fail("missing key")
+		}
+
+		if err != nil {
+			return fail(err.Error())
+		}
+
+		if keys[section+"."+key] {
+			return fail("duplicate key " + key)
+		}
+
+		keys[section+"."+key] = true
+		config.Settings = append(config.Settings, &Setting{section, key, value, i + 1})
+	}
+
+	return config, nil
+}
+
+// Remove the comment at the end of a line, if any
+func stripComment(line string) string {
+
+	quote := rune(0)
+
+	for i, c := range line {
+		switch {
+		case quote != 0 && c == quote && (quote == '\'' || i == 0 || line[i-1] != '\\'):
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// Parse a value: a string, an integer, a boolean or an array of strings
+func parseConfigValue(text string) (string, error) {
+
+	if text == "" {
+		return "", fmt.Errorf("missing value")
+	}
+
+	if !strings.HasPrefix(text, "[") {
+
+		value, rest, err := parseConfigScalar(text)
+
+		if err == nil && rest != "" {
+			err = fmt.Errorf("unexpected %v after value", rest)
+		}
+
+		return value, err
+	}
+
+	if !strings.HasSuffix(text, "]") {
+		return "", fmt.Errorf("arrays must be on a single line")
+	}
+
+	text = strings.TrimSpace(text[1 : len(text)-1])
+	values := make([]string, 0)
+
+	for text != "" {
+
+		value, rest, err := parseConfigScalar(text)
+		if err != nil {
+			return "", err
+		}
+
+		values = append(values, value)
+		rest = strings.TrimSpace(rest)
+
+		if rest != "" && !strings.HasPrefix(rest, ",") {
+			return "", fmt.Errorf("expected , between values")
+		}
+
+		text = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+	}
+
+	return strings.Join(values, ","), nil
+}
+
+// Parse a string, an integer or a boolean at the beginning of text, return it and what comes after it
+func parseConfigScalar(text string) (string, string, error) {
+
+	switch text[0] {
+
+	case '\'':
+
+		end := strings.Index(text[1:], "'")
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+
+		return text[1 : end+1], strings.TrimSpace(text[end+2:]), nil
+
+	case '"':
+
+		for end := 1; end < len(text); end++ {
+
+			if text[end] == '\\' {
+				end++
+				continue
+			}
+
+			if text[end] == '"' {
+				value, err := strconv.Unquote(text[:end+1])
+				return value, strings.TrimSpace(text[end+1:]), err
+			}
+		}
+
+		return "", "", fmt.Errorf("unterminated string")
+	}
+
+	end := strings.IndexAny(text, ", \t")
+	if end < 0 {
+		end = len(text)
+	}
+
+	value := text[:end]
+
+	if _, err := strconv.ParseInt(value, 10, 64); err != nil && value != "true" && value != "false" {
+		return "", "", fmt.Errorf("invalid value %v, strings should be quoted", value)
+	}
+
+	return value, strings.TrimSpace(text[end:]), nil
+}
+
+//
+//  APPLYING
+//
+
+// Set the flags of the node that were not given on the command line to their value in the configuration file
+func (config *Config) ApplyFlags(flags *flag.FlagSet) error {
+
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	for _, setting := range config.Settings {
+
+		if setting.Section != ConfigNodeSection {
+			continue
+		}
+
+		if flags.Lookup(setting.Key) == nil {
+			return &ConfigError{config.Path, setting.Line, "unknown setting " + setting.Key}
+		}
+
+		if given[setting.Key] {
+			continue
+		}
+
+		if err := flags.Set(setting.Key, setting.Value); err != nil {
+			return &ConfigError{config.Path, setting.Line, err.Error()}
+		}
+	}
+
+	return nil
+}
+
+// Change Tunables according to the [tuning] section of the configuration file
+func (config *Config) Tune() error {
+
+	for _, setting := range config.Settings {
+
+		if setting.Section != ConfigTuningSection {
+			continue
+		}
+
+		if err := tune(setting.Key, setting.Value); err != nil {
+			return &ConfigError{config.Path, setting.Line, err.Error()}
+		}
+	}
+
+	return nil
+}
+
+// Change one of the Tunables, given by its key in the [tuning] section
+func SetTunable(key, value string) error {
+	return tune(key, value)
+}
+
+// Change one of the Tunables
+func tune(key, value string) error {
+
+	tunable, found := Tunables[key]
+	if !found {
+		return fmt.Errorf("unknown tuning setting %v", key)
+	}
+
+	invalid := fmt.Errorf("invalid value %v for %v", value, key)
+
+	switch pointer := tunable.(type) {
+
+	case *time.Duration:
+
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return invalid
+		}
+		*pointer = duration
+
+	case *int:
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return invalid
+		}
+		*pointer = n
+
+	case *uint64:
+
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || n == 0 {
+			return invalid
+		}
+		*pointer = n
+
+	case *uint32:
+
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || n == 0 {
+			return invalid
+		}
+		*pointer = uint32(n)
+
+	case *byte:
+
+		n, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return invalid
+		}
+		*pointer = byte(n)
+	}
+
+	return nil
+}
@@ -3,34 +3,40 @@ package common
 import "time"
 
 const StatusBufferSize = 5
-const StatusTimeout = 1 * time.Second
-const DownloadTimeout = 5 * time.Second
-const AntiEntropyDT = 1 * time.Second
+const ShutdownTimeout = 5 * time.Second
+const EventBufferSize = 64
+const EventKeepAliveInterval = 15 * time.Second
+const ClientTimeout = 5 * time.Second
+const ClientRetryInterval = 1 * time.Second
+const ClientResponseCacheSize = 256
+const NoRequestID = uint32(0)
+const ResponseMaxBlocks = 64
 const InitialId = uint32(1)
 const NoRouteRumor = time.Duration(0)
 const InitialHopLimit = 10
 const FileChunkSize = 8192
 const SocketBufferSize = 2 * FileChunkSize
+const TCPMaxFrameSize = MaxFragmentCount * FragmentDataSize // Same limit as packets sent in fragments over UDP
+const TCPMaxHelloSize = 256                                 // Enough for the address of a node
+const TCPPacketBufferSize = 64
+const FragmentDataSize = SocketBufferSize - 512 // Leaves room for the fields of the Fragment
+const MaxFragmentCount = 1024
+const MaxReassemblyBuffers = 64
+const MaxReassemblyBytes = 32 * 1024 * 1024
+const StorageMaxRecordSize = TCPMaxFrameSize // Records are packets, which cannot be larger
 const SharedFilesDir = "_SharedFiles/"
 const DownloadDir = "_Downloads/"
-const MaxDownloadRequests = 10
+const DownloadWindow = 8
 const MetaHashChunkId = -1
 const NoChunkId = -2
-const DefaultSearchBudget = 2
-const MaxSearchBudget = 32
 const SearchKeywordSeparator = ","
 const SearchRequestTimeThreshold = int64(500 * time.Millisecond)
-const SearchRequestBudgetIncreaseDT = 1 * time.Second
 const UnverifiableMessageRetryDT = 3 * time.Second
 const SearchNoBudget = uint64(0)
 const SearchRequestResultsThreshold = 2
 const SearchTimeout = 1 * time.Second
-const TransactionHopLimit = 10
-const BlockHopLimit = 20
 const FileNameSeparator = ","
-const InitialMiningSleepTime = 5 * time.Second
 const MiningSleepTimeFactor = 2
-const MiningDifficulty = 16
 const CryptoKeySize = 4096 // bits
 const OnionBufferSize = 2048 // Additional space on top of maximum message size
 const OnionPayloadSize = FileChunkSize + OnionBufferSize
@@ -42,6 +48,32 @@ const OnionSize = OnionPayloadSize + OnionHeaderSize
 const CTRKeySize = 32
 const SignOnly = 1
 const CypherIfPossible = 2
-const MixerNodeBufferSize = 8
 const MixerRandomTimeSleepRange = 1000
 const NoNextHop = ""
+
+// Settings that can be tuned in the [tuning] section of the configuration file, see Tunables.
+// They should not be changed once a gossiper is started.
+var (
+	StatusTimeout                 = 1 * time.Second
+	DownloadTimeout               = 5 * time.Second
+	AntiEntropyDT                 = 1 * time.Second
+	TCPDialTimeout                = 2 * time.Second
+	TCPWriteTimeout               = 5 * time.Second
+	TCPRetryDelay                 = 30 * time.Second
+	FragmentTimeout               = 5 * time.Second
+	MaxDownloadRequests           = 10
+	DefaultSearchBudget           = uint64(2)
+	MaxSearchBudget               = uint64(32)
+	SearchRequestBudgetIncreaseDT = 1 * time.Second
+	TransactionHopLimit           = uint32(10)
+	BlockHopLimit                 = uint32(20)
+	InitialMiningSleepTime        = 5 * time.Second
+	MiningDifficulty              = byte(16)
+	MixerNodeBufferSize           = 8
+	PeerSuspectTimeouts           = 3                // Rumors in a row a peer does not acknowledge before it is suspected
+	PeerEvictTime                 = 30 * time.Second // Time a peer stays suspected and silent before it is evicted
+	PeerExchangeDT                = 10 * time.Second // Time between two samples of neighbors sent to a random neighbor
+	PeerExchangeSize              = 8                // Number of neighbors in a sample
+	MaxPeers                      = 8                // Size of the active view, i.e. neighbors that rumors, broadcasts and searches are sent to
+	PassiveViewSize               = 64               // Other known peers kept to replace neighbors that are evicted
+)
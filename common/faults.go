@@ -0,0 +1,470 @@
+package common
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A FaultySocket wraps the socket of a node and injects faults in the datagrams it sends and receives, as
+// a flaky link would: packets are dropped, duplicated, delayed, reordered or corrupted with the
+// probabilities of a FaultConfig. It is meant to test how the node copes with failures, e.g. timeouts of
+// rumormongering, retries of downloads and verification of data replies.
+type FaultySocket struct {
+	socket  Socket
+	config  *FaultConfig
+	random  *rand.Rand
+	held    map[string]*heldPacket // Packets held to be reordered, by direction and peer
+	stats   FaultStats
+	packets chan *faultyPacket // Received packets, once faults are injected
+	closed  chan struct{}
+	once    *sync.Once
+	lock    *sync.Mutex
+}
+
+// Faults injected in the packets exchanged with a peer. Probabilities are between 0 and 1.
+type Faults struct {
+	Drop      float64
+	Duplicate float64
+	Delay     float64        // Probability that a packet is delayed by DelayTime
+	DelayTime time.Duration  // FaultDelayTime if 0
+	Reorder   float64        // Probability that a packet is held until the next one with the same peer, or for DelayTime
+	Corrupt   float64        // Probability that one random bit of a packet is flipped
+	Direction FaultDirection // Packets in which faults are injected
+}
+
+// Faults of a socket, by peer
+type FaultConfig struct {
+	Default Faults            // Faults of peers that do not have their own
+	Peers   map[string]Faults // Faults by peer address
+	Seed    int64             // Seed of the random decisions, taken from the clock if 0
+}
+
+// Packets in which faults are injected
+type FaultDirection int
+
+const (
+	FaultsBoth     FaultDirection = iota // Sent and received packets
+	FaultsIncoming                       // Received packets only
+	FaultsOutgoing                       // Sent packets only
+)
+
+// Number of faults injected by a socket
+type FaultStats struct {
+	Dropped    int
+	Duplicated int
+	Delayed    int
+	Reordered  int
+	Corrupted  int
+}
+
+type faultyPacket struct {
+	bytes []byte
+	peer  string
+}
+
+type heldPacket struct {
+	packet  *faultyPacket
+	release *time.Timer
+}
+
+// Delay of delayed packets when DelayTime is not set
+const FaultDelayTime = 200 * time.Millisecond
+
+var directionNames = []string{"both", "in", "out"}
+
+//
+//  CONFIGURATION
+//
+
+// Parse faults given as groups of key=value pairs separated by semicolons. The group with a peer key
+// sets the faults of that peer, and the group without one those of all other peers, e.g.
+//
+//	drop=0.1,delay=0.2,delayTime=50ms;peer=127.0.0.1:5001,corrupt=0.05,direction=in
+//
+// Keys are drop, duplicate, delay, delayTime, reorder, corrupt, direction (both, in or out), peer and
+// seed. An empty spec injects no fault.
+func ParseFaults(spec string) (*FaultConfig, error) {
+
+	config := &FaultConfig{Peers: make(map[string]Faults)}
+	hasDefault := false
+
+	for _, group := range strings.Split(spec, ";") {
+
+		if strings.TrimSpace(group) == "" {
+			continue
+		}
+
+		faults := Faults{}
+		peer := ""
+
+		for _, item := range strings.Split(group, ",") {
+
+			separator := strings.Index(item, "=")
+			if separator < 0 {
+				return nil, fmt.Errorf("invalid fault %v, expected key=value", strings.TrimSpace(item))
+			}
+
+			key := strings.TrimSpace(item[:separator])
+			value := strings.TrimSpace(item[separator+1:])
+			invalid := fmt.Errorf("invalid value %v for fault %v", value, key)
+
+			switch key {
+
+			case "drop", "duplicate", "delay", "reorder", "corrupt":
+
+				probability, err := strconv.ParseFloat(value, 64)
+				if err != nil || probability < 0 || probability > 1 {
+					return nil, invalid
+				}
+
+				*faults.probability(key) = probability
+
+			case "delayTime":
+
+				duration, err := time.ParseDuration(value)
+				if err != nil || duration <= 0 {
+					return nil, invalid
+				}
+
+				faults.DelayTime = duration
+
+			case "direction":
+
+				direction, err := parseFaultDirection(value)
+				if err != nil {
+					return nil, err
+				}
+
+				faults.Direction = direction
+
+			case "peer":
+				peer = value
+
+			case "seed":
+
+				seed, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return nil, invalid
+				}
+
+				config.Seed = seed
+
+			default:
+				return nil, fmt.Errorf("unknown fault %v", key)
+			}
+		}
+
+		if peer == "" {
+
+			if hasDefault {
+				return nil, fmt.Errorf("faults of all peers are given twice")
+			}
+
+			hasDefault = true
+			config.Default = faults
+
+		} else {
+
+			if _, found := config.Peers[peer]; found {
+				return nil, fmt.Errorf("faults of %v are given twice", peer)
+			}
+
+			config.Peers[peer] = faults
+		}
+	}
+
+	return config, nil
+}
+
+func parseFaultDirection(text string) (FaultDirection, error) {
+
+	for direction, name := range directionNames {
+		if text == name {
+			return FaultDirection(direction), nil
+		}
+	}
+
+	return FaultsBoth, fmt.Errorf("unknown direction %v, expected one of %v", text, strings.Join(directionNames, ", "))
+}
+
+func (faults *Faults) probability(key string) *float64 {
+
+	switch key {
+	case "drop":
+		return &faults.Drop
+	case "duplicate":
+		return &faults.Duplicate
+	case "delay":
+		return &faults.Delay
+	case "reorder":
+		return &faults.Reorder
+	default:
+		return &faults.Corrupt
+	}
+}
+
+// Faults injected in the packets exchanged with a peer
+func (config *FaultConfig) For(peer string) Faults {
+
+	if faults, found := config.Peers[peer]; found {
+		return faults
+	}
+
+	return config.Default
+}
+
+// Whether faults are injected in packets going in a direction
+func (faults Faults) appliesTo(incoming bool) bool {
+
+	if incoming {
+		return faults.Direction != FaultsOutgoing
+	}
+
+	return faults.Direction != FaultsIncoming
+}
+
+//
+//  SOCKET
+//
+
+// Wrap a socket so that faults are injected in its packets. The socket is unbound with the wrapper.
+func NewFaultySocket(socket Socket, config *FaultConfig) *FaultySocket {
+
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	faulty := &FaultySocket{
+		socket:  socket,
+		config:  config,
+		random:  rand.New(rand.NewSource(seed)),
+		held:    make(map[string]*heldPacket),
+		packets: make(chan *faultyPacket, 256),
+		closed:  make(chan struct{}),
+		once:    &sync.Once{},
+		lock:    &sync.Mutex{},
+	}
+
+	go faulty.receiveLoop()
+
+	return faulty
+}
+
+// Send a packet, unless it is dropped. Errors are only returned for packets sent right away, those of
+// delayed packets are logged.
+func (faulty *FaultySocket) Send(bytes []byte, address string) error {
+
+	select {
+	case <-faulty.closed:
+		return ErrTransportClosed
+	default:
+	}
+
+	// Delayed packets are sent after the caller is done with bytes
+	packet := &faultyPacket{append([]byte{}, bytes...), address}
+
+	return faulty.inject(packet, false, faulty.send)
+}
+
+func (faulty *FaultySocket) Receive() ([]byte, string, bool) {
+
+	select {
+	case packet := <-faulty.packets:
+		return packet.bytes, packet.peer, true
+	case <-faulty.closed:
+		return []byte{}, "", false
+	}
+}
+
+func (faulty *FaultySocket) Unbind() {
+	faulty.once.Do(func() {
+		close(faulty.closed)
+		faulty.socket.Unbind()
+	})
+}
+
+func (faulty *FaultySocket) LocalAddress() string {
+	return faulty.socket.LocalAddress()
+}
+
+// Number of faults injected so far
+func (faulty *FaultySocket) Stats() FaultStats {
+
+	faulty.lock.Lock()
+	defer faulty.lock.Unlock()
+
+	return faulty.stats
+}
+
+// Receive packets from the wrapped socket and inject faults in them until it is unbound
+func (faulty *FaultySocket) receiveLoop() {
+
+	for {
+		bytes, source, ok := faulty.socket.Receive()
+
+		if !ok {
+			faulty.Unbind()
+			return
+		}
+
+		faulty.inject(&faultyPacket{bytes, source}, true, faulty.deliver)
+	}
+}
+
+func (faulty *FaultySocket) send(packet *faultyPacket) error {
+	return faulty.socket.Send(packet.bytes, packet.peer)
+}
+
+// Make a received packet available to Receive
+func (faulty *FaultySocket) deliver(packet *faultyPacket) error {
+	select {
+	case faulty.packets <- packet:
+	case <-faulty.closed:
+	}
+	return nil
+}
+
+// Decide which faults to inject in a packet and pass it on with send, now, later or not at all. Return
+// the first error of the packets passed on right away.
+func (faulty *FaultySocket) inject(packet *faultyPacket, incoming bool, send func(*faultyPacket) error) error {
+
+	faults := faulty.config.For(packet.peer)
+
+	if !faults.appliesTo(incoming) {
+		return send(packet)
+	}
+
+	// Errors of packets passed on later can only be logged
+	sendLater := func(packet *faultyPacket) {
+		if err := send(packet); err != nil {
+			DebugSendError(packet.peer, err)
+		}
+	}
+
+	direction := "outgoing"
+	if incoming {
+		direction = "incoming"
+	}
+
+	delayTime := faults.DelayTime
+	if delayTime == 0 {
+		delayTime = FaultDelayTime
+	}
+
+	faulty.lock.Lock()
+
+	// Draw every number for each packet, so that the same seed gives the same faults
+	drop := faulty.random.Float64() < faults.Drop
+	corrupt := faulty.random.Float64() < faults.Corrupt
+	duplicate := faulty.random.Float64() < faults.Duplicate
+	delay := faulty.random.Float64() < faults.Delay
+	reorder := faulty.random.Float64() < faults.Reorder
+	bit := faulty.random.Intn(8 * (len(packet.bytes) + 1)) // Bit flipped if the packet is corrupted
+
+	key := direction + " " + packet.peer
+	held := faulty.held[key]
+
+	if drop {
+		faulty.stats.Dropped++
+		faulty.lock.Unlock()
+		DebugInjectFault("drop", direction, packet.peer)
+		return nil
+	}
+
+	if corrupt && len(packet.bytes) > 0 {
+		faulty.stats.Corrupted++
+		packet = &faultyPacket{append([]byte{}, packet.bytes...), packet.peer}
+		packet.bytes[bit/8%len(packet.bytes)] ^= 1 << uint(bit%8)
+		DebugInjectFault("corrupt", direction, packet.peer)
+	}
+
+	if duplicate {
+		faulty.stats.Duplicated++
+		DebugInjectFault("duplicate", direction, packet.peer)
+	}
+
+	packets := []*faultyPacket{packet}
+	if duplicate {
+		packets = append(packets, packet)
+	}
+
+	switch {
+
+	case delay:
+
+		faulty.stats.Delayed++
+		faulty.lock.Unlock()
+		DebugInjectFault("delay", direction, packet.peer)
+
+		time.AfterFunc(delayTime, func() {
+			for _, packet := range packets {
+				sendLater(packet)
+			}
+		})
+
+		return nil
+
+	case reorder && held == nil:
+
+		// Send the packet after the next one, or once DelayTime has passed
+		faulty.stats.Reordered++
+		hold := &heldPacket{packet: packet}
+		faulty.held[key] = hold
+
+		hold.release = time.AfterFunc(delayTime, func() {
+			if faulty.release(key, hold) {
+				sendLater(hold.packet)
+			}
+		})
+
+		faulty.lock.Unlock()
+		DebugInjectFault("reorder", direction, packet.peer)
+
+		if duplicate {
+			return send(packet)
+		}
+
+		return nil
+	}
+
+	if held != nil {
+		delete(faulty.held, key)
+		held.release.Stop()
+	}
+
+	faulty.lock.Unlock()
+
+	var err error
+
+	for _, packet := range packets {
+		if e := send(packet); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	// The held packet is overtaken by this one
+	if held != nil {
+		sendLater(held.packet)
+	}
+
+	return err
+}
+
+// Remove a held packet if it is still held, return true if it was
+func (faulty *FaultySocket) release(key string, hold *heldPacket) bool {
+
+	faulty.lock.Lock()
+	defer faulty.lock.Unlock()
+
+	if faulty.held[key] != hold {
+		return false
+	}
+
+	delete(faulty.held, key)
+	return true
+}
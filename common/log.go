@@ -3,14 +3,35 @@ package common
 import (
 	"crypto/sha256"
 	"encoding/hex"
-    "fmt"
-	"log"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 )
 
-var Verbose = true
+// All the functions below send an entry to DefaultLogger. The text of each entry is the line required in
+// the assignment, its fields hold the same values for the text and JSON formats.
+
+func logInfo(category LogCategory, message, text string, fields ...interface{}) {
+	DefaultLogger.Emit(LevelInfo, category, message, text, fields...)
+}
+
+func logDebug(category LogCategory, message, text string, fields ...interface{}) {
+	DefaultLogger.Emit(LevelDebug, category, message, text, fields...)
+}
+
+func logWarn(category LogCategory, message, text string, fields ...interface{}) {
+	DefaultLogger.Emit(LevelWarn, category, message, text, fields...)
+}
+
+func logError(category LogCategory, message, text string, fields ...interface{}) {
+	DefaultLogger.Emit(LevelError, category, message, text, fields...)
+}
+
+// Whether debug entries of a category are logged. Used to skip building entries that are discarded anyway.
+func debugging(category LogCategory) bool {
+	return DefaultLogger.Enabled(LevelDebug, category)
+}
 
 //
 //  INFO MESSAGES
@@ -19,67 +40,78 @@ var Verbose = true
 //  These are log messages to be used in the assignment.
 
 func LogClientMessage(message string) {
-	log.Printf("CLIENT MESSAGE %v\n", message)
+	logInfo(CategoryRumor, "client message", fmt.Sprintf("CLIENT MESSAGE %v", message), "contents", message)
 }
 
 func LogSimpleMessage(message *SimpleMessage) {
-	log.Printf("SIMPLE MESSAGE origin %v from %v contents %v\n",
-		message.OriginalName, message.RelayPeerAddr, message.Contents)
+	logInfo(CategoryRumor, "simple message",
+		fmt.Sprintf("SIMPLE MESSAGE origin %v from %v contents %v", message.OriginalName, message.RelayPeerAddr, message.Contents),
+		"origin", message.OriginalName, "from", message.RelayPeerAddr, "contents", message.Contents)
 }
 
 func LogRumor(rumor IRumorMessage, relayAddress string) {
-    switch t := rumor.(type) {
-    default:
-        log.Printf("RUMOR origin %v from %v ID %v type %T\n", rumor.GetOrigin(), relayAddress, rumor.GetID(), t)
-    case *RumorMessage:
-        log.Printf("RUMOR origin %v from %v ID %v contents %v\n", rumor.GetOrigin(), relayAddress, rumor.GetID(), (rumor.(*RumorMessage)).Text)
-    }
+	switch t := rumor.(type) {
+	default:
+		logInfo(CategoryRumor, "rumor",
+			fmt.Sprintf("RUMOR origin %v from %v ID %v type %T", rumor.GetOrigin(), relayAddress, rumor.GetID(), t),
+			"origin", rumor.GetOrigin(), "from", relayAddress, "id", rumor.GetID(), "type", fmt.Sprintf("%T", t))
+	case *RumorMessage:
+		logInfo(CategoryRumor, "rumor",
+			fmt.Sprintf("RUMOR origin %v from %v ID %v contents %v", t.Origin, relayAddress, t.ID, t.Text),
+			"origin", t.Origin, "from", relayAddress, "id", t.ID, "contents", t.Text)
+	}
 }
 
 func LogMongering(peerAddress string) {
-	log.Printf("MONGERING with %v\n", peerAddress)
+	logInfo(CategoryRumor, "mongering", fmt.Sprintf("MONGERING with %v", peerAddress), "peer", peerAddress)
 }
 
 func LogStatus(status *StatusPacket, relayAddress string) {
-	log.Printf("STATUS from %v ", relayAddress)
-
-	for _, peerStatus := range status.Want {
-		log.Printf("peer %v nextID %v ", peerStatus.Identifier, peerStatus.NextID)
-	}
-
-	log.Printf("\n")
+	logInfo(CategoryRumor, "status", fmt.Sprintf("STATUS from %v %v", relayAddress, statusText(status)),
+		"from", relayAddress, "want", statusField(status))
 }
 
 func LogFlippedCoin(peerAddress string) {
-	log.Printf("FLIPPED COIN sending rumor to %v\n", peerAddress)
+	logInfo(CategoryRumor, "flipped coin", fmt.Sprintf("FLIPPED COIN sending rumor to %v", peerAddress), "peer", peerAddress)
 }
 
 func LogInSyncWith(peerAddress string) {
-	log.Printf("IN SYNC WITH %v\n", peerAddress)
+	logInfo(CategoryRumor, "in sync", fmt.Sprintf("IN SYNC WITH %v", peerAddress), "peer", peerAddress)
 }
 
 func LogPeers(peers []string) {
-	log.Printf("PEERS %v\n", strings.Join(peers, ","))
+	logInfo(CategoryRouting, "peers", fmt.Sprintf("PEERS %v", strings.Join(peers, ",")), "peers", peers)
 }
 
 func LogUpdateRoutingTable(origin, address string) {
-	log.Printf("DSDV %v %v\n", origin, address)
+	logInfo(CategoryRouting, "route updated", fmt.Sprintf("DSDV %v %v", origin, address), "origin", origin, "address", address)
 }
 
 func LogPrivate(private *PrivateMessage) {
-	fmt.Printf("PRIVATE origin %v hop-limit %v contents %v\n", private.Origin, private.HopLimit, private.Text)
+	logInfo(CategoryRouting, "private message",
+		fmt.Sprintf("PRIVATE origin %v hop-limit %v contents %v", private.Origin, private.HopLimit, private.Text),
+		"origin", private.Origin, "hopLimit", private.HopLimit, "contents", private.Text)
 }
 
 func LogDownloadingMetafile(filename string, seed string) {
-	log.Printf("DOWNLOADING metafile of %v from %v\n", filename, seed)
+	logInfo(CategoryFiles, "downloading metafile", fmt.Sprintf("DOWNLOADING metafile of %v from %v", filename, seed),
+		"file", filename, "from", seed)
 }
 
 func LogDownloadingChunk(filename string, n int, seed string) {
-	log.Printf("DOWNLOADING %v chunk %v from %v\n", filename, n, seed)
+	logInfo(CategoryFiles, "downloading chunk", fmt.Sprintf("DOWNLOADING %v chunk %v from %v", filename, n, seed),
+		"file", filename, "chunk", n, "from", seed)
+}
+
+func LogDownload(filename string, metahash []byte, state string, done, total int) {
+	hash := hex.EncodeToString(metahash)
+	logInfo(CategoryFiles, "download",
+		fmt.Sprintf("DOWNLOAD file %v metahash %v state %v chunks %v/%v", filename, hash, state, done, total),
+		"file", filename, "metahash", hash, "state", state, "done", done, "total", total)
 }
 
 func LogReconstructed(filename string) {
-	log.Printf("RECONSTRUCTED file %v\n", filename)
+	logInfo(CategoryFiles, "reconstructed", fmt.Sprintf("RECONSTRUCTED file %v", filename), "file", filename)
 }
 
 func LogMatch(result SearchResult, origin string) {
@@ -90,20 +122,20 @@ func LogMatch(result SearchResult, origin string) {
 		chunks = append(chunks, fmt.Sprintf("%v", chunkId))
 	}
 
-	log.Printf("FOUND match %v at %v metafile=%v chunks=%v\n",
-		result.FileName,
-		origin,
-		hex.EncodeToString(result.MetafileHash[:]),
-		strings.Join(chunks, ","),
-	)
+	hash := hex.EncodeToString(result.MetafileHash[:])
+
+	logInfo(CategorySearch, "match",
+		fmt.Sprintf("FOUND match %v at %v metafile=%v chunks=%v", result.FileName, origin, hash, strings.Join(chunks, ",")),
+		"file", result.FileName, "origin", origin, "metafile", hash, "chunks", result.ChunkMap)
 }
 
 func LogSearchFinished() {
-	log.Printf("SEARCH FINISHED\n")
+	logInfo(CategorySearch, "search finished", "SEARCH FINISHED")
 }
 
 func LogFoundBlock(hash [32]byte) {
-	log.Printf("FOUND-BLOCK %v\n", hex.EncodeToString(hash[:]))
+	hashStr := hex.EncodeToString(hash[:])
+	logInfo(CategoryChain, "found block", fmt.Sprintf("FOUND-BLOCK %v", hashStr), "hash", hashStr)
 }
 
 func LogChain(blocks []*Block) {
@@ -114,16 +146,17 @@ func LogChain(blocks []*Block) {
 		blocksStr = append(blocksStr, block.Str())
 	}
 
-	log.Printf("CHAIN %v\n", strings.Join(blocksStr, " "))
+	logInfo(CategoryChain, "chain", fmt.Sprintf("CHAIN %v", strings.Join(blocksStr, " ")), "length", len(blocks))
 }
 
 func LogShorterFork(block *Block) {
 	hash := block.Hash()
-	log.Printf("FORK-SHORTER %v\n", hex.EncodeToString(hash[:]))
+	hashStr := hex.EncodeToString(hash[:])
+	logInfo(CategoryChain, "shorter fork", fmt.Sprintf("FORK-SHORTER %v", hashStr), "hash", hashStr)
 }
 
 func LogForkLongerRewind(current []*Block) {
-	log.Printf("FORK-LONGER rewind %v blocks\n", len(current))
+	logInfo(CategoryChain, "longer fork", fmt.Sprintf("FORK-LONGER rewind %v blocks", len(current)), "rewind", len(current))
 }
 
 //
@@ -131,285 +164,428 @@ func LogForkLongerRewind(current []*Block) {
 //  --------------
 //
 //  These are optional messages, not required in the assignment
-//  that might be used for debugging.
+//  that might be used for debugging. Unexpected events are logged
+//  as warnings or errors.
 
 func DebugStopMongering(rumor IRumorMessage) {
-	if !Verbose { return }
-    switch t := rumor.(type) {
-    default:
-        log.Printf("STOP MONGERING rumor of type %T\n", t)
-        //log.Printf("unexpected type %T\n", t)     // %T prints whatever type t has
-    case *RumorMessage:
-        log.Printf("STOP MONGERING rumor %v\n", (rumor.(*RumorMessage)).Text)
-    }
+	if !debugging(CategoryRumor) { return }
+	switch t := rumor.(type) {
+	default:
+		logDebug(CategoryRumor, "stop mongering", fmt.Sprintf("STOP MONGERING rumor of type %T", t), "type", fmt.Sprintf("%T", t))
+	case *RumorMessage:
+		logDebug(CategoryRumor, "stop mongering", fmt.Sprintf("STOP MONGERING rumor %v", t.Text), "contents", t.Text)
+	}
 }
 
 func DebugTimeout(peer string) {
-	if !Verbose { return }
-	log.Printf("TIMEOUT from %v\n", peer)
+	logDebug(CategoryRumor, "timeout", fmt.Sprintf("TIMEOUT from %v", peer), "peer", peer)
 }
 
-func DebugSendStatus(status *StatusPacket, to string) {
-	if !Verbose { return }
-	log.Printf("SEND STATUS to %v ", to)
-
-	for _, peerStatus := range status.Want {
-		log.Printf("peer %v nextID %v ", peerStatus.Identifier, peerStatus.NextID)
-	}
+func DebugSendPeerExchange(peers []string, to string) {
+	logDebug(CategoryRouting, "send peer exchange", fmt.Sprintf("SEND PEERS %v to %v", strings.Join(peers, ","), to),
+		"peers", peers, "to", to)
+}
 
-	log.Printf("\n")
+func DebugReceivePeerExchange(peers []string, from string, added []string) {
+	logDebug(CategoryRouting, "receive peer exchange",
+		fmt.Sprintf("RECEIVE PEERS %v from %v added %v", strings.Join(peers, ","), from, strings.Join(added, ",")),
+		"peers", peers, "from", from, "added", added)
 }
 
-func DebugForwardRumor(rumor IRumorMessage) {
-	if !Verbose { return }
-    switch t := rumor.(type) {
-    default:
-        log.Printf("FORWARD rumor origin %v from %v ID %v type %T\n", rumor.GetOrigin(), rumor.GetID(), t)
-    case *RumorMessage:
-        log.Printf("FORWARD rumor %v\n", (rumor.(*RumorMessage)).Text)
-    }
+func DebugPeerState(peer, state string) {
+	logDebug(CategoryRouting, "peer state", fmt.Sprintf("PEER %v is %v", peer, state), "peer", peer, "state", state)
 }
 
-func DebugAskAndSendStatus(status *StatusPacket, to string) {
-	if !Verbose { return }
-	log.Printf("ASK AND SEND STATUS to %v ", to)
+func DebugSendStatus(status *StatusPacket, to string) {
+	if !debugging(CategoryRumor) { return }
+	logDebug(CategoryRumor, "send status", fmt.Sprintf("SEND STATUS to %v %v", to, statusText(status)),
+		"to", to, "want", statusField(status))
+}
 
-	for _, peerStatus := range status.Want {
-		log.Printf("peer %v nextID %v ", peerStatus.Identifier, peerStatus.NextID)
+func DebugForwardRumor(rumor IRumorMessage) {
+	if !debugging(CategoryRumor) { return }
+	switch t := rumor.(type) {
+	default:
+		logDebug(CategoryRumor, "forward rumor",
+			fmt.Sprintf("FORWARD rumor origin %v ID %v type %T", rumor.GetOrigin(), rumor.GetID(), t),
+			"origin", rumor.GetOrigin(), "id", rumor.GetID(), "type", fmt.Sprintf("%T", t))
+	case *RumorMessage:
+		logDebug(CategoryRumor, "forward rumor", fmt.Sprintf("FORWARD rumor %v", t.Text),
+			"origin", t.Origin, "id", t.ID, "contents", t.Text)
 	}
+}
 
-	log.Printf("\n")
+func DebugAskAndSendStatus(status *StatusPacket, to string) {
+	if !debugging(CategoryRumor) { return }
+	logDebug(CategoryRumor, "ask and send status", fmt.Sprintf("ASK AND SEND STATUS to %v %v", to, statusText(status)),
+		"to", to, "want", statusField(status))
 }
 
 func DebugServerRequest(req *http.Request) {
-	if !Verbose { return }
-	log.Printf("%v %v\n", req.Method, req.URL)
+	if !debugging(CategoryNode) { return }
+	logDebug(CategoryNode, "api request", fmt.Sprintf("%v %v", req.Method, req.URL),
+		"method", req.Method, "url", req.URL.String())
+}
+
+func DebugServerError(err error) {
+	logError(CategoryNode, "server error", fmt.Sprintf("WARNING web server stopped: %v", err), "error", err)
 }
 
 func DebugSendRouteRumor(address string) {
-	if !Verbose { return }
-	log.Printf("SEND ROUTE RUMOR to %v\n", address)
+	logDebug(CategoryRouting, "send route rumor", fmt.Sprintf("SEND ROUTE RUMOR to %v", address), "to", address)
 }
 
 func DebugReceiveRouteRumor(origin, address string) {
-	if !Verbose { return }
-	log.Printf("RECEIVE ROUTE RUMOR from %v at %v\n", origin, address)
+	logDebug(CategoryRouting, "receive route rumor", fmt.Sprintf("RECEIVE ROUTE RUMOR from %v at %v", origin, address),
+		"origin", origin, "address", address)
 }
 
 func DebugUnknownDestination(destination string) {
-	if !Verbose { return }
-	log.Printf("UNKNOWN DESTINATION %v\n", destination)
+	logWarn(CategoryRouting, "unknown destination", fmt.Sprintf("UNKNOWN DESTINATION %v", destination),
+		"destination", destination)
 }
 
 func DebugScanChunk(chunkPosition int, hash []byte) {
-	if !Verbose { return }
-	log.Printf("SCAN CHUNK number %v hash %v...\n", chunkPosition, hex.EncodeToString(hash)[:8])
+	if !debugging(CategoryFiles) { return }
+	hashStr := hex.EncodeToString(hash)
+	logDebug(CategoryFiles, "scan chunk", fmt.Sprintf("SCAN CHUNK number %v hash %v...", chunkPosition, hashStr[:8]),
+		"chunk", chunkPosition, "hash", hashStr)
 }
 
 func DebugScanFile(filename string, size int, metahash []byte) {
-	if !Verbose { return }
-	log.Printf("SCAN FILE name %v size %v metahash %v\n", filename, size, hex.EncodeToString(metahash))
+	if !debugging(CategoryFiles) { return }
+	hash := hex.EncodeToString(metahash)
+	logDebug(CategoryFiles, "scan file", fmt.Sprintf("SCAN FILE name %v size %v metahash %v", filename, size, hash),
+		"file", filename, "size", size, "metahash", hash)
 }
 
 func DebugStartDownload(filename string, metahash []byte, source string) {
-	if !Verbose { return }
-	log.Printf("START DOWNLOADING file %v from %v metahash %v\n", filename, source, hex.EncodeToString(metahash))
+	if !debugging(CategoryFiles) { return }
+	hash := hex.EncodeToString(metahash)
+	logDebug(CategoryFiles, "start download",
+		fmt.Sprintf("START DOWNLOADING file %v from %v metahash %v", filename, source, hash),
+		"file", filename, "from", source, "metahash", hash)
 }
 
 func DebugDownloadTimeout(filename string, metahash []byte, source string) {
-	if !Verbose { return }
-	log.Printf("DOWNLOAD TIMEOUT file %v from %v metahash %v\n", filename, source, hex.EncodeToString(metahash))
+	if !debugging(CategoryFiles) { return }
+	hash := hex.EncodeToString(metahash)
+	logDebug(CategoryFiles, "download timeout",
+		fmt.Sprintf("DOWNLOAD TIMEOUT file %v from %v metahash %v", filename, source, hash),
+		"file", filename, "from", source, "metahash", hash)
 }
 
 func DebugDownloadCompleted(filename string, metahash []byte, source string) {
-	if !Verbose { return }
-	log.Printf("DOWNLOAD COMPLETED file %v from %v metahash %v\n", filename, source, hex.EncodeToString(metahash))
+	if !debugging(CategoryFiles) { return }
+	hash := hex.EncodeToString(metahash)
+	logDebug(CategoryFiles, "download completed",
+		fmt.Sprintf("DOWNLOAD COMPLETED file %v from %v metahash %v", filename, source, hash),
+		"file", filename, "from", source, "metahash", hash)
+}
+
+func DebugDownloadPaused(filename string, metahash []byte) {
+	if !debugging(CategoryFiles) { return }
+	hash := hex.EncodeToString(metahash)
+	logDebug(CategoryFiles, "download paused", fmt.Sprintf("DOWNLOAD PAUSED file %v metahash %v", filename, hash),
+		"file", filename, "metahash", hash)
+}
+
+func DebugDownloadResumed(filename string, metahash []byte) {
+	if !debugging(CategoryFiles) { return }
+	hash := hex.EncodeToString(metahash)
+	logDebug(CategoryFiles, "download resumed", fmt.Sprintf("DOWNLOAD RESUMED file %v metahash %v", filename, hash),
+		"file", filename, "metahash", hash)
+}
+
+func DebugDownloadCancelled(filename string, metahash []byte) {
+	if !debugging(CategoryFiles) { return }
+	hash := hex.EncodeToString(metahash)
+	logDebug(CategoryFiles, "download cancelled", fmt.Sprintf("DOWNLOAD CANCELLED file %v metahash %v", filename, hash),
+		"file", filename, "metahash", hash)
+}
+
+func DebugDownloadAlreadyRunning(filename string, metahash []byte) {
+	if !debugging(CategoryFiles) { return }
+	hash := hex.EncodeToString(metahash)
+	logDebug(CategoryFiles, "download already running",
+		fmt.Sprintf("DOWNLOAD ALREADY RUNNING file %v metahash %v", filename, hash),
+		"file", filename, "metahash", hash)
+}
+
+func DebugDownloadRequestTimeout(hash []byte, source string) {
+	if !debugging(CategoryFiles) { return }
+	hashStr := hex.EncodeToString(hash)
+	logDebug(CategoryFiles, "data request timeout", fmt.Sprintf("TIMEOUT data request %v from %v", hashStr, source),
+		"hash", hashStr, "from", source)
+}
+
+func DebugDownloadProgress(filename string, done, total int) {
+	logDebug(CategoryFiles, "download progress", fmt.Sprintf("DOWNLOAD PROGRESS file %v chunks %v/%v", filename, done, total),
+		"file", filename, "done", done, "total", total)
 }
 
 func DebugReceiveDataRequest(request *DataRequest) {
-	if !Verbose { return }
-	log.Printf("RECEIVE DATA REQUEST from %v to %v metahash %v\n", request.Origin, request.Destination, hex.EncodeToString(request.HashValue))
+	if !debugging(CategoryFiles) { return }
+	hash := hex.EncodeToString(request.HashValue)
+	logDebug(CategoryFiles, "receive data request",
+		fmt.Sprintf("RECEIVE DATA REQUEST from %v to %v metahash %v", request.Origin, request.Destination, hash),
+		"origin", request.Origin, "destination", request.Destination, "hash", hash)
 }
 
 func DebugReceiveDataReply(reply *DataReply) {
-	if !Verbose { return }
-	log.Printf("RECEIVE DATA REPLY from %v to %v metahash %v\n", reply.Origin, reply.Destination, hex.EncodeToString(reply.HashValue))
+	if !debugging(CategoryFiles) { return }
+	hash := hex.EncodeToString(reply.HashValue)
+	logDebug(CategoryFiles, "receive data reply",
+		fmt.Sprintf("RECEIVE DATA REPLY from %v to %v metahash %v", reply.Origin, reply.Destination, hash),
+		"origin", reply.Origin, "destination", reply.Destination, "hash", hash)
 }
 
 func DebugForwardPointToPoint(destination, nextAddress string) {
-	if !Verbose { return }
-	log.Printf("ROUTE POINT-TO-POINT MESSAGE destination %v nextAddreess %v\n", destination, nextAddress)
+	logDebug(CategoryRouting, "forward point-to-point",
+		fmt.Sprintf("ROUTE POINT-TO-POINT MESSAGE destination %v nextAddreess %v", destination, nextAddress),
+		"destination", destination, "next", nextAddress)
 }
 
 func DebugHashNotFound(hash []byte, source string) {
-	if !Verbose { return }
-	log.Printf("NOT FOUND hash %v from %v\n", hex.EncodeToString(hash), source)
+	if !debugging(CategoryFiles) { return }
+	hashStr := hex.EncodeToString(hash)
+	logDebug(CategoryFiles, "hash not found", fmt.Sprintf("NOT FOUND hash %v from %v", hashStr, source),
+		"hash", hashStr, "from", source)
 }
 
 func DebugFileNotFound(file string) {
-	if !Verbose { return }
-	log.Printf("NOT FOUND file %v\n", file)
+	logDebug(CategoryFiles, "file not found", fmt.Sprintf("NOT FOUND file %v", file), "file", file)
 }
 
 func DebugCorruptedDataReply(hash []byte, reply *DataReply) {
-	if !Verbose { return }
 
-	expected := hex.EncodeToString(hash)[:8]
-	received := hex.EncodeToString(reply.HashValue)[:8]
+	expected := hex.EncodeToString(hash)
+	received := hex.EncodeToString(reply.HashValue)
 	computedHash := sha256.Sum256(reply.Data)
-	computed := hex.EncodeToString(computedHash[:])[:8]
+	computed := hex.EncodeToString(computedHash[:])
 
-	log.Printf("CORRUPTED DATA REPLY expected %v received %v computed %v\n", expected, received, computed)
+	logWarn(CategoryFiles, "corrupted data reply",
+		fmt.Sprintf("CORRUPTED DATA REPLY expected %v received %v computed %v", expected[:8], received[:8], computed[:8]),
+		"expected", expected, "received", received, "computed", computed)
 }
 
 func DebugSendNoDestination() {
-	if !Verbose { return }
-	log.Printf("WARNING attempt to send or forward to node with no destination\n")
+	logWarn(CategoryRouting, "no destination", "WARNING attempt to send or forward to node with no destination")
 }
 
 func DebugSendNoOrigin() {
-	if !Verbose { return }
-	log.Printf("WARNING attempt to send or forward to node without specifying origin\n")
+	logWarn(CategoryRouting, "no origin", "WARNING attempt to send or forward to node without specifying origin")
 }
 
-func DebugFileTooBig(name string) {
-	if !Verbose { return }
-	log.Printf("WARNING file %v is too big for Peerster (max. 2Mb)\n", name)
+func DebugCorruptedChunk(hash []byte) {
+	hashStr := hex.EncodeToString(hash)
+	logWarn(CategoryFiles, "corrupted chunk", fmt.Sprintf("WARNING chunk %v is corrupted on disk", hashStr), "hash", hashStr)
 }
 
 func DebugStartGossiper(clientAddress, gossipAddress, name string, peers []string, simple bool, rtimer time.Duration) {
-	if !Verbose { return }
-	log.Printf("START GOSSIPER\n")
-	log.Printf("client address %v\n", clientAddress)
-	log.Printf("gossip address %v\n", gossipAddress)
-	log.Printf("name %v\n", name)
-	log.Printf("peers %v\n", peers)
-	log.Printf("simple %v\n", simple)
-	log.Printf("rtimer %v\n", rtimer)
+	logDebug(CategoryNode, "start gossiper",
+		fmt.Sprintf("START GOSSIPER client address %v gossip address %v name %v peers %v simple %v rtimer %v",
+			clientAddress, gossipAddress, name, peers, simple, rtimer),
+		"clientAddress", clientAddress, "gossipAddress", gossipAddress, "name", name, "peers", peers,
+		"simple", simple, "rtimer", rtimer)
 }
 
 func DebugStopGossiper() {
-	if !Verbose { return }
-	log.Printf("STOP GOSSIPER\n")
+	logDebug(CategoryNode, "stop gossiper", "STOP GOSSIPER")
+}
+
+func DebugRestoreState(rumors, messages, blocks, files, downloads int) {
+	logDebug(CategoryNode, "restore state",
+		fmt.Sprintf("RESTORE rumors %v private messages %v blocks %v files %v downloads %v", rumors, messages, blocks, files, downloads),
+		"rumors", rumors, "messages", messages, "blocks", blocks, "files", files, "downloads", downloads)
+}
+
+func DebugSendError(address string, err error) {
+	logWarn(CategoryNetwork, "send failed", fmt.Sprintf("WARNING could not send packet to %v: %v", address, err),
+		"to", address, "error", err)
+}
+
+func DebugTCPFallback(address string, err error) {
+	logDebug(CategoryNetwork, "tcp fallback", fmt.Sprintf("TCP UNAVAILABLE for %v, falling back to UDP: %v", address, err),
+		"to", address, "error", err)
+}
+
+func DebugTCPRejected(remote string, err error) {
+	logWarn(CategoryNetwork, "tcp rejected", fmt.Sprintf("WARNING rejected TCP connection from %v: %v", remote, err),
+		"from", remote, "error", err)
+}
+
+func DebugInjectFault(fault, direction, peer string) {
+	if !debugging(CategoryNetwork) { return }
+	logDebug(CategoryNetwork, "inject fault", fmt.Sprintf("FAULT %v %v packet of %v", fault, direction, peer),
+		"fault", fault, "direction", direction, "peer", peer)
+}
+
+func DebugDropFragment(source string, id uint32, reason string) {
+	logDebug(CategoryNetwork, "drop fragment", fmt.Sprintf("DROP FRAGMENT of packet %v from %v: %v", id, source, reason),
+		"packet", id, "from", source, "reason", reason)
+}
+
+func DebugReassembled(source string, id uint32, size int) {
+	logDebug(CategoryNetwork, "reassembled", fmt.Sprintf("REASSEMBLED packet %v from %v size %v", id, source, size),
+		"packet", id, "from", source, "size", size)
+}
+
+func DebugStorageError(err error) {
+	logError(CategoryNode, "storage error", fmt.Sprintf("WARNING storage error %v", err), "error", err)
+}
+
+func DebugCaptureError(err error) {
+	logError(CategoryNetwork, "capture error", fmt.Sprintf("WARNING capture error %v", err), "error", err)
 }
 
 func DebugStartSearch(keywords []string, budget uint64, increasing bool) {
-	if !Verbose { return }
-	log.Printf("START search %v budget %v increasing %v\n", strings.Join(keywords, SearchKeywordSeparator), budget, increasing)
+	if !debugging(CategorySearch) { return }
+	logDebug(CategorySearch, "start search",
+		fmt.Sprintf("START search %v budget %v increasing %v", strings.Join(keywords, SearchKeywordSeparator), budget, increasing),
+		"keywords", keywords, "budget", budget, "increasing", increasing)
 }
 
 func DebugSearchTimeout(keywords []string) {
-	if !Verbose { return }
-	log.Printf("TIMEOUT search %v\n", strings.Join(keywords, SearchKeywordSeparator))
+	if !debugging(CategorySearch) { return }
+	logDebug(CategorySearch, "search timeout", fmt.Sprintf("TIMEOUT search %v", strings.Join(keywords, SearchKeywordSeparator)),
+		"keywords", keywords)
 }
 
 func DebugSearchResults(keywords []string, results []*SearchResult) {
-	if !Verbose { return }
-	log.Printf("FOUND %v results for keywords %v\n", len(results), strings.Join(keywords, SearchKeywordSeparator))
+	if !debugging(CategorySearch) { return }
+	logDebug(CategorySearch, "search results",
+		fmt.Sprintf("FOUND %v results for keywords %v", len(results), strings.Join(keywords, SearchKeywordSeparator)),
+		"results", len(results), "keywords", keywords)
 }
 
 func DebugInvalidPacket(packet *GossipPacket) {
-	if !Verbose { return }
-	log.Printf("WARNING received invalid packet %v\n", packet)
+	logWarn(CategoryNetwork, "invalid packet", fmt.Sprintf("WARNING received invalid packet %v", packet))
+}
+
+func DebugSignInvalidPacket(packet *GossipPacket) {
+	logWarn(CategoryCrypto, "sign invalid packet", fmt.Sprintf("WARNING attempt to sign invalid packet %v", packet))
 }
 
 func DebugSearchStatus(count int, keywords []string) {
-	if !Verbose { return }
-	log.Printf("SEARCH STATUS %v full results for search %v\n", count, strings.Join(keywords, SearchKeywordSeparator))
+	if !debugging(CategorySearch) { return }
+	logDebug(CategorySearch, "search status",
+		fmt.Sprintf("SEARCH STATUS %v full results for search %v", count, strings.Join(keywords, SearchKeywordSeparator)),
+		"full", count, "keywords", keywords)
 }
 
 func DebugProcessSearchRequest(origin string, keywords []string) {
-	if !Verbose { return }
-	log.Printf("PROCESS search request from %v keywords %v\n", origin, strings.Join(keywords, SearchKeywordSeparator))
+	if !debugging(CategorySearch) { return }
+	logDebug(CategorySearch, "process search request",
+		fmt.Sprintf("PROCESS search request from %v keywords %v", origin, strings.Join(keywords, SearchKeywordSeparator)),
+		"origin", origin, "keywords", keywords)
 }
 
 func DebugIgnoreSpam(origin string, keywords []string) {
-	if !Verbose { return }
-	log.Printf("IGNORE SPAM from %v keywords %v\n", origin, strings.Join(keywords, SearchKeywordSeparator))
+	if !debugging(CategorySearch) { return }
+	logDebug(CategorySearch, "ignore spam",
+		fmt.Sprintf("IGNORE SPAM from %v keywords %v", origin, strings.Join(keywords, SearchKeywordSeparator)),
+		"origin", origin, "keywords", keywords)
 }
 
 func DebugDownloadUnknownFile(hash []byte) {
-	if !Verbose { return }
-	log.Printf("WARNING cannot download unknown file %v\n", hex.EncodeToString(hash))
+	hashStr := hex.EncodeToString(hash)
+	logWarn(CategoryFiles, "unknown file", fmt.Sprintf("WARNING cannot download unknown file %v", hashStr), "metahash", hashStr)
 }
 
 func DebugNoKnownOwnerForFile(hash []byte) {
-	if !Verbose { return }
-	log.Printf("WARNING cannot download file %v has no owner\n", hex.EncodeToString(hash))
+	hashStr := hex.EncodeToString(hash)
+	logWarn(CategoryFiles, "no known owner", fmt.Sprintf("WARNING cannot download file %v has no owner", hashStr), "metahash", hashStr)
 }
 
 func DebugForwardSearchRequest(request *SearchRequest, next string) {
-	if !Verbose { return }
-	log.Printf("FORWARD search request %v from %v to %v budget %v\n", strings.Join(request.Keywords, SearchKeywordSeparator), request.Origin, next, request.Budget)
+	if !debugging(CategorySearch) { return }
+	logDebug(CategorySearch, "forward search request",
+		fmt.Sprintf("FORWARD search request %v from %v to %v budget %v",
+			strings.Join(request.Keywords, SearchKeywordSeparator), request.Origin, next, request.Budget),
+		"keywords", request.Keywords, "origin", request.Origin, "to", next, "budget", request.Budget)
 }
 
 func DebugIgnoreBlockIsNotValid(block *Block) {
-	if !Verbose { return }
+	if !debugging(CategoryChain) { return }
 	hash := block.Hash()
-	log.Printf("IGNORE block %v is invalid\n", hex.EncodeToString(hash[:]))
+	hashStr := hex.EncodeToString(hash[:])
+	logDebug(CategoryChain, "ignore block", fmt.Sprintf("IGNORE block %v is invalid", hashStr),
+		"hash", hashStr, "reason", "invalid")
 }
 
 func DebugIgnoreBlockAlreadyPresent(block *Block) {
-	if !Verbose { return }
+	if !debugging(CategoryChain) { return }
 	hash := block.Hash()
-	log.Printf("IGNORE block %v is already in chain\n", hex.EncodeToString(hash[:]))
+	hashStr := hex.EncodeToString(hash[:])
+	logDebug(CategoryChain, "ignore block", fmt.Sprintf("IGNORE block %v is already in chain", hashStr),
+		"hash", hashStr, "reason", "already in chain")
 }
 
 func DebugIgnoreBlockInconsistent(block *Block) {
-	if !Verbose { return }
+	if !debugging(CategoryChain) { return }
 	hash := block.Hash()
-	log.Printf("IGNORE block %v is inconsistent with current namespace\n", hex.EncodeToString(hash[:]))
+	hashStr := hex.EncodeToString(hash[:])
+	logDebug(CategoryChain, "ignore block", fmt.Sprintf("IGNORE block %v is inconsistent with current namespace", hashStr),
+		"hash", hashStr, "reason", "inconsistent")
 }
 
 func DebugIgnoreBlockPrevDoesntMatch(block *Block, prev [32]byte) {
-	if !Verbose { return }
+	if !debugging(CategoryChain) { return }
 	hash := block.Hash()
-	log.Printf("IGNORE block %v prev hash %v does not match chain end %v\n", hex.EncodeToString(hash[:]),
-		hex.EncodeToString(block.PrevHash[:]), hex.EncodeToString(prev[:]))
+	hashStr := hex.EncodeToString(hash[:])
+	prevStr := hex.EncodeToString(block.PrevHash[:])
+	endStr := hex.EncodeToString(prev[:])
+	logDebug(CategoryChain, "ignore block",
+		fmt.Sprintf("IGNORE block %v prev hash %v does not match chain end %v", hashStr, prevStr, endStr),
+		"hash", hashStr, "reason", "prev does not match", "prev", prevStr, "end", endStr)
 }
 
 func DebugIgnoreTransactionAlreadyInChain(transaction *TxPublish) {
-	if !Verbose { return }
-	log.Printf("IGNORE transaction %v|%v already in chain\n", transaction.File.Name, transaction.User.Name)
+	logDebug(CategoryChain, "ignore transaction",
+		fmt.Sprintf("IGNORE transaction %v|%v already in chain", transaction.File.Name, transaction.User.Name),
+		"file", transaction.File.Name, "user", transaction.User.Name, "reason", "already in chain")
 }
 
 func DebugIgnoreTransactionAlreadyCandidate(transaction *TxPublish) {
-	if !Verbose { return }
-	log.Printf("IGNORE transaction %v|%v already candidate\n", transaction.File.Name, transaction.User.Name)
+	logDebug(CategoryChain, "ignore transaction",
+		fmt.Sprintf("IGNORE transaction %v|%v already candidate", transaction.File.Name, transaction.User.Name),
+		"file", transaction.File.Name, "user", transaction.User.Name, "reason", "already candidate")
 }
 
 func DebugAddCandidateTransaction(transaction *TxPublish) {
-	if !Verbose { return }
-	log.Printf("CANDIDATE transaction %v|%v successfully added\n", transaction.File.Name, transaction.User.Name)
+	logDebug(CategoryChain, "candidate transaction",
+		fmt.Sprintf("CANDIDATE transaction %v|%v successfully added", transaction.File.Name, transaction.User.Name),
+		"file", transaction.File.Name, "user", transaction.User.Name)
 }
 
 func DebugBroadcastTransaction(transaction *TxPublish) {
-	if !Verbose { return }
-	log.Printf("BROADCAST transaction %v|%v\n", transaction.File.Name, transaction.User.Name)
+	logDebug(CategoryChain, "broadcast transaction",
+		fmt.Sprintf("BROADCAST transaction %v|%v", transaction.File.Name, transaction.User.Name),
+		"file", transaction.File.Name, "user", transaction.User.Name)
 }
 
 func DebugReceiveTransaction(transaction *TxPublish) {
-	if !Verbose { return }
-	log.Printf("RECEIVE transaction %v|%v\n", transaction.File.Name, transaction.User.Name)
+	logDebug(CategoryChain, "receive transaction",
+		fmt.Sprintf("RECEIVE transaction %v|%v", transaction.File.Name, transaction.User.Name),
+		"file", transaction.File.Name, "user", transaction.User.Name)
 }
 
 func DebugSleep(duration time.Duration) {
-	if !Verbose { return }
-	log.Printf("SLEEP %v\n", duration)
+	logDebug(CategoryChain, "sleep", fmt.Sprintf("SLEEP %v", duration), "duration", duration)
 }
 
 func DebugChainLength(length int) {
-	if !Verbose { return }
-	log.Printf("CHAIN LENGTH %v\n", length)
+	logDebug(CategoryChain, "chain length", fmt.Sprintf("CHAIN LENGTH %v", length), "length", length)
 }
 
 func DebugBroadcastBlock(hash [32]byte) {
-	if !Verbose { return }
-	log.Printf("BROADCAST BLOCK %v\n", hex.EncodeToString(hash[:]))
+	hashStr := hex.EncodeToString(hash[:])
+	logDebug(CategoryChain, "broadcast block", fmt.Sprintf("BROADCAST BLOCK %v", hashStr), "hash", hashStr)
 }
 
 func DebugServeSeachReply(reply *SearchReply) {
-	if !Verbose { return }
+	if !debugging(CategorySearch) { return }
 
 	results := make([]string, 0)
 
@@ -417,36 +593,81 @@ func DebugServeSeachReply(reply *SearchReply) {
 		results = append(results, result.FileName)
 	}
 
-	log.Printf("SERVE SEARCH REPLY to %v results %v\n", reply.Destination, strings.Join(results, ","))
+	logDebug(CategorySearch, "serve search reply",
+		fmt.Sprintf("SERVE SEARCH REPLY to %v results %v", reply.Destination, strings.Join(results, ",")),
+		"to", reply.Destination, "results", results)
 }
 
 func DebugSkipSendNotAuthenticated() {
-	if !Verbose { return }
-	log.Printf("NOT AUTHENTICATED skip send packet\n")
+	logDebug(CategoryCrypto, "not authenticated", "NOT AUTHENTICATED skip send packet")
 }
 
 func DebugDropUnauthenticatedOrigin(signed *Signature) {
-	if !Verbose {
-		return
-	}
-	log.Printf("DROP SIGNED MESSAGE no key ORIGIN %v\n", signed.Origin)
+	logWarn(CategoryCrypto, "drop signed message", fmt.Sprintf("DROP SIGNED MESSAGE no key ORIGIN %v", signed.Origin),
+		"origin", signed.Origin, "reason", "no key")
 }
 
 func DebugDropIncorrectSignature(signed *Signature) {
-	if !Verbose {
-		return
-	}
-	log.Printf("DROP SIGNED MESSAGE incorrect signature ORIGIN %v\n", signed.Origin)
+	logWarn(CategoryCrypto, "drop signed message", fmt.Sprintf("DROP SIGNED MESSAGE incorrect signature ORIGIN %v", signed.Origin),
+		"origin", signed.Origin, "reason", "incorrect signature")
 }
 
 func DebugDropWrongOrigin(signed *Signature) {
-	if !Verbose { return }
-	log.Printf("DROP SIGNED MESSAGE origin mismatch ORIGIN %v\n", signed.Origin)
+	logWarn(CategoryCrypto, "drop signed message", fmt.Sprintf("DROP SIGNED MESSAGE origin mismatch ORIGIN %v", signed.Origin),
+		"origin", signed.Origin, "reason", "origin mismatch")
+}
+
+func DebugDropUnsigned() {
+	logWarn(CategoryCrypto, "drop unsigned message", "DROP MESSAGE not signed")
 }
 
 func DebugDropCannotCipher(packet *GossipPacket) {
-	if !Verbose {
-		return
+	destination := *packet.GetDestination()
+	logWarn(CategoryCrypto, "drop message", fmt.Sprintf("DROP MESSAGE cannot cipher DESTINATION %v", destination),
+		"destination", destination, "reason", "cannot cipher")
+}
+
+func DebugCryptoError(operation string, err error) {
+	logError(CategoryCrypto, "crypto error", fmt.Sprintf("Error from %v: %v", operation, err),
+		"operation", operation, "error", err)
+}
+
+func DebugDropOnion(err error) {
+	logWarn(CategoryOnion, "drop onion", fmt.Sprintf("DROP ONION %v", err), "error", err)
+}
+
+func DebugDeliverOnion() {
+	logDebug(CategoryOnion, "deliver onion", "DELIVER ONION")
+}
+
+func DebugMixOnion(destination string) {
+	logDebug(CategoryOnion, "mix onion", fmt.Sprintf("MIX ONION next %v", destination), "next", destination)
+}
+
+func DebugReleaseOnion(destination string) {
+	logDebug(CategoryOnion, "release onion", fmt.Sprintf("RELEASE ONION to %v", destination), "to", destination)
+}
+
+// Vector clock of a status packet in the assignment format, e.g. peer A nextID 2 peer B nextID 5
+func statusText(status *StatusPacket) string {
+
+	peers := make([]string, 0, len(status.Want))
+
+	for _, peerStatus := range status.Want {
+		peers = append(peers, fmt.Sprintf("peer %v nextID %v", peerStatus.Identifier, peerStatus.NextID))
 	}
-	log.Printf("DROP MESSAGE cannot cipher DESTINATION %v\n", *packet.GetDestination())
+
+	return strings.Join(peers, " ")
+}
+
+// Vector clock of a status packet as a field, e.g. A:2,B:5
+func statusField(status *StatusPacket) string {
+
+	peers := make([]string, 0, len(status.Want))
+
+	for _, peerStatus := range status.Want {
+		peers = append(peers, fmt.Sprintf("%v:%v", peerStatus.Identifier, peerStatus.NextID))
+	}
+
+	return strings.Join(peers, ",")
 }
@@ -0,0 +1,462 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Logger sends log entries to sinks. Each entry has a level, the category of the subsystem that emitted
+// it, a short message, key/value fields and the line printed for it in the assignment format.
+//
+// Entries below the level of their category are discarded before they reach the sinks. Each sink writes
+// entries in its own format: the assignment format, key=value text or JSON.
+type Logger struct {
+	level  LogLevel                 // Minimum level of categories not in levels
+	levels map[LogCategory]LogLevel // Minimum level by category
+	sinks  []LogSink
+	seq    uint64 // Sequence number of the latest entry
+	lock   *sync.RWMutex
+}
+
+// Severity of a log entry
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota // Details only useful to debug the node
+	LevelInfo                  // Events of the node, among which those required by the assignment
+	LevelWarn                  // Unexpected events the node recovers from
+	LevelError                 // Failures of an operation
+)
+
+// Subsystem that emitted a log entry
+type LogCategory string
+
+const (
+	CategoryRumor   LogCategory = "rumor"   // Rumors, status packets and rumormongering
+	CategoryRouting LogCategory = "routing" // Peers, routing table and point-to-point messages
+	CategoryFiles   LogCategory = "files"   // Shared files and downloads
+	CategorySearch  LogCategory = "search"  // Search requests and replies
+	CategoryChain   LogCategory = "chain"   // Transactions, mining and blocks
+	CategoryCrypto  LogCategory = "crypto"  // Signatures and cyphered messages
+	CategoryOnion   LogCategory = "onion"   // Onion routing and mixing
+	CategoryNode    LogCategory = "node"    // Lifecycle, storage, client commands and API requests
+	CategoryNetwork LogCategory = "network" // Sockets, TCP connections and fragments
+)
+
+// All the categories of log entries
+var LogCategories = []LogCategory{
+	CategoryRumor, CategoryRouting, CategoryFiles, CategorySearch, CategoryChain,
+	CategoryCrypto, CategoryOnion, CategoryNode, CategoryNetwork,
+}
+
+// Layout of the log entries written by a sink
+type LogFormat int
+
+const (
+	FormatAssignment LogFormat = iota // Lines as required in the assignment, e.g. RUMOR origin A from B ID 1 contents hi
+	FormatText                        // Time, level, category, message and key=value fields on one line
+	FormatJSON                        // One JSON object per line
+)
+
+// One event logged by the node
+type LogEntry struct {
+	Seq      uint64 // Increases by one with each entry of the logger
+	Time     time.Time
+	Level    LogLevel
+	Category LogCategory
+	Message  string
+	Fields   []LogField
+	Text     string // Line in the assignment format
+}
+
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// Destination of log entries. Write is called with the entries in order, from one goroutine at a time.
+type LogSink interface {
+	Write(entry *LogEntry)
+}
+
+// Logger used by the Log* and Debug* functions. Until it is replaced, everything is printed to stdout in
+// the assignment format.
+var DefaultLogger = NewLogger(LevelDebug, NewWriterSink(os.Stdout, FormatAssignment))
+
+//
+//  LOGGER
+//
+
+func NewLogger(level LogLevel, sinks ...LogSink) *Logger {
+	return &Logger{
+		level:  level,
+		levels: make(map[LogCategory]LogLevel),
+		sinks:  sinks,
+		lock:   &sync.RWMutex{},
+	}
+}
+
+// Set the minimum level of all categories
+func (logger *Logger) SetLevel(level LogLevel) {
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	logger.level = level
+	logger.levels = make(map[LogCategory]LogLevel)
+}
+
+// Set the minimum level of one category
+func (logger *Logger) SetCategoryLevel(category LogCategory, level LogLevel) {
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	logger.levels[category] = level
+}
+
+// Set levels from a comma-separated list of levels and category=level pairs, e.g. "info,search=debug".
+// Later items take precedence over earlier ones.
+func (logger *Logger) SetLevels(spec string) error {
+
+	for _, item := range strings.Split(spec, ",") {
+
+		item = strings.TrimSpace(item)
+
+		if item == "" {
+			continue
+		}
+
+		separator := strings.Index(item, "=")
+
+		if separator < 0 {
+
+			level, err := ParseLogLevel(item)
+			if err != nil {
+				return err
+			}
+
+			logger.SetLevel(level)
+			continue
+		}
+
+		category, err := ParseLogCategory(item[:separator])
+		if err != nil {
+			return err
+		}
+
+		level, err := ParseLogLevel(item[separator+1:])
+		if err != nil {
+			return err
+		}
+
+		logger.SetCategoryLevel(category, level)
+	}
+
+	return nil
+}
+
+// Whether entries of a given level and category are sent to the sinks
+func (logger *Logger) Enabled(level LogLevel, category LogCategory) bool {
+
+	logger.lock.RLock()
+	defer logger.lock.RUnlock()
+
+	minimum, found := logger.levels[category]
+	if !found {
+		minimum = logger.level
+	}
+
+	return level >= minimum
+}
+
+// Replace the sinks of the logger
+func (logger *Logger) SetSinks(sinks ...LogSink) {
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	logger.sinks = sinks
+}
+
+// First in-memory sink of the logger, nil if there is none
+func (logger *Logger) Ring() *RingSink {
+
+	logger.lock.RLock()
+	defer logger.lock.RUnlock()
+
+	for _, sink := range logger.sinks {
+		if ring, ok := sink.(*RingSink); ok {
+			return ring
+		}
+	}
+
+	return nil
+}
+
+// Log an entry if its level is enabled. Fields alternate keys and values. Errors and values that implement
+// fmt.Stringer are logged as strings.
+func (logger *Logger) Emit(level LogLevel, category LogCategory, message, text string, fields ...interface{}) {
+
+	if !logger.Enabled(level, category) {
+		return
+	}
+
+	entry := &LogEntry{
+		Time:     time.Now(),
+		Level:    level,
+		Category: category,
+		Message:  message,
+		Fields:   make([]LogField, 0, len(fields)/2),
+		Text:     text,
+	}
+
+	for i := 0; i+1 < len(fields); i += 2 {
+
+		value := fields[i+1]
+
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+
+		entry.Fields = append(entry.Fields, LogField{fmt.Sprint(fields[i]), value})
+	}
+
+	// Sinks are called under the lock so that they receive entries in order
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	logger.seq++
+	entry.Seq = logger.seq
+
+	for _, sink := range logger.sinks {
+		sink.Write(entry)
+	}
+}
+
+//
+//  SINKS
+//
+
+// Sink writing formatted entries, one per line, e.g. to stdout or to a file
+type WriterSink struct {
+	writer io.Writer
+	format LogFormat
+}
+
+// Sink keeping the latest entries in memory
+type RingSink struct {
+	entries []*LogEntry // Circular buffer, next is the position of the oldest entry once it is full
+	next    int
+	full    bool
+	lock    *sync.RWMutex
+}
+
+func NewWriterSink(writer io.Writer, format LogFormat) *WriterSink {
+	return &WriterSink{writer, format}
+}
+
+// Create a sink appending entries to a file, which is created if needed
+func NewFileSink(path string, format LogFormat) (*WriterSink, error) {
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWriterSink(file, format), nil
+}
+
+func (sink *WriterSink) Write(entry *LogEntry) {
+	fmt.Fprintln(sink.writer, entry.Format(sink.format))
+}
+
+// Create a sink keeping the latest size entries
+func NewRingSink(size int) *RingSink {
+	return &RingSink{
+		entries: make([]*LogEntry, size),
+		lock:    &sync.RWMutex{},
+	}
+}
+
+func (ring *RingSink) Write(entry *LogEntry) {
+
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	if len(ring.entries) == 0 {
+		return
+	}
+
+	ring.entries[ring.next] = entry
+	ring.next = (ring.next + 1) % len(ring.entries)
+	ring.full = ring.full || ring.next == 0
+}
+
+// Entries in memory that come after a given sequence number, from the oldest to the latest
+func (ring *RingSink) Since(seq uint64) []*LogEntry {
+
+	ring.lock.RLock()
+	defer ring.lock.RUnlock()
+
+	entries := make([]*LogEntry, 0)
+	start := 0
+
+	if ring.full {
+		start = ring.next
+	}
+
+	for i := 0; i < len(ring.entries); i++ {
+
+		entry := ring.entries[(start+i)%len(ring.entries)]
+
+		if entry == nil {
+			break
+		}
+
+		if entry.Seq > seq {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+//
+//  FORMATS
+//
+
+// Print an entry on one line
+func (entry *LogEntry) Format(format LogFormat) string {
+
+	switch format {
+
+	case FormatText:
+
+		var builder strings.Builder
+
+		fmt.Fprintf(&builder, "%v %-5v %-7v %v", entry.Time.Format(logTimeLayout), strings.ToUpper(entry.Level.String()),
+			entry.Category, entry.Message)
+
+		for _, field := range entry.Fields {
+
+			value := fmt.Sprint(field.Value)
+
+			if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+				value = strconv.Quote(value)
+			}
+
+			fmt.Fprintf(&builder, " %v=%v", field.Key, value)
+		}
+
+		return builder.String()
+
+	case FormatJSON:
+
+		bytes, err := json.Marshal(entry)
+		if err != nil {
+			return err.Error()
+		}
+
+		return string(bytes)
+
+	default:
+		return entry.Text
+	}
+}
+
+// Encode an entry as a flat JSON object: seq, time, level, category and msg followed by the fields
+func (entry *LogEntry) MarshalJSON() ([]byte, error) {
+
+	var builder strings.Builder
+
+	fmt.Fprintf(&builder, `{"seq":%v,"time":%q,"level":%q,"category":%q,"msg":%q`, entry.Seq,
+		entry.Time.Format(time.RFC3339Nano), entry.Level, entry.Category, entry.Message)
+
+	for _, field := range entry.Fields {
+
+		key, _ := json.Marshal(field.Key)
+		value, err := json.Marshal(field.Value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&builder, ",%s:%s", key, value)
+	}
+
+	builder.WriteString("}")
+
+	return []byte(builder.String()), nil
+}
+
+//
+//  PARSING
+//
+
+// Time of entries in the text format, with a fixed width so that columns line up
+const logTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+var formatNames = []string{"assignment", "text", "json"}
+
+func (level LogLevel) String() string {
+
+	if level < LevelDebug || level > LevelError {
+		return strconv.Itoa(int(level))
+	}
+
+	return levelNames[level]
+}
+
+func (format LogFormat) String() string {
+
+	if format < FormatAssignment || format > FormatJSON {
+		return strconv.Itoa(int(format))
+	}
+
+	return formatNames[format]
+}
+
+func ParseLogLevel(text string) (LogLevel, error) {
+
+	for level, name := range levelNames {
+		if strings.TrimSpace(text) == name {
+			return LogLevel(level), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %v, expected one of %v", text, strings.Join(levelNames, ", "))
+}
+
+func ParseLogCategory(text string) (LogCategory, error) {
+
+	for _, category := range LogCategories {
+		if strings.TrimSpace(text) == string(category) {
+			return category, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown log category %v", text)
+}
+
+func ParseLogFormat(text string) (LogFormat, error) {
+
+	for format, name := range formatNames {
+		if strings.TrimSpace(text) == name {
+			return LogFormat(format), nil
+		}
+	}
+
+	return FormatAssignment, fmt.Errorf("unknown log format %v, expected one of %v", text, strings.Join(formatNames, ", "))
+}
@@ -0,0 +1,281 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// A MetricRegistry holds the metrics of a node and writes them in the text format of Prometheus:
+//
+//	# HELP peerster_packets_received_total Packets received from other nodes, by type
+//	# TYPE peerster_packets_received_total counter
+//	peerster_packets_received_total{type="rumor"} 12
+//
+// Metrics are written in the order in which they were registered.
+type MetricRegistry struct {
+	metrics []metric
+	lock    *sync.RWMutex
+}
+
+// Metric that can be written by a registry
+type metric interface {
+	writeText(writer io.Writer)
+}
+
+// Value that only goes up, e.g. a number of packets
+type Counter struct {
+	name  string
+	help  string
+	label string // Label of the counter inside a CounterVec, e.g. type="rumor"
+	value uint64
+}
+
+// Counters with the same name, distinguished by the value of one label
+type CounterVec struct {
+	name     string
+	help     string
+	label    string
+	counters map[string]*Counter
+	lock     *sync.RWMutex
+}
+
+// Distribution of observed values, e.g. latencies in seconds
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64 // Upper bounds, in increasing order
+	counts  []uint64  // Number of observations in each bucket, not cumulated
+	sum     float64
+	count   uint64
+	lock    *sync.Mutex
+}
+
+// Value read when the metrics are written, e.g. a number of peers
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// Prefix of the names of all metrics
+const MetricPrefix = "peerster_"
+
+// Upper bounds of latency histograms, in seconds
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//
+//  REGISTRY
+//
+
+func NewMetricRegistry() *MetricRegistry {
+	return &MetricRegistry{
+		metrics: make([]metric, 0),
+		lock:    &sync.RWMutex{},
+	}
+}
+
+func (registry *MetricRegistry) register(metric metric) {
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.metrics = append(registry.metrics, metric)
+}
+
+// Register a counter. Name is given without MetricPrefix.
+func (registry *MetricRegistry) Counter(name, help string) *Counter {
+	counter := &Counter{name: MetricPrefix + name, help: help}
+	registry.register(counter)
+	return counter
+}
+
+// Register counters distinguished by the value of a label
+func (registry *MetricRegistry) CounterVec(name, help, label string) *CounterVec {
+
+	vec := &CounterVec{
+		name:     MetricPrefix + name,
+		help:     help,
+		label:    label,
+		counters: make(map[string]*Counter),
+		lock:     &sync.RWMutex{},
+	}
+
+	registry.register(vec)
+	return vec
+}
+
+// Register a histogram with the given bucket upper bounds, in increasing order
+func (registry *MetricRegistry) Histogram(name, help string, buckets []float64) *Histogram {
+
+	histogram := &Histogram{
+		name:    MetricPrefix + name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+		lock:    &sync.Mutex{},
+	}
+
+	registry.register(histogram)
+	return histogram
+}
+
+// Register a gauge whose value is computed each time the metrics are written
+func (registry *MetricRegistry) GaugeFunc(name, help string, value func() float64) {
+	registry.register(&GaugeFunc{MetricPrefix + name, help, value})
+}
+
+// Write all the metrics in the text format of Prometheus
+func (registry *MetricRegistry) WriteText(writer io.Writer) {
+
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	for _, metric := range registry.metrics {
+		metric.writeText(writer)
+	}
+}
+
+//
+//  METRICS
+//
+
+func (counter *Counter) Inc() {
+	atomic.AddUint64(&counter.value, 1)
+}
+
+func (counter *Counter) Add(n uint64) {
+	atomic.AddUint64(&counter.value, n)
+}
+
+func (counter *Counter) Value() uint64 {
+	return atomic.LoadUint64(&counter.value)
+}
+
+// Counter for a given value of the label, created at 0 if needed
+func (vec *CounterVec) With(value string) *Counter {
+
+	vec.lock.RLock()
+	counter, found := vec.counters[value]
+	vec.lock.RUnlock()
+
+	if found {
+		return counter
+	}
+
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	if counter, found := vec.counters[value]; found {
+		return counter
+	}
+
+	counter = &Counter{name: vec.name, label: fmt.Sprintf("%v=%v", vec.label, strconv.Quote(value))}
+	vec.counters[value] = counter
+
+	return counter
+}
+
+func (histogram *Histogram) Observe(value float64) {
+
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	histogram.sum += value
+	histogram.count++
+
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[i]++
+			return
+		}
+	}
+}
+
+// Number of observations and their sum
+func (histogram *Histogram) Count() (uint64, float64) {
+
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	return histogram.count, histogram.sum
+}
+
+//
+//  TEXT FORMAT
+//
+
+func writeHeader(writer io.Writer, name, help, kind string) {
+	fmt.Fprintf(writer, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func (counter *Counter) writeText(writer io.Writer) {
+	writeHeader(writer, counter.name, counter.help, "counter")
+	counter.writeSample(writer)
+}
+
+func (counter *Counter) writeSample(writer io.Writer) {
+
+	if counter.label == "" {
+		fmt.Fprintf(writer, "%v %v\n", counter.name, counter.Value())
+	} else {
+		fmt.Fprintf(writer, "%v{%v} %v\n", counter.name, counter.label, counter.Value())
+	}
+}
+
+func (vec *CounterVec) writeText(writer io.Writer) {
+
+	writeHeader(writer, vec.name, vec.help, "counter")
+
+	vec.lock.RLock()
+	defer vec.lock.RUnlock()
+
+	values := make([]string, 0, len(vec.counters))
+
+	for value := range vec.counters {
+		values = append(values, value)
+	}
+
+	sort.Strings(values)
+
+	for _, value := range values {
+		vec.counters[value].writeSample(writer)
+	}
+}
+
+func (histogram *Histogram) writeText(writer io.Writer) {
+
+	writeHeader(writer, histogram.name, histogram.help, "histogram")
+
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	cumulated := uint64(0)
+
+	for i, bound := range histogram.buckets {
+		cumulated += histogram.counts[i]
+		fmt.Fprintf(writer, "%v_bucket{le=\"%v\"} %v\n", histogram.name, formatFloat(bound), cumulated)
+	}
+
+	fmt.Fprintf(writer, "%v_bucket{le=\"+Inf\"} %v\n", histogram.name, histogram.count)
+	fmt.Fprintf(writer, "%v_sum %v\n", histogram.name, formatFloat(histogram.sum))
+	fmt.Fprintf(writer, "%v_count %v\n", histogram.name, histogram.count)
+}
+
+func (gauge *GaugeFunc) writeText(writer io.Writer) {
+	writeHeader(writer, gauge.name, gauge.help, "gauge")
+	fmt.Fprintf(writer, "%v %v\n", gauge.name, formatFloat(gauge.value()))
+}
+
+func formatFloat(value float64) string {
+
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -160,6 +160,22 @@ type OnionSubHeader struct {
 	Hash 		[]byte				// 32B - Hash of OnionMessage
 }
 
+// A piece of an encoded GossipPacket that is too big to be sent in a single datagram. The receiver
+// puts the fragments back together and decodes the original packet.
+type Fragment struct {
+	ID    uint32 // Identifies the original packet among those fragmented by the sender
+	Index uint32 // Position of this fragment, starting at 0
+	Count uint32 // Total number of fragments of the original packet
+	Data  []byte
+}
+
+// A sample of the live neighbors of a node, sent to one of them so that it can discover new neighbors.
+// A node that receives a sample answers with one of its own.
+type PeerExchange struct {
+	Peers []string // Addresses of neighbors
+	Reply bool     // True if this is the answer to another sample, which should not be answered
+}
+
 // Aggregate of all other fields, should be used as top-level
 // entity for external communication with other nodes.
 type GossipPacket struct {
@@ -176,6 +192,8 @@ type GossipPacket struct {
     Signature     *Signature
     Cyphered      *CypheredMessage
 	Onion		  *OnionPacket
+	Fragment      *Fragment
+	PeerExchange  *PeerExchange
 }
 
 //
@@ -354,18 +372,77 @@ func (onion *OnionPacket) Packed() *GossipPacket {
 	return &GossipPacket{Onion: onion}
 }
 
+// Pack a Fragment into a GossipPacket
+func (fragment *Fragment) Packed() *GossipPacket {
+
+	if fragment == nil {
+		panic("Cannot pack <nil> fragment into a GossipPacket")
+	}
+
+	return &GossipPacket{Fragment: fragment}
+}
+
+// Pack a PeerExchange into a GossipPacket
+func (exchange *PeerExchange) Packed() *GossipPacket {
+
+	if exchange == nil {
+		panic("Cannot pack <nil> peer exchange into a GossipPacket")
+	}
+
+	return &GossipPacket{PeerExchange: exchange}
+}
+
 //
 //  INTEGRITY CHECKS
 //
 
-// Checks if a given GossipPacket is valid. It is only valid if exactly one of its 10 fields is non-nil.
+// Checks if a given GossipPacket is valid. It is only valid if exactly one of its fields (apart from
+// the signature) is non-nil.
 func (packet *GossipPacket) IsValid() bool {
 	return boolCount(packet.Rumor != nil)+boolCount(packet.Simple != nil)+
 		boolCount(packet.Status != nil)+boolCount(packet.Private != nil)+
 		boolCount(packet.DataReply != nil)+boolCount(packet.DataRequest != nil)+
 		boolCount(packet.SearchReply != nil)+boolCount(packet.SearchRequest != nil)+
 		boolCount(packet.TxPublish != nil)+boolCount(packet.BlockPublish != nil)+
-		+boolCount(packet.Cyphered != nil) + boolCount(packet.Onion != nil) == 1
+		+boolCount(packet.Cyphered != nil) + boolCount(packet.Onion != nil) +
+		boolCount(packet.Fragment != nil) + boolCount(packet.PeerExchange != nil) == 1
+}
+
+// Name of the kind of message carried by a packet, e.g. "rumor" or "dataReply". The signature of a packet
+// does not change its type.
+func (packet *GossipPacket) Type() string {
+	switch {
+	case packet.Simple != nil:
+		return "simple"
+	case packet.Rumor != nil:
+		return "rumor"
+	case packet.Status != nil:
+		return "status"
+	case packet.Private != nil:
+		return "private"
+	case packet.DataRequest != nil:
+		return "dataRequest"
+	case packet.DataReply != nil:
+		return "dataReply"
+	case packet.SearchRequest != nil:
+		return "searchRequest"
+	case packet.SearchReply != nil:
+		return "searchReply"
+	case packet.TxPublish != nil:
+		return "txPublish"
+	case packet.BlockPublish != nil:
+		return "blockPublish"
+	case packet.Cyphered != nil:
+		return "cyphered"
+	case packet.Onion != nil:
+		return "onion"
+	case packet.Fragment != nil:
+		return "fragment"
+	case packet.PeerExchange != nil:
+		return "peerExchange"
+	default:
+		return "unknown"
+	}
 }
 
 // Safety check that we only broadcast packets which are supposed to be broadcast.
@@ -636,6 +713,18 @@ func (r *SearchReply) Hash() (out [32]byte) {
 	return
 }
 
+func (e *PeerExchange) Hash() (out [32]byte) {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, uint32(len(e.Peers)))
+	for _, peer := range e.Peers {
+		h.Write([]byte(peer))
+		h.Write([]byte{0})
+	}
+	binary.Write(h, binary.LittleEndian, e.Reply)
+	copy(out[:], h.Sum(nil))
+	return
+}
+
 func (r *BlockPublish) Hash() (out [32]byte) {
 	h := sha256.New()
 	h.Write([]byte(r.Origin))
@@ -669,6 +758,8 @@ func (packet *GossipPacket) Hash() (out [32]byte) {
 		return packet.TxPublish.Hash()
 	case packet.BlockPublish != nil:
 		return packet.BlockPublish.Hash()
+	case packet.PeerExchange != nil:
+		return packet.PeerExchange.Hash()
 	default:
 		panic("Cannot hash")
 	}
@@ -0,0 +1,91 @@
+package common
+
+//
+//  DATA STRUCTURES
+//
+
+// Reply of a gossiper to a Command, sent back to the address the command came from. ID is the ID of the
+// command. Error is nil if the command succeeded, in which case the field matching the command holds its
+// result, if any.
+type Response struct {
+	ID        uint32
+	Error     *ResponseError
+	MetaHash  []byte          // Metahash of an uploaded file
+	SearchID  string          // ID of a search that was started
+	Downloads []*DownloadInfo // Answer to ListDownloads, or the download that was started
+	Peers     []string        // Answer to ListPeers
+	Routes    []*Route        // Answer to ListRoutes
+	Blocks    []*BlockInfo    // Answer to ListBlocks, from the oldest to the latest
+	Matches   []*SearchResult // Answer to ListMatches
+	Files     []File          // Answer to ListFiles, sorted by name
+	Name      string          // Answer to Status, with Status
+	Status    []PeerStatus    // Vector clock of the node, i.e. next rumor ID expected from each origin
+}
+
+// Reason why a command failed
+type ResponseError struct {
+	Code    string // One of the Error constants
+	Message string // Human-readable description
+}
+
+// Codes of response errors. They are the same as the codes of the errors of the REST API.
+const (
+	ErrorBadRequest = "bad_request" // The command is invalid
+	ErrorNotFound   = "not_found"   // The command refers to an unknown file or download
+	ErrorConflict   = "conflict"    // The download is not in a state that allows the command
+	ErrorTooBig     = "too_big"     // The response does not fit in a datagram
+	ErrorInternal   = "internal"    // Anything else
+)
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+// Progress of a download
+type DownloadInfo struct {
+	Name     string
+	MetaHash []byte
+	State    string
+	Done     uint32 // Number of chunks downloaded
+	Total    uint32 // Number of chunks, 0 until the metafile is downloaded
+	Seeders  []string
+}
+
+// Entry of the routing table
+type Route struct {
+	Origin  string
+	Address string // Neighbor through which origin is reached
+}
+
+// Summary of a block of the chain
+type BlockInfo struct {
+	Hash     []byte
+	PrevHash []byte
+	Files    []File   // Files published in the block
+	Users    []string // Users registered in the block
+}
+
+//
+//  CONSTRUCTORS
+//
+
+func NewErrorResponse(id uint32, code string, err error) *Response {
+	return &Response{ID: id, Error: &ResponseError{code, err.Error()}}
+}
+
+// Summarize a block
+func NewBlockInfo(block *Block) *BlockInfo {
+
+	hash := block.Hash()
+	info := &BlockInfo{Hash: hash[:], PrevHash: block.PrevHash[:]}
+
+	for _, transaction := range block.Transactions {
+		if transaction.File.Name != "" {
+			info.Files = append(info.Files, transaction.File)
+		} else if transaction.User.Name != "" {
+			info.Users = append(info.Users, transaction.User.Name)
+		}
+	}
+
+	return info
+}
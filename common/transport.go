@@ -0,0 +1,402 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Transport carries encoded packets between nodes identified by their address.
+//
+// UDPSocket is the default transport, but a datagram cannot be bigger than SocketBufferSize. TCPTransport
+// carries packets of any size (up to TCPMaxFrameSize) over TCP streams.
+type Transport interface {
+	Send(bytes []byte, address string) error // Send a packet to a node
+	Receive() ([]byte, string, bool)         // Wait for the next packet, return its source and false once unbound
+	Unbind()                                 // Stop sending and receiving
+}
+
+// A Socket is the transport a gossiper listens on for other gossipers. UDPSocket is used by nodes, and
+// the simulator package provides sockets of an in-memory network for tests.
+type Socket interface {
+	Transport
+	LocalAddress() string // Address on which the socket receives packets, given to other nodes
+}
+
+// A TCPTransport sends packets as frames over TCP streams. It listens on the same address as the
+// UDP socket of the node (TCP and UDP ports are distinct), so that neighbors can be reached on both
+// transports with the same address.
+//
+// Streams are reused: a connection to a neighbor is opened on the first packet sent to it and used for
+// all later packets, in both directions. The first frame on a new connection is the address of the node
+// that opened it, so that packets are reported as coming from that address rather than from an ephemeral
+// port. That address must have the IP address the connection comes from, so that a node cannot take the
+// place of another.
+//
+// A write that takes more than TCPWriteTimeout breaks the connection, so that a neighbor that stops
+// reading cannot block the node. Timeouts are those set when the transport is created.
+type TCPTransport struct {
+	Address      string
+	listener     net.Listener
+	connections  map[string]*tcpConnection // Open connections, by address of the neighbor
+	dials        map[string]*tcpDial       // Connections being opened, by address of the neighbor
+	packets      chan *tcpPacket           // Packets received on all connections
+	closed       chan struct{}             // Closed when the transport is unbound
+	dialTimeout  time.Duration             // TCPDialTimeout when the transport was created
+	writeTimeout time.Duration             // TCPWriteTimeout when the transport was created
+	lock         *sync.Mutex
+}
+
+type tcpConnection struct {
+	conn         net.Conn
+	address      string        // Address of the neighbor on the other end
+	writeTimeout time.Duration // TCPWriteTimeout when the transport was created
+	lock         *sync.Mutex
+}
+
+type tcpPacket struct {
+	bytes  []byte
+	source string
+}
+
+// A connection being opened. Senders that need the same neighbor in the meantime wait for it instead of
+// opening their own.
+type tcpDial struct {
+	done       chan struct{} // Closed once the connection is open or failed
+	connection *tcpConnection
+	err        error
+}
+
+// Error returned when a frame is bigger than TCPMaxFrameSize
+var ErrFrameTooBig = errors.New("frame too big")
+
+// Error returned when a node opens a connection from another IP address than the one it claims
+var ErrAddressMismatch = errors.New("address does not match the connection")
+
+// Error returned when a packet needs more than MaxFragmentCount fragments
+var ErrPacketTooBig = errors.New("packet too big")
+
+// Error returned when sending through a transport that was unbound
+var ErrTransportClosed = errors.New("transport closed")
+
+// Create a new TCP transport and start listening on the given address.
+func NewTCPTransport(address string) (*TCPTransport, error) {
+
+	listener, err := net.Listen("tcp4", address)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &TCPTransport{
+		Address:      address,
+		listener:     listener,
+		connections:  make(map[string]*tcpConnection),
+		dials:        make(map[string]*tcpDial),
+		packets:      make(chan *tcpPacket, TCPPacketBufferSize),
+		closed:       make(chan struct{}),
+		dialTimeout:  TCPDialTimeout,
+		writeTimeout: TCPWriteTimeout,
+		lock:         &sync.Mutex{},
+	}
+
+	go transport.accept()
+
+	return transport, nil
+}
+
+// Send data to another address, opening a connection if needed. If an existing connection turns out to
+// be broken, a new one is opened once.
+func (transport *TCPTransport) Send(bytes []byte, address string) error {
+
+	if len(bytes) > TCPMaxFrameSize {
+		return ErrFrameTooBig
+	}
+
+	for attempt := 0; ; attempt++ {
+
+		connection, reused, err := transport.connectionTo(address)
+		if err != nil {
+			return err
+		}
+
+		err = connection.write(bytes)
+
+		if err == nil {
+			return nil
+		}
+
+		transport.drop(connection)
+
+		if !reused || attempt > 0 {
+			return err
+		}
+	}
+}
+
+// Wait until a packet is received on any connection and return it along with the address of the
+// neighbor that sent it, and a flag indicating whether the transport is still alive.
+func (transport *TCPTransport) Receive() ([]byte, string, bool) {
+
+	select {
+	case packet := <-transport.packets:
+		return packet.bytes, packet.source, true
+	case <-transport.closed:
+		return []byte{}, "", false
+	}
+}
+
+// Stop listening and close all connections
+func (transport *TCPTransport) Unbind() {
+
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+
+	select {
+	case <-transport.closed:
+		return
+	default:
+		close(transport.closed)
+	}
+
+	transport.listener.Close()
+
+	for address, connection := range transport.connections {
+		connection.conn.Close()
+		delete(transport.connections, address)
+	}
+}
+
+//
+//  CONNECTIONS
+//
+
+// Return the connection to a neighbor, opening it if needed. Also return true if the connection
+// already existed. A single connection is opened at a time for a neighbor, whatever the number of senders.
+func (transport *TCPTransport) connectionTo(address string) (*tcpConnection, bool, error) {
+
+	transport.lock.Lock()
+
+	if connection, found := transport.connections[address]; found {
+		transport.lock.Unlock()
+		return connection, true, nil
+	}
+
+	if dial, found := transport.dials[address]; found {
+		transport.lock.Unlock()
+		<-dial.done
+		return dial.connection, false, dial.err
+	}
+
+	dial := &tcpDial{done: make(chan struct{})}
+	transport.dials[address] = dial
+
+	transport.lock.Unlock()
+
+	dial.connection, dial.err = transport.dial(address)
+
+	transport.lock.Lock()
+	delete(transport.dials, address)
+	transport.lock.Unlock()
+
+	close(dial.done)
+
+	return dial.connection, false, dial.err
+}
+
+// Open a connection to a neighbor, introduce ourselves and start reading from it.
+func (transport *TCPTransport) dial(address string) (*tcpConnection, error) {
+
+	conn, err := net.DialTimeout("tcp4", address, transport.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	connection := &tcpConnection{conn, address, transport.writeTimeout, &sync.Mutex{}}
+
+	// Introduce ourselves so that the neighbor knows where packets come from
+	if err := connection.write([]byte(transport.Address)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if !transport.register(connection) {
+		return nil, ErrTransportClosed
+	}
+
+	go transport.read(connection)
+
+	return connection, nil
+}
+
+// Accept connections from neighbors until the transport is unbound.
+func (transport *TCPTransport) accept() {
+
+	for {
+
+		conn, err := transport.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+
+			connection, err := transport.greet(conn)
+			if err != nil {
+				DebugTCPRejected(conn.RemoteAddr().String(), err)
+				conn.Close()
+				return
+			}
+
+			if transport.register(connection) {
+				transport.read(connection)
+			}
+		}()
+	}
+}
+
+// Read the address of the neighbor that opened a connection, which it sends in the first frame. The
+// neighbor has TCPDialTimeout to send it. A neighbor listening on all interfaces is known by the IP address
+// the connection comes from.
+func (transport *TCPTransport) greet(conn net.Conn) (*tcpConnection, error) {
+
+	conn.SetReadDeadline(time.Now().Add(transport.dialTimeout))
+
+	hello, err := readFrame(conn, TCPMaxHelloSize)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	claimed, err := net.ResolveTCPAddr("tcp4", string(hello))
+	if err != nil {
+		return nil, err
+	}
+
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, ErrAddressMismatch
+	}
+
+	address := string(hello)
+
+	switch {
+	case claimed.IP == nil || claimed.IP.IsUnspecified():
+		address = net.JoinHostPort(remote.IP.String(), strconv.Itoa(claimed.Port))
+	case !claimed.IP.Equal(remote.IP):
+		return nil, ErrAddressMismatch
+	}
+
+	return &tcpConnection{conn, address, transport.writeTimeout, &sync.Mutex{}}, nil
+}
+
+// Keep track of a new connection, replacing and closing any previous connection to the same neighbor.
+// Return false if the transport is already unbound.
+func (transport *TCPTransport) register(connection *tcpConnection) bool {
+
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+
+	select {
+	case <-transport.closed:
+		connection.conn.Close()
+		return false
+	default:
+	}
+
+	if previous, found := transport.connections[connection.address]; found && previous != connection {
+		previous.conn.Close()
+	}
+
+	transport.connections[connection.address] = connection
+	return true
+}
+
+// Close a connection and forget about it
+func (transport *TCPTransport) drop(connection *tcpConnection) {
+
+	connection.conn.Close()
+
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+
+	if transport.connections[connection.address] == connection {
+		delete(transport.connections, connection.address)
+	}
+}
+
+// Read frames from a connection until it breaks.
+func (transport *TCPTransport) read(connection *tcpConnection) {
+
+	defer transport.drop(connection)
+
+	for {
+
+		frame, err := readFrame(connection.conn, TCPMaxFrameSize)
+		if err != nil {
+			return
+		}
+
+		select {
+		case transport.packets <- &tcpPacket{frame, connection.address}:
+		case <-transport.closed:
+			return
+		}
+	}
+}
+
+//
+//  FRAMES
+//
+
+// Write a frame, i.e. the length of the data on 4 bytes followed by the data. Fail if the frame cannot be
+// written within TCPWriteTimeout.
+func (connection *tcpConnection) write(data []byte) error {
+
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	frame = append(frame, data...)
+
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if err := connection.conn.SetWriteDeadline(time.Now().Add(connection.writeTimeout)); err != nil {
+		return err
+	}
+
+	_, err := connection.conn.Write(frame)
+	return err
+}
+
+// Read a frame written by write, of at most maxSize bytes. The data is read before memory is set aside for
+// all of it, so that announcing a big frame is not enough to make the node allocate it.
+func readFrame(reader io.Reader, maxSize int) ([]byte, error) {
+
+	header := make([]byte, 4)
+
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header))
+
+	if size > int64(maxSize) {
+		return nil, ErrFrameTooBig
+	}
+
+	var data bytes.Buffer
+
+	if _, err := io.CopyN(&data, reader, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return data.Bytes(), nil
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"net"
+	"time"
 )
 
 // A UDPSocket is an abstraction of a typical UDP socket and provides
@@ -12,19 +13,19 @@ type UDPSocket struct {
 }
 
 // Create a new UDP socket and bind it to the given port.
-func NewUDPSocket(address string) *UDPSocket {
+func NewUDPSocket(address string) (*UDPSocket, error) {
 
 	udpAddr, err := net.ResolveUDPAddr("udp4", address)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	udpConn, err := net.ListenUDP("udp4", udpAddr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return &UDPSocket{udpConn, address}
+	return &UDPSocket{udpConn, address}, nil
 }
 
 // Wait until new data is receives and extract it. Also return
@@ -43,18 +44,25 @@ func (socket *UDPSocket) Receive() ([]byte, string, bool) {
 }
 
 // Send data to another address using the socket UDP connection
-func (socket *UDPSocket) Send(bytes []byte, address string) {
+func (socket *UDPSocket) Send(bytes []byte, address string) error {
 
 	udpAddr, err := net.ResolveUDPAddr("udp4", address)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	_, err = socket.connection.WriteToUDP(bytes, udpAddr)
-	if err != nil {
-		panic(err)
-	}
+	return err
+}
+
+// Address the socket is bound to
+func (socket *UDPSocket) LocalAddress() string {
+	return socket.Address
+}
 
+// Make Receive fail once deadline is passed, or never if deadline is zero
+func (socket *UDPSocket) SetDeadline(deadline time.Time) {
+	socket.connection.SetReadDeadline(deadline)
 }
 
 // Close the connection
@@ -2,11 +2,41 @@ package common
 
 import (
 	"math/rand"
+	"net"
+	"sync"
+	"time"
 )
 
+// Source of the random choices of gossipers (peers, coin flips, seeders, etc.), safe for concurrent use.
+// Simulations seed it with SeedRandom to replay the same choices.
+var Random = rand.New(&lockedSource{source: rand.NewSource(time.Now().UnixNano())})
+
+// Source of Random, which is shared by all the goroutines of the node
+type lockedSource struct {
+	source rand.Source
+	lock   sync.Mutex
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.source.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.source.Seed(seed)
+}
+
+// Seed the random choices of gossipers
+func SeedRandom(seed int64) {
+	Random.Seed(seed)
+}
+
 // Return 0 or 1 with 50% probability
 func FlipCoin() bool {
-	return rand.Int() % 2 == 0
+	return Random.Int() % 2 == 0
 }
 
 // Check if an array contains an element
@@ -19,6 +49,41 @@ func Contains(array []string, element string) bool {
 	return false
 }
 
+// Check if address designates the socket bound to local. A socket bound to the unspecified address (0.0.0.0)
+// receives on every interface, so a loopback or interface address with the same port designates it as well.
+func IsLocalAddress(address *net.UDPAddr, local string) bool {
+
+	bound, err := net.ResolveUDPAddr("udp4", local)
+	if err != nil || bound.Port != address.Port {
+		return false
+	}
+
+	if address.IP.Equal(bound.IP) {
+		return true
+	}
+
+	if bound.IP != nil && !bound.IP.IsUnspecified() {
+		return false
+	}
+
+	if address.IP.IsLoopback() {
+		return true
+	}
+
+	interfaces, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, own := range interfaces {
+		if network, ok := own.(*net.IPNet); ok && network.IP.Equal(address.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Return 1 if bool is true
 func boolCount(b bool) int {
 	if b {
@@ -56,7 +121,7 @@ func SplitBudget(budget uint64, into int) []uint64 {
 
 	// Random permutation
 	randomSplits := make([]uint64, len(splits))
-	randomIndices := rand.Perm(len(splits))
+	randomIndices := Random.Perm(len(splits))
 
 	for i, v := range randomIndices {
 		randomSplits[v] = splits[i]
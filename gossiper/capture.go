@@ -0,0 +1,41 @@
+package gossiper
+
+import (
+	"github.com/jfperren/Peerster/common"
+)
+
+// Record every packet sent to or received from neighbors into a capture file (see common.Capture). The
+// file is closed when the gossiper is stopped. Should be called before Start.
+func (gossiper *Gossiper) EnableCapture(path string) error {
+
+	capture, err := common.NewCapture(path)
+	if err != nil {
+		return err
+	}
+
+	gossiper.Capture = capture
+	return nil
+}
+
+// Handle the incoming packets of a capture as if they were received again from the same peers, in the
+// order they were recorded. Outgoing packets are skipped. Return the number of packets replayed.
+//
+// Packets are handled right away rather than with their original timing, which is enough to reproduce
+// how a node reacts to a given sequence of packets. Use the capture command to replay them into a
+// running node over UDP instead.
+func (gossiper *Gossiper) Replay(packets []*common.CapturedPacket) int {
+
+	count := 0
+
+	for _, packet := range packets {
+
+		if packet.Direction != common.CaptureIncoming {
+			continue
+		}
+
+		gossiper.receivePacket(packet.Bytes, packet.Peer)
+		count++
+	}
+
+	return count
+}
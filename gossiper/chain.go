@@ -32,6 +32,9 @@ type BlockChain struct {
     Latest      [32]byte                    // Current hash on the longest chain
 
     lock        *sync.RWMutex               // Mutex to synchronize access to the chain
+    storage     Storage                     // Persists new blocks
+    events      *EventBus                   // Publishes blocks appended to the longest chain
+    metrics     *Metrics                    // Counts mined blocks, forks and rewinds
 }
 
 //
@@ -51,6 +54,8 @@ func NewBlockChain() *BlockChain {
         MinedBlocks: make(chan *common.Block, 2),
         MiningTime:  0,
         lock:        &sync.RWMutex{},
+        storage:     &NullStorage{},
+        metrics:     NewMetrics(),
     }
 }
 
@@ -70,6 +75,24 @@ func (gossiper *Gossiper) NewTransaction(metaFile *MetaFile) *common.TxPublish {
     return &tx
 }
 
+// Scan a file from the shared files folder and publish it on the chain. Return its metafile.
+func (gossiper *Gossiper) Share(fileName string) (*MetaFile, error) {
+
+    metaFile, err := gossiper.FileSystem.ScanFile(fileName)
+    if err != nil {
+        return nil, err
+    }
+
+    transaction := gossiper.NewTransaction(metaFile)
+
+    if gossiper.BlockChain.TryAddFile(transaction) {
+        gossiper.broadcastToNeighbors(transaction.Packed())
+        common.DebugBroadcastTransaction(transaction)
+    }
+
+    return metaFile, nil
+}
+
 func (gossiper *Gossiper) NewTransactionKey(username string, publicKey rsa.PublicKey) *common.TxPublish {
     tx := &common.TxPublish{
         User: common.User{
@@ -88,8 +111,14 @@ func (gossiper *Gossiper) NewTransactionKey(username string, publicKey rsa.Publi
 func (gossiper *Gossiper) waitForNewBlocks() {
 
     for {
+        var block *common.Block
+
         // Wait for blocks
-        block := <- gossiper.BlockChain.MinedBlocks
+        select {
+        case block = <- gossiper.BlockChain.MinedBlocks:
+        case <-gossiper.ctx.Done():
+            return
+        }
 
         publish := &common.BlockPublish{
             Block:    *block,
@@ -200,6 +229,7 @@ func (bc *BlockChain) TryAddBlock(candidate *common.Block) bool {
 
     bc.Blocks[hash] = candidate
     bc.Length[hash] = bc.Length[candidate.PrevHash] + 1
+    bc.storage.StoreBlock(candidate)
 
 
     if bc.IsNew || bytes.Compare(candidate.PrevHash[:], bc.Latest[:]) == 0 {
@@ -223,6 +253,7 @@ func (bc *BlockChain) TryAddBlock(candidate *common.Block) bool {
         bc.updatePendingTransactions()
 
         common.LogChain(bc.allBlocks())
+        bc.events.publish(&Event{Block: candidate})
 
     } else if bc.Length[hash] > bc.Length[bc.Latest] {
 
@@ -242,13 +273,26 @@ func (bc *BlockChain) TryAddBlock(candidate *common.Block) bool {
         bc.updatePendingTransactions()
 
         common.LogForkLongerRewind(currentChain)
+        bc.metrics.Rewinds.Inc()
+        bc.metrics.RewoundBlocks.Add(uint64(len(currentChain)))
         common.DebugChainLength(bc.Length[hash])
         common.LogChain(bc.allBlocks())
 
+        // Both chains go from the latest block back to the fork
+        discarded := reversed(currentChain)
+        appended := reversed(newChain)
+
+        bc.events.publish(&Event{ForkRewind: &ForkRewind{discarded, appended}})
+
+        for _, block := range appended {
+            bc.events.publish(&Event{Block: block})
+        }
+
     } else {
 
         // We already stored it, just log
         common.LogShorterFork(candidate)
+        bc.metrics.Forks.Inc()
         common.DebugChainLength(bc.Length[hash])
     }
 
@@ -312,7 +356,8 @@ func (bc *BlockChain) fastForward(chain []*common.Block) {
     bc.Latest = chain[0].Hash()
 }
 
-func (bc *BlockChain) mine() {
+// Mine new blocks until done is closed.
+func (bc *BlockChain) mine(done <-chan struct{}) {
 
     bc.MiningTime = time.Now().UnixNano()
 
@@ -320,6 +365,12 @@ func (bc *BlockChain) mine() {
 
     for {
 
+        select {
+        case <-done:
+            return
+        default:
+        }
+
         var nonce [32]byte
 
         _, err := rand.Read(nonce[:])
@@ -343,6 +394,7 @@ func (bc *BlockChain) mine() {
         if isValidHash(hash) {
 
             common.LogFoundBlock(hash)
+            bc.metrics.BlocksMined.Inc()
 
             if bc.TryAddBlock(candidate) {
 
@@ -357,9 +409,18 @@ func (bc *BlockChain) mine() {
                 }
 
                 common.DebugSleep(sleepTime)
-                time.Sleep(sleepTime)
 
-                bc.MinedBlocks <- candidate
+                select {
+                case <-time.After(sleepTime):
+                case <-done:
+                    return
+                }
+
+                select {
+                case bc.MinedBlocks <- candidate:
+                case <-done:
+                    return
+                }
 
                 bc.MiningTime = time.Now().UnixNano()
             }
@@ -536,6 +597,26 @@ func (bc *BlockChain) FirstCommonAncestor(current, new *common.Block) (*common.B
 /////////////////////////
 // RETRIEVAL FUNCTIONS //
 /////////////////////////
+
+// Return a known block, on the longest chain or not.
+func (bc *BlockChain) GetBlock(hash [32]byte) (*common.Block, bool) {
+
+    bc.lock.RLock()
+    defer bc.lock.RUnlock()
+
+    block, found := bc.Blocks[hash]
+    return block, found
+}
+
+// Return the blocks of the longest chain, from the first one to the latest.
+func (bc *BlockChain) LongestChain() []*common.Block {
+
+    bc.lock.RLock()
+    defer bc.lock.RUnlock()
+
+    return reversed(bc.allBlocks())
+}
+
 func (bc *BlockChain) GetPublicKey(peer string) (rsa.PublicKey, bool) {
     bc.lock.Lock()
     defer bc.lock.Unlock()
@@ -551,6 +632,18 @@ func (bc *BlockChain) GetPublicKey(peer string) (rsa.PublicKey, bool) {
 //  HELPERS
 //
 
+// Return a copy of a list of blocks in reverse order
+func reversed(blocks []*common.Block) []*common.Block {
+
+    result := make([]*common.Block, len(blocks))
+
+    for i, block := range blocks {
+        result[len(blocks) - 1 - i] = block
+    }
+
+    return result
+}
+
 func isValidHash(hash [32]byte) bool {
     return hash[0] == 0 && hash[1] == 0 && hash[2] <= common.MiningDifficulty
 }
\ No newline at end of file
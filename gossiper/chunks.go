@@ -0,0 +1,164 @@
+package gossiper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/jfperren/Peerster/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A ChunkStore keeps the content of chunks and metafiles on disk, so that shared and downloaded
+// files do not need to fit in memory. It is content-addressed: each blob is stored in a file named
+// after the hex-encoded SHA-256 of its content, in a sub-folder named after the first byte of the
+// hash (to keep folders reasonably small for big files).
+//
+// Only the list of stored hashes is kept in memory.
+type ChunkStore struct {
+	path      string          // Root folder of the store
+	temporary bool            // True if the folder should be deleted on Close
+	hashes    map[string]bool // Hashes of all the blobs in the store
+	lock      *sync.RWMutex   // Synchronize access to hashes
+}
+
+// Open (or create) a chunk store in a given folder. If path is empty, the store uses a
+// temporary folder that is deleted when the store is closed.
+func NewChunkStore(path string) (*ChunkStore, error) {
+
+	temporary := path == ""
+
+	if temporary {
+
+		tmp, err := ioutil.TempDir("", "peerster-chunks")
+		if err != nil {
+			return nil, err
+		}
+
+		path = tmp
+	}
+
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &ChunkStore{
+		path:      path,
+		temporary: temporary,
+		hashes:    make(map[string]bool),
+		lock:      &sync.RWMutex{},
+	}
+
+	// Index blobs left by a previous run
+	dirs, _ := ioutil.ReadDir(path)
+
+	for _, dir := range dirs {
+
+		if !dir.IsDir() {
+			continue
+		}
+
+		files, _ := ioutil.ReadDir(filepath.Join(path, dir.Name()))
+
+		for _, file := range files {
+			if len(file.Name()) == 2*sha256.Size {
+				store.hashes[file.Name()] = true
+			}
+		}
+	}
+
+	return store, nil
+}
+
+// Store a blob and return its hash.
+func (cs *ChunkStore) Put(data []byte) []byte {
+
+	hash := sha256.Sum256(data)
+	key := hex.EncodeToString(hash[:])
+
+	if cs.Has(hash[:]) {
+		return hash[:]
+	}
+
+	path := cs.blobPath(key)
+
+	// Write to a temporary file first so that a crash never leaves a truncated blob behind.
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+
+	if err != nil {
+		common.DebugStorageError(err)
+		return hash[:]
+	}
+
+	cs.lock.Lock()
+	cs.hashes[key] = true
+	cs.lock.Unlock()
+
+	return hash[:]
+}
+
+// Return the blob with a given hash, if present and not corrupted.
+func (cs *ChunkStore) Get(hash []byte) ([]byte, bool) {
+
+	if !cs.Has(hash) {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(cs.blobPath(hex.EncodeToString(hash)))
+
+	if err != nil {
+		common.DebugStorageError(err)
+		return nil, false
+	}
+
+	if computed := sha256.Sum256(data); !bytes.Equal(computed[:], hash) {
+		common.DebugCorruptedChunk(hash)
+		return nil, false
+	}
+
+	return data, true
+}
+
+// Check if a blob is present in the store
+func (cs *ChunkStore) Has(hash []byte) bool {
+
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	return cs.hashes[hex.EncodeToString(hash)]
+}
+
+// Remove a blob from the store
+func (cs *ChunkStore) Delete(hash []byte) {
+
+	key := hex.EncodeToString(hash)
+
+	cs.lock.Lock()
+	delete(cs.hashes, key)
+	cs.lock.Unlock()
+
+	if err := os.Remove(cs.blobPath(key)); err != nil && !os.IsNotExist(err) {
+		common.DebugStorageError(err)
+	}
+}
+
+// Close the store, deleting its content if it is temporary.
+func (cs *ChunkStore) Close() {
+	if cs.temporary {
+		os.RemoveAll(cs.path)
+	}
+}
+
+// Path of the file holding a given blob
+func (cs *ChunkStore) blobPath(key string) string {
+	return filepath.Join(cs.path, key[:2], key)
+}
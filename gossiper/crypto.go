@@ -8,7 +8,6 @@ import (
     "crypto/rsa"
     "crypto/sha256"
     "errors"
-    "fmt"
     "github.com/jfperren/Peerster/common"
 )
 
@@ -54,7 +53,7 @@ func (c *Crypto) PublicKey() rsa.PublicKey {
 func (c *Crypto) Decypher(payload []byte) []byte {
     decyphered, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, c.PrivateKey, payload, []byte(""))
     if err != nil {
-        fmt.Printf("Error from decryption: %s\n", err)
+        common.DebugCryptoError("decryption", err)
         return []byte{}
     }
     return decyphered
@@ -63,7 +62,7 @@ func (c *Crypto) Decypher(payload []byte) []byte {
 func (c *Crypto) Cypher(payload []byte, publicKey rsa.PublicKey) []byte {
     cyphered, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &publicKey, payload, []byte(""))
     if err != nil {
-        fmt.Printf("Error from encryption: %s\n", err)
+        common.DebugCryptoError("encryption", err)
         return []byte{}
     }
     return cyphered
@@ -73,7 +72,7 @@ func (c *Crypto) Sign(payload []byte) []byte {
     hashed := sha256.Sum256(payload)
     signature, err := rsa.SignPSS(rand.Reader, c.PrivateKey, crypto.SHA256, hashed[:], nil)
     if err != nil {
-        fmt.Printf("Error from signing: %s\n", err)
+        common.DebugCryptoError("signing", err)
         return []byte{}
     }
     return signature
@@ -83,7 +82,7 @@ func (c *Crypto) Verify(payload, signature []byte, publicKey rsa.PublicKey) bool
     hashed := sha256.Sum256(payload)
     err := rsa.VerifyPSS(&publicKey, crypto.SHA256, hashed[:], signature, nil)
     if err != nil {
-        fmt.Printf("Error from verification: %s\n", err)
+        common.DebugCryptoError("verification", err)
         return false
     }
     return true
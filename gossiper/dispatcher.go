@@ -39,11 +39,18 @@ func (dispatcher *Dispatcher) dispatchPacket(identifier string, packet *common.G
 
 	expected := dispatcher.HandlerCount[identifier] > 0
 
-	if expected {
-		dispatcher.Handlers[identifier] <- packet
+	if !expected {
+		return false
 	}
 
-	return expected
+	// Waiting for room in a full channel would hold the lock, and keep the processes that timed out from
+	// unregistering. The packet is handled as unexpected instead.
+	select {
+	case dispatcher.Handlers[identifier] <- packet:
+		return true
+	default:
+		return false
+	}
 }
 
 // Create / return a channel that will allow to receive status packets from a given node.
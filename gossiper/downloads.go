@@ -0,0 +1,498 @@
+package gossiper
+
+import (
+	"encoding/hex"
+	"github.com/jfperren/Peerster/common"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Download keeps track of the progress of a file being downloaded. Chunks are requested in parallel
+// from all the peers known to hold them, keeping at most Window requests in flight at the same time.
+//
+// The download first fetches the metafile (and, for big files, the whole tree of metafiles), then the
+// chunks in rarest-first order, i.e. chunks held by the fewest peers are requested first. A request that
+// times out or returns corrupted data is retried with another seeder, up to MaxDownloadRequests times.
+//
+// Downloads are tracked by the DownloadManager, which allows to pause, resume or cancel them.
+type Download struct {
+	Name     string // Name of the file once downloaded
+	MetaHash []byte // Hash of the metafile of the file
+	Seeder   string // Peer to download from, or "" to use search results
+	Window   int    // Maximum number of concurrent requests
+
+	state    DownloadState
+	done     int             // Number of chunks downloaded
+	total    int             // Number of chunks in the file, 0 while the metafiles are downloaded
+	inFlight map[string]int  // Number of pending requests per peer
+	seeders  map[string]bool // Peers that provided at least one chunk or metafile
+	stop     chan struct{}   // Closed to stop the running download, nil if it is not running
+	lock     *sync.RWMutex
+}
+
+type DownloadState int
+
+const (
+	DownloadRunning DownloadState = iota
+	DownloadPaused
+	DownloadCompleted
+	DownloadFailed
+	DownloadCancelled
+)
+
+func (state DownloadState) String() string {
+	switch state {
+	case DownloadRunning:
+		return "running"
+	case DownloadPaused:
+		return "paused"
+	case DownloadCompleted:
+		return "completed"
+	case DownloadFailed:
+		return "failed"
+	case DownloadCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// A hash (chunk or metafile) that should be downloaded. Replies are matched to requests by hash, so a
+// hash is only downloaded once even if several chunks of the file have the same content.
+type downloadTask struct {
+	hash     []byte
+	chunkId  int             // Index of the first chunk with this hash in the file, or MetaHashChunkId
+	chunkIds []int           // Indices of all the chunks with this hash
+	attempts int             // Number of requests sent for this hash
+	tried    map[string]bool // Peers that failed to provide the hash
+}
+
+// Outcome of a request. Reply is nil if the request failed.
+type downloadResult struct {
+	task  *downloadTask
+	peer  string
+	reply *common.DataReply
+}
+
+func NewDownload(name string, metaHash []byte, seeder string, window int) *Download {
+
+	if window < 1 {
+		window = 1
+	}
+
+	return &Download{
+		Name:     name,
+		MetaHash: metaHash,
+		Seeder:   seeder,
+		Window:   window,
+		state:    DownloadPaused,
+		inFlight: make(map[string]int),
+		seeders:  make(map[string]bool),
+		lock:     &sync.RWMutex{},
+	}
+}
+
+// Current state of the download
+func (download *Download) State() DownloadState {
+
+	download.lock.RLock()
+	defer download.lock.RUnlock()
+
+	return download.state
+}
+
+// Number of chunks downloaded and total number of chunks. Total is 0 until the metafiles are known.
+func (download *Download) Progress() (int, int) {
+
+	download.lock.RLock()
+	defer download.lock.RUnlock()
+
+	return download.done, download.total
+}
+
+// Peers that provided data for this download so far.
+func (download *Download) Seeders() []string {
+
+	download.lock.RLock()
+	defer download.lock.RUnlock()
+
+	seeders := make([]string, 0, len(download.seeders))
+
+	for seeder := range download.seeders {
+		seeders = append(seeders, seeder)
+	}
+
+	sort.Strings(seeders)
+
+	return seeders
+}
+
+func newDownloadTask(hash []byte, chunkId int) *downloadTask {
+	return &downloadTask{
+		hash:     hash,
+		chunkId:  chunkId,
+		chunkIds: []int{chunkId},
+		tried:    make(map[string]bool),
+	}
+}
+
+// Create one task per distinct hash, in order of first appearance. The chunk ids of a hash that appears
+// several times are gathered in its task.
+func newDownloadTasks(hashes [][]byte, chunkIds []int) []*downloadTask {
+
+	tasks := make([]*downloadTask, 0, len(hashes))
+	byHash := make(map[string]*downloadTask)
+
+	for i, hash := range hashes {
+
+		key := hex.EncodeToString(hash)
+
+		if task, found := byHash[key]; found {
+			task.chunkIds = append(task.chunkIds, chunkIds[i])
+			continue
+		}
+
+		task := newDownloadTask(hash, chunkIds[i])
+		byHash[key] = task
+		tasks = append(tasks, task)
+	}
+
+	return tasks
+}
+
+//
+//  GOSSIPER METHODS
+//
+
+// Download all the metafiles, then all the chunks of a file and reconstruct it. Return false if the
+// download could not complete or was stopped. Chunks already in the store are not downloaded again,
+// so that a paused or failed download resumes where it stopped.
+func (gossiper *Gossiper) runDownload(download *Download, stop <-chan struct{}) bool {
+
+	metaFile, found := gossiper.FileSystem.getMetaFile(download.MetaHash)
+
+	if !found {
+
+		if !gossiper.fetch(download, []*downloadTask{newDownloadTask(download.MetaHash, common.MetaHashChunkId)}, stop) {
+			return false
+		}
+
+		metaFile, _ = gossiper.FileSystem.getMetaFile(download.MetaHash)
+	}
+
+	// Walk down the tree of metafiles, one level at a time
+	for {
+
+		_, missing := gossiper.FileSystem.resolveChunkHashes(metaFile)
+
+		if len(missing) == 0 {
+			break
+		}
+
+		chunkIds := make([]int, len(missing))
+
+		for i := range missing {
+			chunkIds[i] = common.MetaHashChunkId
+		}
+
+		if !gossiper.fetch(download, newDownloadTasks(missing, chunkIds), stop) {
+			return false
+		}
+	}
+
+	hashes, chunkIds := gossiper.updateProgress(download)
+	gossiper.publishProgress(download)
+
+	tasks := newDownloadTasks(hashes, chunkIds)
+	gossiper.sortRarestFirst(download, tasks)
+
+	if !gossiper.fetch(download, tasks, stop) {
+		return false
+	}
+
+	if err := gossiper.FileSystem.reconstructFile(download.MetaHash); err != nil {
+		common.DebugStorageError(err)
+		return false
+	}
+
+	return true
+}
+
+// Count the chunks of a file that are already downloaded and return the hashes and ids of those that
+// are still missing. Progress is only known once the whole metafile tree is in the store.
+func (gossiper *Gossiper) updateProgress(download *Download) ([][]byte, []int) {
+
+	metaFile, found := gossiper.FileSystem.getMetaFile(download.MetaHash)
+
+	if !found {
+		return nil, nil
+	}
+
+	allHashes, missing := gossiper.FileSystem.resolveChunkHashes(metaFile)
+
+	if len(missing) > 0 {
+		return nil, nil
+	}
+
+	hashes, chunkIds := gossiper.FileSystem.missingChunks(metaFile)
+
+	download.lock.Lock()
+	download.total = len(allHashes)
+	download.done = len(allHashes) - len(hashes)
+	download.lock.Unlock()
+
+	return hashes, chunkIds
+}
+
+// Download a list of hashes, keeping up to download.Window requests in flight. Tasks are started in
+// order. Return false if one of them could not be downloaded, if stop is closed or if the gossiper stops. Requests still in
+// flight when stopping simply complete in the background, as results is large enough to hold them.
+func (gossiper *Gossiper) fetch(download *Download, tasks []*downloadTask, stop <-chan struct{}) bool {
+
+	results := make(chan *downloadResult, download.Window)
+	pending := 0
+
+	for len(tasks) > 0 || pending > 0 {
+
+		select {
+		case <-stop:
+			return false
+		case <-gossiper.ctx.Done():
+			return false
+		default:
+		}
+
+		// Fill the window
+		for len(tasks) > 0 && pending < download.Window {
+
+			task := tasks[0]
+			peer, found := gossiper.seederFor(download, task)
+
+			if !found {
+				common.DebugNoKnownOwnerForFile(download.MetaHash)
+				return false
+			}
+
+			tasks = tasks[1:]
+			pending++
+			task.attempts++
+
+			download.lock.Lock()
+			download.inFlight[peer]++
+			download.lock.Unlock()
+
+			gossiper.spawn(func() { gossiper.requestData(task, peer, results) })
+		}
+
+		var result *downloadResult
+
+		select {
+		case result = <-results:
+		case <-stop:
+			return false
+		case <-gossiper.ctx.Done():
+			return false
+		}
+
+		pending--
+
+		download.lock.Lock()
+		download.inFlight[result.peer]--
+		download.lock.Unlock()
+
+		task := result.task
+
+		if result.reply == nil {
+
+			task.tried[result.peer] = true
+
+			if task.attempts >= common.MaxDownloadRequests {
+				// Let pending requests finish before giving up, so that they release the dispatcher.
+				for ; pending > 0; pending-- {
+					<-results
+				}
+				return false
+			}
+
+			// Retry as soon as possible, hopefully with another seeder
+			gossiper.Metrics.ChunkRetries.Inc()
+			tasks = append([]*downloadTask{task}, tasks...)
+			continue
+		}
+
+		gossiper.storeDownloadedData(download, task, result.reply)
+	}
+
+	return true
+}
+
+// Send a data request to a peer and wait for the reply, then report the result.
+func (gossiper *Gossiper) requestData(task *downloadTask, peer string, results chan<- *downloadResult) {
+
+	replies := gossiper.Dispatcher.dataReplies(task.hash)
+	defer gossiper.Dispatcher.stopWaitingOnDataReply(task.hash)
+
+	request := gossiper.GenerateDataRequest(peer, task.hash)
+	sent := time.Now()
+	gossiper.sendToNode(request.Packed(), request.Destination, nil)
+
+	timer := time.NewTimer(common.DownloadTimeout)
+	defer timer.Stop()
+
+	select {
+	case packet := <-replies:
+
+		reply := packet.DataReply
+
+		if !reply.VerifyHash(task.hash) {
+			common.DebugCorruptedDataReply(task.hash, reply)
+			results <- &downloadResult{task, peer, nil}
+			return
+		}
+
+		gossiper.Metrics.ChunkLatency.Observe(time.Since(sent).Seconds())
+		results <- &downloadResult{task, peer, reply}
+
+	case <-timer.C:
+		common.DebugDownloadRequestTimeout(task.hash, peer)
+		results <- &downloadResult{task, peer, nil}
+
+	case <-gossiper.ctx.Done():
+		results <- &downloadResult{task, peer, nil}
+	}
+}
+
+// Store the content of a successful reply and log progress.
+func (gossiper *Gossiper) storeDownloadedData(download *Download, task *downloadTask, reply *common.DataReply) {
+
+	if task.chunkId == common.MetaHashChunkId {
+
+		if _, found := gossiper.FileSystem.getMetaFile(download.MetaHash); !found {
+			gossiper.FileSystem.storeDownloadedMetaFile(download.Name, reply.Data)
+		} else {
+			gossiper.FileSystem.storeData(reply.Data)
+		}
+
+		download.lock.Lock()
+		download.seeders[reply.Origin] = true
+		download.lock.Unlock()
+
+		common.LogDownloadingMetafile(download.Name, reply.Origin)
+		return
+	}
+
+	gossiper.FileSystem.storeData(reply.Data)
+
+	for _, chunkId := range task.chunkIds {
+		common.LogDownloadingChunk(download.Name, chunkId, reply.Origin)
+	}
+
+	download.lock.Lock()
+	download.seeders[reply.Origin] = true
+	download.done += len(task.chunkIds)
+	done, total := download.done, download.total
+	download.lock.Unlock()
+
+	common.DebugDownloadProgress(download.Name, done, total)
+	gossiper.publishProgress(download)
+}
+
+// Publish the current state and progress of a download on the event bus.
+func (gossiper *Gossiper) publishProgress(download *Download) {
+
+	download.lock.RLock()
+	progress := &DownloadProgress{download.Name, download.MetaHash, download.state, download.done, download.total}
+	download.lock.RUnlock()
+
+	gossiper.Events.publish(&Event{DownloadProgress: progress})
+}
+
+// Choose the peer to which a task should be sent: among the seeders of the hash, prefer those that did
+// not fail on this task yet, then those with the fewest requests in flight.
+func (gossiper *Gossiper) seederFor(download *Download, task *downloadTask) (string, bool) {
+
+	if download.Seeder != "" {
+		return download.Seeder, true
+	}
+
+	seeders := gossiper.seedersOf(download, task)
+
+	if len(seeders) == 0 {
+		return "", false
+	}
+
+	candidates := make([]string, 0)
+
+	for _, seeder := range seeders {
+		if !task.tried[seeder] {
+			candidates = append(candidates, seeder)
+		}
+	}
+
+	// Every seeder failed once, give them another chance
+	if len(candidates) == 0 {
+		candidates = seeders
+	}
+
+	download.lock.RLock()
+	defer download.lock.RUnlock()
+
+	best := make([]string, 0)
+
+	for _, candidate := range candidates {
+		switch {
+		case len(best) == 0 || download.inFlight[candidate] < download.inFlight[best[0]]:
+			best = []string{candidate}
+		case download.inFlight[candidate] == download.inFlight[best[0]]:
+			best = append(best, candidate)
+		}
+	}
+
+	return best[common.Random.Intn(len(best))], true
+}
+
+// Sort chunk tasks so that chunks held by the fewest peers come first. Chunks with the same number of
+// seeders keep their order in the file.
+func (gossiper *Gossiper) sortRarestFirst(download *Download, tasks []*downloadTask) {
+
+	if download.Seeder != "" {
+		return
+	}
+
+	rarity := make(map[*downloadTask]int)
+
+	for _, task := range tasks {
+		rarity[task] = len(gossiper.seedersOf(download, task))
+	}
+
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return rarity[tasks[i]] < rarity[tasks[j]]
+	})
+}
+
+// Peers known to hold any of the chunks of a task
+func (gossiper *Gossiper) seedersOf(download *Download, task *downloadTask) []string {
+
+	if len(task.chunkIds) == 1 {
+		return gossiper.SearchEngine.seeders(download.MetaHash, task.chunkId)
+	}
+
+	all := make(map[string]bool)
+
+	for _, chunkId := range task.chunkIds {
+		for _, seeder := range gossiper.SearchEngine.seeders(download.MetaHash, chunkId) {
+			all[seeder] = true
+		}
+	}
+
+	seeders := make([]string, 0, len(all))
+
+	for seeder := range all {
+		seeders = append(seeders, seeder)
+	}
+
+	sort.Strings(seeders)
+
+	return seeders
+}
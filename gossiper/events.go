@@ -0,0 +1,161 @@
+package gossiper
+
+import (
+	"github.com/jfperren/Peerster/common"
+	"sync"
+)
+
+// An Event describes something that happened in the gossiper. Like GossipPacket, it is an aggregate in
+// which exactly one field is non-nil.
+type Event struct {
+	Rumor            *common.RumorMessage   // A chat rumor was received, or sent by this node
+	PrivateMessage   *common.PrivateMessage // A private message was delivered to this node
+	Peer             *NewPeer               // A neighbor was added
+	PeerState        *PeerStateChange       // A neighbor was suspected, evicted or heard from again
+	Route            *RouteUpdate           // The next hop towards a node changed
+	Block            *common.Block          // A block was appended to the longest chain
+	ForkRewind       *ForkRewind            // The longest chain switched to another branch
+	SearchMatch      *SearchMatch           // A search result matched one of our searches
+	DownloadProgress *DownloadProgress      // A download changed state or received a chunk
+}
+
+// A neighbor, learnt from a packet or added by the user
+type NewPeer struct {
+	Address string
+}
+
+// A change of the liveness of a neighbor, see Router
+type PeerStateChange struct {
+	Address string
+	State   PeerState
+}
+
+// A new entry of the routing table
+type RouteUpdate struct {
+	Origin  string // Name of the node
+	Address string // Address of the neighbor through which it is reached
+}
+
+// A switch of the longest chain to a longer branch. Both lists go from the block after the common
+// ancestor to the latest one. Appended blocks are also published one by one as Block events.
+type ForkRewind struct {
+	Discarded []*common.Block // Blocks that are no longer on the longest chain
+	Appended  []*common.Block // Blocks of the new branch
+}
+
+// A search result received from another node
+type SearchMatch struct {
+	Origin string
+	Result *common.SearchResult
+}
+
+// Snapshot of a download
+type DownloadProgress struct {
+	Name     string
+	MetaHash []byte
+	State    DownloadState
+	Done     int // Number of chunks downloaded
+	Total    int // Number of chunks in the file, 0 until the metafiles are known
+}
+
+// The EventBus delivers events to all its subscribers. Publishing never blocks the gossiper: a
+// subscriber that does not keep up misses the events that do not fit in its buffer.
+type EventBus struct {
+	subscriptions map[*Subscription]bool
+	closed        bool
+	lock          *sync.RWMutex
+}
+
+// A Subscription receives events on its Events channel until it is closed, or until the gossiper stops.
+type Subscription struct {
+	Events  <-chan *Event
+	events  chan *Event
+	dropped int // Number of events that did not fit in the channel
+	bus     *EventBus
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscriptions: make(map[*Subscription]bool),
+		lock:          &sync.RWMutex{},
+	}
+}
+
+// Start receiving events. Events are buffered up to common.EventBufferSize.
+func (bus *EventBus) Subscribe() *Subscription {
+
+	events := make(chan *Event, common.EventBufferSize)
+	subscription := &Subscription{Events: events, events: events, bus: bus}
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.closed {
+		close(events)
+	} else {
+		bus.subscriptions[subscription] = true
+	}
+
+	return subscription
+}
+
+// Stop receiving events. The Events channel is closed.
+func (subscription *Subscription) Close() {
+
+	bus := subscription.bus
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.subscriptions[subscription] {
+		delete(bus.subscriptions, subscription)
+		close(subscription.events)
+	}
+}
+
+// Number of events that were dropped because the subscriber did not read them fast enough.
+func (subscription *Subscription) Dropped() int {
+
+	subscription.bus.lock.RLock()
+	defer subscription.bus.lock.RUnlock()
+
+	return subscription.dropped
+}
+
+// Deliver an event to all subscribers. Does nothing on a nil bus, so that components work on
+// their own, e.g. in tests.
+func (bus *EventBus) publish(event *Event) {
+
+	if bus == nil {
+		return
+	}
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	for subscription := range bus.subscriptions {
+		select {
+		case subscription.events <- event:
+		default:
+			subscription.dropped++
+		}
+	}
+}
+
+// Close all subscriptions. Events published afterwards are ignored.
+func (bus *EventBus) Close() {
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.closed {
+		return
+	}
+
+	bus.closed = true
+
+	for subscription := range bus.subscriptions {
+		delete(bus.subscriptions, subscription)
+		close(subscription.events)
+	}
+}
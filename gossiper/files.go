@@ -1,24 +1,32 @@
 package gossiper
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
 	"github.com/jfperren/Peerster/common"
+	"io"
 	"os"
+	"sort"
 	"sync"
-	"time"
 )
 
 // File System handles the low-level complexity of chunking (scanning) existing files, storing file hashes,
 // deciding which hashes are missing in a file, etc...
+//
+// The content of chunks and metafiles lives in a ChunkStore on disk. Files that have more chunks than
+// fit in a single metafile are indexed by a tree of metafiles: an index metafile starts with one byte
+// giving its depth (1 if it points to regular metafiles, 2 if it points to depth-1 index metafiles, etc...)
+// followed by the hashes of its children. Regular metafiles are unchanged, so that files up to 2Mb remain
+// compatible with other nodes.
 type FileSystem struct {
 	sharedPath   string
 	downloadPath string
-	chunks       map[string]*Chunk
 	metaFiles    map[string]*MetaFile
+	chunkHashes  map[string][][]byte // Chunk hashes of each file, once its whole metafile tree is known
+	store        *ChunkStore
 	lock	 	 *sync.RWMutex
+	storage      Storage
 }
 
 type MetaFile struct {
@@ -28,13 +36,9 @@ type MetaFile struct {
 	Data 	[]byte
 }
 
-type Chunk struct {
-	hash []byte
-	data []byte
-}
-
 const FileNotFound = 1
-const FileTooBig = 2
+const FileNotReadable = 2
+const FileIncomplete = 3 // Some of its metafiles or chunks are not in the store
 
 // Errors thrown by the File System type
 type FileSystemError struct {
@@ -46,22 +50,37 @@ func (e *FileSystemError) Error() string {
 	switch e.flag {
 	case FileNotFound:
 		return "File not found: " + e.filename
-	case FileTooBig:
-		return "File is too big: " + e.filename + " (max. 2Mb)"
+	case FileNotReadable:
+		return "File could not be read: " + e.filename
+	case FileIncomplete:
+		return "File is incomplete: " + e.filename
 	default:
 		return "Unexpected error"
 	}
 }
 
-// Create a new File System
-func NewFileSystem(sharedPath, downloadPath string) *FileSystem {
+// Maximum number of hashes in a regular metafile
+const metaFileCapacity = common.FileChunkSize / sha256.Size
+
+// Maximum number of hashes in an index metafile (one byte is used for its depth)
+const indexCapacity = (common.FileChunkSize - 1) / sha256.Size
+
+// Create a new File System. Chunks are stored in chunkPath, or in a temporary folder if it is empty.
+func NewFileSystem(sharedPath, downloadPath, chunkPath string) *FileSystem {
+
+	store, err := NewChunkStore(chunkPath)
+	if err != nil {
+		panic(err)
+	}
 
 	return &FileSystem{
 		sharedPath: sharedPath,
 		downloadPath: downloadPath,
-		chunks: make(map[string]*Chunk),
 		metaFiles: make(map[string]*MetaFile),
+		chunkHashes: make(map[string][][]byte),
+		store: store,
 		lock: &sync.RWMutex{},
+		storage: &NullStorage{},
 	}
 }
 
@@ -71,43 +90,36 @@ func NewMetaFile(name string, data []byte) *MetaFile {
 	return &MetaFile{name, 0, hash[:], data}
 }
 
-// Create a new chunk
-func NewChunk(data []byte) *Chunk {
-	hash := sha256.Sum256(data)
-	return &Chunk{hash[:], data}
-}
-
 // Get meta file related to a hash
 func (fs *FileSystem) getMetaFile(hash []byte) (*MetaFile, bool) {
+
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
 	v, found := fs.metaFiles[hex.EncodeToString(hash)]
 	return v, found
 }
 
-// Get chunk related to a hash
-func (fs *FileSystem) getChunk(hash []byte) (*Chunk, bool) {
-	v, found := fs.chunks[hex.EncodeToString(hash)]
-	return v, found
-}
+// All the files that are shared or downloaded, sorted by name
+func (fs *FileSystem) allMetaFiles() []*MetaFile {
 
-// Number of chunks related to a metafile
-func (metaFile *MetaFile) countOfChunks() int {
-	return len(metaFile.Data) / sha256.Size
-}
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
 
-// Returns the i-th hash in the metafile
-func (metaFile *MetaFile) hashAt(index int) []byte {
-	return metaFile.Data[index*sha256.Size : (index+1)*sha256.Size]
-}
+	metaFiles := make([]*MetaFile, 0, len(fs.metaFiles))
+
+	for _, metaFile := range fs.metaFiles {
+		metaFiles = append(metaFiles, metaFile)
+	}
 
-// Size in bytes of a chunk
-func (chunk *Chunk) size() int {
-	return len(chunk.data)
+	sort.Slice(metaFiles, func(i, j int) bool { return metaFiles[i].Name < metaFiles[j].Name })
+
+	return metaFiles
 }
 
-// Return true if a chunk is the last expected one in a file
-func (chunk *Chunk) isLastIn(metaFile *MetaFile) bool {
-	lastHash := metaFile.hashAt(metaFile.countOfChunks() - 1)
-	return bytes.Compare(lastHash, chunk.hash) == 0
+// Get the content of a chunk or metafile related to a hash
+func (fs *FileSystem) getData(hash []byte) ([]byte, bool) {
+	return fs.store.Get(hash)
 }
 
 // Store a meta file into the file system
@@ -115,272 +127,352 @@ func (fs *FileSystem) storeMetaFile(metaFile *MetaFile) {
 
 	key := hex.EncodeToString(metaFile.Hash)
 
+	fs.lock.Lock()
 	fs.metaFiles[key] = metaFile
+	fs.lock.Unlock()
 
+	fs.store.Put(metaFile.Data)
+	fs.storage.StoreMetaFile(metaFile)
 }
 
-// Store a chunk into the file system
-func (fs *FileSystem) storeChunk(chunk Chunk)  {
-
-	key := hex.EncodeToString(chunk.hash)
+// Close the file system and release its chunk store.
+func (fs *FileSystem) Close() {
+	fs.store.Close()
+}
 
-	fs.chunks[key] = &chunk
+//
+//  METAFILE TREES
+//
 
+// Return true if the metafile data is an index, i.e. points to other metafiles instead of chunks.
+func isIndexMetaFile(data []byte) bool {
+	return len(data) % sha256.Size == 1
 }
 
-// Take a data reply and store its information in the file system.
-func (fs *FileSystem) processDataReply(name string, metaHash []byte, reply *common.DataReply) {
+// Split the data of a metafile into the hashes it contains
+func hashesIn(data []byte) [][]byte {
 
-	metaFile, found := fs.getMetaFile(metaHash)
+	if isIndexMetaFile(data) {
+		data = data[1:]
+	}
 
-	if !found {
+	hashes := make([][]byte, 0, len(data) / sha256.Size)
 
-		metaFile = NewMetaFile(name, reply.Data)
-		fs.storeMetaFile(metaFile)
+	for i := 0; i + sha256.Size <= len(data); i += sha256.Size {
+		hashes = append(hashes, data[i:i+sha256.Size])
+	}
 
-	} else {
+	return hashes
+}
 
-		chunk := NewChunk(reply.Data)
+// Build the (tree of) metafile(s) indexing a list of chunk hashes. Every metafile but the root is put
+// in the chunk store, the root is returned.
+func (fs *FileSystem) buildMetaFileTree(chunkHashes []byte) []byte {
 
-		fs.storeChunk(*chunk)
+	if len(chunkHashes) <= metaFileCapacity * sha256.Size {
+		return chunkHashes
+	}
 
-		metaFile.Size += chunk.size()
+	// First level, regular metafiles pointing to chunks
+	level := make([]byte, 0)
 
-		if chunk.isLastIn(metaFile) {
-			fs.reconstructFile(metaFile.Hash)
+	for i := 0; i < len(chunkHashes); i += metaFileCapacity * sha256.Size {
+		end := i + metaFileCapacity * sha256.Size
+		if end > len(chunkHashes) {
+			end = len(chunkHashes)
 		}
+		level = append(level, fs.store.Put(chunkHashes[i:end])...)
 	}
-}
 
-// Reconstruct a file using all the chunks downloaded.
-func (fs *FileSystem) reconstructFile(metaHash []byte) {
+	// Upper levels, index metafiles pointing to the level below
+	for depth := byte(1); ; depth++ {
 
-	data := make([]byte, 0)
+		if len(level) <= indexCapacity * sha256.Size {
+			return append([]byte{depth}, level...)
+		}
 
-	metaFile, found := fs.getMetaFile(metaHash)
+		next := make([]byte, 0)
 
-	if !found {
-		panic("File not found")
+		for i := 0; i < len(level); i += indexCapacity * sha256.Size {
+			end := i + indexCapacity * sha256.Size
+			if end > len(level) {
+				end = len(level)
+			}
+			next = append(next, fs.store.Put(append([]byte{depth}, level[i:end]...))...)
+		}
+
+		level = next
 	}
+}
 
-	for i := 0; i < metaFile.countOfChunks(); i++ {
+// Resolve the list of chunk hashes of a metafile by walking down its tree. If some metafiles of the
+// tree are not yet in the store, their hashes are returned as second value instead.
+func (fs *FileSystem) resolveChunkHashes(metaFile *MetaFile) ([][]byte, [][]byte) {
 
-		hash := metaFile.hashAt(i)
-		chunk, found := fs.getChunk(hash)
+	key := hex.EncodeToString(metaFile.Hash)
 
-		if !found {
-			panic("Chunk not found")
-		}
+	fs.lock.RLock()
+	hashes, found := fs.chunkHashes[key]
+	fs.lock.RUnlock()
 
-		data = append(data, chunk.data...)
+	if found {
+		return hashes, nil
 	}
 
-	common.LogReconstructed(metaFile.Name)
+	missing := make([][]byte, 0)
+	hashes = fs.resolveChunkHashesIn(metaFile.Data, &missing)
 
-	filePath := fs.downloadPath + metaFile.Name
-	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		fmt.Print(err)
+	if len(missing) > 0 {
+		return nil, missing
 	}
-	file.Write(data)
 
-}
+	fs.lock.Lock()
+	fs.chunkHashes[key] = hashes
+	fs.lock.Unlock()
 
-// Check what is the next missing hash related to a file.
-//
-// - First return value is the next hash to be downloaded (or [] if completed)
-// - Second return value is the next chunk Id (or -1 if metafile is still needed, -2 if completed)
-// - Third return value returns true if the download is completed.
-//
-func (fs *FileSystem) downloadStatus(metaHash []byte) ([]byte, int, bool) {
+	return hashes, nil
+}
 
-	metaFile, found := fs.getMetaFile(metaHash)
+func (fs *FileSystem) resolveChunkHashesIn(data []byte, missing *[][]byte) [][]byte {
 
-	if !found {
-		return metaHash, common.MetaHashChunkId, false
+	if !isIndexMetaFile(data) {
+		return hashesIn(data)
 	}
 
-	for i := 0; i < metaFile.countOfChunks(); i++ {
+	hashes := make([][]byte, 0)
 
-		hash := metaFile.hashAt(i)
+	for _, hash := range hashesIn(data) {
 
-		_, found := fs.getChunk(hash)
+		child, found := fs.store.Get(hash)
 
 		if !found {
-			return hash, i + 1, false
+			*missing = append(*missing, hash)
+			continue
 		}
+
+		hashes = append(hashes, fs.resolveChunkHashesIn(child, missing)...)
 	}
 
-	return make([]byte, 0), common.NoChunkId, true
+	return hashes
 }
 
-// Prepares a file so as to make it available to send on the network. Chunk + computes hash
-func (fs *FileSystem) ScanFile(fileName string) (*MetaFile, error) {
+//
+//  DOWNLOADING & SCANNING
+//
 
-	// Open file for reading
-	filePath := fs.sharedPath + fileName
-	file, err := os.Open(filePath)
+// Store the top-level metafile of a file being downloaded.
+func (fs *FileSystem) storeDownloadedMetaFile(name string, data []byte) *MetaFile {
 
-	if err != nil {
-		common.DebugFileNotFound(fileName)
-		return nil, &FileSystemError{fileName, FileNotFound}
-	}
-
-	size := 0
-	hashes := make([]byte, 0)
-	chunks := make([]Chunk, 0)
+	metaFile := NewMetaFile(name, data)
+	fs.storeMetaFile(metaFile)
 
-	for i := 0; true; i++ {
+	return metaFile
+}
 
-		buff := make([]byte, common.FileChunkSize)
-		count, err := file.Read(buff)
-		if err != nil {
-			fmt.Print(err)
-		}
+// Store a downloaded chunk or metafile
+func (fs *FileSystem) storeData(data []byte) {
+	fs.store.Put(data)
+}
 
-		// Compute hash of chunk
-		hash := sha256.Sum256(buff)
+// Reconstruct a file using all the chunks downloaded. Chunks are read from the store and written
+// one by one, so that the whole file is never held in memory. Return an error if some of them are
+// missing or if the file cannot be written.
+func (fs *FileSystem) reconstructFile(metaHash []byte) error {
 
-		// Append hash and increase length
-		hashes = append(hashes, hash[:]...)
-		size += count
+	metaFile, found := fs.getMetaFile(metaHash)
 
-		chunk := Chunk{hash[:], buff}
-		chunks = append(chunks, chunk)
+	if !found {
+		return &FileSystemError{hex.EncodeToString(metaHash), FileNotFound}
+	}
 
-		if len(hashes) > common.FileChunkSize {
-			common.DebugFileTooBig(fileName)
-			return nil, &FileSystemError{fileName, FileTooBig}
-		}
+	hashes, missing := fs.resolveChunkHashes(metaFile)
 
-		if count < common.FileChunkSize {
-			break
-		}
+	if len(missing) > 0 {
+		return &FileSystemError{metaFile.Name, FileIncomplete}
 	}
 
-	// Calculate hash of hashes
-	metaHash := sha256.Sum256(hashes)
-
-	// Create and open meta file
-	metaFile := &MetaFile{fileName, size, metaHash[:], hashes}
-	fs.storeMetaFile(metaFile)
+	if err := os.MkdirAll(fs.downloadPath, 0755); err != nil {
+		return err
+	}
 
-	// Store all chunks
-	for i, chunk := range chunks {
-		common.DebugScanChunk(i, chunk.hash)
-		fs.storeChunk(chunk)
+	filePath := fs.downloadPath + metaFile.Name
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	common.DebugScanFile(fileName, size, metaHash[:])
+	writer := bufio.NewWriter(file)
+	size := 0
 
-	return metaFile, nil
-}
+	for _, hash := range hashes {
 
-func (fs *FileSystem) getFileWithName(filename string) *MetaFile {
+		data, found := fs.store.Get(hash)
 
-	for _, metaFile := range fs.metaFiles {
-		if metaFile.Name == filename {
-			return metaFile
+		if !found {
+			return &FileSystemError{metaFile.Name, FileIncomplete}
+		}
+
+		if _, err := writer.Write(data); err != nil {
+			return err
 		}
+
+		size += len(data)
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
 	}
 
+	metaFile.Size = size
+	fs.storage.StoreMetaFile(metaFile)
+
+	common.LogReconstructed(metaFile.Name)
+
 	return nil
 }
 
-//
-//  GOSSIPER METHODS
-//
+// Forget a file, e.g. one whose download was cancelled, and delete from the store its chunks and
+// metafiles that are not used by any other file.
+func (fs *FileSystem) discardFile(metaHash []byte) {
 
-// Start a new download process. As long as there are missing chunks related to the metahash provided, it will
-// continue to download the remaining ones. If there is a timeout or the response does not match the data requested,
-// it will restart evert 5 seconds, up to a total of 10 tries before stopping.
-//
-//  - name: Name of the file as it will appear in the file system later on
-//  - metaHash: Hash of the requested file
-//  - peer: Name of the peer from which we want to download the file
-//  - counter: Set to 0 for new downloads, it will increase up to 10 until timing out.
-//
-func (gossiper *Gossiper) StartDownload(name string, metaHash []byte, peer string, counter int) {
+	key := hex.EncodeToString(metaHash)
+
+	fs.lock.Lock()
+	metaFile, found := fs.metaFiles[key]
+	delete(fs.metaFiles, key)
+	delete(fs.chunkHashes, key)
+
+	others := make([]*MetaFile, 0, len(fs.metaFiles))
+	for _, other := range fs.metaFiles {
+		others = append(others, other)
+	}
+	fs.lock.Unlock()
 
-	if counter > common.MaxDownloadRequests {
-		// Probably print some stuff
-		common.DebugDownloadTimeout(name, metaHash, peer)
+	if !found {
 		return
 	}
 
-	nextHash, chunkId, completed := gossiper.FileSystem.downloadStatus(metaHash)
+	used := make(map[string]bool)
 
-	if completed {
-		common.DebugDownloadCompleted(name, metaHash, peer)
-		return
+	for _, other := range others {
+		used[hex.EncodeToString(other.Hash)] = true
+		fs.collectBlobs(other.Data, used)
 	}
 
-	if peer == "" {
+	owned := map[string]bool{key: true}
+	fs.collectBlobs(metaFile.Data, owned)
 
-		fileMap, found := gossiper.SearchEngine.FileMap(metaHash)
+	for blob := range owned {
+		if !used[blob] {
+			hash, _ := hex.DecodeString(blob)
+			fs.store.Delete(hash)
+		}
+	}
+}
 
-		if !found {
-			common.DebugDownloadUnknownFile(metaHash)
-			return
+// Add to blobs the hashes of all chunks and metafiles below a metafile. Only the parts of the tree
+// that are in the store are visited.
+func (fs *FileSystem) collectBlobs(data []byte, blobs map[string]bool) {
+
+	index := isIndexMetaFile(data)
+
+	for _, hash := range hashesIn(data) {
+
+		blobs[hex.EncodeToString(hash)] = true
+
+		if !index {
+			continue
 		}
 
-		if chunkId == common.MetaHashChunkId {
-			peer, found = fileMap.peerForMetafile(counter)
-		} else {
-			peer, found = fileMap.peerForChunk(uint64(chunkId), counter)
+		if child, found := fs.store.Get(hash); found {
+			fs.collectBlobs(child, blobs)
 		}
+	}
+}
 
-		if !found {
-			common.DebugNoKnownOwnerForFile(metaHash)
-			return
+// Return the hashes of all the chunks of a file that are not yet in the store, in order, along
+// with their chunk Id. Should only be called once the whole metafile tree is known.
+func (fs *FileSystem) missingChunks(metaFile *MetaFile) ([][]byte, []int) {
+
+	hashes, _ := fs.resolveChunkHashes(metaFile)
+
+	missing := make([][]byte, 0)
+	chunkIds := make([]int, 0)
+
+	for i, hash := range hashes {
+		if !fs.store.Has(hash) {
+			missing = append(missing, hash)
+			chunkIds = append(chunkIds, i + 1)
 		}
 	}
 
-	common.DebugStartDownload(name, nextHash, peer)
+	return missing, chunkIds
+}
 
-	go func() {
+// Prepares a file so as to make it available to send on the network. Chunk + computes hash. The file
+// is read chunk by chunk and each chunk is written to the store right away.
+func (fs *FileSystem) ScanFile(fileName string) (*MetaFile, error) {
 
-		ticker := time.NewTicker(common.DownloadTimeout)
-		defer ticker.Stop()
+	// Open file for reading
+	filePath := fs.sharedPath + fileName
+	file, err := os.Open(filePath)
 
-		select {
-		case packet := <-gossiper.Dispatcher.dataReplies(nextHash):
+	if err != nil {
+		common.DebugFileNotFound(fileName)
+		return nil, &FileSystemError{fileName, FileNotFound}
+	}
 
-			reply := packet.DataReply
+	defer file.Close()
 
-			if reply == nil {
-				// Error, we expect only a data reply from this
-				return
-			}
+	size := 0
+	hashes := make([]byte, 0)
+	buff := make([]byte, common.FileChunkSize)
 
-			if !reply.VerifyHash(nextHash) {
-				// Unexpected hash or incorrect data, retry
-				common.DebugCorruptedDataReply(nextHash, reply)
-				go gossiper.StartDownload(name, metaHash, peer, counter+1)
-				return
-			}
+	for i := 0; true; i++ {
 
-			gossiper.FileSystem.processDataReply(name, metaHash, reply)
+		count, err := io.ReadFull(file, buff)
 
-			// At this point, the download is successful, so we can log it
+		if count > 0 {
 
-			if chunkId == common.MetaHashChunkId {
-				common.LogDownloadingMetafile(name, packet.DataReply.Origin)
-			} else {
-				common.LogDownloadingChunk(name, chunkId, packet.DataReply.Origin)
-			}
+			hash := fs.store.Put(buff[:count])
+			common.DebugScanChunk(i, hash)
 
-			// Then we start downloading the next chunk
-			go gossiper.StartDownload(name, metaHash, peer, 0)
+			// Append hash and increase length
+			hashes = append(hashes, hash...)
+			size += count
+		}
 
-		case <-ticker.C: // Timeout
-			go gossiper.StartDownload(name, metaHash, peer, counter+1)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
 		}
 
-		gossiper.Dispatcher.stopWaitingOnDataReply(nextHash)
-	}()
+		if err != nil {
+			common.DebugStorageError(err)
+			return nil, &FileSystemError{fileName, FileNotReadable}
+		}
+	}
+
+	// Create meta file
+	metaFile := NewMetaFile(fileName, fs.buildMetaFileTree(hashes))
+	metaFile.Size = size
+	fs.storeMetaFile(metaFile)
 
-	request := gossiper.GenerateDataRequest(peer, nextHash)
-	gossiper.sendToNode(request.Packed(), request.Destination, nil)
+	common.DebugScanFile(fileName, size, metaFile.Hash)
+
+	return metaFile, nil
+}
+
+func (fs *FileSystem) getFileWithName(filename string) *MetaFile {
 
-}
\ No newline at end of file
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	for _, metaFile := range fs.metaFiles {
+		if metaFile.Name == filename {
+			return metaFile
+		}
+	}
+
+	return nil
+}
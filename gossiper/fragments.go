@@ -0,0 +1,214 @@
+package gossiper
+
+import (
+	"fmt"
+	"github.com/dedis/protobuf"
+	"github.com/jfperren/Peerster/common"
+	"sync"
+	"time"
+)
+
+// A Fragmenter splits encoded packets that do not fit in a datagram into Fragments, and puts received
+// fragments back together.
+//
+// Fragments of a packet are kept in a reassembly buffer until all of them are received. To bound memory,
+// a buffer is dropped if it is not completed within FragmentTimeout, and the oldest buffers are dropped
+// when there are more than MaxReassemblyBuffers of them or when they hold more than MaxReassemblyBytes.
+type Fragmenter struct {
+	nextID  uint32                       // ID of the next packet to fragment
+	buffers map[string]*reassemblyBuffer // Packets being reassembled, by source and ID
+	size    int                          // Number of bytes held in all buffers
+	lock    *sync.Mutex
+}
+
+type reassemblyBuffer struct {
+	source    string
+	id        uint32
+	fragments [][]byte
+	received  int
+	size      int
+	created   time.Time
+}
+
+func NewFragmenter() *Fragmenter {
+	return &Fragmenter{
+		nextID:  common.Random.Uint32(),
+		buffers: make(map[string]*reassemblyBuffer),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Split an encoded packet into fragments of at most FragmentDataSize bytes.
+func (fragmenter *Fragmenter) Split(bytes []byte) ([]*common.Fragment, error) {
+
+	count := (len(bytes) + common.FragmentDataSize - 1) / common.FragmentDataSize
+
+	if count > common.MaxFragmentCount {
+		return nil, common.ErrPacketTooBig
+	}
+
+	fragmenter.lock.Lock()
+	id := fragmenter.nextID
+	fragmenter.nextID++
+	fragmenter.lock.Unlock()
+
+	fragments := make([]*common.Fragment, 0, count)
+
+	for i := 0; i < count; i++ {
+
+		end := (i + 1) * common.FragmentDataSize
+		if end > len(bytes) {
+			end = len(bytes)
+		}
+
+		fragments = append(fragments, &common.Fragment{
+			ID:    id,
+			Index: uint32(i),
+			Count: uint32(count),
+			Data:  bytes[i*common.FragmentDataSize : end],
+		})
+	}
+
+	return fragments, nil
+}
+
+// Add a fragment received from a given source. Once all the fragments of a packet are received, return
+// the whole encoded packet and true.
+func (fragmenter *Fragmenter) Add(source string, fragment *common.Fragment) ([]byte, bool) {
+
+	if fragment.Count == 0 || fragment.Count > common.MaxFragmentCount || fragment.Index >= fragment.Count ||
+		len(fragment.Data) > common.FragmentDataSize {
+		common.DebugDropFragment(source, fragment.ID, "invalid fragment")
+		return nil, false
+	}
+
+	key := fmt.Sprintf("%v/%v", source, fragment.ID)
+
+	fragmenter.lock.Lock()
+	defer fragmenter.lock.Unlock()
+
+	fragmenter.expire()
+
+	buffer, found := fragmenter.buffers[key]
+
+	if !found {
+
+		for len(fragmenter.buffers) >= common.MaxReassemblyBuffers {
+			fragmenter.dropOldest()
+		}
+
+		buffer = &reassemblyBuffer{
+			source:    source,
+			id:        fragment.ID,
+			fragments: make([][]byte, fragment.Count),
+			created:   time.Now(),
+		}
+
+		fragmenter.buffers[key] = buffer
+	}
+
+	if int(fragment.Count) != len(buffer.fragments) {
+		common.DebugDropFragment(source, fragment.ID, "inconsistent fragment count")
+		return nil, false
+	}
+
+	if buffer.fragments[fragment.Index] != nil {
+		return nil, false
+	}
+
+	for fragmenter.size+len(fragment.Data) > common.MaxReassemblyBytes && len(fragmenter.buffers) > 1 {
+		fragmenter.dropOldestExcept(key)
+	}
+
+	buffer.fragments[fragment.Index] = fragment.Data
+	buffer.received++
+	buffer.size += len(fragment.Data)
+	fragmenter.size += len(fragment.Data)
+
+	if buffer.received < len(buffer.fragments) {
+		return nil, false
+	}
+
+	fragmenter.remove(key)
+
+	bytes := make([]byte, 0, buffer.size)
+
+	for _, data := range buffer.fragments {
+		bytes = append(bytes, data...)
+	}
+
+	common.DebugReassembled(source, fragment.ID, len(bytes))
+
+	return bytes, true
+}
+
+// Drop buffers that were not completed in time. Must be called with the lock held.
+func (fragmenter *Fragmenter) expire() {
+	for key, buffer := range fragmenter.buffers {
+		if time.Since(buffer.created) > common.FragmentTimeout {
+			common.DebugDropFragment(buffer.source, buffer.id, "reassembly timeout")
+			fragmenter.remove(key)
+		}
+	}
+}
+
+// Drop the oldest buffer. Must be called with the lock held.
+func (fragmenter *Fragmenter) dropOldest() {
+	fragmenter.dropOldestExcept("")
+}
+
+// Drop the oldest buffer other than the one with a given key. Must be called with the lock held.
+func (fragmenter *Fragmenter) dropOldestExcept(except string) {
+
+	oldest := ""
+
+	for key, buffer := range fragmenter.buffers {
+		if key != except && (oldest == "" || buffer.created.Before(fragmenter.buffers[oldest].created)) {
+			oldest = key
+		}
+	}
+
+	if oldest != "" {
+		buffer := fragmenter.buffers[oldest]
+		common.DebugDropFragment(buffer.source, buffer.id, "too many packets being reassembled")
+		fragmenter.remove(oldest)
+	}
+}
+
+// Must be called with the lock held.
+func (fragmenter *Fragmenter) remove(key string) {
+	fragmenter.size -= fragmenter.buffers[key].size
+	delete(fragmenter.buffers, key)
+}
+
+//
+//  GOSSIPER METHODS
+//
+
+// Send an encoded packet to a neighbor. Packets that are too big for a datagram are sent as fragments
+// when going through UDP.
+func (gossiper *Gossiper) sendOver(transport common.Transport, bytes []byte, peerAddress string) error {
+
+	if transport != common.Transport(gossiper.GossipSocket) || len(bytes) <= common.SocketBufferSize {
+		return transport.Send(bytes, peerAddress)
+	}
+
+	fragments, err := gossiper.Fragmenter.Split(bytes)
+	if err != nil {
+		return err
+	}
+
+	for _, fragment := range fragments {
+
+		encoded, err := protobuf.Encode(fragment.Packed())
+		if err != nil {
+			return err
+		}
+
+		if err := transport.Send(encoded, peerAddress); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
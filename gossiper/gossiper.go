@@ -1,10 +1,10 @@
 package gossiper
 
 import (
-	"fmt"
+	"context"
 	"github.com/dedis/protobuf"
 	"github.com/jfperren/Peerster/common"
-	"log"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -19,12 +19,14 @@ type Gossiper struct {
 	Name   			string // Name of this node
 	Simple 			bool   // Stores if gossiper runs in simple mode.
 	MixLength       uint   // Number of hops messages should go through
+	DownloadWindow  int    // Maximum number of concurrent chunk requests per download
 
-	GossipSocket 	*common.UDPSocket // UDP Socket that connects to other nodes
+	GossipSocket 	common.Socket // Socket that connects to other nodes, a UDPSocket outside of simulations
 	ClientSocket 	*common.UDPSocket // UDP Socket that connects to the client
+	TCPSocket       *common.TCPTransport // TCP transport for big packets, nil unless EnableTCP was called
 
 	Rumors   		*RumorDatabase           // Database of known Rumors
-	Messages 		[]*common.PrivateMessage // List of Private Messages Received
+	Messages 		[]*common.PrivateMessage // List of Private Messages Received, read with PrivateMessages()
 
 	FileSystem 		*FileSystem 	// Stores and serves shared files
 	Dispatcher 		*Dispatcher 	// Dispatches incoming messages to expecting processes
@@ -35,6 +37,19 @@ type Gossiper struct {
     Crypto          *Crypto         // Stores the RSA keys, and handle the (de)cyphering and
                                     // signing/validating messages
     Mixer 			*Mixer // Stores pending packets to be forwarded through a mix-network
+	Fragmenter      *Fragmenter // Splits and reassembles packets too big for a datagram
+	Storage         Storage // Persists the state of the node across restarts
+	Downloads       *DownloadManager // Keeps track of running, paused and past downloads
+	Events          *EventBus // Notifies subscribers of new rumors, private messages, blocks and matches
+	ClientResponses *ResponseCache // Latest responses sent to clients
+	Metrics         *Metrics // Counters of packets, downloads, searches, blocks, etc.
+	Capture         *common.Capture // Records the packets sent and received, nil unless EnableCapture was called
+
+	messagesLock    *sync.RWMutex      // Guards Messages
+	ctx             context.Context    // Cancelled when the gossiper is stopped
+	cancel          context.CancelFunc
+	routines        *sync.WaitGroup    // Goroutines started by the gossiper, see spawn
+	lifecycleLock   *sync.Mutex
 }
 
 const (
@@ -51,40 +66,80 @@ const (
 //  - simple: Start this gossiper in simple mode (i.e. no gossip, only simple messages)
 //  - rtimer: Time in seconds between route rumors. Set to 0 for not sending route rumors at all.
 //  - separatefs: True if this gossiper uses its own subfolder for _Download and _SharedFiles.
+//  - dataDir: Directory in which the state of the node is persisted. Set to "" to keep everything in memory.
 //
-// Note - Use gossiper.Start() to Start listening for messages.
+// Note - Use gossiper.Start() to Start listening for messages, and gossiper.Stop() to stop.
 //
-func NewGossiper(gossipAddress, clientAddress, name string, peers string, simple bool, rtimer int, separatefs bool, keySize, cryptoOpts int, mixLength uint) *Gossiper {
+// Return an error if a socket cannot be bound or the storage cannot be opened.
+//
+func NewGossiper(gossipAddress, clientAddress, name string, peers string, simple bool, rtimer int, separatefs bool, dataDir string, keySize, cryptoOpts int, mixLength uint) (*Gossiper, error) {
+
+	gossipSocket, err := common.NewUDPSocket(gossipAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewGossiperOn(gossipSocket, clientAddress, name, peers, simple, rtimer, separatefs,
+		dataDir, keySize, cryptoOpts, mixLength)
+}
+
+// Create a new Gossiper that talks to other gossipers through the given socket instead of binding a UDP
+// socket, e.g. a socket of an in-memory network. Other parameters are the same as in NewGossiper. The
+// gossiper unbinds the socket when it is stopped, or right away if it cannot be created.
+func NewGossiperOn(gossipSocket common.Socket, clientAddress, name string, peers string, simple bool, rtimer int, separatefs bool, dataDir string, keySize, cryptoOpts int, mixLength uint) (*Gossiper, error) {
 
-	gossipSocket := common.NewUDPSocket(gossipAddress)
 	var clientSocket *common.UDPSocket
 
 	if clientAddress != "" {
-		clientSocket = common.NewUDPSocket(clientAddress)
+
+		socket, err := common.NewUDPSocket(clientAddress)
+		if err != nil {
+			gossipSocket.Unbind()
+			return nil, err
+		}
+
+		clientSocket = socket
 	}
 
 	downloadPath := common.DownloadDir
 	sharedPath := common.SharedFilesDir
+	chunkPath := ""
 
 	if separatefs {
 		downloadPath = downloadPath + name + "/"
 		sharedPath = sharedPath + name + "/"
 	}
 
+	if dataDir != "" {
+		chunkPath = filepath.Join(dataDir, "chunks")
+	}
+
 	var mixer *Mixer
 	if cryptoOpts != 0 {
 		mixer = NewMixer()
 	}
 
-	return &Gossiper{
+	storage, err := NewStorage(dataDir)
+	if err != nil {
+		gossipSocket.Unbind()
+		if clientSocket != nil {
+			clientSocket.Unbind()
+		}
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	gossiper := &Gossiper{
 		Name:         	name,
 		Simple:       	simple,
 		GossipSocket: 	gossipSocket,
 		ClientSocket: 	clientSocket,
 		MixLength: 		mixLength,
+		DownloadWindow: common.DownloadWindow,
 
 		Rumors:     	NewRumorDatabase(),
-		FileSystem: 	NewFileSystem(sharedPath, downloadPath),
+		FileSystem: 	NewFileSystem(sharedPath, downloadPath, chunkPath),
 		Dispatcher: 	NewDispatcher(),
 		Router:     	NewRouter(peers, time.Duration(rtimer)*time.Second),
 		SpamDetector:   NewSpamDetector(),
@@ -92,7 +147,30 @@ func NewGossiper(gossipAddress, clientAddress, name string, peers string, simple
 		BlockChain:		NewBlockChain(),
         Crypto:         NewCrypto(keySize, cryptoOpts),
 		Mixer:			mixer,
+		Downloads:      NewDownloadManager(),
+		Fragmenter:     NewFragmenter(),
+		Events:         NewEventBus(),
+		ClientResponses: NewResponseCache(),
+		Metrics:         NewMetrics(),
+
+		messagesLock:   &sync.RWMutex{},
+		ctx:            ctx,
+		cancel:         cancel,
+		routines:       &sync.WaitGroup{},
+		lifecycleLock:  &sync.Mutex{},
 	}
+
+	gossiper.restore(storage)
+
+	// Only publish what happens after the state is restored
+	gossiper.Router.events = gossiper.Events
+	gossiper.BlockChain.events = gossiper.Events
+	gossiper.SearchEngine.events = gossiper.Events
+	gossiper.BlockChain.metrics = gossiper.Metrics
+	gossiper.Router.metrics = gossiper.Metrics
+	gossiper.Metrics.observe(gossiper)
+
+	return gossiper, nil
 }
 
 // --
@@ -100,62 +178,178 @@ func NewGossiper(gossipAddress, clientAddress, name string, peers string, simple
 // --
 
 
-// Start listening for UDP packets on Gossiper's clientAddress & gossipAddress
+// Start listening for UDP packets on Gossiper's clientAddress & gossipAddress. All the loops of the
+// gossiper run in the background until Stop is called.
 func (gossiper *Gossiper) Start() {
 
 	if gossiper.ShouldAuthenticate() {
-		go gossiper.tryAuthenticate()
+		gossiper.spawn(gossiper.tryAuthenticate)
+	}
+
+	gossiper.spawn(func() { gossiper.receiveGossip(gossiper.GossipSocket) })
+
+	if gossiper.TCPSocket != nil {
+		gossiper.spawn(func() { gossiper.receiveGossip(gossiper.TCPSocket) })
 	}
 
-	go gossiper.receiveGossip()
-	go gossiper.sendRouteRumors()
+	gossiper.spawn(gossiper.sendRouteRumors)
 
 	if !gossiper.Simple {
-		go gossiper.antiEntropy()
+		gossiper.spawn(gossiper.antiEntropy)
+		gossiper.spawn(gossiper.exchangePeers)
 	}
 
 	if gossiper.ClientSocket != nil {
-		go gossiper.receiveClient()
+		gossiper.spawn(gossiper.receiveClient)
 	}
 
-	go gossiper.waitForNewBlocks()
-	go gossiper.BlockChain.mine()
+	gossiper.spawn(gossiper.waitForNewBlocks)
+	gossiper.spawn(func() { gossiper.BlockChain.mine(gossiper.ctx.Done()) })
+
+	gossiper.resumeDownloads()
 
 	if gossiper.Mixer != nil {
-		go gossiper.ReleaseOnions()
+		gossiper.spawn(gossiper.ReleaseOnions)
 	}
+}
+
+// Also accept TCP connections on the gossip address, and send big packets (data replies, onions and
+// blocks) to neighbors over TCP when they accept it. Should be called before Start. Return an error if
+// the TCP port cannot be bound.
+func (gossiper *Gossiper) EnableTCP() error {
 
-	// Allows the loops to run indefinitely after the main code is completed.
-	wg := new(sync.WaitGroup)
-	wg.Add(6)
-	wg.Wait()
+	transport, err := common.NewTCPTransport(gossiper.GossipSocket.LocalAddress())
+	if err != nil {
+		return err
+	}
+
+	gossiper.TCPSocket = transport
+
+	return nil
 }
 
-// Unbind from all ports, stop processes.
-func (gossiper *Gossiper) Stop() {
-	gossiper.ClientSocket.Unbind()
+// Stop all the loops of the gossiper (including rumormongering, mining and downloads), unbind from all
+// ports and wait until every goroutine started by the gossiper has returned, then release files and
+// storage. If ctx is done before that, Stop returns ctx.Err() right away, and files and storage are
+// released in the background once the remaining goroutines return, as they may still be using them.
+//
+// Downloads that are running are stopped without changing their state, so that they resume the next
+// time a gossiper is started with the same dataDir.
+func (gossiper *Gossiper) Stop(ctx context.Context) error {
+
+	gossiper.lifecycleLock.Lock()
+	gossiper.cancel()
+	gossiper.lifecycleLock.Unlock()
+
+	if gossiper.ClientSocket != nil {
+		gossiper.ClientSocket.Unbind()
+	}
+
 	gossiper.GossipSocket.Unbind()
+
+	if gossiper.TCPSocket != nil {
+		gossiper.TCPSocket.Unbind()
+	}
+
+	finished := make(chan struct{})
+
+	go func() {
+		gossiper.routines.Wait()
+		close(finished)
+	}()
+
+	release := func() {
+
+		gossiper.FileSystem.Close()
+		gossiper.Storage.Close()
+
+		if gossiper.Capture != nil {
+			gossiper.Capture.Close()
+		}
+	}
+
+	var err error
+
+	select {
+	case <-finished:
+		release()
+	case <-ctx.Done():
+		err = ctx.Err()
+		go func() {
+			<-finished
+			release()
+		}()
+	}
+
+	gossiper.Events.Close()
+
+	common.DebugStopGossiper()
+
+	return err
+}
+
+// Run a function in a new goroutine that Stop waits for. Once the gossiper is stopped, the function is
+// not run at all.
+func (gossiper *Gossiper) spawn(function func()) {
+
+	gossiper.lifecycleLock.Lock()
+	defer gossiper.lifecycleLock.Unlock()
+
+	if gossiper.ctx.Err() != nil {
+		return
+	}
+
+	gossiper.routines.Add(1)
+
+	go func() {
+		defer gossiper.routines.Done()
+		function()
+	}()
+}
+
+// Wait for a given duration. Return false if the gossiper was stopped in the meantime.
+func (gossiper *Gossiper) sleep(duration time.Duration) bool {
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-gossiper.ctx.Done():
+		return false
+	}
 }
 
 //
 //  EVENT LOOPS
 //
 
-// Main loop for handling gossip packets from other nodes.
-func (gossiper *Gossiper) receiveGossip() {
+// Main loop for handling gossip packets from other nodes on a given transport.
+func (gossiper *Gossiper) receiveGossip(transport common.Transport) {
 	for {
-		bytes, source, alive := gossiper.GossipSocket.Receive()
+		bytes, source, alive := transport.Receive()
 
 		if !alive {
 			break
 		}
 
-        if gossiper.handleReceivedPacket(bytes, source) {
-            continue
-        }
+		if gossiper.Capture != nil {
+			gossiper.Capture.Record(common.CaptureIncoming, source, bytes)
+		}
+
+		gossiper.receivePacket(bytes, source)
+	}
+}
+
+// Handle a packet received from a neighbor, and record that the neighbor is alive if the packet is valid
+func (gossiper *Gossiper) receivePacket(bytes []byte, source string) {
 
-		gossiper.Router.AddPeerIfNeeded(source)
+	if gossiper.handleReceivedPacket(bytes, source) {
+		return
 	}
+
+	gossiper.Router.heardFrom(source)
 }
 
 func (gossiper *Gossiper) handleReceivedPacket(bytes []byte, source string) bool {
@@ -164,10 +358,25 @@ func (gossiper *Gossiper) handleReceivedPacket(bytes []byte, source string) bool
 
     if !packet.IsValid() {
         common.DebugInvalidPacket(&packet)
+        gossiper.Metrics.PacketsReceived.With("invalid").Inc()
         return true
     }
 
-    go gossiper.HandleGossip(&packet, source)
+    gossiper.Metrics.PacketsReceived.With(packet.Type()).Inc()
+
+    // Wait for the other fragments, then handle the original packet
+    if packet.Fragment != nil {
+
+        bytes, complete := gossiper.Fragmenter.Add(source, packet.Fragment)
+
+        if !complete {
+            return false
+        }
+
+        return gossiper.handleReceivedPacket(bytes, source)
+    }
+
+    gossiper.spawn(func() { gossiper.HandleGossip(&packet, source) })
     return false
 }
 
@@ -178,14 +387,14 @@ func (gossiper *Gossiper) receiveClient() {
 	for {
 
 		var command common.Command
-		bytes, _, alive := gossiper.ClientSocket.Receive()
+		bytes, source, alive := gossiper.ClientSocket.Receive()
 
 		if !alive {
 			break
 		}
 
 		protobuf.Decode(bytes, &command)
-		go gossiper.HandleClient(&command)
+		gossiper.spawn(func() { gossiper.answerClient(&command, source) })
 	}
 }
 
@@ -209,19 +418,20 @@ func (gossiper *Gossiper) HandleClient(command *common.Command) error {
 
 		if gossiper.Simple {
 
-			message := common.NewSimpleMessage(gossiper.Name, gossiper.GossipSocket.Address, content)
-			go gossiper.broadcastToNeighbors(message.Packed())
+			message := common.NewSimpleMessage(gossiper.Name, gossiper.GossipSocket.LocalAddress(), content)
+			gossiper.spawn(func() { gossiper.broadcastToNeighbors(message.Packed()) })
 
 		} else {
 
 			rumor := gossiper.GenerateRumor(content)
 
 			gossiper.Rumors.Put(rumor)
+			gossiper.publishRumor(rumor)
 
 			peer, found := gossiper.Router.randomPeer()
 
 			if found {
-				go gossiper.rumormonger(rumor, peer)
+				gossiper.spawn(func() { gossiper.rumormonger(rumor, peer) })
 			}
 		}
 
@@ -233,7 +443,7 @@ func (gossiper *Gossiper) HandleClient(command *common.Command) error {
 		private := common.NewPrivateMessage(gossiper.Name,destination, content)
 
 		destined := gossiper.sendToNode(private.Packed(), destination, nil)
-		gossiper.Messages = append(gossiper.Messages, private)
+		gossiper.storePrivateMessage(private)
 
 		if destined {
 			common.LogPrivate(private)
@@ -245,23 +455,35 @@ func (gossiper *Gossiper) HandleClient(command *common.Command) error {
 		filename := command.Download.FileName
 		hash := command.Download.Hash
 
-		go gossiper.StartDownload(filename, hash, destination, 0)
+		gossiper.StartDownload(filename, hash, destination)
 
-	case command.Upload != nil:
+	case command.ListDownloads != nil:
 
-		metaFile, err := gossiper.FileSystem.ScanFile(command.Upload.FileName)
-		if err != nil { return err }
+		for _, download := range gossiper.Downloads.All() {
+			done, total := download.Progress()
+			common.LogDownload(download.Name, download.MetaHash, download.State().String(), done, total)
+		}
 
-		transaction := gossiper.NewTransaction(metaFile)
+	case command.PauseDownload != nil:
 
-		if gossiper.BlockChain.TryAddFile(transaction) {
-			gossiper.broadcastToNeighbors(transaction.Packed())
-			common.DebugBroadcastTransaction(transaction)
-		}
+		return gossiper.PauseDownload(command.PauseDownload.Hash)
+
+	case command.ResumeDownload != nil:
+
+		return gossiper.ResumeDownload(command.ResumeDownload.Hash)
+
+	case command.CancelDownload != nil:
+
+		return gossiper.CancelDownload(command.CancelDownload.Hash)
+
+	case command.Upload != nil:
+
+		_, err := gossiper.Share(command.Upload.FileName)
+		return err
 
 	case command.Search != nil:
 
-		gossiper.RingSearch(command.Search.Keywords, command.Search.Budget)
+		gossiper.StartSearch(command.Search.Keywords, command.Search.Budget)
 	}
 
 	return nil
@@ -276,7 +498,8 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
 	}
 
 	if gossiper.ShouldAuthenticate() && packet.Signature == nil {
-		fmt.Printf("DROP MESSAGE not signed\n")
+		common.DebugDropUnsigned()
+		gossiper.Metrics.SignatureFailures.With("unsigned").Inc()
 		return
 	}
 
@@ -288,6 +511,7 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
 
 		if !exists {
 			common.DebugDropUnauthenticatedOrigin(packet.Signature)
+			gossiper.Metrics.SignatureFailures.With("unknown_origin").Inc()
 			return
 		}
 
@@ -295,6 +519,7 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
 
 		if !gossiper.Crypto.Verify(hash[:], packet.Signature.Signature, publicKey) {
 			common.DebugDropIncorrectSignature(packet.Signature)
+			gossiper.Metrics.SignatureFailures.With("incorrect").Inc()
 			return
 		}
 	}
@@ -304,9 +529,9 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
 	case packet.Simple != nil:
 
 		common.LogSimpleMessage(packet.Simple)
-		common.LogPeers(gossiper.Router.Peers)
+		common.LogPeers(gossiper.Router.Neighbors())
 
-		go gossiper.broadcastToNeighbors(packet)
+		gossiper.spawn(func() { gossiper.broadcastToNeighbors(packet) })
 
 	case packet.Rumor != nil:
 
@@ -316,18 +541,18 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
 			common.LogRumor(packet.Rumor, source)
 		}
 
-		common.LogPeers(gossiper.Router.Peers)
+		common.LogPeers(gossiper.Router.Neighbors())
 
 		gossiper.handleRumor(packet.Rumor, source)
 
 		statusPacket := gossiper.GenerateStatusPacket()
 		common.DebugSendStatus(statusPacket, source)
-		go gossiper.sendToNeighbor(source, statusPacket.Packed())
+		gossiper.spawn(func() { gossiper.sendToNeighbor(source, statusPacket.Packed()) })
 
 	case packet.Status != nil:
 
 		common.LogStatus(packet.Status, source)
-		common.LogPeers(gossiper.Router.Peers)
+		common.LogPeers(gossiper.Router.Neighbors())
 
 		expected := gossiper.Dispatcher.dispatchStatusPacket(source, packet)
 
@@ -336,7 +561,7 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
 			rumor, _, _ := gossiper.CompareStatus(packet.Status.Want, ComparisonModeMissingOrNew)
 
 			if rumor != nil {
-				go gossiper.rumormonger(*rumor, source)
+				gossiper.spawn(func() { gossiper.rumormonger(*rumor, source) })
 			}
 		}
 
@@ -348,8 +573,9 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
 		destined := gossiper.sendToNode(packet, destination, hopLimit)
 
 		if destined {
-			gossiper.Messages = append(gossiper.Messages, packet.Private)
+			gossiper.storePrivateMessage(packet.Private)
 			common.LogPrivate(packet.Private)
+			gossiper.Events.publish(&Event{PrivateMessage: packet.Private})
 		}
 
 	case packet.DataReply != nil:
@@ -392,6 +618,7 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
 
 		if !gossiper.SpamDetector.shouldProcessSearchRequest(packet.SearchRequest) {
 			common.DebugIgnoreSpam(packet.SearchRequest.Origin, packet.SearchRequest.Keywords)
+			gossiper.Metrics.SearchesDropped.Inc()
 			return
 		}
 
@@ -400,15 +627,16 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
 		}
 
 		common.DebugProcessSearchRequest(packet.SearchRequest.Origin, packet.SearchRequest.Keywords)
+		gossiper.Metrics.SearchesProcessed.Inc()
 
-		go gossiper.forwardSearchRequest(packet.SearchRequest, source)
+		gossiper.spawn(func() { gossiper.forwardSearchRequest(packet.SearchRequest, source) })
 
 		results := gossiper.FileSystem.Search(packet.SearchRequest.Keywords)
 		reply := common.NewSearchReply(gossiper.Name, packet.SearchRequest.Origin, results)
 
 		common.DebugServeSeachReply(reply)
 
-		go gossiper.sendToNode(reply.Packed(), reply.Destination, nil)
+		gossiper.spawn(func() { gossiper.sendToNode(reply.Packed(), reply.Destination, nil) })
 
 	case packet.SearchReply != nil:
 
@@ -418,7 +646,7 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
 		destined := gossiper.sendToNode(packet, destination, hopLimit)
 
 		if destined {
-			go gossiper.SearchEngine.StoreResults(packet.SearchReply.Results, packet.SearchReply.Origin)
+			gossiper.spawn(func() { gossiper.SearchEngine.StoreResults(packet.SearchReply.Results, packet.SearchReply.Origin) })
 		}
 
 	case packet.TxPublish != nil:
@@ -460,7 +688,7 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
             // decypher payload
             signedBytes, err := CTRDecipher(packet.Cyphered.Payload, symmetricKey, packet.Cyphered.IV)
             if err != nil {
-                log.Println(err)
+                common.DebugCryptoError("decryption", err)
                 return
             }
             var signed common.GossipPacket
@@ -482,14 +710,22 @@ func (gossiper *Gossiper) HandleGossip(packet *common.GossipPacket, source strin
 
 			if err != nil {
 				// Drop the packet
+				common.DebugDropOnion(err)
 			} else if gossipPacket != nil {
 				// Process the packet as a normal packet
+				common.DebugDeliverOnion()
 				gossiper.HandleGossip(gossipPacket, source)
 			} else if gossiper.Mixer != nil {
 				// Give it to the mixer logic to store and forward later on
-				gossiper.Mixer.ForwardPacket(packet.Onion)
+				common.DebugMixOnion(packet.Onion.Destination)
+				gossiper.Metrics.OnionsMixed.Inc()
+				gossiper.Mixer.ForwardPacket(packet.Onion, gossiper.ctx.Done())
 			}
 		}
+
+	case packet.PeerExchange != nil:
+
+		gossiper.handlePeerExchange(packet.PeerExchange, source)
 	}
 }
 
@@ -508,24 +744,11 @@ func (gossiper *Gossiper) GenerateStatusPacket() *common.StatusPacket {
 // Generate a data reply to a given request
 func (gossiper *Gossiper) GenerateDataReply(request *common.DataRequest) (*common.DataReply, bool) {
 
-	var data []byte
-
-	metaHash, found := gossiper.FileSystem.getMetaFile(request.HashValue)
-
-	if found {
-
-		data = metaHash.Data
+	data, found := gossiper.FileSystem.getData(request.HashValue)
 
-	} else {
-
-		chunk, found := gossiper.FileSystem.getChunk(request.HashValue)
-
-		if !found {
-			common.DebugHashNotFound(request.HashValue, request.Origin)
-			return nil, false
-		}
-
-		data = chunk.data
+	if !found {
+		common.DebugHashNotFound(request.HashValue, request.Origin)
+		return nil, false
 	}
 
 	return &common.DataReply{
@@ -569,8 +792,13 @@ func (gossiper *Gossiper) GenerateRouteRumor() *common.RumorMessage {
 // Send ready onion packets
 func (gossiper *Gossiper) ReleaseOnions() {
 	for {
-		packet := <- gossiper.Mixer.ToSend
-		gossiper.sendToNode(packet.Packed(), packet.Destination, &packet.HopLimit)
+		select {
+		case packet := <- gossiper.Mixer.ToSend:
+			common.DebugReleaseOnion(packet.Destination)
+			gossiper.sendToNode(packet.Packed(), packet.Destination, &packet.HopLimit)
+		case <-gossiper.ctx.Done():
+			return
+		}
 	}
 }
 
@@ -580,7 +808,7 @@ func (gossiper *Gossiper) ReleaseOnions() {
 func (gossiper *Gossiper) SignPacket(packet *common.GossipPacket) *common.Signature {
 
     if !packet.IsValid() {
-		log.Printf("Sending invalid packet: %v\n", packet)
+		common.DebugSignInvalidPacket(packet)
         return nil
 	}
 
@@ -600,14 +828,14 @@ func (gossiper *Gossiper) CypherPacket(packet *common.GossipPacket, destination
     if exists {
         bytes, err := EncodeBlock(packet, common.CTRKeySize)
         if err != nil {
-            log.Println(err)
+            common.DebugCryptoError("encryption", err)
             return nil
         }
 
         symmetricKey := NewCTRSecret()
         cypheredPayload, iv, err := CTRCipher(bytes, symmetricKey)
         if err != nil {
-            log.Println(err)
+            common.DebugCryptoError("encryption", err)
             return nil
         }
 
@@ -0,0 +1,405 @@
+package gossiper
+
+import (
+	"encoding/hex"
+	"github.com/jfperren/Peerster/common"
+	"sync"
+)
+
+// The DownloadManager keeps track of all the downloads of a node, running or not, so that they can
+// be listed, paused, resumed and cancelled.
+//
+// Every change of state is persisted in the Storage of the node. As chunks are kept in the ChunkStore,
+// a download that was running when the node stopped resumes where it left off on the next Start.
+type DownloadManager struct {
+	downloads map[string]*Download
+	order     []string // Metahashes of the downloads, in the order they were started
+	lock      *sync.RWMutex
+	storage   Storage
+}
+
+// The part of a Download that is persisted.
+type DownloadRecord struct {
+	Name     string
+	MetaHash []byte
+	Seeder   string
+	State    int
+}
+
+const DownloadNotFound = 1
+const DownloadNotRunning = 2
+const DownloadNotPaused = 3
+const DownloadFinished = 4
+
+// Errors thrown when controlling downloads
+type DownloadError struct {
+	metaHash []byte
+	flag     int
+}
+
+func (e *DownloadError) Error() string {
+
+	hash := hex.EncodeToString(e.metaHash)
+
+	switch e.flag {
+	case DownloadNotFound:
+		return "No download for hash: " + hash
+	case DownloadNotRunning:
+		return "Download is not running: " + hash
+	case DownloadNotPaused:
+		return "Download is neither paused nor failed: " + hash
+	case DownloadFinished:
+		return "Download is already completed: " + hash
+	default:
+		return "Unexpected error"
+	}
+}
+
+func NewDownloadManager() *DownloadManager {
+	return &DownloadManager{
+		downloads: make(map[string]*Download),
+		order:     make([]string, 0),
+		lock:      &sync.RWMutex{},
+		storage:   &NullStorage{},
+	}
+}
+
+// Return the download of the file with a given metahash
+func (dm *DownloadManager) Get(metaHash []byte) (*Download, bool) {
+
+	dm.lock.RLock()
+	defer dm.lock.RUnlock()
+
+	download, found := dm.downloads[hex.EncodeToString(metaHash)]
+	return download, found
+}
+
+// Return all downloads, in the order in which they were started
+func (dm *DownloadManager) All() []*Download {
+
+	dm.lock.RLock()
+	defer dm.lock.RUnlock()
+
+	downloads := make([]*Download, 0, len(dm.order))
+
+	for _, key := range dm.order {
+		downloads = append(downloads, dm.downloads[key])
+	}
+
+	return downloads
+}
+
+// Track a download, replacing any previous download of the same file.
+func (dm *DownloadManager) add(download *Download) {
+
+	key := hex.EncodeToString(download.MetaHash)
+
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	if _, found := dm.downloads[key]; !found {
+		dm.order = append(dm.order, key)
+	}
+
+	dm.downloads[key] = download
+}
+
+// Track a download unless the same file is already being downloaded, in which case the running download
+// is returned instead. The check and the replacement happen under the same lock, so that two downloads of
+// a file never run at the same time.
+func (dm *DownloadManager) addUnlessRunning(download *Download) (*Download, bool) {
+
+	key := hex.EncodeToString(download.MetaHash)
+
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	existing, found := dm.downloads[key]
+
+	if found && existing.State() == DownloadRunning {
+		return existing, true
+	}
+
+	if !found {
+		dm.order = append(dm.order, key)
+	}
+
+	dm.downloads[key] = download
+
+	return nil, false
+}
+
+// Stop tracking a download
+func (dm *DownloadManager) remove(download *Download) {
+
+	key := hex.EncodeToString(download.MetaHash)
+
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	if dm.downloads[key] != download {
+		return
+	}
+
+	delete(dm.downloads, key)
+
+	for i, other := range dm.order {
+		if other == key {
+			dm.order = append(dm.order[:i], dm.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Persist the current state of a download
+func (dm *DownloadManager) save(download *Download) {
+	dm.storage.StoreDownload(download.record())
+}
+
+func (download *Download) record() *DownloadRecord {
+
+	download.lock.RLock()
+	defer download.lock.RUnlock()
+
+	return &DownloadRecord{download.Name, download.MetaHash, download.Seeder, int(download.state)}
+}
+
+//
+//  GOSSIPER METHODS
+//
+
+// Start a new download in the background. If the file is already being downloaded, the running download
+// is returned instead.
+//
+//  - name: Name of the file as it will appear in the file system later on
+//  - metaHash: Hash of the requested file
+//  - peer: Name of the peer from which we want to download the file, or "" to use the results of previous searches
+//
+func (gossiper *Gossiper) StartDownload(name string, metaHash []byte, peer string) *Download {
+
+	download := NewDownload(name, metaHash, peer, gossiper.DownloadWindow)
+
+	// Running from the start, so that concurrent calls see it as such until it is launched
+	download.state = DownloadRunning
+
+	if running, found := gossiper.Downloads.addUnlessRunning(download); found {
+		common.DebugDownloadAlreadyRunning(name, metaHash)
+		return running
+	}
+
+	gossiper.launchDownload(download, DownloadRunning)
+
+	return download
+}
+
+// Pause a running download. Chunks downloaded so far are kept.
+func (gossiper *Gossiper) PauseDownload(metaHash []byte) error {
+
+	download, found := gossiper.Downloads.Get(metaHash)
+
+	if !found {
+		return &DownloadError{metaHash, DownloadNotFound}
+	}
+
+	download.lock.Lock()
+
+	if download.state != DownloadRunning {
+		download.lock.Unlock()
+		return &DownloadError{metaHash, DownloadNotRunning}
+	}
+
+	download.state = DownloadPaused
+
+	if download.stop != nil {
+		close(download.stop)
+		download.stop = nil
+	}
+
+	download.lock.Unlock()
+
+	gossiper.Downloads.save(download)
+	gossiper.publishProgress(download)
+	common.DebugDownloadPaused(download.Name, metaHash)
+
+	return nil
+}
+
+// Resume a download that was paused or that failed.
+func (gossiper *Gossiper) ResumeDownload(metaHash []byte) error {
+
+	download, found := gossiper.Downloads.Get(metaHash)
+
+	if !found {
+		return &DownloadError{metaHash, DownloadNotFound}
+	}
+
+	if !gossiper.launchDownload(download, DownloadPaused, DownloadFailed) {
+		return &DownloadError{metaHash, DownloadNotPaused}
+	}
+
+	common.DebugDownloadResumed(download.Name, metaHash)
+
+	return nil
+}
+
+// Cancel a download that is not completed yet and delete the chunks downloaded so far.
+func (gossiper *Gossiper) CancelDownload(metaHash []byte) error {
+
+	download, found := gossiper.Downloads.Get(metaHash)
+
+	if !found {
+		return &DownloadError{metaHash, DownloadNotFound}
+	}
+
+	download.lock.Lock()
+
+	if download.state == DownloadCompleted {
+		download.lock.Unlock()
+		return &DownloadError{metaHash, DownloadFinished}
+	}
+
+	download.state = DownloadCancelled
+	running := download.stop != nil
+
+	if running {
+		close(download.stop)
+		download.stop = nil
+	}
+
+	download.lock.Unlock()
+
+	gossiper.Downloads.save(download)
+	gossiper.Downloads.remove(download)
+	gossiper.publishProgress(download)
+
+	// A running download discards its chunks itself once it has stopped
+	if !running {
+		gossiper.FileSystem.discardFile(metaHash)
+	}
+
+	common.DebugDownloadCancelled(download.Name, metaHash)
+
+	return nil
+}
+
+// Launch all the downloads that were running when the node stopped.
+func (gossiper *Gossiper) resumeDownloads() {
+
+	for _, download := range gossiper.Downloads.All() {
+
+		download.lock.Lock()
+		idle := download.state == DownloadRunning && download.stop == nil
+		if idle {
+			download.Window = gossiper.DownloadWindow
+		}
+		download.lock.Unlock()
+
+		if idle {
+			gossiper.launchDownload(download, DownloadRunning)
+		}
+	}
+}
+
+// Track a download that was persisted in a previous run. It is only launched by resumeDownloads.
+func (gossiper *Gossiper) restoreDownload(record *DownloadRecord) {
+
+	if DownloadState(record.State) == DownloadCancelled {
+		gossiper.FileSystem.discardFile(record.MetaHash)
+		return
+	}
+
+	download := NewDownload(record.Name, record.MetaHash, record.Seeder, gossiper.DownloadWindow)
+	download.state = DownloadState(record.State)
+
+	gossiper.updateProgress(download)
+	gossiper.Downloads.add(download)
+}
+
+// Mark a download that is in one of the given states as running and run it in the background. The state
+// is checked and changed under the same lock, so that a download is never launched twice. Return false
+// if the download is in another state or if it is already running.
+func (gossiper *Gossiper) launchDownload(download *Download, states ...DownloadState) bool {
+
+	download.lock.Lock()
+
+	launchable := false
+
+	for _, state := range states {
+		launchable = launchable || download.state == state
+	}
+
+	if !launchable || (download.state == DownloadRunning && download.stop != nil) {
+		download.lock.Unlock()
+		return false
+	}
+
+	// Make sure that a previous run stops, should it still be there
+	if download.stop != nil {
+		close(download.stop)
+	}
+
+	stop := make(chan struct{})
+
+	download.state = DownloadRunning
+	download.stop = stop
+	download.lock.Unlock()
+
+	gossiper.Downloads.save(download)
+	gossiper.publishProgress(download)
+
+	gossiper.spawn(func() { gossiper.download(download, stop) })
+
+	return true
+}
+
+// Run a download until it completes, fails or is stopped, then record its outcome.
+func (gossiper *Gossiper) download(download *Download, stop chan struct{}) {
+
+	common.DebugStartDownload(download.Name, download.MetaHash, download.Seeder)
+
+	completed := gossiper.runDownload(download, stop)
+
+	// The gossiper is stopping, keep the download running so that it resumes on the next start
+	if !completed && gossiper.ctx.Err() != nil {
+		return
+	}
+
+	download.lock.Lock()
+
+	if download.state == DownloadCancelled {
+
+		download.lock.Unlock()
+
+		// Unless the same file is being downloaded again in the meantime
+		if _, found := gossiper.Downloads.Get(download.MetaHash); !found {
+			gossiper.FileSystem.discardFile(download.MetaHash)
+		}
+
+		return
+	}
+
+	// Paused, possibly resumed since then by another run
+	if download.stop != stop {
+		download.lock.Unlock()
+		return
+	}
+
+	download.stop = nil
+
+	if completed {
+		download.state = DownloadCompleted
+	} else {
+		download.state = DownloadFailed
+	}
+
+	download.lock.Unlock()
+
+	gossiper.Downloads.save(download)
+	gossiper.publishProgress(download)
+
+	if completed {
+		common.DebugDownloadCompleted(download.Name, download.MetaHash, download.Seeder)
+	} else {
+		common.DebugDownloadTimeout(download.Name, download.MetaHash, download.Seeder)
+	}
+}
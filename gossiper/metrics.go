@@ -0,0 +1,87 @@
+package gossiper
+
+import (
+	"github.com/jfperren/Peerster/common"
+	"io"
+)
+
+// Metrics of a gossiper, served by the web server in the text format of Prometheus. Counters start at 0
+// when the gossiper is created, they are not persisted.
+type Metrics struct {
+	registry *common.MetricRegistry
+
+	PacketsReceived   *common.CounterVec // By GossipPacket type, "invalid" for packets that could not be decoded
+	PacketsSent       *common.CounterVec // By GossipPacket type, once wrapped in cyphered or onion packets
+	MongeringRounds   *common.Counter    // Rumors sent to a peer before waiting for its status
+	CoinFlips         *common.CounterVec // By outcome, "continue" or "stop"
+	AntiEntropy       *common.Counter    // Status packets sent to a random peer by anti-entropy
+	ChunkLatency      *common.Histogram  // Time between a data request and its valid reply, in seconds
+	ChunkRetries      *common.Counter    // Data requests sent again after a timeout or a corrupted reply
+	SearchesProcessed *common.Counter    // Search requests of other nodes that were processed
+	SearchesDropped   *common.Counter    // Search requests dropped by the SpamDetector
+	BlocksMined       *common.Counter
+	Forks             *common.Counter    // Blocks stored on a fork shorter than the longest chain
+	Rewinds           *common.Counter    // Switches of the longest chain to another branch
+	RewoundBlocks     *common.Counter    // Blocks removed from the longest chain by rewinds
+	SignatureFailures *common.CounterVec // By reason, e.g. "incorrect" or "unsigned"
+	OnionsMixed       *common.Counter    // Onion packets stored by the mixer to be forwarded later
+	PeersEvicted      *common.Counter    // Peers removed from the neighbors because they stopped answering
+}
+
+func NewMetrics() *Metrics {
+
+	registry := common.NewMetricRegistry()
+
+	return &Metrics{
+		registry: registry,
+
+		PacketsReceived: registry.CounterVec("packets_received_total", "Packets received from other nodes, by type", "type"),
+		PacketsSent:     registry.CounterVec("packets_sent_total", "Packets sent to neighbors, by type", "type"),
+		MongeringRounds: registry.Counter("rumormongering_rounds_total", "Rumors sent to a peer before waiting for its status"),
+		CoinFlips:       registry.CounterVec("coin_flips_total", "Coin flips at the end of rumormongering, by outcome", "outcome"),
+		AntiEntropy:     registry.Counter("anti_entropy_total", "Status packets sent by anti-entropy"),
+		ChunkLatency: registry.Histogram("download_chunk_latency_seconds", "Time between a data request and its reply",
+			common.LatencyBuckets),
+		ChunkRetries:      registry.Counter("download_chunk_retries_total", "Data requests sent again after a failure"),
+		SearchesProcessed: registry.Counter("search_requests_processed_total", "Search requests of other nodes processed"),
+		SearchesDropped:   registry.Counter("search_requests_dropped_total", "Search requests dropped as spam"),
+		BlocksMined:       registry.Counter("blocks_mined_total", "Blocks mined by the node"),
+		Forks:             registry.Counter("chain_forks_total", "Blocks stored on a fork shorter than the longest chain"),
+		Rewinds:           registry.Counter("chain_rewinds_total", "Switches of the longest chain to another branch"),
+		RewoundBlocks:     registry.Counter("chain_rewound_blocks_total", "Blocks removed from the longest chain by rewinds"),
+		SignatureFailures: registry.CounterVec("signature_failures_total", "Packets dropped because of their signature, by reason", "reason"),
+		OnionsMixed:       registry.Counter("onion_packets_mixed_total", "Onion packets stored by the mixer to be forwarded"),
+		PeersEvicted:      registry.Counter("peers_evicted_total", "Peers evicted because they stopped answering"),
+	}
+}
+
+// Add gauges that read the current state of a gossiper
+func (metrics *Metrics) observe(gossiper *Gossiper) {
+
+	metrics.registry.GaugeFunc("peers", "Number of neighbors", func() float64 {
+		gossiper.Router.Mutex.RLock()
+		defer gossiper.Router.Mutex.RUnlock()
+		return float64(len(gossiper.Router.Peers))
+	})
+
+	metrics.registry.GaugeFunc("passive_peers", "Number of known peers that are not neighbors, but may replace one", func() float64 {
+		return float64(gossiper.Router.passiveCount())
+	})
+
+	metrics.registry.GaugeFunc("routes", "Number of entries of the routing table", func() float64 {
+		gossiper.Router.Mutex.RLock()
+		defer gossiper.Router.Mutex.RUnlock()
+		return float64(len(gossiper.Router.NextHop))
+	})
+
+	metrics.registry.GaugeFunc("chain_length", "Number of blocks of the longest chain", func() float64 {
+		gossiper.BlockChain.lock.RLock()
+		defer gossiper.BlockChain.lock.RUnlock()
+		return float64(gossiper.BlockChain.Length[gossiper.BlockChain.Latest])
+	})
+}
+
+// Write the metrics in the text format of Prometheus
+func (metrics *Metrics) WriteText(writer io.Writer) {
+	metrics.registry.WriteText(writer)
+}
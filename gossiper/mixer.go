@@ -2,44 +2,49 @@ package gossiper
 
 import (
 	"github.com/jfperren/Peerster/common"
-	"math/rand"
 	"sync"
 	"time"
 )
 
 type Mixer struct {
 	ToSend chan *common.OnionPacket
-	buffer [common.MixerNodeBufferSize]*common.OnionPacket // buffer to contain packets, and send them when the buffer is filled
-	bufferSize uint
+	buffer []*common.OnionPacket // buffer to contain packets, and send them when the buffer is filled
+	bufferSize int
 
 	lock sync.RWMutex
 }
 
 func NewMixer() *Mixer {
 	var m Mixer
+	m.buffer = make([]*common.OnionPacket, common.MixerNodeBufferSize)
 	m.bufferSize = 0
 	m.ToSend = make(chan *common.OnionPacket)
 	return &m
 }
 
-func (m *Mixer) ForwardPacket(p *common.OnionPacket) {
+// Buffer a packet, and release all buffered packets once the buffer is full. Packets are dropped if
+// done is closed before they can be released.
+func (m *Mixer) ForwardPacket(p *common.OnionPacket, done <-chan struct{}) {
 	m.lock.Lock()
 	m.buffer[m.bufferSize] = p
 	m.bufferSize++
 	if m.bufferSize == common.MixerNodeBufferSize {
 		m.lock.Unlock()
-		m.ReleasePackets()
+		m.ReleasePackets(done)
 	} else {
 		m.lock.Unlock()
 	}
 }
 
-func (m *Mixer) ReleasePackets() {
+func (m *Mixer) ReleasePackets(done <-chan struct{}) {
 	m.lock.Lock()
-	var randomDuration = time.Duration(rand.Intn(common.MixerRandomTimeSleepRange)) * time.Millisecond
+	var randomDuration = time.Duration(common.Random.Intn(common.MixerRandomTimeSleepRange)) * time.Millisecond
 	time.Sleep(randomDuration)
 	for _, packet := range m.buffer {
-		m.ToSend <- packet
+		select {
+		case m.ToSend <- packet:
+		case <-done:
+		}
 	}
 	m.bufferSize = 0
 	m.lock.Unlock()
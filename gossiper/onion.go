@@ -6,7 +6,6 @@ import (
     "crypto/rsa"
     "errors"
     "github.com/jfperren/Peerster/common"
-    mrand "math/rand"
 )
 
 
@@ -280,7 +279,7 @@ func (gossiper *Gossiper) randomMixerNodeExcept(except string) string {
 
     for {
 
-        index := mrand.Intn(len(gossiper.BlockChain.Peers))
+        index := common.Random.Intn(len(gossiper.BlockChain.Peers))
         i := 0
 
         for node, _ := range gossiper.BlockChain.Peers {
@@ -0,0 +1,246 @@
+package gossiper
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dedis/protobuf"
+	"github.com/jfperren/Peerster/common"
+	"sort"
+	"sync"
+)
+
+// Responses to the latest commands of the clients. A client that does not get a response sends its command
+// again with the same ID: thanks to the cache, the command is answered again instead of being executed twice.
+type ResponseCache struct {
+	responses map[string]*common.Response // By source and ID of the command, nil while it is executed
+	order     []string                    // Keys of responses, from the oldest to the latest
+	lock      *sync.Mutex
+}
+
+func NewResponseCache() *ResponseCache {
+	return &ResponseCache{
+		responses: make(map[string]*common.Response),
+		order:     make([]string, 0),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Register a command that is about to be executed. If it was already registered, return false along with
+// its response, which is nil if the command is still being executed.
+func (cache *ResponseCache) begin(key string) (*common.Response, bool) {
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if response, found := cache.responses[key]; found {
+		return response, false
+	}
+
+	cache.responses[key] = nil
+	cache.order = append(cache.order, key)
+
+	if len(cache.order) > common.ClientResponseCacheSize {
+		delete(cache.responses, cache.order[0])
+		cache.order = cache.order[1:]
+	}
+
+	return nil, true
+}
+
+// Store the response to a command registered with begin
+func (cache *ResponseCache) end(key string, response *common.Response) {
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if _, found := cache.responses[key]; found {
+		cache.responses[key] = response
+	}
+}
+
+// Error sent instead of a response that does not fit in a datagram
+var ErrResponseTooBig = errors.New("response does not fit in a datagram")
+
+//
+//  GOSSIPER FUNCTIONS
+//
+
+// Execute a command received on the client socket and send the response back to its source. Commands with
+// an ID that change the node are only executed once, see ResponseCache. Queries are simply executed again.
+func (gossiper *Gossiper) answerClient(command *common.Command, source string) {
+
+	if command.ID == common.NoRequestID || command.IsQuery() {
+		gossiper.replyToClient(gossiper.Respond(command), source)
+		return
+	}
+
+	key := fmt.Sprintf("%v/%v", source, command.ID)
+
+	if response, first := gossiper.ClientResponses.begin(key); !first {
+		if response != nil {
+			gossiper.replyToClient(response, source)
+		}
+		return
+	}
+
+	response := gossiper.Respond(command)
+	gossiper.ClientResponses.end(key, response)
+	gossiper.replyToClient(response, source)
+}
+
+// Execute a command from the client and build the response to send back. Commands that have a result are
+// executed here, the others by HandleClient.
+func (gossiper *Gossiper) Respond(command *common.Command) *common.Response {
+
+	if command == nil {
+		return common.NewErrorResponse(common.NoRequestID, common.ErrorBadRequest, common.InvalidCommandError())
+	}
+
+	if !command.IsValid() {
+		return common.NewErrorResponse(command.ID, common.ErrorBadRequest, common.InvalidCommandError())
+	}
+
+	response := &common.Response{ID: command.ID}
+
+	switch {
+
+	case command.Upload != nil:
+
+		metaFile, err := gossiper.Share(command.Upload.FileName)
+		if err != nil {
+			return common.NewErrorResponse(command.ID, errorCode(err), err)
+		}
+
+		response.MetaHash = metaFile.Hash
+
+	case command.Download != nil:
+
+		download := gossiper.StartDownload(command.Download.FileName, command.Download.Hash, command.Download.Destination)
+		response.Downloads = []*common.DownloadInfo{downloadInfo(download)}
+
+	case command.Search != nil:
+
+		response.SearchID = gossiper.StartSearch(command.Search.Keywords, command.Search.Budget)
+
+	case command.ListDownloads != nil:
+
+		for _, download := range gossiper.Downloads.All() {
+			response.Downloads = append(response.Downloads, downloadInfo(download))
+		}
+
+	case command.ListPeers != nil:
+
+		response.Peers = gossiper.Router.Neighbors()
+
+	case command.ListRoutes != nil:
+
+		gossiper.Router.Mutex.RLock()
+
+		for origin, address := range gossiper.Router.NextHop {
+			response.Routes = append(response.Routes, &common.Route{origin, address})
+		}
+
+		gossiper.Router.Mutex.RUnlock()
+
+		sort.Slice(response.Routes, func(i, j int) bool { return response.Routes[i].Origin < response.Routes[j].Origin })
+
+	case command.ListBlocks != nil:
+
+		blocks := gossiper.BlockChain.LongestChain()
+
+		if len(blocks) > common.ResponseMaxBlocks {
+			blocks = blocks[len(blocks)-common.ResponseMaxBlocks:]
+		}
+
+		for _, block := range blocks {
+			response.Blocks = append(response.Blocks, common.NewBlockInfo(block))
+		}
+
+	case command.ListMatches != nil:
+
+		se := gossiper.SearchEngine
+
+		se.lock.RLock()
+
+		for _, result := range se.results {
+			if len(command.ListMatches.Keywords) == 0 || Match(result.FileName, command.ListMatches.Keywords) {
+				response.Matches = append(response.Matches, result)
+			}
+		}
+
+		se.lock.RUnlock()
+
+	case command.ListFiles != nil:
+
+		for _, metaFile := range gossiper.FileSystem.allMetaFiles() {
+			response.Files = append(response.Files, common.File{metaFile.Name, int64(metaFile.Size), metaFile.Hash})
+		}
+
+	case command.Status != nil:
+
+		response.Name = gossiper.Name
+		response.Status = gossiper.GenerateStatusPacket().Want
+
+	default:
+
+		if err := gossiper.HandleClient(command); err != nil {
+			return common.NewErrorResponse(command.ID, errorCode(err), err)
+		}
+	}
+
+	return response
+}
+
+// Send a response to the address a command came from
+func (gossiper *Gossiper) replyToClient(response *common.Response, address string) {
+
+	bytes, err := protobuf.Encode(response)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(bytes) > common.SocketBufferSize {
+		bytes, _ = protobuf.Encode(common.NewErrorResponse(response.ID, common.ErrorTooBig, ErrResponseTooBig))
+	}
+
+	if err := gossiper.ClientSocket.Send(bytes, address); err != nil {
+		common.DebugSendError(address, err)
+	}
+}
+
+// Classify an error returned by the gossiper
+func errorCode(err error) string {
+
+	switch e := err.(type) {
+
+	case *common.CommandError:
+		return common.ErrorBadRequest
+
+	case *DownloadError:
+		if e.flag == DownloadNotFound {
+			return common.ErrorNotFound
+		}
+		return common.ErrorConflict
+
+	case *FileSystemError:
+		if e.flag == FileNotFound {
+			return common.ErrorNotFound
+		}
+	}
+
+	return common.ErrorInternal
+}
+
+func downloadInfo(download *Download) *common.DownloadInfo {
+
+	done, total := download.Progress()
+
+	return &common.DownloadInfo{
+		Name:     download.Name,
+		MetaHash: download.MetaHash,
+		State:    download.State().String(),
+		Done:     uint32(done),
+		Total:    uint32(total),
+		Seeders:  download.Seeders(),
+	}
+}
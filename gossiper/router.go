@@ -4,7 +4,8 @@ import (
 	"github.com/dedis/protobuf"
 	"github.com/jfperren/Peerster/common"
 	"log"
-	"math/rand"
+	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -12,61 +13,155 @@ import (
 
 // A Router is responsible for handling the neighbors (Peers) for gossip communication as well
 // as a DSDV table (NextHop) for the more complex routing of private messages and downloads.
+//
+// The Router also tracks the liveness of each neighbor. A neighbor that does not answer several rumors in
+// a row is suspected, and a suspected neighbor that stays silent is evicted from Peers. Evicted neighbors
+// are admitted again as soon as a packet is received from them.
+//
+// Membership follows HyParView: Peers is a small active view of at most common.MaxPeers neighbors, which
+// rumors, broadcasts and searches are sent to. Other known peers are kept in a larger passive view of at
+// most common.PassiveViewSize peers, from which random peers are promoted when neighbors are evicted.
+// Peers learned through peer exchanges only enter the passive view, and a passive peer is only promoted
+// once it was heard from, so that a neighbor cannot fill the active view with addresses of its choice.
+// Unlike HyParView, the views are not kept symmetric: a peer may have us in its active view while we only
+// have it in our passive view. We still answer its packets, so rumors keep flowing both ways.
 type Router struct {
 	NextHop map[string]string // Routing Table
-	Peers   []string          // List of known peer IP addresses
+	Peers   []string          // Active view: IP addresses of the neighbors, without passive or evicted peers. Read with Neighbors()
 	Rtimer  time.Duration     // Interval for sending route rumors
     Mutex    *sync.RWMutex     // Read-write lock to access the routing table
+
+	health      map[string]*PeerHealth // Liveness of every peer, passive and evicted ones included
+	tcpFailures map[string]time.Time // Last time a TCP connection to a peer failed
+	events      *EventBus            // Publishes changes of the routing table
+	metrics     *Metrics
+}
+
+// Liveness of a neighbor
+type PeerHealth struct {
+	Address   string
+	State     PeerState
+	Since     time.Time     // When the peer entered its state
+	LastHeard time.Time     // Time of the last packet received from the peer, zero if none was
+	Timeouts  int           // Rumors in a row that the peer did not acknowledge, while sending nothing else either
+	RTT       time.Duration // Smoothed time between a rumor and the status that acknowledges it, 0 until measured
+}
+
+type PeerState int
+
+const (
+	PeerAlive     PeerState = iota // The peer answers, or was not given a chance to fail yet
+	PeerSuspected                  // The peer did not answer the last common.PeerSuspectTimeouts rumors
+	PeerEvicted                    // The peer was suspected for common.PeerEvictTime and is no longer in Peers
+	PeerPassive                    // The peer is known but not in Peers, and may replace an evicted neighbor
+)
+
+func (state PeerState) String() string {
+	switch state {
+	case PeerAlive:
+		return "alive"
+	case PeerSuspected:
+		return "suspected"
+	case PeerEvicted:
+		return "evicted"
+	case PeerPassive:
+		return "passive"
+	default:
+		return "unknown"
+	}
 }
 
 func NewRouter(peers string, rtimer time.Duration) *Router {
 
-	return &Router{
+	router := &Router{
 		NextHop: make(map[string]string),
-		Peers:   strings.Split(peers, ","),
+		Peers:   make([]string, 0),
 		Rtimer:  rtimer,
 		Mutex: &sync.RWMutex{},
+		health:      make(map[string]*PeerHealth),
+		tcpFailures: make(map[string]time.Time),
 	}
-}
 
-// Add a new peer IP address to the list of known peers
-func (router *Router) AddPeerIfNeeded(peer string) {
+	for _, peer := range strings.Split(peers, ",") {
 
-	if !common.Contains(router.Peers, peer) {
-		router.Peers = append(router.Peers, peer)
+		if _, known := router.health[peer]; peer == "" || known {
+			continue
+		}
+
+		health := &PeerHealth{Address: peer, State: PeerAlive, Since: time.Now()}
+		router.health[peer] = health
+
+		if len(router.Peers) < common.MaxPeers {
+			router.Peers = append(router.Peers, peer)
+		} else {
+			router.makePassive(health)
+		}
 	}
+
+	return router
 }
 
+// Add a new peer IP address to the active view, or admit a passive or evicted peer again. If the active view
+// is full, a random neighbor is moved to the passive view to make room.
+func (router *Router) AddPeerIfNeeded(peer string) {
+	router.admit(peer, false)
+}
+
+// Random peer to send a rumor to, among those that are not suspected if there are any
 func (router *Router) randomPeer() (string, bool) {
+	return router.pickPeer("", false)
+}
 
-	if len(router.Peers) == 0 {
-		return "", false
-	}
+// Random peer other than the given one, among those that are not suspected if there are any
+func (router *Router) randomPeerExcept(peer string) (string, bool) {
+	return router.pickPeer(peer, false)
+}
 
-	return router.Peers[rand.Int()%len(router.Peers)], true
+// Random peer, suspected or not
+func (router *Router) randomPeerOrSuspect() (string, bool) {
+	return router.pickPeer("", true)
 }
 
-func (router *Router) randomPeerExcept(peer string) (string, bool) {
+func (router *Router) pickPeer(except string, suspects bool) (string, bool) {
 
-	if len(router.Peers) == 0 {
-		return "", false
-	}
+	router.Mutex.RLock()
+	defer router.Mutex.RUnlock()
 
-	if len(router.Peers) == 1 && router.Peers[0] == peer {
-		return "", false
-	}
+	candidates := make([]string, 0, len(router.Peers))
+	suspected := make([]string, 0)
 
-	for {
-		potentialPeer, found := router.randomPeer()
+	for _, peer := range router.Peers {
 
-		if !found {
-			return potentialPeer, found
+		if peer == except {
+			continue
 		}
 
-		if potentialPeer != peer {
-			return potentialPeer, true
+		if health, found := router.health[peer]; found && health.State == PeerSuspected && !suspects {
+			suspected = append(suspected, peer)
+		} else {
+			candidates = append(candidates, peer)
 		}
 	}
+
+	if len(candidates) == 0 {
+		candidates = suspected
+	}
+
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	return candidates[common.Random.Int()%len(candidates)], true
+}
+
+// Copy of Peers. Peers changes while the gossiper runs, so it should only be read through this method or
+// with Mutex held.
+func (router *Router) Neighbors() []string {
+
+	router.Mutex.RLock()
+	defer router.Mutex.RUnlock()
+
+	return append([]string{}, router.Peers...)
 }
 
 func (router *Router) updateRoutingTable(origin, address string) {
@@ -81,7 +176,456 @@ func (router *Router) updateRoutingTable(origin, address string) {
 		router.NextHop[origin] = address
         router.Mutex.Unlock()
 		common.LogUpdateRoutingTable(origin, address)
+		router.events.publish(&Event{Route: &RouteUpdate{origin, address}})
+	}
+}
+
+// Remember that a peer could not be reached over TCP
+func (router *Router) markTCPFailure(peer string) {
+	router.Mutex.Lock()
+	router.tcpFailures[peer] = time.Now()
+	router.Mutex.Unlock()
+}
+
+// Check if a peer should be tried over TCP, i.e. it did not fail to accept a connection recently.
+func (router *Router) acceptsTCP(peer string) bool {
+
+	router.Mutex.RLock()
+	defer router.Mutex.RUnlock()
+
+	failure, found := router.tcpFailures[peer]
+	return !found || time.Since(failure) > common.TCPRetryDelay
+}
+
+//
+//  LIVENESS
+//
+
+// Record that a packet was received from a peer. The peer is added to Peers if it was not known, passive or
+// evicted and the active view has room, and to the passive view otherwise.
+func (router *Router) heardFrom(peer string) {
+	router.admit(peer, true)
+}
+
+func (router *Router) admit(peer string, heard bool) {
+
+	router.Mutex.Lock()
+
+	changes := make([]*PeerStateChange, 0)
+	health, found := router.health[peer]
+
+	if !found {
+		health = &PeerHealth{Address: peer, State: PeerAlive, Since: time.Now()}
+		router.health[peer] = health
+	}
+
+	if heard {
+		health.LastHeard = time.Now()
+	}
+
+	previous := health.State
+	active := common.Contains(router.Peers, peer)
+	added := false
+
+	switch {
+
+	case active && heard:
+		health.Timeouts = 0
+		health.State = PeerAlive
+
+	case !active && (!heard || len(router.Peers) < common.MaxPeers):
+
+		// Peers added by hand always make it to the active view
+		if len(router.Peers) >= common.MaxPeers {
+			if demoted, found := router.demoteRandomPeer(); found {
+				changes = append(changes, &PeerStateChange{demoted, PeerPassive})
+			}
+		}
+
+		health.Timeouts = 0
+		health.State = PeerAlive
+		router.Peers = append(router.Peers, peer)
+		added = true
+
+	case !active && previous != PeerPassive:
+		router.makePassive(health)
+	}
+
+	if health.State != previous {
+		health.Since = time.Now()
+	}
+
+	if found && health.State != previous {
+		changes = append(changes, &PeerStateChange{peer, health.State})
+	}
+
+	router.Mutex.Unlock()
+
+	if added {
+		router.events.publish(&Event{Peer: &NewPeer{peer}})
+	}
+
+	router.publishStateChanges(changes)
+}
+
+// Record that a peer did not acknowledge a rumor sent at a given time, and suspect it after
+// common.PeerSuspectTimeouts timeouts in a row. Timeouts of peers heard from since then are ignored: the
+// acknowledgement may have been lost, or taken by another rumor sent to the same peer.
+func (router *Router) timedOut(peer string, sent time.Time) {
+
+	router.Mutex.Lock()
+
+	health, found := router.health[peer]
+
+	if !found || health.State == PeerEvicted || health.LastHeard.After(sent) {
+		router.Mutex.Unlock()
+		return
+	}
+
+	health.Timeouts++
+	suspected := health.State == PeerAlive && health.Timeouts >= common.PeerSuspectTimeouts
+
+	if suspected {
+		health.State = PeerSuspected
+		health.Since = time.Now()
+	}
+
+	router.Mutex.Unlock()
+
+	if suspected {
+		common.DebugPeerState(peer, PeerSuspected.String())
+		router.events.publish(&Event{PeerState: &PeerStateChange{peer, PeerSuspected}})
+	}
+}
+
+// Record the time a peer took to acknowledge a rumor
+func (router *Router) measuredRTT(peer string, rtt time.Duration) {
+
+	router.Mutex.Lock()
+	defer router.Mutex.Unlock()
+
+	health, found := router.health[peer]
+
+	if !found {
+		return
+	}
+
+	// Same smoothing as the round-trip time of TCP
+	if health.RTT == 0 {
+		health.RTT = rtt
+	} else {
+		health.RTT = (7*health.RTT + rtt) / 8
+	}
+}
+
+// Remove from Peers the peers that were suspected for more than common.PeerEvictTime without being heard from
+func (router *Router) evictSilentPeers() {
+
+	router.Mutex.Lock()
+
+	evicted := make([]string, 0)
+	peers := make([]string, 0, len(router.Peers))
+
+	for _, peer := range router.Peers {
+
+		health, found := router.health[peer]
+
+		if found && health.State == PeerSuspected && time.Since(health.Since) > common.PeerEvictTime {
+			health.State = PeerEvicted
+			health.Since = time.Now()
+			evicted = append(evicted, peer)
+		} else {
+			peers = append(peers, peer)
+		}
+	}
+
+	router.Peers = peers
+
+	router.Mutex.Unlock()
+
+	for _, peer := range evicted {
+		common.DebugPeerState(peer, PeerEvicted.String())
+		router.metrics.PeersEvicted.Inc()
+		router.events.publish(&Event{PeerState: &PeerStateChange{peer, PeerEvicted}})
+	}
+}
+
+// Random evicted peer, to check whether it came back
+func (router *Router) randomEvictedPeer() (string, bool) {
+
+	evicted := make([]string, 0)
+
+	for _, health := range router.Health() {
+		if health.State == PeerEvicted {
+			evicted = append(evicted, health.Address)
+		}
+	}
+
+	if len(evicted) == 0 {
+		return "", false
+	}
+
+	return evicted[common.Random.Int()%len(evicted)], true
+}
+
+// Liveness of all the peers: those in Peers in the same order, then passive and evicted peers by address
+func (router *Router) Health() []PeerHealth {
+
+	router.Mutex.RLock()
+	defer router.Mutex.RUnlock()
+
+	peers := make([]PeerHealth, 0, len(router.health))
+	others := make([]PeerHealth, 0)
+
+	for _, peer := range router.Peers {
+		if health, found := router.health[peer]; found {
+			peers = append(peers, *health)
+		}
+	}
+
+	for _, health := range router.health {
+		if health.State == PeerEvicted || health.State == PeerPassive {
+			others = append(others, *health)
+		}
+	}
+
+	sort.Slice(others, func(i, j int) bool { return others[i].Address < others[j].Address })
+
+	return append(peers, others...)
+}
+
+//
+//  MEMBERSHIP
+//
+
+// Promote random passive peers to Peers until the active view is full, e.g. after neighbors were evicted.
+// Only peers that were heard from are promoted.
+func (router *Router) fillActiveView() {
+
+	router.Mutex.Lock()
+
+	promoted := make([]string, 0)
+	passive := router.passivePeers()
+
+	for _, i := range common.Random.Perm(len(passive)) {
+
+		if len(router.Peers) >= common.MaxPeers {
+			break
+		}
+
+		health := router.health[passive[i]]
+
+		if health.LastHeard.IsZero() {
+			continue
+		}
+
+		health.State = PeerAlive
+		health.Since = time.Now()
+		health.Timeouts = 0
+
+		router.Peers = append(router.Peers, passive[i])
+		promoted = append(promoted, passive[i])
+	}
+
+	router.Mutex.Unlock()
+
+	for _, peer := range promoted {
+		router.events.publish(&Event{Peer: &NewPeer{peer}})
+		common.DebugPeerState(peer, PeerAlive.String())
+		router.events.publish(&Event{PeerState: &PeerStateChange{peer, PeerAlive}})
+	}
+}
+
+// Random passive peer that was never heard from, to check that it answers while the active view has room.
+// The peer is promoted by heardFrom once it does.
+func (router *Router) randomUnheardPeer() (string, bool) {
+
+	router.Mutex.RLock()
+	defer router.Mutex.RUnlock()
+
+	if len(router.Peers) >= common.MaxPeers {
+		return "", false
+	}
+
+	unheard := make([]string, 0)
+
+	for _, peer := range router.passivePeers() {
+		if router.health[peer].LastHeard.IsZero() {
+			unheard = append(unheard, peer)
+		}
+	}
+
+	if len(unheard) == 0 {
+		return "", false
+	}
+
+	return unheard[common.Random.Int()%len(unheard)], true
+}
+
+// Number of peers in the passive view
+func (router *Router) passiveCount() int {
+
+	router.Mutex.RLock()
+	defer router.Mutex.RUnlock()
+
+	return len(router.passivePeers())
+}
+
+// Addresses of the passive peers, sorted so that random choices only depend on common.Random. Must be
+// called with the lock held.
+func (router *Router) passivePeers() []string {
+
+	passive := make([]string, 0)
+
+	for address, health := range router.health {
+		if health.State == PeerPassive {
+			passive = append(passive, address)
+		}
+	}
+
+	sort.Strings(passive)
+	return passive
+}
+
+// Put a peer that is not in Peers in the passive view, and forget random passive peers beyond
+// common.PassiveViewSize. Must be called with the lock held.
+func (router *Router) makePassive(health *PeerHealth) {
+
+	health.State = PeerPassive
+	health.Since = time.Now()
+	health.Timeouts = 0
+
+	passive := router.passivePeers()
+	count := len(passive)
+
+	for _, i := range common.Random.Perm(len(passive)) {
+
+		if count <= common.PassiveViewSize {
+			break
+		}
+
+		if passive[i] != health.Address {
+			delete(router.health, passive[i])
+			count--
+		}
+	}
+}
+
+// Move a random neighbor from Peers to the passive view. Must be called with the lock held.
+func (router *Router) demoteRandomPeer() (string, bool) {
+
+	if len(router.Peers) == 0 {
+		return "", false
+	}
+
+	peer := router.Peers[common.Random.Int()%len(router.Peers)]
+	peers := make([]string, 0, len(router.Peers))
+
+	for _, other := range router.Peers {
+		if other != peer {
+			peers = append(peers, other)
+		}
+	}
+
+	router.Peers = peers
+
+	health, found := router.health[peer]
+
+	if !found {
+		health = &PeerHealth{Address: peer}
+		router.health[peer] = health
 	}
+
+	router.makePassive(health)
+
+	return peer, true
+}
+
+func (router *Router) publishStateChanges(changes []*PeerStateChange) {
+	for _, change := range changes {
+		common.DebugPeerState(change.Address, change.State.String())
+		router.events.publish(&Event{PeerState: change})
+	}
+}
+
+//
+//  PEER EXCHANGE
+//
+
+// Random sample of at most n peers other than the given one, to share with a neighbor. The sample is taken
+// from the neighbors that are alive and were heard from in the last common.PeerEvictTime, so that only
+// peers known to answer are passed on.
+func (router *Router) samplePeers(n int, except string) []string {
+
+	router.Mutex.RLock()
+
+	candidates := make([]string, 0, len(router.Peers))
+
+	for _, peer := range router.Peers {
+
+		if peer == "" || peer == except {
+			continue
+		}
+
+		health, found := router.health[peer]
+
+		if found && health.State == PeerAlive && !health.LastHeard.IsZero() && time.Since(health.LastHeard) <= common.PeerEvictTime {
+			candidates = append(candidates, peer)
+		}
+	}
+
+	router.Mutex.RUnlock()
+
+	sample := make([]string, 0, n)
+
+	for _, i := range common.Random.Perm(len(candidates)) {
+
+		if len(sample) >= n {
+			break
+		}
+
+		sample = append(sample, candidates[i])
+	}
+
+	return sample
+}
+
+// Add the peers learned from a neighbor to the passive view. They are only promoted to Peers once they are
+// heard from. Known peers, evicted ones included, are left as they are: an evicted peer is only
+// admitted again once it is heard from. Addresses that do not resolve to a reachable UDP address, or that designate
+// the socket bound to self, are dropped. Return the peers that were added.
+func (router *Router) addExchangedPeers(addresses []string, self string) []string {
+
+	router.Mutex.Lock()
+	defer router.Mutex.Unlock()
+
+	added := make([]string, 0)
+
+	for _, address := range addresses {
+
+		resolved, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil || resolved.Port == 0 || resolved.IP == nil || resolved.IP.IsUnspecified() {
+			continue
+		}
+
+		if common.IsLocalAddress(resolved, self) {
+			continue
+		}
+
+		peer := resolved.String()
+
+		if _, known := router.health[peer]; known || common.Contains(router.Peers, peer) {
+			continue
+		}
+
+		health := &PeerHealth{Address: peer}
+		router.health[peer] = health
+		router.makePassive(health)
+
+		added = append(added, peer)
+	}
+
+	return added
 }
 
 //
@@ -118,7 +662,7 @@ func (gossiper *Gossiper) sendToNode(packet *common.GossipPacket, destination st
 
 	if found {
 		common.DebugForwardPointToPoint(destination, nextPeer)
-		go gossiper.sendToNeighbor(nextPeer, packet)
+		gossiper.spawn(func() { gossiper.sendToNeighbor(nextPeer, packet) })
 	} else {
 		common.DebugUnknownDestination(destination)
 	}
@@ -173,7 +717,42 @@ func (gossiper *Gossiper) sendToNeighbor(peerAddress string, packet *common.Goss
 		panic(err)
 	}
 
-	gossiper.GossipSocket.Send(bytes, peerAddress)
+	transport := gossiper.transportFor(peerAddress, packet, len(bytes))
+	err = gossiper.sendOver(transport, bytes, peerAddress)
+
+	// Fall back to UDP if the peer does not accept TCP connections
+	if err != nil && transport != common.Transport(gossiper.GossipSocket) {
+		common.DebugTCPFallback(peerAddress, err)
+		gossiper.Router.markTCPFailure(peerAddress)
+		err = gossiper.sendOver(gossiper.GossipSocket, bytes, peerAddress)
+	}
+
+	if err != nil {
+		common.DebugSendError(peerAddress, err)
+		return
+	}
+
+	if gossiper.Capture != nil {
+		gossiper.Capture.Record(common.CaptureOutgoing, peerAddress, bytes)
+	}
+
+	gossiper.Metrics.PacketsSent.With(packet.Type()).Inc()
+}
+
+// Choose the transport used to send a packet to a neighbor. Packets that are typically big (data replies,
+// onions and blocks) or that do not fit in a datagram go through TCP when it is enabled, unless the
+// neighbor recently refused a TCP connection. Everything else goes through UDP.
+func (gossiper *Gossiper) transportFor(peerAddress string, packet *common.GossipPacket, size int) common.Transport {
+
+	if gossiper.TCPSocket == nil || !gossiper.Router.acceptsTCP(peerAddress) {
+		return gossiper.GossipSocket
+	}
+
+	if size > common.SocketBufferSize || packet.DataReply != nil || packet.Onion != nil || packet.BlockPublish != nil {
+		return gossiper.TCPSocket
+	}
+
+	return gossiper.GossipSocket
 }
 
 // Broadcast a GossipPacket containing a Simple message to every neighboring node.
@@ -183,9 +762,7 @@ func (gossiper *Gossiper) broadcastToNeighborsExcept(packet *common.GossipPacket
 		log.Panicf("Cannot broadcast packet %v.", packet)
 	}
 
-	for i := 0; i < len(gossiper.Router.Peers); i++ {
-
-		peer := gossiper.Router.Peers[i]
+	for _, peer := range gossiper.Router.Neighbors() {
 
 		if except == nil || !common.Contains(*except, peer) {
 			gossiper.sendToNeighbor(peer, packet)
@@ -210,9 +787,49 @@ func (gossiper *Gossiper) sendRouteRumors() {
 		if found {
 			routeRumor := gossiper.GenerateRouteRumor()
 			common.DebugSendRouteRumor(peer)
-			go gossiper.sendToNeighbor(peer, routeRumor.Packed())
+			gossiper.spawn(func() { gossiper.sendToNeighbor(peer, routeRumor.Packed()) })
 		}
 
-		time.Sleep(gossiper.Router.Rtimer)
+		if !gossiper.sleep(gossiper.Router.Rtimer) {
+			return
+		}
+	}
+}
+
+// Main loop for exchanging peers. Every common.PeerExchangeDT, a sample of the live peers is sent to a
+// random neighbor, which answers with a sample of its own.
+func (gossiper *Gossiper) exchangePeers() {
+
+	if common.PeerExchangeDT <= 0 {
+		return
 	}
-}
\ No newline at end of file
+
+	for {
+		if !gossiper.sleep(common.PeerExchangeDT) {
+			return
+		}
+
+		peer, found := gossiper.Router.randomPeer()
+
+		if found {
+			exchange := &common.PeerExchange{Peers: gossiper.Router.samplePeers(common.PeerExchangeSize, peer)}
+			common.DebugSendPeerExchange(exchange.Peers, peer)
+			gossiper.spawn(func() { gossiper.sendToNeighbor(peer, exchange.Packed()) })
+		}
+	}
+}
+
+// Add the peers of an exchange, and answer it with a sample of our own unless it is already an answer
+func (gossiper *Gossiper) handlePeerExchange(exchange *common.PeerExchange, source string) {
+
+	added := gossiper.Router.addExchangedPeers(exchange.Peers, gossiper.GossipSocket.LocalAddress())
+	common.DebugReceivePeerExchange(exchange.Peers, source, added)
+
+	if exchange.Reply {
+		return
+	}
+
+	reply := &common.PeerExchange{Peers: gossiper.Router.samplePeers(common.PeerExchangeSize, source), Reply: true}
+	common.DebugSendPeerExchange(reply.Peers, source)
+	gossiper.sendToNeighbor(source, reply.Packed())
+}
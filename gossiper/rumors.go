@@ -9,9 +9,10 @@ import (
 // Database-like object that stores / serves Rumors in a thread-safe way,
 // while also offer higher-level functions related to those Rumors.
 type RumorDatabase struct {
-	nextID uint32                                     // NextID to be used for Rumors
-	Rumors map[string]map[uint32]*common.IRumorMessage // List of rumor Ids per node
-	Mutex  *sync.RWMutex                              // Read-write lock to access the database
+	nextID  uint32                                      // NextID to be used for Rumors
+	Rumors  map[string]map[uint32]*common.IRumorMessage // List of rumor Ids per node
+	Mutex   *sync.RWMutex                               // Read-write lock to access the database
+	storage Storage                                     // Persists new rumors
 }
 
 // Create an empty database of Rumors.
@@ -21,6 +22,7 @@ func NewRumorDatabase() *RumorDatabase {
 		nextID: common.InitialId,
 		Rumors: make(map[string]map[uint32]*common.IRumorMessage),
 		Mutex: &sync.RWMutex{},
+		storage: &NullStorage{},
 	}
 }
 
@@ -73,6 +75,7 @@ func (r *RumorDatabase) Put(rumor common.IRumorMessage) {
 	}
 
 	r.Rumors[rumor.GetOrigin()][rumor.GetID()] = &rumor
+	r.storage.StoreRumor(rumor)
 }
 
 // Returns, for a given origin node, the first message ID that is NOT
@@ -268,15 +271,22 @@ func (gossiper *Gossiper) rumormonger(rumor common.IRumorMessage, peer string) {
 
 	// Forward package to peer
 	common.LogMongering(peer)
-	go gossiper.sendToNeighbor(peer, rumor.Packed())
+	gossiper.Metrics.MongeringRounds.Inc()
+	gossiper.spawn(func() { gossiper.sendToNeighbor(peer, rumor.Packed()) })
+	sent := time.Now()
 
 	// Start timer
 	ticker := time.NewTicker(common.StatusTimeout)
 	defer ticker.Stop()
 
 	select {
+	case <-gossiper.ctx.Done():
+		gossiper.Dispatcher.stopWaitingOnStatusPacket(peer)
+		return
+
 	case packet := <-gossiper.Dispatcher.statusPackets(peer):
 
+		gossiper.Router.measuredRTT(peer, time.Since(sent))
 		statusPacket := packet.Status
 
 		// Compare status from peer with own messages
@@ -285,12 +295,12 @@ func (gossiper *Gossiper) rumormonger(rumor common.IRumorMessage, peer string) {
 		switch {
 		case statuses != nil: // Peer has new messages
 			statusPacket := &common.StatusPacket{statuses}
-			go gossiper.sendToNeighbor(peer, statusPacket.Packed())
+			gossiper.spawn(func() { gossiper.sendToNeighbor(peer, statusPacket.Packed()) })
 			shouldContinue = true
 
 		case otherRumor != nil: // Peer is missing messages
 
-			go gossiper.rumormonger(*otherRumor, peer)
+			gossiper.spawn(func() { gossiper.rumormonger(*otherRumor, peer) })
 			shouldContinue = true
 
 		default:
@@ -300,6 +310,7 @@ func (gossiper *Gossiper) rumormonger(rumor common.IRumorMessage, peer string) {
 
 	case <-ticker.C: // Timeout
 		common.DebugTimeout(peer)
+		gossiper.Router.timedOut(peer, sent)
 		shouldContinue = false
 	}
 
@@ -311,9 +322,15 @@ func (gossiper *Gossiper) rumormonger(rumor common.IRumorMessage, peer string) {
 		return
 	}
 
-	if !shouldContinue && common.FlipCoin() {
-		common.LogFlippedCoin(newPeer)
-		shouldContinue = true
+	if !shouldContinue {
+
+		if common.FlipCoin() {
+			common.LogFlippedCoin(newPeer)
+			gossiper.Metrics.CoinFlips.With("continue").Inc()
+			shouldContinue = true
+		} else {
+			gossiper.Metrics.CoinFlips.With("stop").Inc()
+		}
 	}
 
 	if shouldContinue {
@@ -333,26 +350,58 @@ func (gossiper *Gossiper) handleRumor(rumor common.IRumorMessage, source string)
         }
 
         gossiper.Rumors.Put(rumor)
+        gossiper.publishRumor(rumor)
+
         peer, found := gossiper.Router.randomPeerExcept(source)
 
         if found {
             common.DebugForwardRumor(rumor)
-            go gossiper.rumormonger(rumor, peer)
+            gossiper.spawn(func() { gossiper.rumormonger(rumor, peer) })
         }
     }
 }
 
+// Publish chat rumors, i.e. all rumors except route rumors.
+func (gossiper *Gossiper) publishRumor(rumor common.IRumorMessage) {
+    if message, ok := rumor.(*common.RumorMessage); ok && !message.IsRouteRumor() {
+        gossiper.Events.publish(&Event{Rumor: message})
+    }
+}
+
 // Main loop for pinging other nodes as part of the anti-entropy algorithm.
+//
+// Suspected peers are also sent status packets, which gives them a chance to answer before being evicted,
+// and so is one evicted peer on each round, so that it is admitted again if it came back. Neighbors that
+// were evicted are replaced by random peers of the passive view. While the active view has room, one passive
+// peer that was never heard from is sent a status packet as well, and is promoted once it answers.
 func (gossiper *Gossiper) antiEntropy() {
 	for {
-		peer, found := gossiper.Router.randomPeer()
+		gossiper.Router.evictSilentPeers()
+		gossiper.Router.fillActiveView()
+
+		peer, found := gossiper.Router.randomPeerOrSuspect()
 
 		if found {
 			packet := gossiper.GenerateStatusPacket().Packed()
 			common.DebugAskAndSendStatus(packet.Status, peer)
-			go gossiper.sendToNeighbor(peer, packet)
+			gossiper.Metrics.AntiEntropy.Inc()
+			gossiper.spawn(func() { gossiper.sendToNeighbor(peer, packet) })
+		}
+
+		if evicted, found := gossiper.Router.randomEvictedPeer(); found {
+			packet := gossiper.GenerateStatusPacket().Packed()
+			common.DebugAskAndSendStatus(packet.Status, evicted)
+			gossiper.spawn(func() { gossiper.sendToNeighbor(evicted, packet) })
 		}
 
-		time.Sleep(common.AntiEntropyDT)
+		if unheard, found := gossiper.Router.randomUnheardPeer(); found {
+			packet := gossiper.GenerateStatusPacket().Packed()
+			common.DebugAskAndSendStatus(packet.Status, unheard)
+			gossiper.spawn(func() { gossiper.sendToNeighbor(unheard, packet) })
+		}
+
+		if !gossiper.sleep(common.AntiEntropyDT) {
+			return
+		}
 	}
 }
\ No newline at end of file
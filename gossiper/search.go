@@ -19,6 +19,7 @@ type SearchEngine struct {
     fileMaps        map[string]*FileMap         // Keeps track of file chunks location
     results         []*common.SearchResult      // All results received
     lock            *sync.RWMutex               // Synchronize access
+    events          *EventBus                   // Publishes new matches
 }
 
 // Represents a search request that has not yet completed.
@@ -60,35 +61,53 @@ func (fileMap *FileMap) isComplete() bool {
     return true
 }
 
-// Random peer from which to download the metaFile of a given file.
-func (fileMap *FileMap) peerForMetafile(counter int) (string, bool) {
-    peer, found := fileMap.peerForChunk(1, counter)
-    return peer, found
-}
+// Check if at least one seed is known for every chunk of a file
+func (se *SearchEngine) isAvailable(metaHash []byte) bool {
 
-// Random peer from which to download a given chunk of a file.
-func (fileMap *FileMap) peerForChunk(chunkId uint64, counter int) (string, bool) {
+    se.lock.RLock()
+    defer se.lock.RUnlock()
 
-    potentialPeers, found := fileMap.chunkMap[chunkId]
+    fileMap, found := se.fileMaps[hex.EncodeToString(metaHash)]
 
-    if !found { return "", false }
+    return found && fileMap.isComplete()
+}
 
-    index := counter % len(potentialPeers)
+// Names of the peers known to hold a given chunk of a file. Since peers download the metafiles of a
+// file before its chunks, any peer holding one of its chunks can serve its metafiles (MetaHashChunkId).
+func (se *SearchEngine) seeders(metaHash []byte, chunkId int) []string {
 
-    i := 0
+    se.lock.RLock()
+    defer se.lock.RUnlock()
+
+    seeders := make([]string, 0)
+    fileMap, found := se.fileMaps[hex.EncodeToString(metaHash)]
+
+    if !found {
+        return seeders
+    }
 
-    for peer, _ := range potentialPeers {
+    if chunkId != common.MetaHashChunkId {
 
-        if i == index {
-            return peer, true
+        for peer := range fileMap.chunkMap[uint64(chunkId)] {
+            seeders = append(seeders, peer)
         }
 
-        i++
+        return seeders
     }
 
-    return "", false
-}
+    all := make(map[string]bool)
 
+    for _, peers := range fileMap.chunkMap {
+        for peer := range peers {
+            if !all[peer] {
+                all[peer] = true
+                seeders = append(seeders, peer)
+            }
+        }
+    }
+
+    return seeders
+}
 
 // Get the fileMap for a given meta-hash
 func (se *SearchEngine) FileMap(hash []byte) (*FileMap, bool) {
@@ -163,9 +182,15 @@ func (se *SearchEngine) StoreResults(results []*common.SearchResult, origin stri
             }
 
             common.LogMatch(*result, origin)
+            se.events.publish(&Event{SearchMatch: &SearchMatch{origin, result}})
             se.results = append(se.results, result)
 
             fillChunkMap(fileMap.chunkMap, result, origin)
+
+        } else if fileMap, found := se.fileMaps[hex.EncodeToString(result.MetafileHash)]; found {
+
+            // The file was already found, but this peer can serve its chunks as well
+            fillChunkMap(fileMap.chunkMap, result, origin)
         }
     }
 
@@ -186,9 +211,21 @@ func (fs *FileSystem) Search(keywords []string) []*common.SearchResult {
 
     results := make([]*common.SearchResult, 0)
 
+    fs.lock.RLock()
+    metaFiles := make([]*MetaFile, 0, len(fs.metaFiles))
     for _, metaFile := range fs.metaFiles {
-        if Match(metaFile.Name, keywords) {
-            results = append(results, fs.newSearchResult(metaFile))
+        metaFiles = append(metaFiles, metaFile)
+    }
+    fs.lock.RUnlock()
+
+    for _, metaFile := range metaFiles {
+        if !Match(metaFile.Name, keywords) {
+            continue
+        }
+
+        // Files whose metafile tree is not fully known cannot be described yet
+        if result, ok := fs.newSearchResult(metaFile); ok {
+            results = append(results, result)
         }
     }
 
@@ -197,27 +234,29 @@ func (fs *FileSystem) Search(keywords []string) []*common.SearchResult {
     return results
 }
 
-func (fs *FileSystem) newSearchResult(metaFile *MetaFile) *common.SearchResult {
+func (fs *FileSystem) newSearchResult(metaFile *MetaFile) (*common.SearchResult, bool) {
+
+    hashes, missing := fs.resolveChunkHashes(metaFile)
+
+    if len(missing) > 0 {
+        return nil, false
+    }
 
     return &common.SearchResult{
         FileName:       metaFile.Name,
         MetafileHash:   metaFile.Hash,
-        ChunkMap:       fs.chunkMap(metaFile),
-        ChunkCount:     uint64(metaFile.countOfChunks()),
-    }
+        ChunkMap:       fs.chunkMap(hashes),
+        ChunkCount:     uint64(len(hashes)),
+    }, true
 }
 
-func (fs *FileSystem) chunkMap(metaFile *MetaFile) []uint64 {
+func (fs *FileSystem) chunkMap(hashes [][]byte) []uint64 {
 
     chunkMap := make([]uint64, 0)
 
-    for i := 1; i <= metaFile.countOfChunks(); i++ {
-
-        hash := metaFile.hashAt(i - 1)
-        _, found  := fs.getChunk(hash)
-
-        if found {
-            chunkMap = append(chunkMap, uint64(i))
+    for i, hash := range hashes {
+        if fs.store.Has(hash) {
+            chunkMap = append(chunkMap, uint64(i + 1))
         }
     }
 
@@ -322,11 +361,23 @@ func fillChunkMap(chunkMap map[uint64]map[string]bool, result *common.SearchResu
 //  GOSSIPER FUNCTIONS
 //
 
+// Start a ring search in the background and return its ID. Matches are logged and published on the
+// event bus.
+func (gossiper *Gossiper) StartSearch(keywords []string, budget uint64) string {
+
+    searchId := gossiper.SearchEngine.createNewActiveSearch(keywords)
+    gossiper.spawn(func() { gossiper.ringSearch(searchId, keywords, budget) })
+
+    return searchId
+}
+
 func (gossiper *Gossiper) RingSearch(keywords []string, budget uint64) {
+    gossiper.ringSearch(gossiper.SearchEngine.createNewActiveSearch(keywords), keywords, budget)
+}
 
-    timestamp := time.Now().Unix()
+func (gossiper *Gossiper) ringSearch(searchId string, keywords []string, budget uint64) {
 
-    searchId := gossiper.SearchEngine.createNewActiveSearch(keywords)
+    timestamp := time.Now().Unix()
 
     if budget == common.SearchNoBudget {
         gossiper.ringSearchInternal(searchId, keywords, common.DefaultSearchBudget, timestamp, true)
@@ -363,7 +414,9 @@ func (gossiper *Gossiper) ringSearchInternal(searchId string, keywords []string,
         return
     }
 
-    time.Sleep(common.SearchRequestBudgetIncreaseDT)
+    if !gossiper.sleep(common.SearchRequestBudgetIncreaseDT) {
+        return
+    }
 
     gossiper.ringSearchInternal(searchId, keywords, budget * 2, timestamp, true)
 }
@@ -373,19 +426,21 @@ func (gossiper *Gossiper) forwardSearchRequest(searchRequest *common.SearchReque
 
 
     searchRequest.Budget--
-    budgets := common.SplitBudget(searchRequest.Budget, len(gossiper.Router.Peers) - 1)
+    peers := gossiper.Router.Neighbors()
+    budgets := common.SplitBudget(searchRequest.Budget, len(peers) - 1)
 
     i := 0
 
-    for _, peer := range gossiper.Router.Peers {
+    for _, peer := range peers {
 
         if origin == peer {
             continue
         }
 
+        peer := peer
         request := common.CopySearchRequest(searchRequest, budgets[i])
         common.DebugForwardSearchRequest(request, peer)
-        go gossiper.sendToNeighbor(peer, request.Packed())
+        gossiper.spawn(func() { gossiper.sendToNeighbor(peer, request.Packed()) })
 
         i++
     }
@@ -0,0 +1,430 @@
+package gossiper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/dedis/protobuf"
+	"github.com/jfperren/Peerster/common"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A Storage persists the state of a node (rumors, private messages, blocks, shared files and downloads) so that
+// it can be restored when the node restarts. The content of shared files is not part of it, as it is
+// already kept on disk by the ChunkStore of the FileSystem.
+//
+// Components call the Store functions whenever their state changes, and the Gossiper calls the Load
+// functions once, in NewGossiper, to rebuild its state.
+type Storage interface {
+	StoreRumor(rumor common.IRumorMessage)
+	StorePrivateMessage(private *common.PrivateMessage)
+	StoreBlock(block *common.Block)
+	StoreMetaFile(metaFile *MetaFile)
+	StoreDownload(record *DownloadRecord)
+
+	LoadRumors() []common.IRumorMessage
+	LoadPrivateMessages() []*common.PrivateMessage
+	LoadBlocks() []*common.Block
+	LoadMetaFiles() []*MetaFile
+	LoadDownloads() []*DownloadRecord
+
+	Close()
+}
+
+// Create the storage to be used by a node. If dataDir is empty, nothing is persisted and the
+// node keeps its whole state in memory.
+func NewStorage(dataDir string) (Storage, error) {
+
+	if dataDir == "" {
+		return &NullStorage{}, nil
+	}
+
+	return NewDiskStorage(dataDir)
+}
+
+//
+//  NULL STORAGE
+//
+
+// A Storage that does not persist anything.
+type NullStorage struct{}
+
+func (s *NullStorage) StoreRumor(rumor common.IRumorMessage)              {}
+func (s *NullStorage) StorePrivateMessage(private *common.PrivateMessage) {}
+func (s *NullStorage) StoreBlock(block *common.Block)                     {}
+func (s *NullStorage) StoreMetaFile(metaFile *MetaFile)                   {}
+func (s *NullStorage) StoreDownload(record *DownloadRecord)               {}
+
+func (s *NullStorage) LoadRumors() []common.IRumorMessage            { return nil }
+func (s *NullStorage) LoadPrivateMessages() []*common.PrivateMessage { return nil }
+func (s *NullStorage) LoadBlocks() []*common.Block                   { return nil }
+func (s *NullStorage) LoadMetaFiles() []*MetaFile                    { return nil }
+func (s *NullStorage) LoadDownloads() []*DownloadRecord              { return nil }
+
+func (s *NullStorage) Close() {}
+
+//
+//  DISK STORAGE
+//
+
+const (
+	rumorsJournal    = "rumors.log"
+	privateJournal   = "private.log"
+	blocksJournal    = "blocks.log"
+	metaFilesJournal = "metafiles.log"
+	downloadsJournal = "downloads.log"
+)
+
+// A Storage that keeps its data in a directory on disk. Rumors, private messages, blocks, metafiles
+// and downloads are appended to journals, one per kind of record.
+//
+// Each journal entry is the protobuf encoding of the record, prefixed by its length. A record
+// that was only partially written (e.g. the node crashed) is cut off the journal when opening it,
+// so that the records appended afterwards can be read back.
+type DiskStorage struct {
+	Path     string
+	journals map[string]*os.File
+	lock     *sync.Mutex
+}
+
+// Open (or create) the storage located at the given path.
+func NewDiskStorage(path string) (*DiskStorage, error) {
+
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := &DiskStorage{
+		Path:     path,
+		journals: make(map[string]*os.File),
+		lock:     &sync.Mutex{},
+	}
+
+	for _, name := range []string{rumorsJournal, privateJournal, blocksJournal, metaFilesJournal, downloadsJournal} {
+
+		file, err := openJournal(filepath.Join(path, name))
+
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+
+		storage.journals[name] = file
+	}
+
+	return storage, nil
+}
+
+func (s *DiskStorage) StoreRumor(rumor common.IRumorMessage) {
+	s.append(rumorsJournal, rumor.Packed())
+}
+
+func (s *DiskStorage) StorePrivateMessage(private *common.PrivateMessage) {
+	s.append(privateJournal, private.Packed())
+}
+
+func (s *DiskStorage) StoreBlock(block *common.Block) {
+	s.append(blocksJournal, block)
+}
+
+func (s *DiskStorage) StoreMetaFile(metaFile *MetaFile) {
+	s.append(metaFilesJournal, metaFile)
+}
+
+func (s *DiskStorage) StoreDownload(record *DownloadRecord) {
+	s.append(downloadsJournal, record)
+}
+
+func (s *DiskStorage) LoadRumors() []common.IRumorMessage {
+
+	rumors := make([]common.IRumorMessage, 0)
+
+	s.replay(rumorsJournal, func(data []byte) {
+
+		var packet common.GossipPacket
+
+		if protobuf.Decode(data, &packet) != nil {
+			return
+		}
+
+		switch {
+		case packet.Rumor != nil:
+			rumors = append(rumors, packet.Rumor)
+		case packet.TxPublish != nil:
+			rumors = append(rumors, packet.TxPublish)
+		case packet.BlockPublish != nil:
+			rumors = append(rumors, packet.BlockPublish)
+		}
+	})
+
+	return rumors
+}
+
+func (s *DiskStorage) LoadPrivateMessages() []*common.PrivateMessage {
+
+	messages := make([]*common.PrivateMessage, 0)
+
+	s.replay(privateJournal, func(data []byte) {
+
+		var packet common.GossipPacket
+
+		if protobuf.Decode(data, &packet) == nil && packet.Private != nil {
+			messages = append(messages, packet.Private)
+		}
+	})
+
+	return messages
+}
+
+func (s *DiskStorage) LoadBlocks() []*common.Block {
+
+	blocks := make([]*common.Block, 0)
+
+	s.replay(blocksJournal, func(data []byte) {
+
+		var block common.Block
+
+		if protobuf.Decode(data, &block) == nil {
+			blocks = append(blocks, &block)
+		}
+	})
+
+	return blocks
+}
+
+func (s *DiskStorage) LoadMetaFiles() []*MetaFile {
+
+	metaFiles := make([]*MetaFile, 0)
+
+	s.replay(metaFilesJournal, func(data []byte) {
+
+		var metaFile MetaFile
+
+		if protobuf.Decode(data, &metaFile) == nil {
+			metaFiles = append(metaFiles, &metaFile)
+		}
+	})
+
+	return metaFiles
+}
+
+// Load the last known state of each download, in the order in which downloads were first started.
+func (s *DiskStorage) LoadDownloads() []*DownloadRecord {
+
+	records := make([]*DownloadRecord, 0)
+	indices := make(map[string]int)
+
+	s.replay(downloadsJournal, func(data []byte) {
+
+		var record DownloadRecord
+
+		if protobuf.Decode(data, &record) != nil {
+			return
+		}
+
+		key := hex.EncodeToString(record.MetaHash)
+
+		if index, found := indices[key]; found {
+			records[index] = &record
+		} else {
+			indices[key] = len(records)
+			records = append(records, &record)
+		}
+	})
+
+	return records
+}
+
+// Close all the journals. The storage should not be used afterwards.
+func (s *DiskStorage) Close() {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name, file := range s.journals {
+		file.Close()
+		delete(s.journals, name)
+	}
+}
+
+//
+//  JOURNALS
+//
+
+// Append a record at the end of a journal
+func (s *DiskStorage) append(journal string, structPtr interface{}) {
+
+	data, err := protobuf.Encode(structPtr)
+	if err != nil {
+		common.DebugStorageError(err)
+		return
+	}
+
+	record := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+	n := binary.PutUvarint(record, uint64(len(data)))
+	record = append(record[:n], data...)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, found := s.journals[journal]
+
+	if !found {
+		return
+	}
+
+	if _, err := file.Write(record); err != nil {
+		common.DebugStorageError(err)
+	}
+}
+
+// Open a journal for appending, after cutting off whatever follows its last complete record.
+func openJournal(path string) (*os.File, error) {
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	end := readRecords(file, func(data []byte) {})
+
+	if err := file.Truncate(end); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Read all records of a journal, in the order they were written.
+func (s *DiskStorage) replay(journal string, handle func(data []byte)) {
+
+	file, err := os.Open(filepath.Join(s.Path, journal))
+	if err != nil {
+		common.DebugStorageError(err)
+		return
+	}
+	defer file.Close()
+
+	readRecords(file, handle)
+}
+
+// Read records from the start of a file until one of them is incomplete or too large to be valid,
+// and return the offset at which the last valid record ends.
+func readRecords(file *os.File, handle func(data []byte)) int64 {
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		common.DebugStorageError(err)
+		return 0
+	}
+
+	reader := &recordReader{reader: bufio.NewReader(file)}
+	end := int64(0)
+
+	for {
+
+		size, err := binary.ReadUvarint(reader)
+		if err != nil || size > common.StorageMaxRecordSize {
+			return end
+		}
+
+		data := make([]byte, size)
+
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return end
+		}
+
+		end = reader.offset
+		handle(data)
+	}
+}
+
+// A reader that keeps track of how many bytes were read from a journal
+type recordReader struct {
+	reader *bufio.Reader
+	offset int64
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *recordReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.offset++
+	}
+	return b, err
+}
+
+//
+//  GOSSIPER METHODS
+//
+
+// Rebuild the state of the gossiper from a storage, then start persisting every change into it.
+func (gossiper *Gossiper) restore(storage Storage) {
+
+	rumors := storage.LoadRumors()
+
+	for _, rumor := range rumors {
+		gossiper.Rumors.Put(rumor)
+	}
+
+	// Make sure we do not reuse IDs of rumors we created before restarting
+	if nextID := gossiper.Rumors.NextIDFor(gossiper.Name); nextID > gossiper.Rumors.nextID {
+		gossiper.Rumors.nextID = nextID
+	}
+
+	gossiper.Messages = append(gossiper.Messages, storage.LoadPrivateMessages()...)
+
+	blocks := storage.LoadBlocks()
+
+	for _, block := range blocks {
+		gossiper.BlockChain.TryAddBlock(block)
+	}
+
+	metaFiles := storage.LoadMetaFiles()
+
+	for _, metaFile := range metaFiles {
+		gossiper.FileSystem.storeMetaFile(metaFile)
+	}
+
+	downloads := storage.LoadDownloads()
+
+	for _, record := range downloads {
+		gossiper.restoreDownload(record)
+	}
+
+	common.DebugRestoreState(len(rumors), len(gossiper.Messages), len(blocks), len(metaFiles), len(downloads))
+
+	gossiper.Storage = storage
+	gossiper.Rumors.storage = storage
+	gossiper.BlockChain.storage = storage
+	gossiper.FileSystem.storage = storage
+	gossiper.Downloads.storage = storage
+}
+
+// Store a private message that was sent or received by this node.
+func (gossiper *Gossiper) storePrivateMessage(private *common.PrivateMessage) {
+
+	gossiper.messagesLock.Lock()
+	gossiper.Messages = append(gossiper.Messages, private)
+	gossiper.messagesLock.Unlock()
+
+	gossiper.Storage.StorePrivateMessage(private)
+}
+
+// Copy of the private messages sent or received by this node, in the order they were stored
+func (gossiper *Gossiper) PrivateMessages() []*common.PrivateMessage {
+
+	gossiper.messagesLock.RLock()
+	defer gossiper.messagesLock.RUnlock()
+
+	return append([]*common.PrivateMessage{}, gossiper.Messages...)
+}
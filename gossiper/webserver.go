@@ -1,18 +1,72 @@
 package gossiper
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"github.com/jfperren/Peerster/common"
+	"net"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
-var g *Gossiper
+// A WebServer serves the GUI and the REST API of one gossiper. Several web servers can run side by side
+// in the same process, each bound to its own gossiper.
+//
+// The API lives under /api/v1 and is described in web/openapi.yaml. Request and response bodies are JSON
+// objects. Failed requests are answered with an error status and an APIError body.
+//
+// When tokens are configured, API requests must carry one, either as a bearer token or as the password of
+// HTTP basic authentication (the user name is ignored, so that browsers can simply prompt for it). The
+// read token only gives access to GET requests, everything that changes the node needs the admin token.
+type WebServer struct {
+	gossiper *Gossiper
+	options  WebServerOptions
+	root     string         // Folder holding the GUI and the OpenAPI document
+	mux      *http.ServeMux
+	server   *http.Server   // Nil unless the web server was started with StartWebServer
+}
 
-type RumorsAndStatuses struct {
-	Rumors   []*common.IRumorMessage
-	Statuses []common.PeerStatus
+// Options of a WebServer. The zero value serves plain HTTP without authentication.
+type WebServerOptions struct {
+	CertFile   string // Certificate for TLS, in PEM format. Leave empty to serve plain HTTP.
+	KeyFile    string // Private key of the certificate, in PEM format
+	ReadToken  string // Token that gives read-only access to the API
+	AdminToken string // Token that gives full access to the API
+}
+
+// Rights of the author of a request
+type Role int
+
+const (
+	RoleNone   Role = iota // Unauthenticated
+	RoleReader             // Can only read the state of the node
+	RoleAdmin              // Can also send messages, manage peers, share and download files
+)
+
+// Prefix of all the routes of the API
+const APIPrefix = "/api/v1"
+
+//
+//  API TYPES
+//
+
+// Body of the response to a failed request
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string // Machine-readable reason, e.g. "not_found"
+	Message string // Human-readable description
+}
+
+type Node struct {
+	Name    string
+	Address string
 }
 
 type User struct {
@@ -21,6 +75,33 @@ type User struct {
 	Secure  bool
 }
 
+type Peer struct {
+	Address string
+}
+
+type PeerStatus struct {
+	Address   string
+	State     string  // alive, suspected or evicted
+	Since     string  // When the peer entered its state
+	LastHeard string  `json:",omitempty"` // Time of the last packet received from the peer
+	Timeouts  int     // Rumors in a row the peer did not acknowledge, while sending nothing else either
+	RTT       float64 // Smoothed round-trip time of rumors in milliseconds, 0 until measured
+}
+
+type Rumors struct {
+	Rumors []*common.IRumorMessage
+	Next   string // Value of the since parameter that returns the rumors that come after these ones
+}
+
+type NewRumor struct {
+	Text string
+}
+
+type PrivateMessages struct {
+	Messages []*common.PrivateMessage
+	Next     int // Value of the since parameter that returns the messages that come after these ones
+}
+
 type Message struct {
 	Destination string
 	Text        string
@@ -29,6 +110,7 @@ type Message struct {
 type File struct {
 	Name string
 	Hash string
+	Size int `json:",omitempty"`
 }
 
 type FileRequest struct {
@@ -38,320 +120,1061 @@ type FileRequest struct {
 }
 
 type SearchRequest struct {
-	Keywords    string
-	Budget      int
+	Keywords []string
+	Budget   uint64
 }
 
-type SearchResult struct {
+type DownloadStatus struct {
 	Name    string
-	Hash	string
-	Full	bool
+	Hash    string
+	State   string
+	Done    int
+	Total   int
+	Seeders []string
 }
 
+type SearchResult struct {
+	Name string
+	Hash string
+	Full bool
+}
+
+type ChainBlock struct {
+	Hash     string
+	PrevHash string
+	Files    []File
+	Users    []string
+}
+
+type Logs struct {
+	Entries []*common.LogEntry
+	Next    uint64 // Value of the since parameter that returns the entries that come after these ones
+}
+
+type ChainRewind struct {
+	Discarded []string // Hashes of the blocks no longer on the longest chain
+	Appended  []string // Hashes of the blocks of the new branch
+}
+
+//
+//  SERVER
+//
+
+// Create a web server for a gossiper. The GUI and the OpenAPI document are served from the web folder of
+// the working directory.
+func NewWebServer(gossiper *Gossiper, options WebServerOptions) *WebServer {
+
+	server := &WebServer{
+		gossiper: gossiper,
+		options:  options,
+		root:     "./web",
+		mux:      http.NewServeMux(),
+	}
+
+	server.mux.Handle("/", http.FileServer(http.Dir(server.root)))
+
+	server.handle("/node", server.handleNode)
+	server.handle("/peers", server.handlePeers)
+	server.handle("/peers/health", server.handlePeerHealth)
+	server.handle("/users", server.handleUsers)
+	server.handle("/rumors", server.handleRumors)
+	server.handle("/private-messages", server.handlePrivateMessages)
+	server.handle("/files", server.handleFiles)
+	server.handle("/files/", server.handleFile)
+	server.handle("/downloads", server.handleDownloads)
+	server.handle("/downloads/", server.handleDownload)
+	server.handle("/searches", server.handleSearches)
+	server.handle("/search-results", server.handleSearchResults)
+	server.handle("/chain/blocks", server.handleBlocks)
+	server.handle("/chain/blocks/", server.handleBlock)
+	server.handle("/events", server.handleEvents)
+	server.handle("/logs", server.handleLogs)
+	server.handle("/metrics", server.handleMetrics)
+	server.handle("/openapi.yaml", server.handleOpenAPI)
+
+	return server
+}
+
+// Create a web server for a gossiper and serve it in the background, over TLS if a certificate is given.
+// The address is either a port, on which the server listens on all interfaces, or host:port. Return an
+// error if the certificate cannot be loaded or if the server cannot listen on the address.
+func StartWebServer(gossiper *Gossiper, address string, options WebServerOptions) (*WebServer, error) {
+
+	if !strings.Contains(address, ":") {
+		address = ":" + address
+	}
 
+	server := NewWebServer(gossiper, options)
+	server.server = &http.Server{Addr: address, Handler: server}
 
-func StartWebServer(gossiper *Gossiper, port string) {
+	if options.CertFile != "" {
 
-	// Stores gossiper
-	g = gossiper
+		certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
 
-	// Files
-	http.Handle("/", http.FileServer(http.Dir("./web")))
+		server.server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
 
-	// Routes
-	http.HandleFunc("/id", middleware(handleId))
-	http.HandleFunc("/message", middleware(handleMessage))
-	http.HandleFunc("/node", middleware(handleNode))
-	http.HandleFunc("/user", middleware(handleUser))
-	http.HandleFunc("/privateMessage", middleware(handlePrivateMessage))
-	http.HandleFunc("/fileDownload", middleware(handleFileDownload))
-	http.HandleFunc("/fileUpload", middleware(handleFileUpload))
-	http.HandleFunc("/fileSearch", middleware(handleFileSearch))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
 
 	go func() {
-		err := http.ListenAndServe(":"+port, nil)
-		if err == nil {
-			panic(err)
+
+		var err error
+
+		if server.server.TLSConfig != nil {
+			err = server.server.ServeTLS(listener, "", "")
+		} else {
+			err = server.server.Serve(listener)
+		}
+
+		if err != http.ErrServerClosed {
+			common.DebugServerError(err)
 		}
 	}()
+
+	return server, nil
+}
+
+// Stop a web server started with StartWebServer. Event streams end when the gossiper stops.
+func (server *WebServer) Shutdown(ctx context.Context) error {
+
+	if server.server == nil {
+		return nil
+	}
+
+	return server.server.Shutdown(ctx)
+}
+
+func (server *WebServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	server.mux.ServeHTTP(res, req)
 }
 
-func middleware(handler http.HandlerFunc) http.HandlerFunc {
-	return func(res http.ResponseWriter, req *http.Request) {
+func (server *WebServer) handle(path string, handler http.HandlerFunc) {
+	server.mux.HandleFunc(APIPrefix+path, func(res http.ResponseWriter, req *http.Request) {
+
 		common.DebugServerRequest(req)
-		handler(res, req)
+
+		if server.authorize(res, req) {
+			handler(res, req)
+		}
+	})
+}
+
+//
+//  AUTHENTICATION
+//
+
+// Check that the author of a request has the rights it needs. If not, answer with an error and return false.
+func (server *WebServer) authorize(res http.ResponseWriter, req *http.Request) bool {
+
+	required := RoleAdmin
+
+	if req.Method == "GET" || req.Method == "HEAD" {
+		required = RoleReader
+	}
+
+	role := server.roleOf(req)
+
+	if role >= required {
+		return true
+	}
+
+	if role == RoleNone {
+		res.Header().Set("WWW-Authenticate", `Basic realm="Peerster"`)
+		writeError(res, &APIError{http.StatusUnauthorized, "unauthorized", "A valid token is required"})
+	} else {
+		writeError(res, &APIError{http.StatusForbidden, "forbidden", "The admin token is required"})
+	}
+
+	return false
+}
+
+// Role given by the token of a request. Everyone is admin when no token is configured.
+func (server *WebServer) roleOf(req *http.Request) Role {
+
+	if server.options.ReadToken == "" && server.options.AdminToken == "" {
+		return RoleAdmin
+	}
+
+	token := ""
+
+	if _, password, ok := req.BasicAuth(); ok {
+		token = password
+	} else if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+
+	switch {
+	case token == "":
+		return RoleNone
+	case matchesToken(token, server.options.AdminToken):
+		return RoleAdmin
+	case matchesToken(token, server.options.ReadToken):
+		return RoleReader
+	default:
+		return RoleNone
 	}
 }
 
-func handleId(res http.ResponseWriter, req *http.Request) {
+// Compare tokens in constant time. An empty expected token never matches.
+func matchesToken(token, expected string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+//
+//  NODE
+//
+
+func (server *WebServer) handleNode(res http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
 	case "GET":
-		json.NewEncoder(res).Encode(g.Name)
+		writeJSON(res, http.StatusOK, &Node{server.gossiper.Name, server.gossiper.GossipSocket.LocalAddress()})
 
 	default:
-		res.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(res)
 	}
 }
 
-func handleMessage(res http.ResponseWriter, req *http.Request) {
+func (server *WebServer) handlePeers(res http.ResponseWriter, req *http.Request) {
+
+	router := server.gossiper.Router
 
 	switch req.Method {
-	case "POST":
+	case "GET":
 
-		var message string
-		err := json.NewDecoder(req.Body).Decode(&message)
-		if err != nil { handleErr(err, res); return }
+		peers := router.Neighbors()
 
-		var theirStatuses []common.PeerStatus
-		err = json.Unmarshal([]byte(req.Header.Get("x-statuses")), &theirStatuses)
+		writeJSON(res, http.StatusOK, peers)
 
-		if err != nil {
-			res.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(res).Encode("Error decoding 'x-statuses' parameter")
+	case "POST":
+
+		var peer Peer
+		if !readJSON(res, req, &peer) { return }
+
+		if peer.Address == "" {
+			writeError(res, badRequest("Address is required"))
 			return
 		}
 
-		command, err := common.NewMessageCommand(message)
-		if err != nil { handleErr(err, res); return }
-
-		g.HandleClient(command)
+		router.AddPeerIfNeeded(peer.Address)
+		writeJSON(res, http.StatusCreated, &peer)
 
-		_, rumors, myStatuses := g.CompareStatus(theirStatuses, ComparisonModeAllNew)
-		body := &RumorsAndStatuses{rumors, myStatuses}
+	default:
+		writeMethodNotAllowed(res)
+	}
+}
 
-		json.NewEncoder(res).Encode(body)
+// Liveness of the neighbors, evicted ones included
+func (server *WebServer) handlePeerHealth(res http.ResponseWriter, req *http.Request) {
 
+	switch req.Method {
 	case "GET":
 
-		var theirStatuses []common.PeerStatus
-		err := json.Unmarshal([]byte(req.Header.Get("x-statuses")), &theirStatuses)
-		if err != nil { handleErr(err, res); return }
-
-		_, rumors, myStatuses := g.CompareStatus(theirStatuses, ComparisonModeAllNew)
+		peers := make([]*PeerStatus, 0)
 
-		body := RumorsAndStatuses{rumors, myStatuses}
+		for _, health := range server.gossiper.Router.Health() {
+			peers = append(peers, peerStatus(&health))
+		}
 
-		json.NewEncoder(res).Encode(body)
+		writeJSON(res, http.StatusOK, peers)
 
 	default:
-		res.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(res)
 	}
 }
 
-func handleNode(res http.ResponseWriter, req *http.Request) {
+func peerStatus(health *PeerHealth) *PeerStatus {
+
+	status := &PeerStatus{
+		Address:  health.Address,
+		State:    health.State.String(),
+		Since:    health.Since.Format(time.RFC3339Nano),
+		Timeouts: health.Timeouts,
+		RTT:      float64(health.RTT) / float64(time.Millisecond),
+	}
+
+	if !health.LastHeard.IsZero() {
+		status.LastHeard = health.LastHeard.Format(time.RFC3339Nano)
+	}
+
+	return status
+}
+
+// Nodes known through the routing table
+func (server *WebServer) handleUsers(res http.ResponseWriter, req *http.Request) {
+
+	router := server.gossiper.Router
 
 	switch req.Method {
-	case "POST":
+	case "GET":
 
-		var peer string
+		users := make([]*User, 0)
 
-		json.NewDecoder(req.Body).Decode(&peer)
+		router.Mutex.RLock()
 
-		if peer == "" {
-			res.WriteHeader(http.StatusBadRequest)
+		for name, address := range router.NextHop {
+			users = append(users, &User{name, address, false})
 		}
 
-		if common.Contains(g.Router.Peers, peer) {
-			json.NewEncoder(res).Encode("")
-		} else {
-			g.Router.AddPeerIfNeeded(peer)
-			json.NewEncoder(res).Encode(peer)
+		router.Mutex.RUnlock()
+
+		// The chain has a lock of its own, which should not be taken while holding the one of the router
+		for _, user := range users {
+			_, user.Secure = server.gossiper.BlockChain.GetPublicKey(user.Name)
 		}
 
-	case "GET":
-		json.NewEncoder(res).Encode(g.Router.Peers)
+		writeJSON(res, http.StatusOK, users)
 
 	default:
-		res.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(res)
 	}
 }
 
-func handleUser(res http.ResponseWriter, req *http.Request) {
+//
+//  MESSAGES
+//
+
+// Rumors that come after the ones described by the since parameter. Since is a comma-separated list of
+// origin:nextID pairs, as returned in Next. Rumors from origins that are not listed are all returned.
+func (server *WebServer) handleRumors(res http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
+	case "GET":
+
+		statuses, err := parseSince(req.URL.Query().Get("since"))
 
+		if err != nil {
+			writeError(res, badRequest("Invalid since parameter: " + err.Error()))
+			return
+		}
+
+		_, rumors, next := server.gossiper.CompareStatus(statuses, ComparisonModeAllNew)
+
+		writeJSON(res, http.StatusOK, &Rumors{rumors, formatSince(next)})
+
+	case "POST":
+
+		var rumor NewRumor
+		if !readJSON(res, req, &rumor) { return }
+
+		command, err := common.NewMessageCommand(rumor.Text)
+		if err != nil { writeError(res, apiError(err)); return }
+
+		err = server.gossiper.HandleClient(command)
+		if err != nil { writeError(res, apiError(err)); return }
+
+		writeJSON(res, http.StatusCreated, &rumor)
+
+	default:
+		writeMethodNotAllowed(res)
+	}
+}
+
+// Private messages sent or received by the node, starting at index since.
+func (server *WebServer) handlePrivateMessages(res http.ResponseWriter, req *http.Request) {
+
+	switch req.Method {
 	case "GET":
 
-		users := make([]*User, 0)
+		since := 0
+
+		if value := req.URL.Query().Get("since"); value != "" {
+
+			index, err := strconv.Atoi(value)
 
-		for k, v := range g.Router.NextHop {
+			if err != nil || index < 0 {
+				writeError(res, badRequest("since should be a positive integer"))
+				return
+			}
 
-			_, found := g.BlockChain.Peers[k]
+			since = index
+		}
 
-			users = append(users, &User{Name: k, Address:v, Secure:found})
+		messages := server.gossiper.PrivateMessages()
+		body := &PrivateMessages{make([]*common.PrivateMessage, 0), len(messages)}
 
+		if since < len(messages) {
+			body.Messages = messages[since:]
 		}
 
-		json.NewEncoder(res).Encode(users)
+		writeJSON(res, http.StatusOK, body)
+
+	case "POST":
+
+		var message Message
+		if !readJSON(res, req, &message) { return }
+
+		command, err := common.NewPrivateMessageCommand(message.Text, message.Destination)
+		if err != nil { writeError(res, apiError(err)); return }
+
+		err = server.gossiper.HandleClient(command)
+		if err != nil { writeError(res, apiError(err)); return }
+
+		writeJSON(res, http.StatusCreated, &message)
 
 	default:
-		res.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(res)
 	}
 }
 
-func handlePrivateMessage(res http.ResponseWriter, req *http.Request) {
+//
+//  FILES
+//
+
+func (server *WebServer) handleFiles(res http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
+	case "GET":
+
+		files := make([]*File, 0)
 
+		for _, metaFile := range server.gossiper.FileSystem.allMetaFiles() {
+			files = append(files, fileFor(metaFile))
+		}
+
+		writeJSON(res, http.StatusOK, files)
+
+	// Share a file of the shared files folder
 	case "POST":
 
-		var message Message
+		var file File
+		if !readJSON(res, req, &file) { return }
 
-		err := json.NewDecoder(req.Body).Decode(&message)
-		if err != nil { handleErr(err, res); return }
+		_, err := common.NewUploadCommand(file.Name)
+		if err != nil { writeError(res, apiError(err)); return }
 
-		command, err := common.NewPrivateMessageCommand(message.Text, message.Destination)
-		if err != nil { handleErr(err, res); return }
+		metaFile, err := server.gossiper.Share(file.Name)
+		if err != nil { writeError(res, apiError(err)); return }
 
-		g.HandleClient(command)
+		writeJSON(res, http.StatusCreated, fileFor(metaFile))
 
-		res.WriteHeader(http.StatusOK)
+	default:
+		writeMethodNotAllowed(res)
+	}
+}
 
+func (server *WebServer) handleFile(res http.ResponseWriter, req *http.Request) {
+
+	hash, ok := pathHash(res, req, "/files/")
+	if !ok { return }
+
+	switch req.Method {
 	case "GET":
 
-		indexHeader := req.Header.Get("x-index")
-		index, err := strconv.Atoi(indexHeader)
+		metaFile, found := server.gossiper.FileSystem.getMetaFile(hash)
 
-		if err != nil {
-			res.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(res).Encode("Error decoding 'x-index' parameter")
+		if !found {
+			writeError(res, notFound("No file with hash " + hex.EncodeToString(hash)))
 			return
 		}
 
-		if index < 0 {
-			res.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(res).Encode("Index should be bigger or equal to 0.")
+		writeJSON(res, http.StatusOK, fileFor(metaFile))
+
+	default:
+		writeMethodNotAllowed(res)
+	}
+}
+
+//
+//  DOWNLOADS
+//
+
+func (server *WebServer) handleDownloads(res http.ResponseWriter, req *http.Request) {
+
+	switch req.Method {
+	case "GET":
+
+		downloads := make([]*DownloadStatus, 0)
+
+		for _, download := range server.gossiper.Downloads.All() {
+			downloads = append(downloads, downloadStatus(download))
+		}
+
+		writeJSON(res, http.StatusOK, downloads)
+
+	// Start a download, from a given node or from the results of previous searches
+	case "POST":
+
+		var request FileRequest
+		if !readJSON(res, req, &request) { return }
+
+		command, err := common.NewDownloadCommand(request.Hash, request.Name, request.Destination)
+		if err != nil { writeError(res, apiError(err)); return }
+
+		download := server.gossiper.StartDownload(command.Download.FileName, command.Download.Hash, command.Download.Destination)
+
+		writeJSON(res, http.StatusAccepted, downloadStatus(download))
+
+	default:
+		writeMethodNotAllowed(res)
+	}
+}
+
+// A download, or its pause and resume actions.
+func (server *WebServer) handleDownload(res http.ResponseWriter, req *http.Request) {
+
+	path := strings.TrimPrefix(req.URL.Path, APIPrefix + "/downloads/")
+	action := ""
+
+	if i := strings.Index(path, "/"); i >= 0 {
+		path, action = path[:i], path[i+1:]
+	}
+
+	hash, err := hex.DecodeString(path)
+
+	if err != nil || len(hash) == 0 {
+		writeError(res, badRequest("Invalid hash: " + path))
+		return
+	}
+
+	switch {
+	case action == "" && req.Method == "GET":
+
+		download, found := server.gossiper.Downloads.Get(hash)
+
+		if !found {
+			writeError(res, apiError(&DownloadError{hash, DownloadNotFound}))
 			return
 		}
 
-		var body []*common.PrivateMessage
+		writeJSON(res, http.StatusOK, downloadStatus(download))
+
+	case action == "" && req.Method == "DELETE":
 
-		if index >= len(g.Messages) {
-			body = make([]*common.PrivateMessage, 0)
+		err = server.gossiper.CancelDownload(hash)
+		if err != nil { writeError(res, apiError(err)); return }
+
+		res.WriteHeader(http.StatusNoContent)
+
+	case action == "pause" && req.Method == "POST", action == "resume" && req.Method == "POST":
+
+		if action == "pause" {
+			err = server.gossiper.PauseDownload(hash)
 		} else {
-			body = g.Messages[index:]
+			err = server.gossiper.ResumeDownload(hash)
 		}
 
-		json.NewEncoder(res).Encode(body)
+		if err != nil { writeError(res, apiError(err)); return }
+
+		download, _ := server.gossiper.Downloads.Get(hash)
+		writeJSON(res, http.StatusOK, downloadStatus(download))
+
+	case action == "" || action == "pause" || action == "resume":
+		writeMethodNotAllowed(res)
 
 	default:
-		res.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(res, notFound("Unknown action: " + action))
 	}
 }
 
-func handleFileUpload(res http.ResponseWriter, req *http.Request) {
+//
+//  SEARCH
+//
+
+func (server *WebServer) handleSearches(res http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
 
+	// Start a search in the background, results are listed in /search-results
 	case "POST":
 
-		var filename string
-		err := json.NewDecoder(req.Body).Decode(&filename)
-		if err != nil { handleErr(err, res); return }
+		var request SearchRequest
+		if !readJSON(res, req, &request) { return }
 
-		command, err := common.NewUploadCommand(filename)
-		if err != nil { handleErr(err, res); return }
+		command, err := common.NewSearchCommand(strings.Join(request.Keywords, common.SearchKeywordSeparator), request.Budget)
+		if err != nil { writeError(res, apiError(err)); return }
 
-		err = g.HandleClient(command)
-		if err != nil { handleErr(err, res); return }
+		server.gossiper.StartSearch(command.Search.Keywords, command.Search.Budget)
 
-		metaFile := g.FileSystem.getFileWithName(filename)
+		writeJSON(res, http.StatusAccepted, &request)
 
-		if metaFile == nil {
-			res.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	default:
+		writeMethodNotAllowed(res)
+	}
+}
+
+func (server *WebServer) handleSearchResults(res http.ResponseWriter, req *http.Request) {
 
-		json.NewEncoder(res).Encode(File{
-			metaFile.Name,
-			hex.EncodeToString(metaFile.Hash),
-		})
+	se := server.gossiper.SearchEngine
 
+	switch req.Method {
 	case "GET":
 
-		metaFiles := make([]File, 0)
+		se.lock.RLock()
+		results := append([]*common.SearchResult{}, se.results...)
+		se.lock.RUnlock()
+
+		body := make([]*SearchResult, 0)
 
-		for _, metaFile := range g.FileSystem.metaFiles {
-			metaFiles = append(metaFiles, File{
-				metaFile.Name,
-				hex.EncodeToString(metaFile.Hash),
+		for _, result := range results {
+			body = append(body, &SearchResult{
+				Name: result.FileName,
+				Hash: hex.EncodeToString(result.MetafileHash),
+				Full: se.isAvailable(result.MetafileHash),
 			})
 		}
 
-		json.NewEncoder(res).Encode(metaFiles)
+		writeJSON(res, http.StatusOK, body)
 
 	default:
-		res.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(res)
 	}
 }
 
-func handleFileDownload(res http.ResponseWriter, req *http.Request) {
+//
+//  CHAIN
+//
+
+// Blocks of the longest chain, from the first one to the latest
+func (server *WebServer) handleBlocks(res http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
+	case "GET":
 
-	case "POST":
+		blocks := make([]*ChainBlock, 0)
 
-		var request FileRequest
-		err := json.NewDecoder(req.Body).Decode(&request)
-		if err != nil { handleErr(err, res); return }
+		for _, block := range server.gossiper.BlockChain.LongestChain() {
+			blocks = append(blocks, chainBlock(block))
+		}
 
-		command, err := common.NewDownloadCommand(request.Hash, request.Name, request.Destination)
-		if err != nil { handleErr(err, res); return }
+		writeJSON(res, http.StatusOK, blocks)
+
+	default:
+		writeMethodNotAllowed(res)
+	}
+}
+
+// Any known block, on the longest chain or not
+func (server *WebServer) handleBlock(res http.ResponseWriter, req *http.Request) {
+
+	slice, ok := pathHash(res, req, "/chain/blocks/")
+	if !ok { return }
+
+	var hash [32]byte
+
+	if len(slice) != len(hash) {
+		writeError(res, badRequest("A block hash has 32 bytes"))
+		return
+	}
 
-		g.HandleClient(command)
+	copy(hash[:], slice)
+
+	switch req.Method {
+	case "GET":
+
+		block, found := server.gossiper.BlockChain.GetBlock(hash)
+
+		if !found {
+			writeError(res, notFound("No block with hash " + hex.EncodeToString(slice)))
+			return
+		}
+
+		writeJSON(res, http.StatusOK, chainBlock(block))
+
+	default:
+		writeMethodNotAllowed(res)
+	}
+}
 
+//
+//  EVENTS
+//
+
+// Stream the events of the gossiper as server-sent events, until the client disconnects or the gossiper
+// stops. Each event has a name (rumor, privateMessage, peer, route, block, forkRewind, searchMatch or
+// download) and a JSON body.
+func (server *WebServer) handleEvents(res http.ResponseWriter, req *http.Request) {
+
+	switch req.Method {
+
+	case "GET":
+
+		flusher, ok := res.(http.Flusher)
+
+		if !ok {
+			writeError(res, &APIError{http.StatusNotImplemented, "not_implemented", "Streaming is not supported"})
+			return
+		}
+
+		subscription := server.gossiper.Events.Subscribe()
+		defer subscription.Close()
+
+		res.Header().Set("Content-Type", "text/event-stream")
+		res.Header().Set("Cache-Control", "no-cache")
 		res.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(common.EventKeepAliveInterval)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+
+			case event, open := <-subscription.Events:
+
+				if !open {
+					return
+				}
+
+				name, body := server.serverSentEvent(event)
+				data, err := json.Marshal(body)
+				if err != nil { continue }
+
+				fmt.Fprintf(res, "event: %v\ndata: %s\n\n", name, data)
+				flusher.Flush()
+
+			case <-keepAlive.C:
+
+				// Comments are ignored by clients but detect closed connections
+				fmt.Fprintf(res, ": keep-alive\n\n")
+				flusher.Flush()
+
+			case <-req.Context().Done():
+				return
+			}
+		}
 
 	default:
-		res.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(res)
+	}
+}
+
+// Name and body of the server-sent event describing an event of the gossiper
+func (server *WebServer) serverSentEvent(event *Event) (string, interface{}) {
+
+	switch {
+
+	case event.Rumor != nil:
+		return "rumor", event.Rumor
+
+	case event.PrivateMessage != nil:
+		return "privateMessage", event.PrivateMessage
+
+	case event.Peer != nil:
+		return "peer", event.Peer.Address
+
+	case event.PeerState != nil:
+		return "peerState", &PeerStatus{Address: event.PeerState.Address, State: event.PeerState.State.String()}
+
+	case event.Route != nil:
+		_, secure := server.gossiper.BlockChain.GetPublicKey(event.Route.Origin)
+		return "route", &User{event.Route.Origin, event.Route.Address, secure}
+
+	case event.Block != nil:
+		return "block", chainBlock(event.Block)
+
+	case event.ForkRewind != nil:
+		return "forkRewind", &ChainRewind{blockHashes(event.ForkRewind.Discarded), blockHashes(event.ForkRewind.Appended)}
+
+	case event.SearchMatch != nil:
+		result := event.SearchMatch.Result
+		full := server.gossiper.SearchEngine.isAvailable(result.MetafileHash)
+		return "searchMatch", &SearchResult{result.FileName, hex.EncodeToString(result.MetafileHash), full}
+
+	case event.DownloadProgress != nil:
+		progress := event.DownloadProgress
+		status := &DownloadStatus{
+			Name:    progress.Name,
+			Hash:    hex.EncodeToString(progress.MetaHash),
+			State:   progress.State.String(),
+			Done:    progress.Done,
+			Total:   progress.Total,
+			Seeders: make([]string, 0),
+		}
+		if download, found := server.gossiper.Downloads.Get(progress.MetaHash); found {
+			status.Seeders = download.Seeders()
+		}
+		return "download", status
 	}
+
+	return "unknown", nil
 }
 
-func handleFileSearch(res http.ResponseWriter, req *http.Request) {
+//
+//  LOGS
+//
+
+// Serve the latest log entries kept in memory, as JSON by default or in the format given by the format
+// parameter. Entries can be filtered by minimum level and by category.
+func (server *WebServer) handleLogs(res http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
 
-	case "POST":
+	case "GET":
+
+		ring := common.DefaultLogger.Ring()
+
+		if ring == nil {
+			writeError(res, notFound("Logs are not kept in memory, see the logBuffer flag"))
+			return
+		}
+
+		query := req.URL.Query()
+		since := uint64(0)
+		level := common.LevelDebug
+		format := common.FormatJSON
+
+		var err error
+
+		if value := query.Get("since"); value != "" {
+			if since, err = strconv.ParseUint(value, 10, 64); err != nil {
+				writeError(res, badRequest("Invalid since: " + value))
+				return
+			}
+		}
 
-		var searchRequest SearchRequest
-		err := json.NewDecoder(req.Body).Decode(&searchRequest)
-		if err != nil { handleErr(err, res); return }
+		if value := query.Get("level"); value != "" {
+			if level, err = common.ParseLogLevel(value); err != nil {
+				writeError(res, badRequest(err.Error()))
+				return
+			}
+		}
+
+		if value := query.Get("format"); value != "" {
+			if format, err = common.ParseLogFormat(value); err != nil {
+				writeError(res, badRequest(err.Error()))
+				return
+			}
+		}
+
+		category := common.LogCategory(query.Get("category"))
+
+		if category != "" {
+			if _, err := common.ParseLogCategory(string(category)); err != nil {
+				writeError(res, badRequest(err.Error()))
+				return
+			}
+		}
+
+		logs := &Logs{Entries: make([]*common.LogEntry, 0), Next: since}
 
-		command, err := common.NewSearchCommand(searchRequest.Keywords, uint64(searchRequest.Budget))
-		if err != nil { handleErr(err, res); return }
+		for _, entry := range ring.Since(since) {
 
-		err = g.HandleClient(command)
-		if err != nil { handleErr(err, res); return }
+			logs.Next = entry.Seq
 
+			if entry.Level >= level && (category == "" || entry.Category == category) {
+				logs.Entries = append(logs.Entries, entry)
+			}
+		}
+
+		if format == common.FormatJSON {
+			writeJSON(res, http.StatusOK, logs)
+			return
+		}
+
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		res.WriteHeader(http.StatusOK)
 
+		for _, entry := range logs.Entries {
+			fmt.Fprintln(res, entry.Format(format))
+		}
+
+	default:
+		writeMethodNotAllowed(res)
+	}
+}
+
+//
+//  METRICS
+//
+
+// Serve the metrics of the gossiper in the text format of Prometheus
+func (server *WebServer) handleMetrics(res http.ResponseWriter, req *http.Request) {
+
+	switch req.Method {
 	case "GET":
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		res.WriteHeader(http.StatusOK)
+		server.gossiper.Metrics.WriteText(res)
 
-		results := make([]SearchResult, 0)
+	default:
+		writeMethodNotAllowed(res)
+	}
+}
 
-		for _, result := range g.SearchEngine.results {
+func (server *WebServer) handleOpenAPI(res http.ResponseWriter, req *http.Request) {
 
-			hash := hex.EncodeToString(result.MetafileHash)
+	switch req.Method {
+	case "GET":
+		res.Header().Set("Content-Type", "application/yaml")
+		http.ServeFile(res, req, filepath.Join(server.root, "openapi.yaml"))
 
-			results = append(results, SearchResult{
-				Name: result.FileName,
-				Hash: hash,
-				Full: g.SearchEngine.fileMaps[hash].isComplete(),
-			})
+	default:
+		writeMethodNotAllowed(res)
+	}
+}
+
+//
+//  CONVERSIONS
+//
+
+func fileFor(metaFile *MetaFile) *File {
+	return &File{metaFile.Name, hex.EncodeToString(metaFile.Hash), metaFile.Size}
+}
+
+func downloadStatus(download *Download) *DownloadStatus {
+
+	done, total := download.Progress()
+
+	return &DownloadStatus{
+		Name:    download.Name,
+		Hash:    hex.EncodeToString(download.MetaHash),
+		State:   download.State().String(),
+		Done:    done,
+		Total:   total,
+		Seeders: download.Seeders(),
+	}
+}
+
+func chainBlock(block *common.Block) *ChainBlock {
+
+	hash := block.Hash()
+	files := make([]File, 0)
+	users := make([]string, 0)
+
+	for _, transaction := range block.Transactions {
+		if transaction.File.Name != "" {
+			files = append(files, File{transaction.File.Name, hex.EncodeToString(transaction.File.MetafileHash), int(transaction.File.Size)})
+		} else if transaction.User.Name != "" {
+			users = append(users, transaction.User.Name)
 		}
+	}
+
+	return &ChainBlock{hex.EncodeToString(hash[:]), hex.EncodeToString(block.PrevHash[:]), files, users}
+}
 
-		json.NewEncoder(res).Encode(results)
+func blockHashes(blocks []*common.Block) []string {
+
+	hashes := make([]string, 0, len(blocks))
+
+	for _, block := range blocks {
+		hash := block.Hash()
+		hashes = append(hashes, hex.EncodeToString(hash[:]))
+	}
 
+	return hashes
+}
+
+// Parse a since parameter of the form origin:nextID,origin:nextID,...
+func parseSince(since string) ([]common.PeerStatus, error) {
+
+	statuses := make([]common.PeerStatus, 0)
+
+	if since == "" {
+		return statuses, nil
+	}
+
+	for _, pair := range strings.Split(since, ",") {
+
+		i := strings.LastIndex(pair, ":")
+
+		if i <= 0 {
+			return nil, fmt.Errorf("expected origin:nextID, got %v", pair)
+		}
+
+		nextID, err := strconv.ParseUint(pair[i+1:], 10, 32)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID in %v", pair)
+		}
+
+		statuses = append(statuses, common.PeerStatus{pair[:i], uint32(nextID)})
+	}
+
+	return statuses, nil
+}
+
+func formatSince(statuses []common.PeerStatus) string {
+
+	pairs := make([]string, 0, len(statuses))
+
+	for _, status := range statuses {
+		pairs = append(pairs, fmt.Sprintf("%v:%v", status.Identifier, status.NextID))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+//
+//  REQUESTS & RESPONSES
+//
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func badRequest(message string) *APIError {
+	return &APIError{http.StatusBadRequest, "bad_request", message}
+}
+
+func notFound(message string) *APIError {
+	return &APIError{http.StatusNotFound, "not_found", message}
+}
+
+// Describe an error returned by the gossiper with the matching status code
+func apiError(err error) *APIError {
+
+	if e, ok := err.(*APIError); ok {
+		return e
+	}
+
+	switch code := errorCode(err); code {
+	case common.ErrorBadRequest:
+		return badRequest(err.Error())
+	case common.ErrorNotFound:
+		return notFound(err.Error())
+	case common.ErrorConflict:
+		return &APIError{http.StatusConflict, code, err.Error()}
 	default:
-		res.WriteHeader(http.StatusMethodNotAllowed)
+		return &APIError{http.StatusInternalServerError, code, err.Error()}
 	}
 }
 
+// Decode the JSON body of a request. If it is invalid, answer with an error and return false.
+func readJSON(res http.ResponseWriter, req *http.Request, body interface{}) bool {
 
-func handleErr(err error, res http.ResponseWriter) bool {
+	if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+		writeError(res, badRequest("Invalid JSON body: " + err.Error()))
+		return false
+	}
 
-	res.WriteHeader(http.StatusBadRequest)
-	json.NewEncoder(res).Encode(err.Error())
 	return true
-}
\ No newline at end of file
+}
+
+// Decode the hex-encoded hash at the end of the path of a request. If it is invalid, answer with an error
+// and return false.
+func pathHash(res http.ResponseWriter, req *http.Request, prefix string) ([]byte, bool) {
+
+	value := strings.TrimPrefix(req.URL.Path, APIPrefix + prefix)
+	hash, err := hex.DecodeString(value)
+
+	if err != nil || len(hash) == 0 {
+		writeError(res, badRequest("Invalid hash: " + value))
+		return nil, false
+	}
+
+	return hash, true
+}
+
+func writeJSON(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(body)
+}
+
+func writeError(res http.ResponseWriter, err *APIError) {
+	writeJSON(res, err.Status, err)
+}
+
+func writeMethodNotAllowed(res http.ResponseWriter) {
+	writeError(res, &APIError{http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed"})
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/jfperren/Peerster/common"
 	"github.com/jfperren/Peerster/gossiper"
 	"os"
@@ -13,51 +15,201 @@ func main() {
 
 	// Define Flags
 
-	uiPort := flag.String("UIPort", "8080", "port for the UI client")
+	configPath := flag.String("config", "", "configuration file, whose settings are overridden by the flags given on the command line")
+	uiPort := flag.String("UIPort", "8080", "port for the UI client, and for the GUI in server mode")
+	clientAddr := flag.String("clientAddr", "", "UDP address on which the node accepts commands from the client, defaults to :UIPort")
+	webAddr := flag.String("webAddr", "", "address of the GUI and the REST API in server mode, defaults to :UIPort")
 	gossipAddr := flag.String("gossipAddr", "127.0.0.1:5000", "port for the gossiper")
 	name := flag.String("name", "REQUIRED", "name of the gossiper")
 	peers := flag.String("peers", "REQUIRED", "comma separated list of peers of the form ip:port")
 	simple := flag.Bool("simple", false, "runs gossiper in simple broadcast mode")
 	server := flag.Bool("server", false, "runs this node in server mode")
 	rtimer := flag.Int("rtimer", 0, "route rumors sending period in seconds, 0 to disable sending of route rumors.")
-	verbose := flag.Bool("verbose", false, "display additional logs (useful for testing)")
+	verbose := flag.Bool("verbose", false, "display additional logs (useful for testing), same as -logLevel=debug")
+	logLevel := flag.String("logLevel", "", "minimum level of logs (debug, info, warn or error), optionally by category, e.g. info,search=debug")
+	logFormat := flag.String("logFormat", "assignment", "format of logs: assignment, text (key=value fields) or json")
+	logFile := flag.String("logFile", "", "file to which logs are appended instead of being printed to stdout")
+	logBuffer := flag.Int("logBuffer", 0, "number of latest log entries kept in memory and served by the API, 0 to disable")
 	separatefs := flag.Bool("separatefs", false, "set to true to use its own _Download and _SharedFile folder")
-    keySize := flag.Int("keySize", common.CryptoKeySize, "set RSA key size")
-    signOnly := flag.Bool("sign-only", false, "set to true to only sign messages")
-    cypherIfPossible := flag.Bool("cypher-if-possible", false, "set to true to cypher all messages that can be cyphered")
-    mixLength := flag.Uint("mixlength", 0, "number of mixer nodes messages should go through")
-    
+	dataDir := flag.String("dataDir", "", "directory in which the node persists its state, empty to keep it in memory only")
+	keySize := flag.Int("keySize", common.CryptoKeySize, "set RSA key size")
+	signOnly := flag.Bool("sign-only", false, "set to true to only sign messages")
+	cypherIfPossible := flag.Bool("cypher-if-possible", false, "set to true to cypher all messages that can be cyphered")
+	mixLength := flag.Uint("mixlength", 0, "number of mixer nodes messages should go through")
+	downloadWindow := flag.Int("downloadWindow", common.DownloadWindow, "maximum number of chunks requested in parallel for one download")
+	tcp := flag.Bool("tcp", false, "also accept TCP connections on gossipAddr and use them for big packets")
+	capture := flag.String("capture", "", "file in which every packet exchanged with other nodes is recorded, to be read with the capture command")
+	faults := flag.String("faults", "", "faults injected in the UDP packets of the node to test it on a flaky network, e.g. drop=0.1,delay=0.2;peer=127.0.0.1:5001,corrupt=0.05")
+	tlsCert := flag.String("tlsCert", "", "certificate (PEM) to serve the GUI and API over HTTPS in server mode")
+	tlsKey := flag.String("tlsKey", "", "private key (PEM) of the certificate given in tlsCert")
+	readToken := flag.String("readToken", os.Getenv("PEERSTER_READ_TOKEN"), "token giving read-only access to the API, defaults to $PEERSTER_READ_TOKEN")
+	adminToken := flag.String("adminToken", os.Getenv("PEERSTER_ADMIN_TOKEN"), "token giving full access to the API, defaults to $PEERSTER_ADMIN_TOKEN")
+
 	flag.Parse()
 
-	var g *gossiper.Gossiper
+	if *configPath != "" {
+		if err := loadConfig(*configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	// -verbose is kept as a shortcut for -logLevel=debug
+	if *logLevel == "" {
+		*logLevel = "info"
+		if *verbose {
+			*logLevel = "debug"
+		}
+	}
+
+	if err := setUpLogging(*logLevel, *logFormat, *logFile, *logBuffer); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	cryptoOpts := 0
+	if *cypherIfPossible {
+		cryptoOpts = common.CypherIfPossible
+	} else if *signOnly {
+		cryptoOpts = common.SignOnly
+	}
+
+	// The client uses UDP and the web server TCP, so both can use UIPort
+	if *clientAddr == "" {
+		*clientAddr = ":" + *uiPort
+	}
+
+	if *webAddr == "" {
+		*webAddr = ":" + *uiPort
+	}
+
+	faultConfig, err := common.ParseFaults(*faults)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	udpSocket, err := common.NewUDPSocket(*gossipAddr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var socket common.Socket = udpSocket
 
-    cryptoOpts := 0
-    if *cypherIfPossible {
-        cryptoOpts = common.CypherIfPossible
-    } else if *signOnly {
-        cryptoOpts = common.SignOnly
-    }
+	if *faults != "" {
+		socket = common.NewFaultySocket(socket, faultConfig)
+	}
+
+	g, err := gossiper.NewGossiperOn(socket, *clientAddr, *name, *peers, *simple, *rtimer, *separatefs, *dataDir, *keySize, cryptoOpts, *mixLength)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
+	var web *gossiper.WebServer
 
 	if *server {
-		g = gossiper.NewGossiper(*gossipAddr, "", *name, *peers, *simple, *rtimer, *separatefs, *keySize, cryptoOpts, *mixLength)
-		gossiper.StartWebServer(g, *uiPort)
-		common.DebugStartGossiper("no_client_address", g.GossipSocket.Address, g.Name, g.Router.Peers, g.Simple, g.Router.Rtimer)
-	} else {
-		g = gossiper.NewGossiper(*gossipAddr, ":"+*uiPort, *name, *peers, *simple, *rtimer, *separatefs, *keySize, cryptoOpts, *mixLength)
-		common.DebugStartGossiper(g.ClientSocket.Address, g.GossipSocket.Address, g.Name, g.Router.Peers, g.Simple, g.Router.Rtimer)
+		web, err = gossiper.StartWebServer(g, *webAddr, gossiper.WebServerOptions{
+			CertFile:   *tlsCert,
+			KeyFile:    *tlsKey,
+			ReadToken:  *readToken,
+			AdminToken: *adminToken,
+		})
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	}
 
-	common.Verbose = *verbose
+	common.DebugStartGossiper(g.ClientSocket.Address, g.GossipSocket.LocalAddress(), g.Name, g.Router.Neighbors(), g.Simple, g.Router.Rtimer)
+
+	g.DownloadWindow = *downloadWindow
+
+	if *tcp {
+		if err := g.EnableTCP(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if *capture != "" {
+		if err := g.EnableCapture(*capture); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
 
 	g.Start()
 
-	c := make(chan os.Signal)
+	// Run until interrupted, then give the gossiper and the web server some time to stop cleanly
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+
+	ctx, cancel := context.WithTimeout(context.Background(), common.ShutdownTimeout)
+	defer cancel()
+
+	// Open event streams only end once the gossiper stops, so the web server is shut down at the same time
+	served := make(chan error, 1)
+
 	go func() {
-		<-c
-		g.Stop()
-		common.DebugStopGossiper()
-		os.Exit(1)
+		if web != nil {
+			served <- web.Shutdown(ctx)
+		} else {
+			served <- nil
+		}
 	}()
+
+	stopped := g.Stop(ctx)
+
+	if err := <-served; err != nil || stopped != nil {
+		os.Exit(1)
+	}
+}
+
+// Apply a configuration file to the flags that were not given and to the tunable settings
+func loadConfig(path string) error {
+
+	config, err := common.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	if err := config.ApplyFlags(flag.CommandLine); err != nil {
+		return err
+	}
+
+	return config.Tune()
+}
+
+// Replace the default logger by one with the given levels, format and sinks
+func setUpLogging(levels, format, file string, buffer int) error {
+
+	logFormat, err := common.ParseLogFormat(format)
+	if err != nil {
+		return err
+	}
+
+	sink := common.NewWriterSink(os.Stdout, logFormat)
+
+	if file != "" {
+		if sink, err = common.NewFileSink(file, logFormat); err != nil {
+			return err
+		}
+	}
+
+	logger := common.NewLogger(common.LevelInfo, sink)
+
+	if buffer > 0 {
+		logger.SetSinks(sink, common.NewRingSink(buffer))
+	}
+
+	if err := logger.SetLevels(levels); err != nil {
+		return err
+	}
+
+	common.DefaultLogger = logger
+	return nil
 }
@@ -0,0 +1,107 @@
+package peerster
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dedis/protobuf"
+	"github.com/jfperren/Peerster/common"
+	"time"
+)
+
+// A Client sends commands to the client port of a running node, e.g. one started with the Peerster
+// executable, and waits for its responses. Commands are sent one at a time.
+//
+// Each command gets a new ID. Until the response with that ID arrives, the command is sent again every
+// common.ClientRetryInterval: the node only executes it once and answers each copy.
+type Client struct {
+	socket  *common.UDPSocket
+	address string // Client address of the node
+	nextID  uint32
+	Timeout time.Duration // How long to wait for a response
+}
+
+// Error returned by Client.Send when the node does not answer in time
+var ErrNoResponse = errors.New("peerster: no response from the node")
+
+// Create a client for the node listening for client commands on address. The client listens for responses
+// on an ephemeral port.
+func Dial(address string) (*Client, error) {
+
+	socket, err := common.NewUDPSocket("127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("peerster: %v", err)
+	}
+
+	// IDs differ from those of a previous client that used the same port, whose responses may be cached
+	firstID := uint32(time.Now().UnixNano())
+
+	return &Client{socket, address, firstID, common.ClientTimeout}, nil
+}
+
+// Send a command and wait for the response of the node. If the node reports an error, it is returned as
+// a *common.ResponseError along with the response.
+func (client *Client) Send(command *common.Command) (*common.Response, error) {
+
+	client.nextID++
+	if client.nextID == common.NoRequestID {
+		client.nextID++
+	}
+
+	command.ID = client.nextID
+
+	bytes, err := protobuf.Encode(command)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(client.Timeout)
+	defer client.socket.SetDeadline(time.Time{})
+
+	for time.Now().Before(deadline) {
+
+		if err := client.socket.Send(bytes, client.address); err != nil {
+			return nil, err
+		}
+
+		retry := time.Now().Add(common.ClientRetryInterval)
+		if retry.After(deadline) {
+			retry = deadline
+		}
+
+		if response, received := client.receive(command.ID, retry); received {
+
+			if response.Error != nil {
+				return response, response.Error
+			}
+
+			return response, nil
+		}
+	}
+
+	return nil, ErrNoResponse
+}
+
+// Wait for the response to the command with the given ID, ignoring late responses to previous commands
+func (client *Client) receive(id uint32, deadline time.Time) (*common.Response, bool) {
+
+	client.socket.SetDeadline(deadline)
+
+	for {
+
+		bytes, _, alive := client.socket.Receive()
+		if !alive {
+			return nil, false
+		}
+
+		var response common.Response
+
+		if protobuf.Decode(bytes, &response) == nil && response.ID == id {
+			return &response, true
+		}
+	}
+}
+
+// Stop listening for responses
+func (client *Client) Close() {
+	client.socket.Unbind()
+}
@@ -0,0 +1,292 @@
+// Package peerster lets Go programs run Peerster nodes without going through the command line.
+//
+// A Node wraps a gossiper configured with Options. Once started, it gossips with its peers in the
+// background until it is stopped, and reports what it receives on subscription channels:
+//
+//	node, err := peerster.New(peerster.Options{
+//		Name:          "Alice",
+//		GossipAddress: "127.0.0.1:5000",
+//		Peers:         []string{"127.0.0.1:5001"},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//
+//	rumors := node.Rumors()
+//	node.Start()
+//	defer node.Stop(context.Background())
+//
+//	node.Broadcast("Hello")
+//
+//	for rumor := range rumors {
+//		fmt.Printf("%v: %v\n", rumor.Origin, rumor.Text)
+//	}
+//
+// Subscription channels are buffered. A program that does not read them misses events rather than
+// slowing down the node. All channels are closed when the node stops.
+package peerster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"strings"
+	"time"
+)
+
+// Options of a Node. Only Name and GossipAddress are required, zero values give the defaults of the
+// Peerster executable.
+type Options struct {
+	Name               string        // Name of the node, should be unique in the network
+	GossipAddress      string        // Address on which the node listens to other nodes
+	ClientAddress      string        // Address on which the node listens for client commands, "" for none
+	Peers              []string      // Addresses of the initial neighbors. More are learnt later on.
+	Simple             bool          // Only broadcast simple messages, no gossip
+	RouteRumorInterval time.Duration // Time between route rumors, 0 for no route rumors
+	SeparateFS         bool          // Use subfolders named after the node for shared and downloaded files
+	DataDir            string        // Directory in which the state is persisted, "" to keep it in memory
+	CryptoMode         int           // 0, common.SignOnly or common.CypherIfPossible
+	KeySize            int           // Size of the RSA keys, 0 for common.CryptoKeySize
+	MixLength          uint          // Number of mixer nodes private messages go through
+	DownloadWindow     int           // Chunks requested in parallel per download, 0 for common.DownloadWindow
+	TCP                bool          // Also use TCP for big packets
+}
+
+// A Peerster node that can be embedded in another program.
+type Node struct {
+	Gossiper *gossiper.Gossiper // Underlying gossiper, for what the Node does not expose
+}
+
+// Error returned by New when Options.Name is missing
+var ErrNoName = errors.New("peerster: a node needs a name")
+
+// Error returned by New when Options.GossipAddress is missing
+var ErrNoGossipAddress = errors.New("peerster: a node needs a gossip address")
+
+// Error returned by Search when no keywords are given
+var ErrNoKeywords = errors.New("peerster: cannot search without keywords")
+
+// Create a new node. The node binds its sockets right away, but does not do anything until Start is called.
+func New(options Options) (*Node, error) {
+
+	if options.Name == "" {
+		return nil, ErrNoName
+	}
+
+	if options.GossipAddress == "" {
+		return nil, ErrNoGossipAddress
+	}
+
+	if options.KeySize == 0 {
+		options.KeySize = common.CryptoKeySize
+	}
+
+	g, err := gossiper.NewGossiper(options.GossipAddress, options.ClientAddress, options.Name,
+		strings.Join(options.Peers, ","), options.Simple, 0, options.SeparateFS, options.DataDir,
+		options.KeySize, options.CryptoMode, options.MixLength)
+
+	if err != nil {
+		return nil, fmt.Errorf("peerster: %v", err)
+	}
+
+	g.Router.Rtimer = options.RouteRumorInterval
+
+	if options.DownloadWindow > 0 {
+		g.DownloadWindow = options.DownloadWindow
+	}
+
+	if options.TCP {
+		if err := g.EnableTCP(); err != nil {
+			g.Stop(context.Background())
+			return nil, fmt.Errorf("peerster: %v", err)
+		}
+	}
+
+	return &Node{g}, nil
+}
+
+// Name of the node
+func (node *Node) Name() string {
+	return node.Gossiper.Name
+}
+
+// Start gossiping in the background.
+func (node *Node) Start() {
+	node.Gossiper.Start()
+}
+
+// Stop the node and wait until it has released everything, or until ctx is done. Subscription
+// channels are closed.
+func (node *Node) Stop(ctx context.Context) error {
+	return node.Gossiper.Stop(ctx)
+}
+
+// Addresses of the neighbors of the node
+func (node *Node) Peers() []string {
+
+	return node.Gossiper.Router.Neighbors()
+}
+
+//
+//  MESSAGES
+//
+
+// Send a rumor to every node in the network.
+func (node *Node) Broadcast(text string) error {
+
+	command, err := common.NewMessageCommand(text)
+	if err != nil {
+		return err
+	}
+
+	return node.Gossiper.HandleClient(command)
+}
+
+// Send a private message to another node.
+func (node *Node) SendPrivate(destination, text string) error {
+
+	command, err := common.NewPrivateMessageCommand(text, destination)
+	if err != nil {
+		return err
+	}
+
+	return node.Gossiper.HandleClient(command)
+}
+
+//
+//  FILES
+//
+
+// Share a file of the shared files folder with the network. Return the hash of its metafile, with
+// which other nodes can download it.
+func (node *Node) Share(fileName string) ([]byte, error) {
+
+	metaFile, err := node.Gossiper.Share(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return metaFile.Hash, nil
+}
+
+// Start downloading a file in the background. An empty peer downloads the file from the nodes that
+// matched previous searches. Use the returned download to follow its progress.
+func (node *Node) Download(fileName string, metaHash []byte, peer string) *gossiper.Download {
+	return node.Gossiper.StartDownload(fileName, metaHash, peer)
+}
+
+// All downloads, running or not
+func (node *Node) Downloads() []*gossiper.Download {
+	return node.Gossiper.Downloads.All()
+}
+
+// Search the network for files matching some keywords. Matches are sent on SearchMatches. With a
+// budget of 0, the budget is increased until enough matches are found.
+func (node *Node) Search(keywords []string, budget uint64) error {
+
+	if len(keywords) == 0 {
+		return ErrNoKeywords
+	}
+
+	node.Gossiper.StartSearch(keywords, budget)
+	return nil
+}
+
+// Blocks of the longest chain known to the node, from the first one to the latest.
+func (node *Node) Chain() []*common.Block {
+	return node.Gossiper.BlockChain.LongestChain()
+}
+
+//
+//  SUBSCRIPTIONS
+//
+
+// Receive all events of the node. Close the subscription when it is no longer needed.
+func (node *Node) Subscribe() *gossiper.Subscription {
+	return node.Gossiper.Events.Subscribe()
+}
+
+// Receive the chat rumors sent or received by the node, from the moment this is called.
+func (node *Node) Rumors() <-chan *common.RumorMessage {
+
+	rumors := make(chan *common.RumorMessage, common.EventBufferSize)
+
+	node.forward(func(event *gossiper.Event) {
+		if event.Rumor != nil {
+			select {
+			case rumors <- event.Rumor:
+			default: // The reader does not keep up, drop it
+			}
+		}
+	}, func() { close(rumors) })
+
+	return rumors
+}
+
+// Receive the private messages delivered to the node, from the moment this is called.
+func (node *Node) PrivateMessages() <-chan *common.PrivateMessage {
+
+	messages := make(chan *common.PrivateMessage, common.EventBufferSize)
+
+	node.forward(func(event *gossiper.Event) {
+		if event.PrivateMessage != nil {
+			select {
+			case messages <- event.PrivateMessage:
+			default: // The reader does not keep up, drop it
+			}
+		}
+	}, func() { close(messages) })
+
+	return messages
+}
+
+// Receive the results of searches that match their keywords, from the moment this is called.
+func (node *Node) SearchMatches() <-chan *gossiper.SearchMatch {
+
+	matches := make(chan *gossiper.SearchMatch, common.EventBufferSize)
+
+	node.forward(func(event *gossiper.Event) {
+		if event.SearchMatch != nil {
+			select {
+			case matches <- event.SearchMatch:
+			default: // The reader does not keep up, drop it
+			}
+		}
+	}, func() { close(matches) })
+
+	return matches
+}
+
+// Receive the blocks appended to the longest chain, from the moment this is called.
+func (node *Node) Blocks() <-chan *common.Block {
+
+	blocks := make(chan *common.Block, common.EventBufferSize)
+
+	node.forward(func(event *gossiper.Event) {
+		if event.Block != nil {
+			select {
+			case blocks <- event.Block:
+			default: // The reader does not keep up, drop it
+			}
+		}
+	}, func() { close(blocks) })
+
+	return blocks
+}
+
+// Pass every event of a new subscription to handle, then call done once the node stops.
+func (node *Node) forward(handle func(*gossiper.Event), done func()) {
+
+	subscription := node.Gossiper.Events.Subscribe()
+
+	go func() {
+
+		defer done()
+
+		for event := range subscription.Events {
+			handle(event)
+		}
+	}()
+}
@@ -1,9 +1,11 @@
 #!/bin/bash
 
-# Build client and gossiper
+# Build client, capture tool and gossiper
 go build
 cd client
 go build
+cd ../capture
+go build
 cd ..
 
 # Rename Peerster into gossiper
@@ -0,0 +1,231 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A Cluster runs gossipers in one process, connected through a simulated Network, so that their behavior
+// can be tested with go test rather than by spawning binaries.
+//
+// Each node shares and downloads files in its own temporary directory, which is removed by Stop.
+type Cluster struct {
+	Network *Network
+	Nodes   []*gossiper.Gossiper
+	dir     string
+}
+
+// Options of a cluster
+type Options struct {
+	Size       int        // Number of nodes
+	Seed       int64      // Seed of the network and of the random choices of gossipers
+	Topology   Topology   // Initial peers of each node, FullMesh if nil
+	Conditions Conditions // Conditions of all the links
+	RouteTimer int        // Time in seconds between route rumors, 0 to send none
+
+	// Faults injected in the packets of some nodes, by index. The GossipSocket of these nodes is a
+	// common.FaultySocket.
+	Faults map[int]*common.FaultConfig
+}
+
+// Neighbors of a node, by index, in a cluster of a given size
+type Topology func(index, size int) []int
+
+// Nodes are connected to the previous and the next one
+func Line(index, size int) []int {
+
+	neighbors := make([]int, 0)
+
+	if index > 0 {
+		neighbors = append(neighbors, index-1)
+	}
+
+	if index < size-1 {
+		neighbors = append(neighbors, index+1)
+	}
+
+	return neighbors
+}
+
+// Nodes are connected to the previous and the next one, and the last node to the first one
+func Ring(index, size int) []int {
+
+	if size < 3 {
+		return Line(index, size)
+	}
+
+	return []int{(index + size - 1) % size, (index + 1) % size}
+}
+
+// Every node is connected to every other one
+func FullMesh(index, size int) []int {
+
+	neighbors := make([]int, 0)
+
+	for i := 0; i < size; i++ {
+		if i != index {
+			neighbors = append(neighbors, i)
+		}
+	}
+
+	return neighbors
+}
+
+// Node 0 is connected to every other node, which are only connected to it
+func Star(index, size int) []int {
+
+	if index == 0 {
+		return FullMesh(index, size)
+	}
+
+	return []int{0}
+}
+
+// Address of a node on the network of a cluster
+func Address(index int) string {
+	return fmt.Sprintf("10.0.%v.%v:5000", index/250, index%250+1)
+}
+
+// Name of a node of a cluster
+func Name(index int) string {
+	return fmt.Sprintf("node%v", index)
+}
+
+//
+//  CLUSTER
+//
+
+// Create the nodes of a cluster. They do not run until Start is called.
+//
+// Note - The random choices of all gossipers are seeded with common.SeedRandom, so only one cluster
+// should run at a time.
+func NewCluster(options Options) (*Cluster, error) {
+
+	topology := options.Topology
+	if topology == nil {
+		topology = FullMesh
+	}
+
+	dir, err := ioutil.TempDir("", "peerster-simulation")
+	if err != nil {
+		return nil, err
+	}
+
+	common.SeedRandom(options.Seed)
+
+	cluster := &Cluster{
+		Network: NewNetwork(options.Seed, options.Conditions),
+		Nodes:   make([]*gossiper.Gossiper, options.Size),
+		dir:     dir,
+	}
+
+	for i := 0; i < options.Size; i++ {
+
+		peers := make([]string, 0)
+
+		for _, neighbor := range topology(i, options.Size) {
+			peers = append(peers, Address(neighbor))
+		}
+
+		socket, err := cluster.Network.Bind(Address(i))
+		if err != nil {
+			cluster.removeFiles()
+			return nil, err
+		}
+
+		var nodeSocket common.Socket = socket
+
+		if faults, found := options.Faults[i]; found {
+			nodeSocket = common.NewFaultySocket(socket, faults)
+		}
+
+		node, err := gossiper.NewGossiperOn(nodeSocket, "", Name(i), strings.Join(peers, ","), false, options.RouteTimer,
+			false, "", 0, 0, 0)
+
+		if err != nil {
+			cluster.removeFiles()
+			return nil, err
+		}
+
+		sharedPath := filepath.Join(dir, Name(i), "shared") + "/"
+		downloadPath := filepath.Join(dir, Name(i), "downloads") + "/"
+
+		for _, path := range []string{sharedPath, downloadPath} {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				cluster.removeFiles()
+				return nil, err
+			}
+		}
+
+		node.FileSystem = gossiper.NewFileSystem(sharedPath, downloadPath, "")
+		cluster.Nodes[i] = node
+	}
+
+	return cluster, nil
+}
+
+// Start all the nodes
+func (cluster *Cluster) Start() {
+	for _, node := range cluster.Nodes {
+		node.Start()
+	}
+}
+
+// Stop all the nodes and remove their files
+func (cluster *Cluster) Stop() {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, node := range cluster.Nodes {
+		node.Stop(ctx)
+	}
+
+	cluster.removeFiles()
+}
+
+func (cluster *Cluster) removeFiles() {
+	os.RemoveAll(cluster.dir)
+}
+
+// Write a file in the shared directory of a node and share it
+func (cluster *Cluster) Share(index int, name string, data []byte) (*gossiper.MetaFile, error) {
+
+	path := filepath.Join(cluster.dir, Name(index), "shared", name)
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return nil, err
+	}
+
+	return cluster.Nodes[index].Share(name)
+}
+
+// Content of a file downloaded by a node
+func (cluster *Cluster) Downloaded(index int, name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(cluster.dir, Name(index), "downloads", name))
+}
+
+// Wait until a condition holds, checking it every 10 milliseconds. Return false if it still does not after
+// timeout.
+func WaitFor(timeout time.Duration, condition func() bool) bool {
+
+	deadline := time.Now().Add(timeout)
+
+	for !condition() {
+
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
@@ -0,0 +1,292 @@
+package simulator
+
+import (
+	"errors"
+	"github.com/jfperren/Peerster/common"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Network carries packets between Sockets in memory, in place of UDP. Packets can be delayed, lost,
+// reordered and cut by partitions, following the Conditions of each link.
+//
+// Every decision (loss, delay, reordering) is drawn from a random generator seeded at creation, in the
+// order in which packets are sent. Goroutines of the gossipers are still scheduled by the runtime, so two
+// runs with the same seed make the same decisions for the same sequence of packets, but the sequence
+// itself may differ slightly.
+type Network struct {
+	conditions Conditions          // Conditions of links without their own
+	links      map[link]Conditions // Conditions by link, in both directions
+	groups     map[string]int      // Partition of each address, 0 if it is not in any
+	sockets    map[string]*Socket  // Bound sockets, by address
+	random     *rand.Rand
+	stats      Stats
+	lock       *sync.Mutex
+}
+
+// Conditions of the links of a network
+type Conditions struct {
+	Latency      time.Duration // Time a packet takes to reach its destination
+	Jitter       time.Duration // Random extra delay of each packet, up to Jitter
+	Loss         float64       // Probability that a packet is lost
+	Reorder      float64       // Probability that a packet is held for ReorderDelay, so that later packets overtake it
+	ReorderDelay time.Duration
+}
+
+// Number of packets handled by a network
+type Stats struct {
+	Sent      int // Packets sent by sockets, to a bound address or not
+	Delivered int // Packets put in the queue of their destination
+	Lost      int // Packets dropped because of Loss, a partition or a destination that is not bound
+	Overflow  int // Packets dropped because the queue of their destination was full
+}
+
+// Socket of a network, bound to an address. It implements common.Socket.
+type Socket struct {
+	address string
+	network *Network
+	packets chan *datagram
+	closed  chan struct{}
+	once    *sync.Once
+}
+
+type datagram struct {
+	bytes  []byte
+	source string
+}
+
+// Pair of addresses, in alphabetical order
+type link struct {
+	a, b string
+}
+
+// Number of packets that wait in a socket before it drops new ones, as the buffer of a UDP socket would
+const SocketQueueSize = 1024
+
+// Error returned when binding an address that is already bound
+var ErrAddressInUse = errors.New("address already in use")
+
+// Error returned when sending a packet bigger than common.SocketBufferSize, which would be truncated by UDP
+var ErrDatagramTooBig = errors.New("datagram too big")
+
+//
+//  NETWORK
+//
+
+// Create a network whose random decisions are drawn from the given seed
+func NewNetwork(seed int64, conditions Conditions) *Network {
+	return &Network{
+		conditions: conditions,
+		links:      make(map[link]Conditions),
+		groups:     make(map[string]int),
+		sockets:    make(map[string]*Socket),
+		random:     rand.New(rand.NewSource(seed)),
+		lock:       &sync.Mutex{},
+	}
+}
+
+func newLink(a, b string) link {
+
+	if b < a {
+		a, b = b, a
+	}
+
+	return link{a, b}
+}
+
+// Bind a socket to an address. The address can be bound again once the socket is unbound, e.g. to restart
+// a node.
+func (network *Network) Bind(address string) (*Socket, error) {
+
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	if _, found := network.sockets[address]; found {
+		return nil, ErrAddressInUse
+	}
+
+	socket := &Socket{
+		address: address,
+		network: network,
+		packets: make(chan *datagram, SocketQueueSize),
+		closed:  make(chan struct{}),
+		once:    &sync.Once{},
+	}
+
+	network.sockets[address] = socket
+
+	return socket, nil
+}
+
+// Set the conditions of all the links that do not have their own
+func (network *Network) SetConditions(conditions Conditions) {
+
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	network.conditions = conditions
+}
+
+// Set the conditions of the link between two addresses, in both directions
+func (network *Network) SetLink(a, b string, conditions Conditions) {
+
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	network.links[newLink(a, b)] = conditions
+}
+
+// Remove the conditions of the link between two addresses, which then follows those of the network
+func (network *Network) ResetLink(a, b string) {
+
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	delete(network.links, newLink(a, b))
+}
+
+// Split the network: addresses of different groups cannot reach each other anymore. Addresses that are in
+// no group form one more group. Replaces the previous partition, if any.
+func (network *Network) Partition(groups ...[]string) {
+
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	network.groups = make(map[string]int)
+
+	for i, group := range groups {
+		for _, address := range group {
+			network.groups[address] = i + 1
+		}
+	}
+}
+
+// Remove the partition, so that all addresses can reach each other again
+func (network *Network) Heal() {
+	network.Partition()
+}
+
+// Number of packets handled since the network was created
+func (network *Network) Stats() Stats {
+
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	return network.stats
+}
+
+// Decide the fate of a packet and schedule its delivery
+func (network *Network) send(bytes []byte, source, destination string) {
+
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	network.stats.Sent++
+
+	conditions, found := network.links[newLink(source, destination)]
+	if !found {
+		conditions = network.conditions
+	}
+
+	// Draw every number even when the packet is dropped, so that a partition does not shift the
+	// decisions made for later packets
+	lost := network.random.Float64() < conditions.Loss
+	reordered := network.random.Float64() < conditions.Reorder
+	jitter := network.random.Float64()
+
+	if lost || network.groups[source] != network.groups[destination] {
+		network.stats.Lost++
+		return
+	}
+
+	delay := conditions.Latency + time.Duration(jitter*float64(conditions.Jitter))
+
+	if reordered {
+		delay += conditions.ReorderDelay
+	}
+
+	packet := &datagram{append([]byte{}, bytes...), source}
+
+	if delay <= 0 {
+		network.deliver(packet, destination)
+		return
+	}
+
+	time.AfterFunc(delay, func() {
+
+		network.lock.Lock()
+		defer network.lock.Unlock()
+
+		network.deliver(packet, destination)
+	})
+}
+
+// Put a packet in the queue of its destination. Should be called with the lock.
+func (network *Network) deliver(packet *datagram, destination string) {
+
+	socket, found := network.sockets[destination]
+
+	if !found {
+		network.stats.Lost++
+		return
+	}
+
+	select {
+	case socket.packets <- packet:
+		network.stats.Delivered++
+	default:
+		network.stats.Overflow++
+	}
+}
+
+//
+//  SOCKET
+//
+
+func (socket *Socket) Send(bytes []byte, address string) error {
+
+	select {
+	case <-socket.closed:
+		return common.ErrTransportClosed
+	default:
+	}
+
+	if len(bytes) > common.SocketBufferSize {
+		return ErrDatagramTooBig
+	}
+
+	socket.network.send(bytes, socket.address, address)
+
+	return nil
+}
+
+func (socket *Socket) Receive() ([]byte, string, bool) {
+
+	select {
+	case packet := <-socket.packets:
+		return packet.bytes, packet.source, true
+	case <-socket.closed:
+		return []byte{}, "", false
+	}
+}
+
+// Close the socket and release its address. Packets still on their way to it are lost.
+func (socket *Socket) Unbind() {
+
+	socket.once.Do(func() {
+
+		close(socket.closed)
+
+		socket.network.lock.Lock()
+		defer socket.network.lock.Unlock()
+
+		if socket.network.sockets[socket.address] == socket {
+			delete(socket.network.sockets, socket.address)
+		}
+	})
+}
+
+func (socket *Socket) LocalAddress() string {
+	return socket.address
+}
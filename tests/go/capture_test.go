@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/simulator"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCaptureFile(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "peerster-capture")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "node.capture")
+
+	capture, err := common.NewCapture(path)
+	if err != nil {
+		t.Fatalf("Could not create the capture: %v", err)
+	}
+
+	capture.Record(common.CaptureIncoming, "127.0.0.1:5001", []byte("first"))
+	capture.Record(common.CaptureOutgoing, "127.0.0.1:5002", []byte("second"))
+	capture.Close()
+	capture.Record(common.CaptureOutgoing, "127.0.0.1:5002", []byte("ignored"))
+
+	// A packet that was only partially written is ignored
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{100, 1, 2})
+	file.Close()
+
+	packets, err := common.ReadCapture(path)
+	if err != nil {
+		t.Fatalf("Could not read the capture: %v", err)
+	}
+
+	if len(packets) != 2 {
+		t.Fatalf("Expected 2 packets, got %v", len(packets))
+	}
+
+	if packets[0].Direction != common.CaptureIncoming || packets[0].Peer != "127.0.0.1:5001" || !bytes.Equal(packets[0].Bytes, []byte("first")) {
+		t.Errorf("Unexpected first packet %+v", packets[0])
+	}
+
+	if packets[1].Direction != common.CaptureOutgoing || packets[1].Peer != "127.0.0.1:5002" || !bytes.Equal(packets[1].Bytes, []byte("second")) {
+		t.Errorf("Unexpected second packet %+v", packets[1])
+	}
+
+	if packets[1].Time < packets[0].Time || time.Since(packets[0].Timestamp()) > time.Minute {
+		t.Errorf("Packets should be timestamped when recorded")
+	}
+
+	ioutil.WriteFile(path, []byte("not a capture"), 0644)
+
+	if _, err := common.ReadCapture(path); err != common.ErrNotCapture {
+		t.Errorf("Expected ErrNotCapture, got %v", err)
+	}
+}
+
+func TestCaptureAndReplay(t *testing.T) {
+
+	holdMinedBlocks(t)
+
+	dir, _ := ioutil.TempDir("", "peerster-capture")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "node1.capture")
+
+	cluster, err := simulator.NewCluster(simulator.Options{Size: 2, Seed: 8, Topology: simulator.Line})
+	if err != nil {
+		t.Fatalf("Could not create the cluster: %v", err)
+	}
+
+	if err := cluster.Nodes[1].EnableCapture(path); err != nil {
+		t.Fatalf("Could not enable the capture: %v", err)
+	}
+
+	cluster.Start()
+
+	command, _ := common.NewMessageCommand("Reproduce me")
+	cluster.Nodes[0].HandleClient(command)
+
+	received := simulator.WaitFor(5*time.Second, func() bool {
+		return hasRumor(cluster.Nodes[1], simulator.Name(0), "Reproduce me")
+	})
+
+	// Stopping the node closes the capture
+	cluster.Stop()
+
+	if !received {
+		t.Fatalf("The rumor should have been received")
+	}
+
+	packets, err := common.ReadCapture(path)
+	if err != nil {
+		t.Fatalf("Could not read the capture: %v", err)
+	}
+
+	rumors, statuses := 0, 0
+
+	for _, captured := range packets {
+
+		packet, err := captured.Decode()
+		if err != nil || captured.Peer != simulator.Address(0) {
+			t.Errorf("Unexpected packet %+v", captured)
+			continue
+		}
+
+		switch {
+		case captured.Direction == common.CaptureIncoming && packet.Rumor != nil && packet.Rumor.Text == "Reproduce me":
+			rumors++
+		case captured.Direction == common.CaptureOutgoing && packet.Status != nil:
+			statuses++
+		}
+	}
+
+	if rumors == 0 || statuses == 0 {
+		t.Errorf("The capture should contain the rumor received and the statuses sent, got %v packets", len(packets))
+	}
+
+	// Replaying the capture into a fresh node gives it the same rumor
+	replay := startCluster(t, simulator.Options{Size: 1, Seed: 8})
+	defer replay.Stop()
+
+	if count := replay.Nodes[0].Replay(packets); count == 0 || count == len(packets) {
+		t.Errorf("Only incoming packets should be replayed, got %v of %v", count, len(packets))
+	}
+
+	replayed := simulator.WaitFor(5*time.Second, func() bool {
+		return hasRumor(replay.Nodes[0], simulator.Name(0), "Reproduce me")
+	})
+
+	if !replayed {
+		t.Errorf("The replayed rumor should have been received")
+	}
+}
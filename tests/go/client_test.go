@@ -0,0 +1,239 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/dedis/protobuf"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"github.com/jfperren/Peerster/peerster"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClientReceivesResponses(t *testing.T) {
+
+	node, err := peerster.New(peerster.Options{
+		Name:          "Alice",
+		GossipAddress: "127.0.0.1:9890",
+		ClientAddress: "127.0.0.1:9891",
+		Peers:         []string{"127.0.0.1:9899"},
+		SeparateFS:    true,
+	})
+
+	if err != nil {
+		t.Fatalf("Could not create node: %v", err)
+	}
+
+	node.Start()
+	defer node.Stop(context.Background())
+
+	client, err := peerster.Dial("127.0.0.1:9891")
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	defer client.Close()
+
+	command, _ := common.NewMessageCommand("Hello")
+
+	if _, err := client.Send(command); err != nil {
+		t.Errorf("Sending a rumor should succeed, got %v", err)
+	}
+
+	command, _ = common.NewListPeersCommand()
+	response, err := client.Send(command)
+
+	if err != nil || len(response.Peers) != 1 || response.Peers[0] != "127.0.0.1:9899" {
+		t.Errorf("Expected the initial peer, got %v (%v)", response, err)
+	}
+
+	// The node may mine a block in the meantime
+	chain := node.Chain()
+	command, _ = common.NewListBlocksCommand()
+	response, err = client.Send(command)
+
+	if err != nil || len(response.Blocks) < len(chain) {
+		t.Fatalf("Expected at least %v blocks, got %v (%v)", len(chain), response, err)
+	}
+
+	for i, block := range chain {
+		if hash := block.Hash(); !bytes.Equal(response.Blocks[i].Hash, hash[:]) {
+			t.Errorf("Block %v differs from the chain of the node", i)
+		}
+	}
+
+	// Errors of the node are reported to the client
+	command, _ = common.NewUploadCommand("missing.txt")
+
+	if _, err := client.Send(command); err == nil {
+		t.Errorf("Sharing a missing file should fail")
+	} else if e, ok := err.(*common.ResponseError); !ok || e.Code != common.ErrorNotFound {
+		t.Errorf("Expected a not_found error, got %v", err)
+	}
+
+	if _, err := client.Send(&common.Command{}); err == nil {
+		t.Errorf("An empty command should be rejected")
+	} else if e, ok := err.(*common.ResponseError); !ok || e.Code != common.ErrorBadRequest {
+		t.Errorf("Expected a bad_request error, got %v", err)
+	}
+
+	command, _ = common.NewSearchCommand("hello", 1)
+
+	if response, err := client.Send(command); err != nil || response.SearchID == "" {
+		t.Errorf("Expected the ID of the search, got %v (%v)", response, err)
+	}
+}
+
+func TestCommandsAreExecutedOnce(t *testing.T) {
+
+	g, err := gossiper.NewGossiper("127.0.0.1:9892", "127.0.0.1:9893", "Alice", "", false, 0, true, "", 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Could not create gossiper: %v", err)
+	}
+
+	g.Start()
+	defer g.Stop(context.Background())
+
+	socket, err := common.NewUDPSocket("127.0.0.1:9894")
+	if err != nil {
+		t.Fatalf("Could not bind socket: %v", err)
+	}
+	defer socket.Unbind()
+
+	// A client that missed the response sends the same command again
+	command, _ := common.NewMessageCommand("Hello")
+	command.ID = 42
+	bytes, _ := protobuf.Encode(command)
+
+	for i := 0; i < 2; i++ {
+
+		socket.Send(bytes, "127.0.0.1:9893")
+		socket.SetDeadline(time.Now().Add(2 * time.Second))
+
+		received, _, alive := socket.Receive()
+		if !alive {
+			t.Fatalf("No response to copy %v of the command", i)
+		}
+
+		var response common.Response
+		protobuf.Decode(received, &response)
+
+		if response.ID != 42 || response.Error != nil {
+			t.Errorf("Unexpected response %v", response)
+		}
+	}
+
+	if next := g.Rumors.NextIDFor("Alice"); next != 2 {
+		t.Errorf("The rumor should have been sent once, next ID is %v", next)
+	}
+}
+
+func TestQueryCommands(t *testing.T) {
+
+	g, err := gossiper.NewGossiper("127.0.0.1:9895", "127.0.0.1:9896", "Alice", "", false, 0, true, "", 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Could not create gossiper: %v", err)
+	}
+
+	g.Start()
+	defer g.Stop(context.Background())
+
+	client, err := peerster.Dial("127.0.0.1:9896")
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	defer client.Close()
+
+	command, _ := common.NewMessageCommand("Hello")
+	client.Send(command)
+
+	command, _ = common.NewStatusCommand()
+	response, err := client.Send(command)
+
+	if err != nil || response.Name != "Alice" {
+		t.Fatalf("Expected the status of Alice, got %v (%v)", response, err)
+	}
+
+	if len(response.Status) != 1 || response.Status[0].Identifier != "Alice" || response.Status[0].NextID != 2 {
+		t.Errorf("Expected vector clock Alice:2, got %v", response.Status)
+	}
+
+	command, _ = common.NewListFilesCommand()
+
+	if response, err := client.Send(command); err != nil || len(response.Files) != 0 {
+		t.Errorf("Expected no files, got %v (%v)", response, err)
+	}
+
+	result := &common.SearchResult{"hello.txt", make([]byte, 32), []uint64{1}, 1}
+	g.StartSearch([]string{"hello"}, 1)
+	g.SearchEngine.StoreResults([]*common.SearchResult{result}, "Bob")
+
+	command, _ = common.NewListMatchesCommand("")
+
+	if response, err := client.Send(command); err != nil || len(response.Matches) != 1 {
+		t.Errorf("Expected one search result, got %v (%v)", response, err)
+	}
+
+	command, _ = common.NewListMatchesCommand("other")
+
+	if response, err := client.Send(command); err != nil || len(response.Matches) != 0 {
+		t.Errorf("Expected no search result for other keywords, got %v (%v)", response, err)
+	}
+}
+
+func TestClientAndWebServerShareAPort(t *testing.T) {
+
+	g, err := gossiper.NewGossiper("127.0.0.1:9897", "127.0.0.1:9898", "Alice", "", false, 0, true, "", 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Could not create gossiper: %v", err)
+	}
+
+	g.Start()
+	defer g.Stop(context.Background())
+
+	server := startTestWebServer(t, g, "127.0.0.1:9898", gossiper.WebServerOptions{})
+	defer server.Shutdown(context.Background())
+
+	client, err := peerster.Dial("127.0.0.1:9898")
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	defer client.Close()
+
+	command, _ := common.NewMessageCommand("Hello")
+
+	if _, err := client.Send(command); err != nil {
+		t.Fatalf("The client should reach the node: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for {
+
+		res, err := http.Get("http://127.0.0.1:9898" + gossiper.APIPrefix + "/rumors")
+
+		if err == nil {
+
+			var rumors gossiper.Rumors
+			json.NewDecoder(res.Body).Decode(&rumors)
+			res.Body.Close()
+
+			if len(rumors.Rumors) != 1 || rumors.Next != "Alice:2" {
+				t.Errorf("The web server should serve the rumor sent by the client, got %v", rumors.Next)
+			}
+
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Could not reach the web server: %v", err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
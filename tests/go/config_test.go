@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"flag"
+	"github.com/jfperren/Peerster/common"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+# Node
+name = "Alice"
+peers = ["127.0.0.1:5001", '127.0.0.1:5002'] # Bootstrap peers
+rtimer = 5
+simple = true
+
+[tuning]
+antiEntropy = "250ms"
+maxSearchBudget = 64
+`
+
+func TestConfigSetsFlagsNotGiven(t *testing.T) {
+
+	config, err := common.ParseConfig("test.toml", testConfig)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	name := flags.String("name", "", "")
+	peers := flags.String("peers", "", "")
+	rtimer := flags.Int("rtimer", 0, "")
+	simple := flags.Bool("simple", false, "")
+
+	flags.Parse([]string{"-name=Bob"})
+
+	if err := config.ApplyFlags(flags); err != nil {
+		t.Fatalf("Could not apply config: %v", err)
+	}
+
+	if *name != "Bob" {
+		t.Errorf("Flags given on the command line should win, name is %v", *name)
+	}
+
+	if *peers != "127.0.0.1:5001,127.0.0.1:5002" || *rtimer != 5 || !*simple {
+		t.Errorf("Unexpected settings peers=%v rtimer=%v simple=%v", *peers, *rtimer, *simple)
+	}
+}
+
+func TestConfigTunesSettings(t *testing.T) {
+
+	keepTunables(t, "antiEntropy", "maxSearchBudget")
+
+	config, _ := common.ParseConfig("test.toml", testConfig)
+
+	if err := config.Tune(); err != nil {
+		t.Fatalf("Could not tune: %v", err)
+	}
+
+	if common.AntiEntropyDT != 250*time.Millisecond || common.MaxSearchBudget != 64 {
+		t.Errorf("Unexpected tuning %v %v", common.AntiEntropyDT, common.MaxSearchBudget)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+
+	cases := []struct {
+		contents string
+		error    string
+	}{
+		{"name = Alice", "test.toml:1: invalid value Alice, strings should be quoted"},
+		{"\n[network]", "test.toml:2: unknown section network"},
+		{"name = \"Alice\"\nname = \"Bob\"", "test.toml:2: duplicate key name"},
+		{"peers = [\"a\" \"b\"]", "test.toml:1: expected , between values"},
+	}
+
+	for _, c := range cases {
+		if _, err := common.ParseConfig("test.toml", c.contents); err == nil || err.Error() != c.error {
+			t.Errorf("Expected error %v, got %v", c.error, err)
+		}
+	}
+
+	config, _ := common.ParseConfig("test.toml", "[tuning]\nminingDifficulty = 300")
+
+	if err := config.Tune(); err == nil || !strings.Contains(err.Error(), "test.toml:2") {
+		t.Errorf("A difficulty that does not fit in a byte should be rejected, got %v", err)
+	}
+
+	config, _ = common.ParseConfig("test.toml", "nmae = \"Alice\"")
+
+	if err := config.ApplyFlags(flag.NewFlagSet("test", flag.ContinueOnError)); err == nil {
+		t.Errorf("Unknown settings should be rejected")
+	}
+}
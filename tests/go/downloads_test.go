@@ -0,0 +1,488 @@
+package tests
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/dedis/protobuf"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Neighbor of a gossiper that answers its data requests on behalf of seeders that only exist in the test.
+// Seeders in silent never answer. Replies are delayed, so that the requests of a download overlap.
+type fakeSeeders struct {
+	socket   *common.UDPSocket
+	gossiper *gossiper.Gossiper
+	data     map[string][]byte // Content of the chunks and metafiles, by hex hash
+	silent   map[string]bool
+	delay    time.Duration
+
+	requests    map[string]int // Number of requests received per seeder
+	hashes      map[string]int // Number of requests received per hash
+	inFlight    int            // Requests received and not answered yet
+	maxInFlight int
+	lock        *sync.Mutex
+}
+
+// Split data into chunks, and return the chunks, their hashes and the metafile listing them.
+func chunkData(data []byte) ([][]byte, [][]byte, []byte) {
+
+	chunks := make([][]byte, 0)
+	hashes := make([][]byte, 0)
+	metaFile := make([]byte, 0)
+
+	for i := 0; i < len(data); i += common.FileChunkSize {
+
+		end := i + common.FileChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		hash := sha256.Sum256(data[i:end])
+		chunks = append(chunks, data[i:end])
+		hashes = append(hashes, hash[:])
+		metaFile = append(metaFile, hash[:]...)
+	}
+
+	return chunks, hashes, metaFile
+}
+
+// Start a neighbor at address that serves data to g on behalf of seeders, and route them through it.
+// Return the fake seeders and the metahash of data.
+func startFakeSeeders(t *testing.T, g *gossiper.Gossiper, address string, seeders []string, data []byte) (*fakeSeeders, []byte) {
+
+	socket, err := common.NewUDPSocket(address)
+	if err != nil {
+		t.Fatalf("Could not bind fake seeders: %v", err)
+	}
+
+	fake := &fakeSeeders{
+		socket:   socket,
+		gossiper: g,
+		data:     make(map[string][]byte),
+		silent:   make(map[string]bool),
+		delay:    50 * time.Millisecond,
+		requests: make(map[string]int),
+		hashes:   make(map[string]int),
+		lock:     &sync.Mutex{},
+	}
+
+	chunks, hashes, metaFile := chunkData(data)
+
+	for i, chunk := range chunks {
+		fake.data[hex.EncodeToString(hashes[i])] = chunk
+	}
+
+	metaHash := sha256.Sum256(metaFile)
+	fake.data[hex.EncodeToString(metaHash[:])] = metaFile
+
+	g.Router.Mutex.Lock()
+
+	for _, seeder := range seeders {
+		g.Router.NextHop[seeder] = address
+	}
+
+	g.Router.Mutex.Unlock()
+
+	go fake.serve()
+
+	return fake, metaHash[:]
+}
+
+// Tell g that every seeder holds every chunk of the file, as if they had answered a search.
+func (fake *fakeSeeders) announce(name string, metaHash []byte, chunkCount int, seeders []string) {
+
+	chunkMap := make([]uint64, 0)
+
+	for i := 1; i <= chunkCount; i++ {
+		chunkMap = append(chunkMap, uint64(i))
+	}
+
+	fake.gossiper.RingSearch([]string{name}, 1)
+
+	// Each seeder answers the same search with the whole file
+	for _, seeder := range seeders {
+		result := &common.SearchResult{FileName: name, MetafileHash: metaHash, ChunkMap: chunkMap, ChunkCount: uint64(chunkCount)}
+		fake.gossiper.SearchEngine.StoreResults([]*common.SearchResult{result}, seeder)
+	}
+}
+
+// Stop answering the requests sent to seeder
+func (fake *fakeSeeders) mute(seeder string) {
+	fake.lock.Lock()
+	fake.silent[seeder] = true
+	fake.lock.Unlock()
+}
+
+func (fake *fakeSeeders) serve() {
+
+	for {
+
+		bytes, _, alive := fake.socket.Receive()
+
+		if !alive {
+			return
+		}
+
+		var packet common.GossipPacket
+
+		if protobuf.Decode(bytes, &packet) != nil || packet.DataRequest == nil {
+			continue
+		}
+
+		request := packet.DataRequest
+
+		fake.lock.Lock()
+		fake.requests[request.Destination]++
+		fake.hashes[hex.EncodeToString(request.HashValue)]++
+		silent := fake.silent[request.Destination]
+
+		if !silent {
+			fake.inFlight++
+			if fake.inFlight > fake.maxInFlight {
+				fake.maxInFlight = fake.inFlight
+			}
+		}
+
+		fake.lock.Unlock()
+
+		if !silent {
+			go fake.answer(request)
+		}
+	}
+}
+
+func (fake *fakeSeeders) answer(request *common.DataRequest) {
+
+	time.Sleep(fake.delay)
+
+	reply := &common.DataReply{
+		Origin:      request.Destination,
+		Destination: request.Origin,
+		HopLimit:    common.InitialHopLimit,
+		HashValue:   request.HashValue,
+		Data:        fake.data[hex.EncodeToString(request.HashValue)],
+	}
+
+	fake.lock.Lock()
+	fake.inFlight--
+	fake.lock.Unlock()
+
+	fake.gossiper.HandleGossip(reply.Packed(), fake.socket.Address)
+}
+
+// Number of requests received for each seeder and for each hash, and the highest number of requests that were
+// waiting for an answer at the same time.
+func (fake *fakeSeeders) stats() (map[string]int, map[string]int, int) {
+
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	requests := make(map[string]int)
+	hashes := make(map[string]int)
+
+	for seeder, count := range fake.requests {
+		requests[seeder] = count
+	}
+
+	for hash, count := range fake.hashes {
+		hashes[hash] = count
+	}
+
+	return requests, hashes, fake.maxInFlight
+}
+
+// Start a download and fail if it does not complete before timeout. The reconstructed file is removed.
+func downloadWithin(t *testing.T, g *gossiper.Gossiper, name string, metaHash []byte, seeder string, timeout time.Duration) {
+
+	download := g.StartDownload(name, metaHash, seeder)
+	deadline := time.Now().Add(timeout)
+
+	for download.State() == gossiper.DownloadRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if download.State() != gossiper.DownloadCompleted {
+		t.Fatalf("Download of %v did not complete in %v, is %v", name, timeout, download.State())
+	}
+
+	os.Remove(common.DownloadDir + g.Name + "/" + name)
+}
+
+func randomBytes(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+func TestDownloadKeepsWindowOfRequests(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9180", "Alice", "127.0.0.1:9181", "", 0)
+	defer stopTestGossiper(g)
+
+	g.DownloadWindow = 3
+
+	fake, metaHash := startFakeSeeders(t, g, "127.0.0.1:9181", []string{"Bob"}, randomBytes(10*common.FileChunkSize))
+	defer fake.socket.Unbind()
+
+	downloadWithin(t, g, "window.bin", metaHash, "Bob", 3*time.Second)
+
+	requests, _, maxInFlight := fake.stats()
+
+	// One request for the metafile, then one per chunk
+	if requests["Bob"] != 11 {
+		t.Errorf("Expected 11 requests, got %v", requests["Bob"])
+	}
+
+	if maxInFlight != g.DownloadWindow {
+		t.Errorf("Expected up to %v requests in flight, got %v", g.DownloadWindow, maxInFlight)
+	}
+}
+
+func TestDownloadSpreadsChunksAcrossSeeders(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9182", "Alice", "127.0.0.1:9183", "", 0)
+	defer stopTestGossiper(g)
+
+	seeders := []string{"Bob", "Charlie"}
+	fake, metaHash := startFakeSeeders(t, g, "127.0.0.1:9183", seeders, randomBytes(10*common.FileChunkSize))
+	defer fake.socket.Unbind()
+
+	fake.announce("spread.bin", metaHash, 10, seeders)
+
+	downloadWithin(t, g, "spread.bin", metaHash, "", 3*time.Second)
+
+	requests, _, _ := fake.stats()
+
+	if requests["Bob"] < 4 || requests["Charlie"] < 4 || requests["Bob"]+requests["Charlie"] != 11 {
+		t.Errorf("Chunks should be requested evenly from both seeders, got %v", requests)
+	}
+}
+
+func TestDownloadRetriesWithAnotherSeeder(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9184", "Alice", "127.0.0.1:9185", "", 0)
+	defer stopTestGossiper(g)
+
+	seeders := []string{"Bob", "Charlie"}
+	fake, metaHash := startFakeSeeders(t, g, "127.0.0.1:9185", seeders, randomBytes(6*common.FileChunkSize))
+	defer fake.socket.Unbind()
+
+	fake.mute("Bob")
+	fake.announce("retry.bin", metaHash, 6, seeders)
+
+	// The requests sent to Bob time out once, then go to Charlie
+	downloadWithin(t, g, "retry.bin", metaHash, "", 3*common.DownloadTimeout)
+
+	requests, hashes, _ := fake.stats()
+
+	if requests["Bob"] == 0 {
+		t.Errorf("Some requests should have been sent to Bob, got %v", requests)
+	}
+
+	for hash, count := range hashes {
+		if count > 2 {
+			t.Errorf("Hash %v should be requested at most twice, got %v", hash, count)
+		}
+	}
+
+	if len(hashes) != 7 {
+		t.Errorf("Expected requests for the metafile and 6 chunks, got %v", len(hashes))
+	}
+}
+
+func TestDownloadRequestsRepeatedChunksOnce(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9186", "Alice", "127.0.0.1:9187", "", 0)
+	defer stopTestGossiper(g)
+
+	// Chunks 1, 3 and 5 have the same content, as do chunks 2 and 4
+	first, second := randomBytes(common.FileChunkSize), randomBytes(common.FileChunkSize)
+	data := make([]byte, 0)
+
+	for _, chunk := range [][]byte{first, second, first, second, first, randomBytes(100)} {
+		data = append(data, chunk...)
+	}
+
+	fake, metaHash := startFakeSeeders(t, g, "127.0.0.1:9187", []string{"Bob"}, data)
+	defer fake.socket.Unbind()
+
+	downloadWithin(t, g, "repeated.bin", metaHash, "Bob", 3*time.Second)
+
+	requests, hashes, _ := fake.stats()
+
+	// One request for the metafile, then one per distinct chunk
+	if requests["Bob"] != 4 {
+		t.Errorf("Expected 4 requests, got %v", requests["Bob"])
+	}
+
+	for hash, count := range hashes {
+		if count != 1 {
+			t.Errorf("Hash %v should be requested once, got %v", hash, count)
+		}
+	}
+}
+
+func TestDownloadFailsWhenFileCannotBeWritten(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9188", "Alice", "127.0.0.1:9189", "", 0)
+	defer stopTestGossiper(g)
+
+	fake, metaHash := startFakeSeeders(t, g, "127.0.0.1:9189", []string{"Bob"}, randomBytes(2*common.FileChunkSize))
+	defer fake.socket.Unbind()
+
+	// A directory stands where the file should be written
+	path := common.DownloadDir + "Alice/unwritable.bin"
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	download := g.StartDownload("unwritable.bin", metaHash, "Bob")
+	deadline := time.Now().Add(3 * time.Second)
+
+	for download.State() == gossiper.DownloadRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if download.State() != gossiper.DownloadFailed {
+		t.Errorf("Download should have failed, is %v", download.State())
+	}
+}
+
+func TestDownloadPauseResumeCancel(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9190", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	hash := make([]byte, 32)
+	download := g.StartDownload("file.txt", hash, "Nobody")
+
+	if download.State() != gossiper.DownloadRunning {
+		t.Errorf("Download should be running, is %v", download.State())
+	}
+
+	if g.ResumeDownload(hash) == nil {
+		t.Errorf("Should not resume a running download")
+	}
+
+	if err := g.PauseDownload(hash); err != nil || download.State() != gossiper.DownloadPaused {
+		t.Errorf("Download should be paused, is %v (%v)", download.State(), err)
+	}
+
+	if err := g.ResumeDownload(hash); err != nil || download.State() != gossiper.DownloadRunning {
+		t.Errorf("Download should be running again, is %v (%v)", download.State(), err)
+	}
+
+	if err := g.CancelDownload(hash); err != nil || download.State() != gossiper.DownloadCancelled {
+		t.Errorf("Download should be cancelled, is %v (%v)", download.State(), err)
+	}
+
+	if len(g.Downloads.All()) != 0 {
+		t.Errorf("Cancelled download should not be listed")
+	}
+
+	if g.CancelDownload(hash) == nil {
+		t.Errorf("Should not cancel an unknown download")
+	}
+}
+
+func TestConcurrentDownloadControlsLaunchOnce(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9192", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	hash := make([]byte, 32)
+	downloads := make(chan *gossiper.Download, 50)
+	resumed := make(chan error, 50)
+
+	var wg sync.WaitGroup
+
+	// Calls are released together to make them overlap as much as possible
+	start := make(chan struct{})
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			downloads <- g.StartDownload("file.txt", hash, "Nobody")
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+	close(downloads)
+
+	download := <-downloads
+
+	for other := range downloads {
+		if other != download {
+			t.Fatalf("Concurrent downloads of the same file should share a single download")
+		}
+	}
+
+	g.PauseDownload(hash)
+	start = make(chan struct{})
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			resumed <- g.ResumeDownload(hash)
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+	close(resumed)
+
+	count := 0
+
+	for err := range resumed {
+		if err == nil {
+			count++
+		}
+	}
+
+	if count != 1 {
+		t.Errorf("Download should be resumed once, was resumed %v times", count)
+	}
+}
+
+func TestDownloadsAreRestored(t *testing.T) {
+
+	path := newTestDir(t)
+	defer os.RemoveAll(path)
+
+	paused := make([]byte, 32)
+	cancelled := make([]byte, 32)
+	cancelled[0] = 1
+
+	g := newTestGossiper(t, "127.0.0.1:9191", "Alice", "", path, 0)
+	g.StartDownload("paused.txt", paused, "Nobody")
+	g.StartDownload("cancelled.txt", cancelled, "Nobody")
+	g.PauseDownload(paused)
+	g.CancelDownload(cancelled)
+	stopTestGossiper(g)
+
+	g = newTestGossiper(t, "127.0.0.1:9191", "Alice", "", path, 0)
+	defer stopTestGossiper(g)
+
+	downloads := g.Downloads.All()
+
+	if len(downloads) != 1 {
+		t.Fatalf("Expected 1 download, got %v", len(downloads))
+	}
+
+	if downloads[0].Name != "paused.txt" || downloads[0].State() != gossiper.DownloadPaused {
+		t.Errorf("Wrong download %v in state %v", downloads[0].Name, downloads[0].State())
+	}
+}
@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"testing"
+	"time"
+)
+
+// Wait for the next event for which match returns true, skipping the others.
+func waitForEvent(t *testing.T, subscription *gossiper.Subscription, match func(*gossiper.Event) bool) *gossiper.Event {
+
+	timeout := time.After(2 * time.Second)
+
+	for {
+		select {
+		case event, open := <-subscription.Events:
+			if !open {
+				t.Fatalf("Subscription closed while waiting for an event")
+			}
+			if match(event) {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for an event")
+		}
+	}
+}
+
+func TestRumorAndRouteEvents(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9590", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	subscription := g.Events.Subscribe()
+
+	rumor := &common.RumorMessage{"Bob", 1, "Hello"}
+	g.HandleGossip(rumor.Packed(), "127.0.0.1:9599")
+
+	route := waitForEvent(t, subscription, func(event *gossiper.Event) bool { return event.Route != nil }).Route
+
+	if route.Origin != "Bob" || route.Address != "127.0.0.1:9599" {
+		t.Errorf("Unexpected route %v -> %v", route.Origin, route.Address)
+	}
+
+	received := waitForEvent(t, subscription, func(event *gossiper.Event) bool { return event.Rumor != nil }).Rumor
+
+	if received.Origin != "Bob" || received.Text != "Hello" {
+		t.Errorf("Unexpected rumor %v from %v", received.Text, received.Origin)
+	}
+
+	// Already known, should not be published again
+	g.HandleGossip(rumor.Packed(), "127.0.0.1:9599")
+
+	subscription.Close()
+
+	for event := range subscription.Events {
+		if event.Rumor != nil {
+			t.Errorf("Rumor should only be published once")
+		}
+	}
+}
+
+func TestBlockAndForkEvents(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9591", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	subscription := g.Events.Subscribe()
+	isBlock := func(event *gossiper.Event) bool { return event.Block != nil }
+
+	b0 := newGenesisBlock(make([]string, 0))
+	b1 := newValidBlock(b0.Hash(), make([]string, 0))
+	b1Fork := newValidBlock(b0.Hash(), make([]string, 0))
+	b2Fork := newValidBlock(b1Fork.Hash(), make([]string, 0))
+
+	g.BlockChain.TryAddBlock(b0)
+	g.BlockChain.TryAddBlock(b1)
+
+	if block := waitForEvent(t, subscription, isBlock).Block; block.Hash() != b0.Hash() {
+		t.Errorf("First block event should be b0")
+	}
+
+	if block := waitForEvent(t, subscription, isBlock).Block; block.Hash() != b1.Hash() {
+		t.Errorf("Second block event should be b1")
+	}
+
+	// A fork as long as the longest chain does not change anything, a longer one does
+	g.BlockChain.TryAddBlock(b1Fork)
+	g.BlockChain.TryAddBlock(b2Fork)
+
+	event := waitForEvent(t, subscription, func(event *gossiper.Event) bool { return event.ForkRewind != nil || isBlock(event) })
+
+	if event.ForkRewind == nil {
+		t.Fatalf("Expected a fork rewind before the blocks of the new branch")
+	}
+
+	rewind := event.ForkRewind
+
+	if len(rewind.Discarded) != 1 || rewind.Discarded[0].Hash() != b1.Hash() {
+		t.Errorf("Rewind should discard [b1], discards %v blocks", len(rewind.Discarded))
+	}
+
+	if len(rewind.Appended) != 2 || rewind.Appended[0].Hash() != b1Fork.Hash() || rewind.Appended[1].Hash() != b2Fork.Hash() {
+		t.Errorf("Rewind should append [b1Fork, b2Fork], appends %v blocks", len(rewind.Appended))
+	}
+
+	if block := waitForEvent(t, subscription, isBlock).Block; block.Hash() != b1Fork.Hash() {
+		t.Errorf("Block event should be b1Fork")
+	}
+
+	if block := waitForEvent(t, subscription, isBlock).Block; block.Hash() != b2Fork.Hash() {
+		t.Errorf("Block event should be b2Fork")
+	}
+}
+
+func TestDownloadProgressEvents(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9592", "Alice", "", "", 0)
+
+	subscription := g.Events.Subscribe()
+	isProgress := func(event *gossiper.Event) bool { return event.DownloadProgress != nil }
+
+	hash := make([]byte, 32)
+	g.StartDownload("file.txt", hash, "Nobody")
+
+	if progress := waitForEvent(t, subscription, isProgress).DownloadProgress; progress.State != gossiper.DownloadRunning {
+		t.Errorf("Download should be running, is %v", progress.State)
+	}
+
+	g.PauseDownload(hash)
+
+	if progress := waitForEvent(t, subscription, isProgress).DownloadProgress; progress.State != gossiper.DownloadPaused {
+		t.Errorf("Download should be paused, is %v", progress.State)
+	}
+
+	// Subscriptions are closed when the gossiper stops
+	stopTestGossiper(g)
+
+	for range subscription.Events {
+	}
+}
@@ -0,0 +1,213 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/simulator"
+	"testing"
+	"time"
+)
+
+func TestParseFaults(t *testing.T) {
+
+	config, err := common.ParseFaults("drop=0.1,delay=0.5,delayTime=50ms;peer=10.0.0.2:5000,corrupt=1,direction=in;seed=7,peer=10.0.0.3:5000")
+	if err != nil {
+		t.Fatalf("Could not parse faults: %v", err)
+	}
+
+	if faults := config.For("10.0.0.9:5000"); faults.Drop != 0.1 || faults.Delay != 0.5 || faults.DelayTime != 50*time.Millisecond {
+		t.Errorf("Unexpected default faults %+v", faults)
+	}
+
+	if faults := config.For("10.0.0.2:5000"); faults.Drop != 0 || faults.Corrupt != 1 || faults.Direction != common.FaultsIncoming {
+		t.Errorf("Faults of a peer should replace the default ones, got %+v", faults)
+	}
+
+	if config.Seed != 7 || len(config.Peers) != 2 {
+		t.Errorf("Expected seed 7 and two peers, got %+v", config)
+	}
+
+	for _, spec := range []string{"drop", "drop=2", "loss=0.1", "direction=up", "delayTime=-1s", "drop=0.1;delay=0.1",
+		"peer=a,drop=1;peer=a,drop=0.5"} {
+		if _, err := common.ParseFaults(spec); err == nil {
+			t.Errorf("Faults %v should be rejected", spec)
+		}
+	}
+}
+
+func TestFaultySocketInjectsFaults(t *testing.T) {
+
+	send := func(spec string, packets ...string) ([]string, common.FaultStats) {
+
+		network := simulator.NewNetwork(1, simulator.Conditions{})
+		a, _ := network.Bind("10.0.0.1:5000")
+		b, _ := network.Bind("10.0.0.2:5000")
+		defer b.Unbind()
+
+		config, err := common.ParseFaults(spec)
+		if err != nil {
+			t.Fatalf("Could not parse faults: %v", err)
+		}
+
+		faulty := common.NewFaultySocket(a, config)
+		defer faulty.Unbind()
+
+		for _, packet := range packets {
+			faulty.Send([]byte(packet), b.LocalAddress())
+		}
+
+		return receiveAll(b, 100*time.Millisecond), faulty.Stats()
+	}
+
+	if received, stats := send("drop=1", "a", "b"); len(received) != 0 || stats.Dropped != 2 {
+		t.Errorf("Dropped packets should not arrive, got %v", received)
+	}
+
+	if received, _ := send("duplicate=1", "a"); len(received) != 2 || received[0] != "a" || received[1] != "a" {
+		t.Errorf("Duplicated packets should arrive twice, got %v", received)
+	}
+
+	if received, _ := send("reorder=1,delayTime=1s", "a", "b"); len(received) != 2 || received[0] != "b" || received[1] != "a" {
+		t.Errorf("A held packet should arrive after the next one, got %v", received)
+	}
+
+	if received, stats := send("delay=1,delayTime=50ms", "a"); len(received) != 1 || stats.Delayed != 1 {
+		t.Errorf("A delayed packet should arrive later, got %v", received)
+	}
+
+	if received, _ := send("drop=1,direction=in", "a"); len(received) != 1 {
+		t.Errorf("Faults of incoming packets should not apply to sent packets, got %v", received)
+	}
+
+	if received, _ := send("drop=1;peer=10.0.0.2:5000,drop=0", "a"); len(received) != 1 {
+		t.Errorf("Faults of a peer should replace the default ones, got %v", received)
+	}
+
+	received, stats := send("corrupt=1,seed=3", "hello")
+
+	if len(received) != 1 || stats.Corrupted != 1 || received[0] == "hello" || bitsDiffer([]byte(received[0]), []byte("hello")) != 1 {
+		t.Errorf("Exactly one bit of a corrupted packet should be flipped, got %q", received)
+	}
+}
+
+func TestRumorsSurviveFaults(t *testing.T) {
+
+	holdMinedBlocks(t)
+
+	faults, _ := common.ParseFaults("drop=0.3,duplicate=0.2,reorder=0.2,delayTime=20ms,seed=1")
+
+	cluster := startCluster(t, simulator.Options{
+		Size:     4,
+		Seed:     6,
+		Topology: simulator.Ring,
+		Faults:   map[int]*common.FaultConfig{0: faults, 2: faults},
+	})
+	defer cluster.Stop()
+
+	command, _ := common.NewMessageCommand("Anybody there?")
+	cluster.Nodes[0].HandleClient(command)
+
+	received := simulator.WaitFor(15*time.Second, func() bool {
+		for _, node := range cluster.Nodes {
+			if !hasRumor(node, simulator.Name(0), "Anybody there?") {
+				return false
+			}
+		}
+		return true
+	})
+
+	if !received {
+		t.Fatalf("All nodes should eventually receive the rumor")
+	}
+
+	if stats := cluster.Nodes[0].GossipSocket.(*common.FaultySocket).Stats(); stats.Dropped == 0 {
+		t.Errorf("Some packets should have been dropped, got %+v", stats)
+	}
+}
+
+func TestDownloadSurvivesCorruption(t *testing.T) {
+
+	holdMinedBlocks(t)
+
+	setTunable(t, "downloadTimeout", "200ms")
+
+	// Only packets of the seeder are corrupted
+	faults, _ := common.ParseFaults("corrupt=0.5,direction=out,seed=2")
+
+	cluster := startCluster(t, simulator.Options{
+		Size:       2,
+		Seed:       7,
+		Topology:   simulator.Line,
+		RouteTimer: 1,
+		Faults:     map[int]*common.FaultConfig{1: faults},
+	})
+	defer cluster.Stop()
+
+	waitForRoute(t, cluster.Nodes[0], simulator.Name(1))
+
+	data := randomData(8*common.FileChunkSize, 7)
+
+	metaFile, err := cluster.Share(1, "movie.mp4", data)
+	if err != nil {
+		t.Fatalf("Could not share the file: %v", err)
+	}
+
+	download := cluster.Nodes[0].StartDownload("movie.mp4", metaFile.Hash, simulator.Name(1))
+	waitForDownload(t, download)
+
+	if downloaded, _ := cluster.Downloaded(0, "movie.mp4"); !bytes.Equal(downloaded, data) {
+		t.Errorf("The downloaded file should be identical despite corrupted replies")
+	}
+
+	if stats := cluster.Nodes[1].GossipSocket.(*common.FaultySocket).Stats(); stats.Corrupted == 0 {
+		t.Errorf("Some packets should have been corrupted, got %+v", stats)
+	}
+
+	if cluster.Nodes[0].Metrics.ChunkRetries.Value() == 0 {
+		t.Errorf("Corrupted replies should have been requested again")
+	}
+}
+
+// Packets received by a socket until none arrives for the given time
+func receiveAll(socket common.Socket, quiet time.Duration) []string {
+
+	packets := make(chan string, 64)
+
+	go func() {
+		for {
+			data, _, ok := socket.Receive()
+			if !ok {
+				return
+			}
+			packets <- string(data)
+		}
+	}()
+
+	received := make([]string, 0)
+
+	for {
+		select {
+		case packet := <-packets:
+			received = append(received, packet)
+		case <-time.After(quiet):
+			return received
+		}
+	}
+}
+
+func bitsDiffer(a, b []byte) int {
+
+	if len(a) != len(b) {
+		return -1
+	}
+
+	count := 0
+
+	for i := range a {
+		for diff := a[i] ^ b[i]; diff != 0; diff &= diff - 1 {
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestDir(t *testing.T) string {
+
+	path, err := ioutil.TempDir("", "peerster-files")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+
+	return path
+}
+
+func writeRandomFile(t *testing.T, path string, size int) []byte {
+
+	data := make([]byte, size)
+	rand.Read(data)
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Could not write file %v: %v", path, err)
+	}
+
+	return data
+}
+
+func TestChunkStorePersistsBlobs(t *testing.T) {
+
+	path := newTestDir(t)
+	defer os.RemoveAll(path)
+
+	store, _ := gossiper.NewChunkStore(path)
+	hash := store.Put([]byte("some data"))
+	other := sha256.Sum256([]byte("other data"))
+
+	// Reopening the store should find blobs stored previously
+	store, _ = gossiper.NewChunkStore(path)
+
+	data, found := store.Get(hash)
+
+	if !found || !bytes.Equal(data, []byte("some data")) {
+		t.Errorf("Should find blob that was stored, got %v", data)
+	}
+
+	if store.Has(other[:]) {
+		t.Errorf("Should not find blob that was never stored")
+	}
+}
+
+func TestChunkStoreTemporary(t *testing.T) {
+
+	store, _ := gossiper.NewChunkStore("")
+	hash := store.Put([]byte("some data"))
+
+	if !store.Has(hash) {
+		t.Errorf("Should find blob that was stored")
+	}
+
+	store.Close()
+
+	if _, found := store.Get(hash); found {
+		t.Errorf("Temporary store should be deleted on close")
+	}
+}
+
+func TestScanSmallFileKeepsFlatMetaFile(t *testing.T) {
+
+	path := newTestDir(t)
+	defer os.RemoveAll(path)
+
+	data := writeRandomFile(t, filepath.Join(path, "small.bin"), 3*common.FileChunkSize+10)
+
+	fs := gossiper.NewFileSystem(path+"/", path+"/", "")
+	defer fs.Close()
+
+	metaFile, err := fs.ScanFile("small.bin")
+	if err != nil {
+		t.Fatalf("Could not scan file: %v", err)
+	}
+
+	// Metafile should be the concatenation of the hashes of each chunk, as in the original protocol
+	expected := make([]byte, 0)
+
+	for i := 0; i < len(data); i += common.FileChunkSize {
+		end := i + common.FileChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha256.Sum256(data[i:end])
+		expected = append(expected, hash[:]...)
+	}
+
+	if !bytes.Equal(metaFile.Data, expected) {
+		t.Errorf("Metafile does not contain the hashes of each chunk")
+	}
+
+	if metaFile.Size != len(data) {
+		t.Errorf("Metafile has size %v, expected %v", metaFile.Size, len(data))
+	}
+}
+
+func TestScanBigFileBuildsIndexMetaFile(t *testing.T) {
+
+	path := newTestDir(t)
+	defer os.RemoveAll(path)
+
+	size := 3 * common.FileChunkSize * common.FileChunkSize / sha256.Size
+	writeRandomFile(t, filepath.Join(path, "big.bin"), size)
+
+	fs := gossiper.NewFileSystem(path+"/", path+"/", "")
+	defer fs.Close()
+
+	metaFile, err := fs.ScanFile("big.bin")
+	if err != nil {
+		t.Fatalf("Could not scan file bigger than 2Mb: %v", err)
+	}
+
+	if len(metaFile.Data) != 1+3*sha256.Size || metaFile.Data[0] != 1 {
+		t.Errorf("Expected index metafile of depth 1 with 3 children, got %v bytes", len(metaFile.Data))
+	}
+
+	if metaFile.Size != size {
+		t.Errorf("Metafile has size %v, expected %v", metaFile.Size, size)
+	}
+
+	results := fs.Search([]string{"big"})
+
+	if len(results) != 1 || results[0].ChunkCount != uint64(size/common.FileChunkSize) {
+		t.Errorf("Expected one search result with %v chunks, got %v", size/common.FileChunkSize, results)
+	}
+}
@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"testing"
+)
+
+func TestFragmentsAreReassembled(t *testing.T) {
+
+	data := make([]byte, 10*common.FragmentDataSize+42)
+	rand.Read(data)
+
+	fragmenter := gossiper.NewFragmenter()
+	fragments, err := fragmenter.Split(data)
+
+	if err != nil || len(fragments) != 11 {
+		t.Fatalf("Expected 11 fragments, got %v (%v)", len(fragments), err)
+	}
+
+	receiver := gossiper.NewFragmenter()
+
+	// Fragments may arrive in any order, and some of them more than once
+	for i := len(fragments) - 1; i > 0; i-- {
+
+		if _, complete := receiver.Add("A", fragments[i]); complete {
+			t.Fatalf("Packet should not be complete before receiving all fragments")
+		}
+
+		receiver.Add("A", fragments[i])
+	}
+
+	// Fragments from another source belong to another packet
+	if _, complete := receiver.Add("B", fragments[0]); complete {
+		t.Errorf("Fragments from different sources should not be mixed")
+	}
+
+	reassembled, complete := receiver.Add("A", fragments[0])
+
+	if !complete || !bytes.Equal(reassembled, data) {
+		t.Errorf("Wrong reassembled packet of size %v", len(reassembled))
+	}
+}
+
+func TestFragmentLimits(t *testing.T) {
+
+	fragmenter := gossiper.NewFragmenter()
+
+	if _, err := fragmenter.Split(make([]byte, common.MaxFragmentCount*common.FragmentDataSize+1)); err == nil {
+		t.Errorf("Should refuse to split a packet into too many fragments")
+	}
+
+	invalid := &common.Fragment{ID: 1, Index: 2, Count: 2, Data: []byte{1}}
+
+	if _, complete := fragmenter.Add("A", invalid); complete {
+		t.Errorf("Should ignore fragment with index out of range")
+	}
+
+	single := &common.Fragment{ID: 2, Index: 0, Count: 1, Data: []byte{1, 2, 3}}
+
+	if data, complete := fragmenter.Add("A", single); !complete || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("Single fragment should be reassembled right away")
+	}
+}
@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"context"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGossipersStopCleanly(t *testing.T) {
+
+	for round := 0; round < 2; round++ {
+
+		alice := newTestGossiper(t, "127.0.0.1:9390", "Alice", "127.0.0.1:9391", "", 1)
+		bob := newTestGossiper(t, "127.0.0.1:9391", "Bob", "127.0.0.1:9390", "", 1)
+
+		alice.Start()
+		bob.Start()
+
+		command, _ := common.NewMessageCommand("Hello")
+		alice.HandleClient(command)
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for bob.Rumors.Get("Alice", 1) == nil && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		if bob.Rumors.Get("Alice", 1) == nil {
+			t.Errorf("Bob should have received the rumor from Alice")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+
+		// Both gossipers should stop in time, and release their ports for the next round
+		if err := alice.Stop(ctx); err != nil {
+			t.Fatalf("Alice did not stop in time: %v", err)
+		}
+
+		if err := bob.Stop(ctx); err != nil {
+			t.Fatalf("Bob did not stop in time: %v", err)
+		}
+
+		cancel()
+	}
+}
+
+func TestGossiperReleasesSocketsWhenStorageFails(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "peerster-data")
+	if err != nil {
+		t.Fatalf("Could not create temporary file: %v", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	// A file cannot be used as data directory
+	g, err := gossiper.NewGossiper("127.0.0.1:9392", "127.0.0.1:9393", "Alice", "", false, 0, true, file.Name(), 0, 0, 0)
+
+	if err == nil {
+		g.Stop(context.Background())
+		t.Fatalf("Expected an error when the storage cannot be opened")
+	}
+
+	for _, address := range []string{"127.0.0.1:9392", "127.0.0.1:9393"} {
+
+		socket, err := common.NewUDPSocket(address)
+		if err != nil {
+			t.Fatalf("Socket %v should have been released: %v", address, err)
+		}
+
+		socket.Unbind()
+	}
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"github.com/jfperren/Peerster/simulator"
+	"testing"
+	"time"
+)
+
+func TestUnresponsivePeerIsEvictedAndReadmitted(t *testing.T) {
+
+	holdMinedBlocks(t)
+
+	setTunable(t, "statusTimeout", "100ms")
+	setTunable(t, "antiEntropy", "100ms")
+	setTunable(t, "peerSuspectTimeouts", "2")
+	setTunable(t, "peerEvictTime", "300ms")
+
+	cluster := startCluster(t, simulator.Options{Size: 3, Seed: 9, Topology: simulator.FullMesh})
+	defer cluster.Stop()
+
+	node := cluster.Nodes[0]
+	sub := node.Events.Subscribe()
+	defer sub.Close()
+
+	cluster.Network.Partition([]string{simulator.Address(0), simulator.Address(1)}, []string{simulator.Address(2)})
+
+	// Rumors sent to node2 are not acknowledged anymore
+	evicted := false
+
+	for i := 0; i < 50 && !evicted; i++ {
+
+		command, _ := common.NewMessageCommand(fmt.Sprintf("Are you there? %v", i))
+		node.HandleClient(command)
+		time.Sleep(100 * time.Millisecond)
+
+		evicted = peerState(node, simulator.Address(2)) == gossiper.PeerEvicted
+	}
+
+	if !evicted {
+		t.Fatalf("node2 should have been evicted, got %+v", node.Router.Health())
+	}
+
+	if common.Contains(node.Router.Neighbors(), simulator.Address(2)) || node.Metrics.PeersEvicted.Value() == 0 {
+		t.Errorf("An evicted peer should be removed from the peers, got %v", node.Router.Neighbors())
+	}
+
+	waitForEvent(t, sub, func(event *gossiper.Event) bool {
+		return event.PeerState != nil && event.PeerState.Address == simulator.Address(2) &&
+			event.PeerState.State == gossiper.PeerSuspected
+	})
+
+	if health := healthOf(node, simulator.Address(1)); health == nil || health.State != gossiper.PeerAlive || health.RTT == 0 {
+		t.Errorf("node1 should be alive with a measured round-trip time, got %+v", health)
+	}
+
+	// Once the partition is healed, node2 answers the status packets sent to evicted peers
+	cluster.Network.Heal()
+
+	readmitted := simulator.WaitFor(5*time.Second, func() bool {
+		return peerState(node, simulator.Address(2)) == gossiper.PeerAlive
+	})
+
+	if !readmitted || !common.Contains(node.Router.Neighbors(), simulator.Address(2)) {
+		t.Fatalf("node2 should have been admitted again, got %+v", node.Router.Health())
+	}
+
+	if health := healthOf(node, simulator.Address(2)); health.Timeouts != 0 || health.LastHeard.IsZero() {
+		t.Errorf("Hearing from a peer should reset its timeouts, got %+v", health)
+	}
+}
+
+func healthOf(node *gossiper.Gossiper, address string) *gossiper.PeerHealth {
+
+	for _, health := range node.Router.Health() {
+		if health.Address == address {
+			return &health
+		}
+	}
+
+	return nil
+}
+
+func peerState(node *gossiper.Gossiper, address string) gossiper.PeerState {
+
+	if health := healthOf(node, address); health != nil {
+		return health.State
+	}
+
+	return -1
+}
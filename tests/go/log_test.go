@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/jfperren/Peerster/common"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLoggerFiltersLevelsByCategory(t *testing.T) {
+
+	logger := common.NewLogger(common.LevelInfo)
+
+	if err := logger.SetLevels("warn,search=debug"); err != nil {
+		t.Fatalf("Could not set levels: %v", err)
+	}
+
+	if logger.Enabled(common.LevelInfo, common.CategoryRumor) {
+		t.Errorf("Info entries of rumor should be discarded")
+	}
+
+	if !logger.Enabled(common.LevelError, common.CategoryRumor) {
+		t.Errorf("Error entries of rumor should be logged")
+	}
+
+	if !logger.Enabled(common.LevelDebug, common.CategorySearch) {
+		t.Errorf("Debug entries of search should be logged")
+	}
+
+	for _, spec := range []string{"loud", "chain=loud", "gossip=debug"} {
+		if err := logger.SetLevels(spec); err == nil {
+			t.Errorf("Levels %v should be rejected", spec)
+		}
+	}
+}
+
+func TestLogFormats(t *testing.T) {
+
+	var assignment, text, json bytes.Buffer
+
+	logger := common.NewLogger(common.LevelInfo,
+		common.NewWriterSink(&assignment, common.FormatAssignment),
+		common.NewWriterSink(&text, common.FormatText),
+		common.NewWriterSink(&json, common.FormatJSON),
+	)
+
+	logger.Emit(common.LevelInfo, common.CategoryRumor, "rumor", "RUMOR origin Alice from 127.0.0.1:5000 ID 1 contents Hello World",
+		"origin", "Alice", "from", "127.0.0.1:5000", "id", 1, "contents", "Hello World")
+	logger.Emit(common.LevelDebug, common.CategoryRumor, "timeout", "TIMEOUT from 127.0.0.1:5000")
+
+	if assignment.String() != "RUMOR origin Alice from 127.0.0.1:5000 ID 1 contents Hello World\n" {
+		t.Errorf("Unexpected assignment format %q", assignment.String())
+	}
+
+	if !strings.Contains(text.String(), ` INFO  rumor   rumor origin=Alice from=127.0.0.1:5000 id=1 contents="Hello World"`) {
+		t.Errorf("Unexpected text format %q", text.String())
+	}
+
+	expected := `{"seq":1,"time":"`
+	fields := `","level":"info","category":"rumor","msg":"rumor","origin":"Alice","from":"127.0.0.1:5000","id":1,"contents":"Hello World"}`
+
+	if !strings.HasPrefix(json.String(), expected) || !strings.HasSuffix(json.String(), fields+"\n") {
+		t.Errorf("Unexpected JSON format %q", json.String())
+	}
+}
+
+func TestRingSinkKeepsLatestEntries(t *testing.T) {
+
+	ring := common.NewRingSink(3)
+	logger := common.NewLogger(common.LevelDebug, ring)
+
+	for i := 0; i < 5; i++ {
+		logger.Emit(common.LevelInfo, common.CategoryChain, "found block", "FOUND-BLOCK")
+	}
+
+	entries := ring.Since(0)
+
+	if len(entries) != 3 || entries[0].Seq != 3 || entries[2].Seq != 5 {
+		t.Fatalf("Expected entries 3 to 5, got %v", entries)
+	}
+
+	if entries := ring.Since(4); len(entries) != 1 || entries[0].Seq != 5 {
+		t.Errorf("Expected entry 5 only, got %v", entries)
+	}
+
+	if logger.Ring() != ring {
+		t.Errorf("The ring should be found among the sinks of the logger")
+	}
+}
+
+func TestWebServerServesLogs(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9990", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	server := newTestWebServer(g)
+	defer server.Close()
+
+	var logs struct {
+		Entries []map[string]interface{}
+		Next    uint64
+	}
+
+	if status := callAPI(t, server, "GET", "/logs", nil, nil); status != 404 {
+		t.Errorf("Logs are not kept in memory by default, got status %v", status)
+	}
+
+	defaultLogger := common.DefaultLogger
+	defer func() { common.DefaultLogger = defaultLogger }()
+
+	common.DefaultLogger = common.NewLogger(common.LevelDebug, common.NewRingSink(16))
+
+	common.LogMongering("127.0.0.1:5001")
+	common.LogFoundBlock([32]byte{})
+
+	if status := callAPI(t, server, "GET", "/logs?category=rumor", nil, &logs); status != 200 {
+		t.Fatalf("Expected the logs, got status %v", status)
+	}
+
+	if len(logs.Entries) != 1 || logs.Entries[0]["msg"] != "mongering" || logs.Entries[0]["peer"] != "127.0.0.1:5001" {
+		t.Errorf("Expected the mongering entry, got %v", logs.Entries)
+	}
+
+	next := logs.Next
+	logs.Entries = nil
+
+	common.LogSearchFinished()
+	callAPI(t, server, "GET", "/logs?category=search&since="+strconv.FormatUint(next, 10), nil, &logs)
+
+	if len(logs.Entries) != 1 || logs.Entries[0]["msg"] != "search finished" {
+		t.Errorf("Expected only the new entry, got %v", logs.Entries)
+	}
+
+	if status := callAPI(t, server, "GET", "/logs?level=loud", nil, nil); status != 400 {
+		t.Errorf("An unknown level should be rejected, got status %v", status)
+	}
+}
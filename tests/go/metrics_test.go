@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsTextFormat(t *testing.T) {
+
+	registry := common.NewMetricRegistry()
+
+	packets := registry.CounterVec("packets_total", "Packets by type", "type")
+	packets.With("status").Add(2)
+	packets.With("rumor").Inc()
+
+	latency := registry.Histogram("latency_seconds", "Latency", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(3)
+
+	registry.GaugeFunc("peers", "Peers", func() float64 { return 4 })
+
+	var text bytes.Buffer
+	registry.WriteText(&text)
+
+	expected := `# HELP peerster_packets_total Packets by type
+# TYPE peerster_packets_total counter
+peerster_packets_total{type="rumor"} 1
+peerster_packets_total{type="status"} 2
+# HELP peerster_latency_seconds Latency
+# TYPE peerster_latency_seconds histogram
+peerster_latency_seconds_bucket{le="0.1"} 1
+peerster_latency_seconds_bucket{le="1"} 2
+peerster_latency_seconds_bucket{le="+Inf"} 3
+peerster_latency_seconds_sum 3.55
+peerster_latency_seconds_count 3
+# HELP peerster_peers Peers
+# TYPE peerster_peers gauge
+peerster_peers 4
+`
+
+	if text.String() != expected {
+		t.Errorf("Unexpected metrics:\n%v", text.String())
+	}
+}
+
+func TestGossiperCountsPackets(t *testing.T) {
+
+	alice := newTestGossiper(t, "127.0.0.1:9991", "Alice", "127.0.0.1:9992", "", 0)
+	bob := newTestGossiper(t, "127.0.0.1:9992", "Bob", "127.0.0.1:9991", "", 0)
+
+	alice.Start()
+	defer stopTestGossiper(alice)
+
+	bob.Start()
+	defer stopTestGossiper(bob)
+
+	command, _ := common.NewMessageCommand("Hello")
+	alice.HandleClient(command)
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for bob.Metrics.PacketsReceived.With("rumor").Value() == 0 {
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Bob should have counted the rumor of Alice")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if alice.Metrics.PacketsSent.With("rumor").Value() == 0 || alice.Metrics.MongeringRounds.Value() == 0 {
+		t.Errorf("Alice should have counted the rumor she sent")
+	}
+
+	// The same search request twice in a row is spam
+	for i := 0; i < 2; i++ {
+		request := &common.SearchRequest{Origin: "Charlie", Budget: 1, Keywords: []string{"hello"}}
+		bob.HandleGossip(&common.GossipPacket{SearchRequest: request}, "127.0.0.1:9991")
+	}
+
+	if processed, dropped := bob.Metrics.SearchesProcessed.Value(), bob.Metrics.SearchesDropped.Value(); processed != 1 || dropped != 1 {
+		t.Errorf("Expected 1 search processed and 1 dropped, got %v and %v", processed, dropped)
+	}
+
+	server := startTestWebServer(t, bob, "127.0.0.1:9994", gossiper.WebServerOptions{})
+	defer server.Shutdown(context.Background())
+
+	var res *http.Response
+	var err error
+
+	for {
+
+		if res, err = http.Get("http://127.0.0.1:9994" + gossiper.APIPrefix + "/metrics"); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline.Add(2 * time.Second)) {
+			t.Fatalf("Could not reach the web server: %v", err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+
+	for _, line := range []string{"peerster_search_requests_dropped_total 1", "peerster_peers 1", `peerster_packets_received_total{type="rumor"} `} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("Metrics should contain %v, got:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"context"
+	"github.com/jfperren/Peerster/peerster"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T, name, address, peer string) *peerster.Node {
+
+	node, err := peerster.New(peerster.Options{
+		Name:          name,
+		GossipAddress: address,
+		Peers:         []string{peer},
+		SeparateFS:    true,
+	})
+
+	if err != nil {
+		t.Fatalf("Could not create %v: %v", name, err)
+	}
+
+	return node
+}
+
+func TestNodeOptionsAreChecked(t *testing.T) {
+
+	if _, err := peerster.New(peerster.Options{GossipAddress: "127.0.0.1:9490"}); err != peerster.ErrNoName {
+		t.Errorf("Expected ErrNoName, got %v", err)
+	}
+
+	if _, err := peerster.New(peerster.Options{Name: "Alice"}); err != peerster.ErrNoGossipAddress {
+		t.Errorf("Expected ErrNoGossipAddress, got %v", err)
+	}
+
+	if _, err := peerster.New(peerster.Options{Name: "Alice", GossipAddress: "not an address"}); err == nil {
+		t.Errorf("Expected an error when the address cannot be bound")
+	}
+}
+
+func TestNodesExchangeMessages(t *testing.T) {
+
+	alice := newTestNode(t, "Alice", "127.0.0.1:9491", "127.0.0.1:9492")
+	bob := newTestNode(t, "Bob", "127.0.0.1:9492", "127.0.0.1:9491")
+
+	rumors := bob.Rumors()
+	messages := alice.PrivateMessages()
+
+	alice.Start()
+	bob.Start()
+
+	if err := alice.Broadcast("Hello"); err != nil {
+		t.Fatalf("Could not broadcast: %v", err)
+	}
+
+	select {
+	case rumor := <-rumors:
+		if rumor.Origin != "Alice" || rumor.Text != "Hello" {
+			t.Errorf("Unexpected rumor %v from %v", rumor.Text, rumor.Origin)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Bob should have received the rumor from Alice")
+	}
+
+	// Bob knows the route to Alice from her rumor
+	if err := bob.SendPrivate("Alice", "Hi"); err != nil {
+		t.Fatalf("Could not send private message: %v", err)
+	}
+
+	select {
+	case message := <-messages:
+		if message.Origin != "Bob" || message.Text != "Hi" {
+			t.Errorf("Unexpected private message %v from %v", message.Text, message.Origin)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Alice should have received the private message from Bob")
+	}
+
+	alice.Stop(context.Background())
+	bob.Stop(context.Background())
+
+	// Subscription channels are closed once the node stops
+	select {
+	case _, open := <-messages:
+		if open {
+			t.Errorf("Channel should be closed")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Channel should be closed")
+	}
+}
@@ -11,7 +11,7 @@ import (
 
 var (
 
-    Alice = gossiper.NewGossiper(
+    Alice, _ = gossiper.NewGossiper(
         "127.0.0.1:9090",
         "",
         "Alice",
@@ -19,11 +19,12 @@ var (
         false,
         0,
         true,
+        "",
         common.CryptoKeySize,
         common.CypherIfPossible,
         1)
 
-    Bob = gossiper.NewGossiper(
+    Bob, _ = gossiper.NewGossiper(
         "127.0.0.1:9091",
         "",
         "Bob",
@@ -31,11 +32,12 @@ var (
         false,
         0,
         true,
+        "",
         common.CryptoKeySize,
         common.CypherIfPossible,
         2)
 
-    Charlie = gossiper.NewGossiper(
+    Charlie, _ = gossiper.NewGossiper(
         "127.0.0.1:9092",
         "",
         "Charlie",
@@ -43,11 +45,12 @@ var (
         false,
         0,
         true,
+        "",
         common.CryptoKeySize,
         common.CypherIfPossible,
         1)
 
-    Delta = gossiper.NewGossiper(
+    Delta, _ = gossiper.NewGossiper(
         "127.0.0.1:9093",
         "",
         "Delta",
@@ -55,6 +58,7 @@ var (
         false,
         0,
         true,
+        "",
         common.CryptoKeySize,
         common.CypherIfPossible,
         2)
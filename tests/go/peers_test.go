@@ -0,0 +1,292 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/dedis/protobuf"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"github.com/jfperren/Peerster/simulator"
+	"testing"
+	"time"
+)
+
+func TestPeerExchangeDiscoversNeighbors(t *testing.T) {
+
+	holdMinedBlocks(t)
+
+	setTunable(t, "peerExchange", "100ms")
+	setTunable(t, "antiEntropy", "100ms")
+
+	cluster := startCluster(t, simulator.Options{Size: 5, Seed: 10, Topology: simulator.Line})
+	defer cluster.Stop()
+
+	// node0 only knows node1 at first
+	discovered := simulator.WaitFor(10*time.Second, func() bool {
+
+		for i := 1; i < len(cluster.Nodes); i++ {
+			if !common.Contains(cluster.Nodes[0].Router.Neighbors(), simulator.Address(i)) {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	if !discovered {
+		t.Fatalf("node0 should have discovered every node, got %v", cluster.Nodes[0].Router.Neighbors())
+	}
+
+	for i, node := range cluster.Nodes {
+		if common.Contains(node.Router.Neighbors(), simulator.Address(i)) {
+			t.Errorf("node%v should not be its own peer, got %v", i, node.Router.Neighbors())
+		}
+	}
+}
+
+func TestExchangedPeersArePassiveUntilHeard(t *testing.T) {
+
+	setTunable(t, "antiEntropy", "100ms")
+
+	cluster := startCluster(t, simulator.Options{Size: 1, Seed: 10})
+	defer cluster.Stop()
+
+	node := cluster.Nodes[0]
+
+	// Of the exchanged peers, only this one exists and answers
+	socket, err := cluster.Network.Bind("10.0.0.13:5000")
+	if err != nil {
+		t.Fatalf("Could not bind socket: %v", err)
+	}
+	defer socket.Unbind()
+
+	go func() {
+		for {
+			_, source, ok := socket.Receive()
+			if !ok {
+				return
+			}
+
+			status := &common.StatusPacket{Want: []common.PeerStatus{{Identifier: "node13", NextID: 1}}}
+			bytes, _ := protobuf.Encode(status.Packed())
+			socket.Send(bytes, source)
+		}
+	}()
+
+	exchange := &common.PeerExchange{Peers: []string{
+		simulator.Address(0), "10.0.0.11:5000", "10.0.0.12:5000", "10.0.0.13:5000",
+	}}
+
+	node.HandleGossip(exchange.Packed(), "10.0.0.10:5000")
+
+	if neighbors := node.Router.Neighbors(); len(neighbors) != 0 {
+		t.Errorf("Exchanged peers should not become neighbors right away, got %v", neighbors)
+	}
+
+	for _, peer := range exchange.Peers[1:] {
+		if state := peerState(node, peer); state != gossiper.PeerPassive {
+			t.Errorf("%v should be passive, is %v", peer, state)
+		}
+	}
+
+	promoted := simulator.WaitFor(5*time.Second, func() bool {
+		return common.Contains(node.Router.Neighbors(), "10.0.0.13:5000")
+	})
+
+	if !promoted {
+		t.Fatalf("The peer that answered should have become a neighbor, got %+v", node.Router.Health())
+	}
+
+	// Peers that never answered are not promoted, even though the active view has room
+	time.Sleep(3 * common.AntiEntropyDT)
+
+	for _, peer := range []string{"10.0.0.11:5000", "10.0.0.12:5000"} {
+		if state := peerState(node, peer); state != gossiper.PeerPassive {
+			t.Errorf("%v should still be passive, is %v", peer, state)
+		}
+	}
+}
+
+func TestPeerAddedByHandReplacesNeighbor(t *testing.T) {
+
+	setTunable(t, "maxPeers", "3")
+
+	node := newTestGossiper(t, "127.0.0.1:9298", "Alice", "10.0.0.11:5000,10.0.0.12:5000,10.0.0.13:5000,10.0.0.14:5000", "", 0)
+	defer stopTestGossiper(node)
+
+	if state := peerState(node, "10.0.0.14:5000"); len(node.Router.Neighbors()) != 3 || state != gossiper.PeerPassive {
+		t.Errorf("Peers beyond MaxPeers should be passive, got %+v", node.Router.Health())
+	}
+
+	// Adding a peer by hand makes room for it in the active view
+	node.Router.AddPeerIfNeeded("10.0.0.14:5000")
+
+	if len(node.Router.Neighbors()) != common.MaxPeers || !common.Contains(node.Router.Neighbors(), "10.0.0.14:5000") {
+		t.Errorf("The peer should have replaced a neighbor, got %v", node.Router.Neighbors())
+	}
+}
+
+func TestActiveViewIsBoundedAndRepaired(t *testing.T) {
+
+	holdMinedBlocks(t)
+
+	setTunable(t, "statusTimeout", "100ms")
+	setTunable(t, "antiEntropy", "100ms")
+	setTunable(t, "peerExchange", "100ms")
+	setTunable(t, "peerSuspectTimeouts", "2")
+	setTunable(t, "peerEvictTime", "300ms")
+	setTunable(t, "maxPeers", "3")
+	setTunable(t, "passiveViewSize", "4")
+
+	cluster := startCluster(t, simulator.Options{Size: 10, Seed: 11, Topology: simulator.Ring})
+	defer cluster.Stop()
+
+	node := cluster.Nodes[0]
+
+	filled := simulator.WaitFor(10*time.Second, func() bool {
+		return len(node.Router.Neighbors()) == common.MaxPeers && countState(node, gossiper.PeerPassive) > 0
+	})
+
+	if !filled {
+		t.Fatalf("node0 should have a full active view and passive peers, got %+v", node.Router.Health())
+	}
+
+	for i, other := range cluster.Nodes {
+		if len(other.Router.Neighbors()) > common.MaxPeers || countState(other, gossiper.PeerPassive) > common.PassiveViewSize {
+			t.Errorf("The views of node%v should be bounded, got %+v", i, other.Router.Health())
+		}
+	}
+
+	// Rumors still reach every node through the active views
+	command, _ := common.NewMessageCommand("Hello everyone")
+	node.HandleClient(command)
+
+	received := simulator.WaitFor(10*time.Second, func() bool {
+
+		for _, other := range cluster.Nodes {
+			if !hasRumor(other, simulator.Name(0), "Hello everyone") {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	if !received {
+		t.Fatalf("The rumor should have reached every node")
+	}
+
+	// A neighbor that stops answering is replaced by a passive peer
+	lost := node.Router.Neighbors()[0]
+	others := make([]string, 0)
+
+	for i := range cluster.Nodes {
+		if simulator.Address(i) != lost {
+			others = append(others, simulator.Address(i))
+		}
+	}
+
+	cluster.Network.Partition([]string{lost}, others)
+
+	repaired := false
+
+	for i := 0; i < 50 && !repaired; i++ {
+
+		command, _ := common.NewMessageCommand(fmt.Sprintf("Still there? %v", i))
+		node.HandleClient(command)
+		time.Sleep(100 * time.Millisecond)
+
+		repaired = peerState(node, lost) == gossiper.PeerEvicted && len(node.Router.Neighbors()) == common.MaxPeers
+	}
+
+	if !repaired {
+		t.Fatalf("%v should have been replaced by a passive peer, got %+v", lost, node.Router.Health())
+	}
+}
+
+func countState(node *gossiper.Gossiper, state gossiper.PeerState) int {
+
+	count := 0
+
+	for _, health := range node.Router.Health() {
+		if health.State == state {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestPeerExchangeDropsInvalidAndOwnAddresses(t *testing.T) {
+
+	// Bound to every interface, so that any loopback or interface address with this port is its own
+	node := newTestGossiper(t, "0.0.0.0:9295", "Alice", "", "", 0)
+	defer stopTestGossiper(node)
+
+	exchange := &common.PeerExchange{Peers: []string{
+		"", "not an address", "10.0.0.11", "10.0.0.11:0", "0.0.0.0:9295", "127.0.0.1:9295", "localhost:9295",
+		"127.0.0.1:9296",
+	}}
+
+	node.HandleGossip(exchange.Packed(), "127.0.0.1:9297")
+
+	if health := node.Router.Health(); len(health) != 1 || health[0].Address != "127.0.0.1:9296" {
+		t.Errorf("Expected to only learn 127.0.0.1:9296, got %+v", health)
+	}
+}
+
+func TestPeerExchangeOnlySharesLiveNeighbors(t *testing.T) {
+
+	cluster := startCluster(t, simulator.Options{Size: 1, Seed: 10})
+	defer cluster.Stop()
+
+	node := cluster.Nodes[0]
+
+	alive, _ := cluster.Network.Bind("10.0.0.21:5000")
+	defer alive.Unbind()
+
+	asking, _ := cluster.Network.Bind("10.0.0.22:5000")
+	defer asking.Unbind()
+
+	// A neighbor that was never heard from, and a passive peer
+	node.Router.AddPeerIfNeeded("10.0.0.23:5000")
+	node.HandleGossip((&common.PeerExchange{Peers: []string{"10.0.0.24:5000"}, Reply: true}).Packed(), "10.0.0.22:5000")
+
+	status := &common.StatusPacket{Want: []common.PeerStatus{{Identifier: "node21", NextID: 1}}}
+	bytes, _ := protobuf.Encode(status.Packed())
+	alive.Send(bytes, simulator.Address(0))
+
+	if !simulator.WaitFor(5*time.Second, func() bool { return common.Contains(node.Router.Neighbors(), "10.0.0.21:5000") }) {
+		t.Fatalf("10.0.0.21:5000 should be a neighbor, got %v", node.Router.Neighbors())
+	}
+
+	replies := make(chan *common.PeerExchange, 1)
+
+	go func() {
+		for {
+			bytes, _, ok := asking.Receive()
+			if !ok {
+				return
+			}
+
+			var packet common.GossipPacket
+			protobuf.Decode(bytes, &packet)
+
+			if packet.PeerExchange != nil {
+				replies <- packet.PeerExchange
+				return
+			}
+		}
+	}()
+
+	bytes, _ = protobuf.Encode((&common.PeerExchange{}).Packed())
+	asking.Send(bytes, simulator.Address(0))
+
+	select {
+	case reply := <-replies:
+		if len(reply.Peers) != 1 || reply.Peers[0] != "10.0.0.21:5000" {
+			t.Errorf("Only the neighbor that was heard from should be shared, got %v", reply.Peers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected an answer to the peer exchange")
+	}
+}
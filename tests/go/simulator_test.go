@@ -0,0 +1,469 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"github.com/jfperren/Peerster/simulator"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSimulatedNetworkConditions(t *testing.T) {
+
+	network := simulator.NewNetwork(1, simulator.Conditions{Latency: 50 * time.Millisecond})
+
+	a, _ := network.Bind("10.0.0.1:5000")
+	b, _ := network.Bind("10.0.0.2:5000")
+	defer a.Unbind()
+	defer b.Unbind()
+
+	if _, err := network.Bind("10.0.0.1:5000"); err != simulator.ErrAddressInUse {
+		t.Errorf("An address should not be bound twice, got %v", err)
+	}
+
+	start := time.Now()
+	a.Send([]byte("hello"), b.LocalAddress())
+
+	if data, source, ok := b.Receive(); !ok || string(data) != "hello" || source != a.LocalAddress() {
+		t.Errorf("Expected hello from %v, got %q from %v", a.LocalAddress(), data, source)
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("The packet should be delayed by the latency, took %v", elapsed)
+	}
+
+	network.SetConditions(simulator.Conditions{})
+	network.Partition([]string{a.LocalAddress()})
+	a.Send([]byte("cut"), b.LocalAddress())
+
+	network.Heal()
+	network.SetLink(a.LocalAddress(), b.LocalAddress(), simulator.Conditions{Loss: 1})
+	b.Send([]byte("lost"), a.LocalAddress())
+
+	network.ResetLink(a.LocalAddress(), b.LocalAddress())
+	a.Send([]byte("healed"), b.LocalAddress())
+
+	if data, _, _ := b.Receive(); string(data) != "healed" {
+		t.Errorf("Only the packet sent after healing should arrive, got %q", data)
+	}
+
+	if stats := network.Stats(); stats.Sent != 4 || stats.Delivered != 2 || stats.Lost != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	if err := a.Send(make([]byte, common.SocketBufferSize+1), b.LocalAddress()); err != simulator.ErrDatagramTooBig {
+		t.Errorf("A datagram bigger than the buffer should be rejected, got %v", err)
+	}
+
+	a.Unbind()
+
+	if err := a.Send([]byte("closed"), b.LocalAddress()); err != common.ErrTransportClosed {
+		t.Errorf("An unbound socket should not send, got %v", err)
+	}
+
+	if _, _, ok := a.Receive(); ok {
+		t.Errorf("An unbound socket should not receive")
+	}
+}
+
+func TestSimulatedNetworkIsSeeded(t *testing.T) {
+
+	received := func(seed int64) []string {
+
+		network := simulator.NewNetwork(seed, simulator.Conditions{Loss: 0.5})
+
+		a, _ := network.Bind("10.0.0.1:5000")
+		b, _ := network.Bind("10.0.0.2:5000")
+		defer a.Unbind()
+		defer b.Unbind()
+
+		for i := 0; i < 50; i++ {
+			a.Send([]byte(fmt.Sprint(i)), b.LocalAddress())
+		}
+
+		packets := make([]string, network.Stats().Delivered)
+
+		for i := range packets {
+			data, _, _ := b.Receive()
+			packets[i] = string(data)
+		}
+
+		return packets
+	}
+
+	first, second, other := received(42), received(42), received(43)
+
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Errorf("The same seed should lose the same packets, got %v and %v", first, second)
+	}
+
+	if fmt.Sprint(first) == fmt.Sprint(other) {
+		t.Errorf("Another seed should lose other packets, got %v twice", first)
+	}
+
+	if len(first) == 0 || len(first) == 50 {
+		t.Errorf("Half of the packets should be lost, got %v", first)
+	}
+}
+
+func TestSimulatedRumorsConverge(t *testing.T) {
+
+	holdMinedBlocks(t)
+
+	cluster := startCluster(t, simulator.Options{
+		Size:     8,
+		Seed:     1,
+		Topology: simulator.Ring,
+		Conditions: simulator.Conditions{
+			Latency:      5 * time.Millisecond,
+			Jitter:       10 * time.Millisecond,
+			Loss:         0.2,
+			Reorder:      0.1,
+			ReorderDelay: 30 * time.Millisecond,
+		},
+	})
+	defer cluster.Stop()
+
+	for i, node := range cluster.Nodes {
+		command, _ := common.NewMessageCommand(fmt.Sprintf("Hello from %v", i))
+		node.HandleClient(command)
+	}
+
+	converged := simulator.WaitFor(20*time.Second, func() bool {
+		for _, node := range cluster.Nodes {
+			for i := range cluster.Nodes {
+				if !hasRumor(node, simulator.Name(i), fmt.Sprintf("Hello from %v", i)) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+
+	if !converged {
+		t.Fatalf("All nodes should eventually know all rumors despite losses, network stats: %+v", cluster.Network.Stats())
+	}
+
+	if stats := cluster.Network.Stats(); stats.Lost == 0 {
+		t.Errorf("Some packets should have been lost, got %+v", stats)
+	}
+}
+
+func TestSimulatedRouting(t *testing.T) {
+
+	holdMinedBlocks(t)
+
+	cluster := startCluster(t, simulator.Options{
+		Size:       5,
+		Seed:       2,
+		Topology:   simulator.Line,
+		Conditions: simulator.Conditions{Latency: 2 * time.Millisecond},
+		RouteTimer: 1,
+	})
+	defer cluster.Stop()
+
+	first, last := cluster.Nodes[0], cluster.Nodes[4]
+	messages := last.Events.Subscribe()
+
+	routed := simulator.WaitFor(10*time.Second, func() bool {
+		first.Router.Mutex.RLock()
+		defer first.Router.Mutex.RUnlock()
+		return first.Router.NextHop[simulator.Name(4)] == simulator.Address(1)
+	})
+
+	if !routed {
+		t.Fatalf("The first node should route to the last one through the second one")
+	}
+
+	command, _ := common.NewPrivateMessageCommand("Hello", simulator.Name(4))
+	first.HandleClient(command)
+
+	event := waitForEvent(t, messages, func(event *gossiper.Event) bool {
+		return event.PrivateMessage != nil
+	})
+
+	if event.PrivateMessage.Origin != simulator.Name(0) || event.PrivateMessage.Text != "Hello" {
+		t.Errorf("The last node should receive the private message, got %v", event)
+	}
+}
+
+func TestSimulatedDownload(t *testing.T) {
+
+	holdMinedBlocks(t)
+
+	cluster := startCluster(t, simulator.Options{
+		Size:     4,
+		Seed:     3,
+		Topology: simulator.Line,
+		Conditions: simulator.Conditions{
+			Latency:      2 * time.Millisecond,
+			Jitter:       5 * time.Millisecond,
+			Reorder:      0.2,
+			ReorderDelay: 20 * time.Millisecond,
+		},
+		RouteTimer: 1,
+	})
+	defer cluster.Stop()
+
+	data := randomData(5*common.FileChunkSize/2, 3)
+
+	metaFile, err := cluster.Share(3, "photo.jpg", data)
+	if err != nil {
+		t.Fatalf("Could not share the file: %v", err)
+	}
+
+	waitForRoute(t, cluster.Nodes[0], simulator.Name(3))
+
+	download := cluster.Nodes[0].StartDownload("photo.jpg", metaFile.Hash, simulator.Name(3))
+	waitForDownload(t, download)
+
+	if downloaded, err := cluster.Downloaded(0, "photo.jpg"); err != nil || !bytes.Equal(downloaded, data) {
+		t.Errorf("The downloaded file should be identical, got %v bytes (%v)", len(downloaded), err)
+	}
+}
+
+func TestSimulatedDownloadWithRepeatedChunks(t *testing.T) {
+
+	holdMinedBlocks(t)
+
+	// A request left without reply would only be retried after the timeout
+	setTunable(t, "downloadTimeout", "30s")
+
+	cluster := startCluster(t, simulator.Options{Size: 2, Seed: 12, Topology: simulator.Line, RouteTimer: 1})
+	defer cluster.Stop()
+
+	// Four chunks of zeros, then a different one
+	data := append(make([]byte, 4*common.FileChunkSize), randomData(common.FileChunkSize, 12)...)
+
+	metaFile, err := cluster.Share(1, "disk.img", data)
+	if err != nil {
+		t.Fatalf("Could not share the file: %v", err)
+	}
+
+	waitForRoute(t, cluster.Nodes[0], simulator.Name(1))
+	waitForRoute(t, cluster.Nodes[1], simulator.Name(0))
+
+	download := cluster.Nodes[0].StartDownload("disk.img", metaFile.Hash, simulator.Name(1))
+
+	completed := simulator.WaitFor(5*time.Second, func() bool {
+		return download.State() == gossiper.DownloadCompleted
+	})
+
+	if done, total := download.Progress(); !completed || done != 5 || total != 5 {
+		t.Fatalf("The download should complete without waiting for a timeout, got %v with %v/%v chunks",
+			download.State(), done, total)
+	}
+
+	if downloaded, err := cluster.Downloaded(0, "disk.img"); err != nil || !bytes.Equal(downloaded, data) {
+		t.Errorf("The downloaded file should be identical, got %v bytes (%v)", len(downloaded), err)
+	}
+
+	// The metafile and each distinct chunk are requested once
+	if requests := cluster.Nodes[0].Metrics.PacketsSent.With("dataRequest").Value(); requests != 3 {
+		t.Errorf("Expected 3 data requests, got %v", requests)
+	}
+}
+
+func TestSimulatedSearch(t *testing.T) {
+
+	holdMinedBlocks(t)
+
+	cluster := startCluster(t, simulator.Options{
+		Size:       6,
+		Seed:       4,
+		Topology:   simulator.Ring,
+		Conditions: simulator.Conditions{Latency: 2 * time.Millisecond, Jitter: 5 * time.Millisecond},
+		RouteTimer: 1,
+	})
+	defer cluster.Stop()
+
+	data := randomData(common.FileChunkSize+100, 4)
+
+	metaFile, err := cluster.Share(3, "report.txt", data)
+	if err != nil {
+		t.Fatalf("Could not share the file: %v", err)
+	}
+
+	waitForRoute(t, cluster.Nodes[0], simulator.Name(3))
+
+	cluster.Nodes[0].StartSearch([]string{"rep"}, common.SearchNoBudget)
+
+	found := simulator.WaitFor(10*time.Second, func() bool {
+		_, found := cluster.Nodes[0].SearchEngine.FileMap(metaFile.Hash)
+		return found
+	})
+
+	if !found {
+		t.Fatalf("The search should find the file of the opposite node")
+	}
+
+	// Without a peer, the download uses the results of the search
+	download := cluster.Nodes[0].StartDownload("report.txt", metaFile.Hash, "")
+	waitForDownload(t, download)
+
+	if downloaded, _ := cluster.Downloaded(0, "report.txt"); !bytes.Equal(downloaded, data) {
+		t.Errorf("The downloaded file should be identical, got %v bytes", len(downloaded))
+	}
+}
+
+func TestSimulatedChainForkIsResolved(t *testing.T) {
+
+	setTunable(t, "initialMiningSleep", "100ms")
+	setTunable(t, "miningDifficulty", "255")
+
+	cluster := startCluster(t, simulator.Options{
+		Size:       4,
+		Seed:       5,
+		Topology:   simulator.FullMesh,
+		Conditions: simulator.Conditions{Latency: time.Millisecond},
+	})
+	defer cluster.Stop()
+
+	// Both halves mine on their own branch and only learn about the other one much later. Blocks still
+	// arrive in order, so that each half knows the whole branch of the other one.
+	slow := simulator.Conditions{Latency: 5 * time.Second}
+
+	for _, left := range []int{0, 1} {
+		for _, right := range []int{2, 3} {
+			cluster.Network.SetLink(simulator.Address(left), simulator.Address(right), slow)
+		}
+	}
+
+	cluster.Share(0, "left.txt", []byte("left"))
+	cluster.Share(2, "right.txt", []byte("right"))
+
+	split := simulator.WaitFor(4*time.Second, func() bool {
+		_, leftOnRight := fileBlock(cluster.Nodes[2], "left.txt")
+		_, rightOnLeft := fileBlock(cluster.Nodes[0], "right.txt")
+		_, left := fileBlock(cluster.Nodes[0], "left.txt")
+		_, right := fileBlock(cluster.Nodes[2], "right.txt")
+		return left && right && !leftOnRight && !rightOnLeft
+	})
+
+	if !split {
+		t.Fatalf("Each half should mine its own file on its own branch")
+	}
+
+	for _, left := range []int{0, 1} {
+		for _, right := range []int{2, 3} {
+			cluster.Network.ResetLink(simulator.Address(left), simulator.Address(right))
+		}
+	}
+
+	agreed := simulator.WaitFor(30*time.Second, func() bool {
+
+		// Both files end up in the same blocks for everyone, so one half dropped its own blocks
+		for _, name := range []string{"left.txt", "right.txt"} {
+
+			expected, found := fileBlock(cluster.Nodes[0], name)
+
+			for _, node := range cluster.Nodes {
+				if hash, ok := fileBlock(node, name); !found || !ok || hash != expected {
+					return false
+				}
+			}
+		}
+
+		return true
+	})
+
+	if !agreed {
+		t.Fatalf("Nodes should agree on the blocks of both files once the link is fast again")
+	}
+
+	rewinds := uint64(0)
+
+	for _, node := range cluster.Nodes {
+		rewinds += node.Metrics.Rewinds.Value()
+	}
+
+	if rewinds == 0 {
+		t.Errorf("At least one node should have switched to the branch of the other half")
+	}
+}
+
+//
+//  HELPERS
+//
+
+// Start a cluster, which is stopped by the caller
+func startCluster(t *testing.T, options simulator.Options) *simulator.Cluster {
+
+	cluster, err := simulator.NewCluster(options)
+	if err != nil {
+		t.Fatalf("Could not create the cluster: %v", err)
+	}
+
+	cluster.Start()
+
+	return cluster
+}
+
+// Keep mined blocks from being published until the end of the test. Blocks use the IDs of rumors, which
+// would make the rumors that follow them harder to follow in tests that are not about the chain.
+func holdMinedBlocks(t *testing.T) {
+	setTunable(t, "initialMiningSleep", "1h")
+}
+
+func hasRumor(node *gossiper.Gossiper, origin, text string) bool {
+
+	for id := common.InitialId; id < node.Rumors.NextIDFor(origin); id++ {
+
+		rumor := node.Rumors.Get(origin, id)
+
+		if message, ok := (*rumor).(*common.RumorMessage); ok && message.Text == text {
+			return true
+		}
+	}
+
+	return false
+}
+
+func waitForRoute(t *testing.T, node *gossiper.Gossiper, destination string) {
+
+	routed := simulator.WaitFor(10*time.Second, func() bool {
+		node.Router.Mutex.RLock()
+		defer node.Router.Mutex.RUnlock()
+		_, found := node.Router.NextHop[destination]
+		return found
+	})
+
+	if !routed {
+		t.Fatalf("%v should have a route to %v", node.Name, destination)
+	}
+}
+
+func waitForDownload(t *testing.T, download *gossiper.Download) {
+
+	completed := simulator.WaitFor(15*time.Second, func() bool {
+		return download.State() == gossiper.DownloadCompleted
+	})
+
+	if !completed {
+		done, total := download.Progress()
+		t.Fatalf("The download should complete, got %v with %v/%v chunks", download.State(), done, total)
+	}
+}
+
+// Hash of the block of the longest chain that publishes a file
+func fileBlock(node *gossiper.Gossiper, name string) ([32]byte, bool) {
+
+	for _, block := range node.BlockChain.LongestChain() {
+		for _, transaction := range block.Transactions {
+			if transaction.File.Name == name {
+				return block.Hash(), true
+			}
+		}
+	}
+
+	return [32]byte{}, false
+}
+
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
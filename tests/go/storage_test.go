@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func newTestStorage(t *testing.T) (*gossiper.DiskStorage, string) {
+
+	path, err := ioutil.TempDir("", "peerster-storage")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+
+	storage, err := gossiper.NewDiskStorage(path)
+	if err != nil {
+		t.Fatalf("Could not open storage: %v", err)
+	}
+
+	return storage, path
+}
+
+func TestStorageReloadsRecords(t *testing.T) {
+
+	storage, path := newTestStorage(t)
+	defer os.RemoveAll(path)
+
+	storage.StoreRumor(&common.RumorMessage{Origin: "A", ID: 1, Text: "Hello"})
+	storage.StoreRumor(&common.TxPublish{Origin: "B", ID: 1, File: common.File{Name: "hello.txt"}})
+	storage.StorePrivateMessage(common.NewPrivateMessage("A", "B", "Hi"))
+
+	block := &common.Block{Transactions: []common.TxPublish{{File: common.File{Name: "hello.txt"}}}}
+	storage.StoreBlock(block)
+
+	metaFile := gossiper.NewMetaFile("hello.txt", make([]byte, sha256.Size))
+	storage.StoreMetaFile(metaFile)
+
+	storage.Close()
+
+	storage, err := gossiper.NewDiskStorage(path)
+	if err != nil {
+		t.Fatalf("Could not reopen storage: %v", err)
+	}
+	defer storage.Close()
+
+	rumors := storage.LoadRumors()
+
+	if len(rumors) != 2 {
+		t.Fatalf("Expected 2 rumors, got %v", len(rumors))
+	}
+
+	if rumor, ok := rumors[0].(*common.RumorMessage); !ok || rumor.Text != "Hello" {
+		t.Errorf("Wrong first rumor %v", rumors[0])
+	}
+
+	if tx, ok := rumors[1].(*common.TxPublish); !ok || tx.File.Name != "hello.txt" {
+		t.Errorf("Wrong second rumor %v", rumors[1])
+	}
+
+	messages := storage.LoadPrivateMessages()
+
+	if len(messages) != 1 || messages[0].Text != "Hi" || messages[0].Destination != "B" {
+		t.Errorf("Wrong private messages %v", messages)
+	}
+
+	blocks := storage.LoadBlocks()
+
+	if len(blocks) != 1 || blocks[0].Hash() != block.Hash() {
+		t.Errorf("Wrong blocks %v", blocks)
+	}
+
+	metaFiles := storage.LoadMetaFiles()
+
+	if len(metaFiles) != 1 || metaFiles[0].Name != "hello.txt" || !bytes.Equal(metaFiles[0].Hash, metaFile.Hash) {
+		t.Errorf("Wrong metafiles %v", metaFiles)
+	}
+}
+
+func TestStorageIgnoresTruncatedRecord(t *testing.T) {
+
+	storage, path := newTestStorage(t)
+	defer os.RemoveAll(path)
+
+	storage.StoreRumor(&common.RumorMessage{Origin: "A", ID: 1, Text: "Hello"})
+	storage.Close()
+
+	// Simulate a crash in the middle of writing a second record
+	file, _ := os.OpenFile(path+"/rumors.log", os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{42, 1, 2})
+	file.Close()
+
+	storage, _ = gossiper.NewDiskStorage(path)
+
+	if rumors := storage.LoadRumors(); len(rumors) != 1 {
+		t.Errorf("Expected 1 rumor, got %v", len(rumors))
+	}
+
+	// Records written after the torn one should not be lost
+	storage.StoreRumor(&common.RumorMessage{Origin: "A", ID: 2, Text: "World"})
+	storage.Close()
+
+	storage, _ = gossiper.NewDiskStorage(path)
+	defer storage.Close()
+
+	rumors := storage.LoadRumors()
+
+	if len(rumors) != 2 {
+		t.Fatalf("Expected 2 rumors, got %v", len(rumors))
+	}
+
+	if rumor, ok := rumors[1].(*common.RumorMessage); !ok || rumor.Text != "World" {
+		t.Errorf("Wrong second rumor %v", rumors[1])
+	}
+}
+
+func TestStorageIgnoresOversizedRecord(t *testing.T) {
+
+	storage, path := newTestStorage(t)
+	defer os.RemoveAll(path)
+
+	storage.Close()
+
+	// A corrupted length prefix should not make the node allocate that much memory
+	file, _ := os.OpenFile(path+"/rumors.log", os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f})
+	file.Close()
+
+	storage, _ = gossiper.NewDiskStorage(path)
+	defer storage.Close()
+
+	if rumors := storage.LoadRumors(); len(rumors) != 0 {
+		t.Errorf("Expected no rumor, got %v", len(rumors))
+	}
+}
+
+func TestGossiperRestoresStateAfterRestart(t *testing.T) {
+
+	path, err := ioutil.TempDir("", "peerster-restart")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	alice := newTestGossiper(t, "127.0.0.1:9396", "Alice", "", path, 0)
+
+	command, _ := common.NewMessageCommand("Hello")
+	alice.HandleClient(command)
+
+	command, _ = common.NewPrivateMessageCommand("Hi", "Bob")
+	alice.HandleClient(command)
+
+	genesis := newGenesisBlock([]string{"hello.txt"})
+	alice.BlockChain.TryAddBlock(genesis)
+	alice.BlockChain.TryAddBlock(newValidBlock(genesis.Hash(), []string{"world.txt"}))
+
+	status := alice.GenerateStatusPacket()
+	latest := alice.BlockChain.Latest
+	messages := alice.PrivateMessages()
+
+	stopTestGossiper(alice)
+
+	alice = newTestGossiper(t, "127.0.0.1:9396", "Alice", "", path, 0)
+	defer stopTestGossiper(alice)
+
+	if restored := alice.GenerateStatusPacket(); len(restored.Want) != 1 || !reflect.DeepEqual(restored.Want, status.Want) {
+		t.Errorf("Expected vector clock %v, got %v", status.Want, restored.Want)
+	}
+
+	if alice.BlockChain.Latest != latest {
+		t.Errorf("Expected chain tip %x, got %x", latest, alice.BlockChain.Latest)
+	}
+
+	if restored := alice.PrivateMessages(); len(restored) != len(messages) || restored[0].Text != "Hi" {
+		t.Errorf("Expected private messages %v, got %v", messages, restored)
+	}
+}
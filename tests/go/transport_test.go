@@ -0,0 +1,255 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/jfperren/Peerster/common"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTCPTransportSendsBigPackets(t *testing.T) {
+
+	alice := newTestTransport(t, "127.0.0.1:9290")
+	defer alice.Unbind()
+
+	bob := newTestTransport(t, "127.0.0.1:9291")
+	defer bob.Unbind()
+
+	// Much bigger than what fits in a datagram
+	data := make([]byte, 4*common.SocketBufferSize)
+	rand.Read(data)
+
+	if err := alice.Send(data, bob.Address); err != nil {
+		t.Fatalf("Could not send packet: %v", err)
+	}
+
+	received, source, alive := bob.Receive()
+
+	if !alive || source != alice.Address || !bytes.Equal(received, data) {
+		t.Fatalf("Wrong packet received from %v (%v bytes)", source, len(received))
+	}
+
+	// The reply should go through the same connection
+	if err := bob.Send([]byte("Thanks"), source); err != nil {
+		t.Fatalf("Could not reply: %v", err)
+	}
+
+	received, source, _ = alice.Receive()
+
+	if source != bob.Address || string(received) != "Thanks" {
+		t.Errorf("Wrong reply %v from %v", string(received), source)
+	}
+}
+
+func TestTCPTransportUnreachablePeer(t *testing.T) {
+
+	alice := newTestTransport(t, "127.0.0.1:9292")
+	defer alice.Unbind()
+
+	if err := alice.Send([]byte("Hello"), "127.0.0.1:9293"); err == nil {
+		t.Errorf("Sending to a peer that does not listen should fail")
+	}
+
+	alice.Unbind()
+
+	if _, _, alive := alice.Receive(); alive {
+		t.Errorf("Transport should not be alive after Unbind")
+	}
+}
+
+func TestTCPTransportRejectsImpostors(t *testing.T) {
+
+	setTunable(t, "tcpDialTimeout", "200ms")
+
+	alice := newTestTransport(t, "127.0.0.1:9294")
+	defer alice.Unbind()
+
+	// A connection from 127.0.0.1 cannot claim to come from another host
+	conn, err := net.Dial("tcp4", alice.Address)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	writeFrame(conn, []byte("10.0.0.1:5000"))
+	writeFrame(conn, []byte("Hello"))
+
+	if !closedByPeer(conn, time.Second) {
+		t.Errorf("A connection claiming another host should be closed")
+	}
+
+	// A connection that does not introduce itself is closed after the timeout
+	silent, err := net.Dial("tcp4", alice.Address)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer silent.Close()
+
+	if !closedByPeer(silent, time.Second) {
+		t.Errorf("A connection that sends no address should be closed")
+	}
+
+	// Nor can it announce a frame bigger than any packet
+	big, err := net.Dial("tcp4", alice.Address)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer big.Close()
+
+	writeFrame(big, []byte("127.0.0.1:9295"))
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, common.TCPMaxFrameSize+1)
+	big.Write(header)
+
+	if !closedByPeer(big, time.Second) {
+		t.Errorf("A connection announcing a frame too big should be closed")
+	}
+}
+
+func TestTCPTransportClosesReplacedConnections(t *testing.T) {
+
+	alice := newTestTransport(t, "127.0.0.1:9280")
+	defer alice.Unbind()
+
+	first, err := net.Dial("tcp4", alice.Address)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer first.Close()
+
+	// Once the packet is received, the connection is registered
+	writeFrame(first, []byte("127.0.0.1:9281"))
+	writeFrame(first, []byte("Hello"))
+	alice.Receive()
+
+	// The same neighbor connects again, e.g. after it restarted
+	second, err := net.Dial("tcp4", alice.Address)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer second.Close()
+
+	writeFrame(second, []byte("127.0.0.1:9281"))
+	writeFrame(second, []byte("Hello again"))
+	alice.Receive()
+
+	if !closedByPeer(first, time.Second) {
+		t.Errorf("The replaced connection should be closed")
+	}
+}
+
+func TestTCPTransportOpensOneConnectionForConcurrentSends(t *testing.T) {
+
+	alice := newTestTransport(t, "127.0.0.1:9282")
+	defer alice.Unbind()
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:9283")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			alice.Send([]byte("Hello"), "127.0.0.1:9283")
+		}()
+	}
+
+	wg.Wait()
+
+	// Give late connections a chance to show up
+	time.Sleep(100 * time.Millisecond)
+
+	if count := len(accepted); count != 1 {
+		t.Errorf("Expected a single connection, got %v", count)
+	}
+
+	for len(accepted) > 0 {
+		(<-accepted).Close()
+	}
+}
+
+func TestTCPTransportWritesTimeOut(t *testing.T) {
+
+	setTunable(t, "tcpWriteTimeout", "200ms")
+
+	alice := newTestTransport(t, "127.0.0.1:9284")
+	defer alice.Unbind()
+
+	// A neighbor that accepts connections but never reads from them
+	listener, err := net.Listen("tcp4", "127.0.0.1:9285")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	sent := make(chan error, 1)
+
+	go func() { sent <- alice.Send(make([]byte, common.TCPMaxFrameSize), "127.0.0.1:9285") }()
+
+	select {
+	case err := <-sent:
+		if err == nil {
+			t.Errorf("Writing to a neighbor that does not read should fail")
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("Writing to a neighbor that does not read should time out")
+	}
+}
+
+func newTestTransport(t *testing.T, address string) *common.TCPTransport {
+
+	transport, err := common.NewTCPTransport(address)
+	if err != nil {
+		t.Fatalf("Could not create transport: %v", err)
+	}
+
+	return transport
+}
+
+func writeFrame(conn net.Conn, data []byte) {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	conn.Write(append(header, data...))
+}
+
+// Check whether the other end closes or resets a connection within a given time
+func closedByPeer(conn net.Conn, timeout time.Duration) bool {
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := conn.Read(make([]byte, 1))
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false
+	}
+
+	return err != nil
+}
@@ -1,10 +1,68 @@
 package tests
 
 import (
+	"context"
 	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
 	"testing"
+	"time"
 )
 
+// Gossiper without a client socket, listening on address and connected to peers (comma-separated). Its files are
+// kept in memory unless dataDir is set, and it sends route rumors every rtimer seconds unless rtimer is 0.
+func newTestGossiper(t *testing.T, address, name, peers, dataDir string, rtimer int) *gossiper.Gossiper {
+
+	g, err := gossiper.NewGossiper(address, "", name, peers, false, rtimer, true, dataDir, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Could not create gossiper %v: %v", name, err)
+	}
+
+	return g
+}
+
+// Stop a gossiper created with newTestGossiper, without a deadline.
+func stopTestGossiper(g *gossiper.Gossiper) {
+	g.Stop(context.Background())
+}
+
+// Change one of the Tunables until the end of the test, given by its key in the [tuning] section.
+func setTunable(t *testing.T, key, value string) {
+
+	keepTunables(t, key)
+
+	if err := common.SetTunable(key, value); err != nil {
+		t.Fatalf("Could not set %v: %v", key, err)
+	}
+}
+
+// Restore Tunables once the test is over. Cleanup functions run after deferred calls, so the gossipers that
+// the test stops in a deferred call no longer read them.
+func keepTunables(t *testing.T, keys ...string) {
+
+	for _, key := range keys {
+
+		switch pointer := common.Tunables[key].(type) {
+		case *time.Duration:
+			value := *pointer
+			t.Cleanup(func() { *pointer = value })
+		case *int:
+			value := *pointer
+			t.Cleanup(func() { *pointer = value })
+		case *uint64:
+			value := *pointer
+			t.Cleanup(func() { *pointer = value })
+		case *uint32:
+			value := *pointer
+			t.Cleanup(func() { *pointer = value })
+		case *byte:
+			value := *pointer
+			t.Cleanup(func() { *pointer = value })
+		default:
+			t.Fatalf("Unknown tunable %v", key)
+		}
+	}
+}
+
 func TestSplitsDeterministic(t *testing.T) {
 
     splits := common.SplitBudget(0, 1)
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/jfperren/Peerster/gossiper"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send an API request with a given Authorization header and return the status code
+func callWithAuthorization(t *testing.T, url, method, authorization string) int {
+
+	req, _ := http.NewRequest(method, url, strings.NewReader(`{"Address": "127.0.0.1:9799"}`))
+
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v %v failed: %v", method, url, err)
+	}
+
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestWebServerRoles(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9790", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	options := gossiper.WebServerOptions{ReadToken: "reader", AdminToken: "admin"}
+	server := httptest.NewServer(gossiper.NewWebServer(g, options))
+	defer server.Close()
+
+	peers := server.URL + gossiper.APIPrefix + "/peers"
+
+	cases := []struct {
+		method        string
+		authorization string
+		status        int
+	}{
+		{"GET", "", http.StatusUnauthorized},
+		{"GET", "Bearer wrong", http.StatusUnauthorized},
+		{"GET", "Bearer reader", http.StatusOK},
+		{"POST", "Bearer reader", http.StatusForbidden},
+		{"POST", "Bearer admin", http.StatusCreated},
+		{"GET", "Basic " + basicCredentials("anyone", "reader"), http.StatusOK},
+		{"POST", "Basic " + basicCredentials("anyone", "admin"), http.StatusCreated},
+	}
+
+	for _, c := range cases {
+		if status := callWithAuthorization(t, peers, c.method, c.authorization); status != c.status {
+			t.Errorf("%v with '%v': expected %v, got %v", c.method, c.authorization, c.status, status)
+		}
+	}
+}
+
+func basicCredentials(user, password string) string {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth(user, password)
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Basic ")
+}
+
+func TestWebServerServesTLS(t *testing.T) {
+
+	path := newTestDir(t)
+	defer os.RemoveAll(path)
+
+	certFile, keyFile := writeSelfSignedCertificate(t, path)
+
+	g := newTestGossiper(t, "127.0.0.1:9791", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	server := startTestWebServer(t, g, "9792", gossiper.WebServerOptions{CertFile: certFile, KeyFile: keyFile})
+	defer server.Shutdown(context.Background())
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	deadline := time.Now().Add(2 * time.Second)
+
+	for {
+
+		res, err := client.Get("https://127.0.0.1:9792" + gossiper.APIPrefix + "/node")
+
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("Expected 200, got %v", res.StatusCode)
+			}
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Could not reach the server over TLS: %v", err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Write a certificate for 127.0.0.1 and its key in a folder, return their paths
+func writeSelfSignedCertificate(t *testing.T, path string) (string, string) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Peerster"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(path, "cert.pem")
+	keyFile := filepath.Join(path, "key.pem")
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestWebServerRejectsInvalidCertificate(t *testing.T) {
+
+	path := newTestDir(t)
+	defer os.RemoveAll(path)
+
+	certFile, _ := writeSelfSignedCertificate(t, path)
+
+	g := newTestGossiper(t, "127.0.0.1:9793", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	// The certificate is given as its own key
+	options := gossiper.WebServerOptions{CertFile: certFile, KeyFile: certFile}
+
+	if _, err := gossiper.StartWebServer(g, "127.0.0.1:9794", options); err == nil {
+		t.Errorf("Starting a web server with an invalid key should fail")
+	}
+}
@@ -0,0 +1,213 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/jfperren/Peerster/common"
+	"github.com/jfperren/Peerster/gossiper"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Serve the API of g without authentication.
+func newTestWebServer(g *gossiper.Gossiper) *httptest.Server {
+	return httptest.NewServer(gossiper.NewWebServer(g, gossiper.WebServerOptions{}))
+}
+
+// Start a web server for g on address, as the executable does.
+func startTestWebServer(t *testing.T, g *gossiper.Gossiper, address string, options gossiper.WebServerOptions) *gossiper.WebServer {
+
+	server, err := gossiper.StartWebServer(g, address, options)
+	if err != nil {
+		t.Fatalf("Could not start web server: %v", err)
+	}
+
+	return server
+}
+
+// Send a request to the API and decode the response into body. Return the status code.
+func callAPI(t *testing.T, server *httptest.Server, method, path string, request, body interface{}) int {
+
+	var reader *bytes.Reader
+
+	if request != nil {
+		data, _ := json.Marshal(request)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, _ := http.NewRequest(method, server.URL+gossiper.APIPrefix+path, reader)
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("%v %v failed: %v", method, path, err)
+	}
+
+	defer res.Body.Close()
+
+	if body != nil {
+		json.NewDecoder(res.Body).Decode(body)
+	}
+
+	return res.StatusCode
+}
+
+func TestWebServersServeTheirOwnNode(t *testing.T) {
+
+	alice := newTestGossiper(t, "127.0.0.1:9690", "Alice", "", "", 0)
+	defer stopTestGossiper(alice)
+
+	aliceServer := newTestWebServer(alice)
+	defer aliceServer.Close()
+
+	bob := newTestGossiper(t, "127.0.0.1:9691", "Bob", "", "", 0)
+	defer stopTestGossiper(bob)
+
+	bobServer := newTestWebServer(bob)
+	defer bobServer.Close()
+
+	var node gossiper.Node
+
+	if callAPI(t, aliceServer, "GET", "/node", nil, &node); node.Name != "Alice" {
+		t.Errorf("Expected Alice, got %v", node.Name)
+	}
+
+	if callAPI(t, bobServer, "GET", "/node", nil, &node); node.Name != "Bob" {
+		t.Errorf("Expected Bob, got %v", node.Name)
+	}
+}
+
+func TestRumorsSince(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9692", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	server := newTestWebServer(g)
+	defer server.Close()
+
+	if status := callAPI(t, server, "POST", "/rumors", &gossiper.NewRumor{"Hello"}, nil); status != http.StatusCreated {
+		t.Fatalf("Expected 201, got %v", status)
+	}
+
+	var rumors gossiper.Rumors
+	callAPI(t, server, "GET", "/rumors", nil, &rumors)
+
+	if len(rumors.Rumors) != 1 || rumors.Next != "Alice:2" {
+		t.Fatalf("Expected one rumor and Next Alice:2, got %v rumors and Next %v", len(rumors.Rumors), rumors.Next)
+	}
+
+	callAPI(t, server, "GET", "/rumors?since="+rumors.Next, nil, &rumors)
+
+	if len(rumors.Rumors) != 0 {
+		t.Errorf("Expected no new rumors, got %v", len(rumors.Rumors))
+	}
+
+	var apiError gossiper.APIError
+
+	if status := callAPI(t, server, "GET", "/rumors?since=Alice", nil, &apiError); status != http.StatusBadRequest || apiError.Code != "bad_request" {
+		t.Errorf("Expected bad_request, got %v %v", status, apiError.Code)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9693", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	server := newTestWebServer(g)
+	defer server.Close()
+
+	var apiError gossiper.APIError
+
+	if status := callAPI(t, server, "GET", "/downloads/00ff", nil, &apiError); status != http.StatusNotFound || apiError.Code != "not_found" {
+		t.Errorf("Expected not_found, got %v %v", status, apiError.Code)
+	}
+
+	if status := callAPI(t, server, "GET", "/chain/blocks/zz", nil, &apiError); status != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %v", status)
+	}
+
+	if status := callAPI(t, server, "GET", "/files/"+strings.Repeat("00", 32), nil, &apiError); status != http.StatusNotFound {
+		t.Errorf("Expected 404, got %v", status)
+	}
+
+	if status := callAPI(t, server, "POST", "/private-messages", &gossiper.Message{"", "Hi"}, &apiError); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 without destination, got %v", status)
+	}
+
+	if status := callAPI(t, server, "PUT", "/node", nil, &apiError); status != http.StatusMethodNotAllowed || apiError.Code != "method_not_allowed" {
+		t.Errorf("Expected method_not_allowed, got %v %v", status, apiError.Code)
+	}
+}
+
+func TestWebServerStreamsEvents(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9694", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	server := newTestWebServer(g)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + gossiper.APIPrefix + "/events")
+
+	if err != nil {
+		t.Fatalf("Could not open event stream: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Unexpected content type %v", contentType)
+	}
+
+	rumor := &common.RumorMessage{"Bob", 1, "Hello"}
+	g.HandleGossip(rumor.Packed(), "127.0.0.1:9699")
+
+	// Skip other events, e.g. the new peer and route, until the rumor
+	reader := bufio.NewReader(res.Body)
+	name := ""
+
+	for {
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended before the rumor event: %v", err)
+		}
+
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "event: ") {
+			name = strings.TrimPrefix(line, "event: ")
+		}
+
+		if strings.HasPrefix(line, "data: ") && name == "rumor" {
+
+			var received common.RumorMessage
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &received)
+
+			if received.Origin != "Bob" || received.ID != 1 || received.Text != "Hello" {
+				t.Errorf("Unexpected rumor %v", received)
+			}
+
+			return
+		}
+	}
+}
+
+func TestStartWebServerReportsListenErrors(t *testing.T) {
+
+	g := newTestGossiper(t, "127.0.0.1:9695", "Alice", "", "", 0)
+	defer stopTestGossiper(g)
+
+	server := startTestWebServer(t, g, "127.0.0.1:9696", gossiper.WebServerOptions{})
+	defer server.Shutdown(context.Background())
+
+	if _, err := gossiper.StartWebServer(g, "127.0.0.1:9696", gossiper.WebServerOptions{}); err == nil {
+		t.Errorf("Starting a second web server on the same address should fail")
+	}
+}
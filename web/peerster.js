@@ -1,40 +1,49 @@
-
 // --- SERVICE LAYER --- //
 
-function getMessages(statuses, callback) {
-  $.ajax({
-    method: "GET",
-    url: "/message",
-    headers: {
-      'x-statuses': JSON.stringify(statuses)
-    },
-    success: function(res) {
-      callback(JSON.parse(res));
-    }
-  });
-};
+var API = "/api/v1";
 
-function postMessage(message, statuses, callback) {
+// Send a JSON request to the API. The callback receives the decoded body, or null and an error message.
+function request(method, path, body, callback) {
   $.ajax({
-    method: "POST",
-    url: "/message",
-    data: JSON.stringify(message),
-    headers: {
-      'x-statuses': JSON.stringify(statuses)
-    },
+    method: method,
+    url: API + path,
+    data: body == null ? null : JSON.stringify(body),
+    contentType: "application/json",
+    dataType: "json",
     success: function(res) {
-      callback(JSON.parse(res));
+      if (callback) { callback(res, null); }
     },
     error: function(res) {
-      callback(null, JSON.parse(res));
+      var message = res.responseJSON ? res.responseJSON.Message : res.statusText;
+      if (callback) { callback(null, message); }
     }
   });
+}
+
+// Format statuses as the 'since' parameter of /rumors
+function formatSince(statuses) {
+  return $.map(statuses, (s) => `${s.Identifier}:${s.NextID}`).join(",");
+}
+
+// Parse the 'Next' value returned by /rumors into statuses
+function parseSince(since) {
+  if (since == "") { return [] }
+  return $.map(since.split(","), function(pair) {
+    var i = pair.lastIndexOf(":");
+    return { Identifier: pair.slice(0, i), NextID: parseInt(pair.slice(i + 1)) };
+  });
+}
+
+function getMessages(statuses, callback) {
+  request("GET", `/rumors?since=${encodeURIComponent(formatSince(statuses))}`, null, callback);
+};
+
+function postMessage(message, callback) {
+  request("POST", "/rumors", { Text: message }, callback);
 };
 
 function getNodes(callback) {
-  $.get("/node", function(res) {
-    callback(JSON.parse(res), null);
-  });
+  request("GET", "/peers", null, callback);
 }
 
 function postNode(node, callback) {
@@ -49,142 +58,88 @@ function postNode(node, callback) {
     return
   }
 
-  $.post('/node', JSON.stringify(node), function(res) {
-    callback(JSON.parse(res), null);
-  });
+  request("POST", "/peers", { Address: node }, callback);
 }
 
 function getUsers(callback) {
-    $.get("/user", function(res) {
-        callback(JSON.parse(res), null);
-    });
+  request("GET", "/users", null, callback);
 }
 
 function postPrivateMessage(message, destination, callback) {
-    $.ajax({
-        method: "POST",
-        url: "/privateMessage",
-        data: JSON.stringify({ 'Destination': destination, 'Text': message }),
-        success: function(res) {
-            callback(JSON.parse(res));
-        }
-    });
+  request("POST", "/private-messages", { Destination: destination, Text: message }, callback);
 };
 
 function getPrivateMessages(callback) {
-  $.ajax({
-    method: "GET",
-    headers: {
-      'x-index': privateMessages.length
-    },
-    url: "/privateMessage",
-    success: function(res) {
-      callback(JSON.parse(res));
-    },
-    error: function(res) {
-      callback(null, res);
-    }
-  });
+  request("GET", `/private-messages?since=${privateMessages.length}`, null, callback);
 };
 
 function uploadFile(filename, callback) {
 
   if ($.map(files, (f) => f.Name).includes(filename)) {
-    callback(null, `$filename is already shared onto the network.`)
+    callback(null, `${filename} is already shared onto the network.`)
+    return
   }
 
-  $.ajax({
-    method: "POST",
-    url: "/fileUpload",
-    data: JSON.stringify(filename),
-    success: function(res) {
-      callback(JSON.parse(res));
-    },
-    error: function(res) {
-      callback(null, res);
-    }
-  });
+  request("POST", "/files", { Name: filename }, callback);
 };
 
 function searchRequest(keywords, callback) {
-  $.ajax({
-    method: "POST",
-    url: "/fileSearch",
-    data: JSON.stringify({
-      Keywords: keywords,
-      Budget: 4
-    }),
-    error: function(res) {
-      callback(null, res);
-    }
-  });
+  request("POST", "/searches", { Keywords: keywords.split(","), Budget: 4 }, callback);
 }
 
 function getUploadedFiles(callback) {
-
-  $.get("/fileUpload", function(res) {
-    callback(JSON.parse(res));
-  });
+  request("GET", "/files", null, callback);
 }
 
 function getSearchResult(callback) {
-
-  $.get("/fileSearch", function(res) {
-    callback(JSON.parse(res));
-  });
+  request("GET", "/search-results", null, callback);
 }
 
 function downloadFilePrivate(filename, hash, destination, callback) {
 
   if ($.map(files, (f) => f.Name).includes(filename)) {
-    callback(null, `$filename is already in your list of files.`)
+    callback(null, `${filename} is already in your list of files.`)
+    return
   }
 
-  $.ajax({
-    method: "POST",
-    url: "/fileDownload",
-    data: JSON.stringify({
-      'Destination': destination,
-      'Hash': hash,
-      'Name': filename
-    }),
-    success: function(res) {
-      callback(JSON.parse(res));
-    },
-    error: function(res) {
-      callback(null, res);
-    }
-  });
+  request("POST", "/downloads", { Name: filename, Hash: hash, Destination: destination }, callback);
 };
 
 function downloadFilePublic(filename, hash, callback) {
 
   if ($.map(files, (f) => f.Name).includes(filename)) {
-    callback(null, `$filename is already in your list of files.`)
+    callback(null, `${filename} is already in your list of files.`)
+    return
   }
 
-  $.ajax({
-    method: "POST",
-    url: "/fileDownload",
-    data: JSON.stringify({
-      'Name': filename,
-      'Hash': hash,
-    }),
-    success: function(res) {
-      callback(JSON.parse(res));
-    },
-    error: function(res) {
-      callback(null, res);
-    }
-  });
+  request("POST", "/downloads", { Name: filename, Hash: hash }, callback);
 };
 
+// Listen to the events pushed by the node. Returns false if the browser does not support it.
+function subscribeToEvents(handlers) {
+
+  if (!window.EventSource) {
+    return false
+  }
+
+  var source = new EventSource(API + "/events");
+
+  $.each(handlers, function(name, handler) {
+    source.addEventListener(name, function(e) {
+      handler(JSON.parse(e.data));
+    });
+  });
+
+  return true
+}
+
 // --- DOM UPDATE --- //
 
 function enqueueMessages(newMessages) {
 
+  // Rumors can come both from events and from /message, only keep those not seen yet
   newMessages = newMessages.filter(function(message) {
-      return !messages.includes(message) && message.Text != "";
+      return advanceStatus(message) && message.Text != "";
   })
 
   messages = messages.concat(newMessages);
@@ -198,6 +153,37 @@ function enqueueMessages(newMessages) {
   }));
 }
 
+// Mark a rumor as seen in statuses. Returns false if it was already seen.
+function advanceStatus(message) {
+
+  var status = statuses.find((s) => s.Identifier == message.Origin);
+
+  if (status == null) {
+    statuses.push({ Identifier: message.Origin, NextID: message.ID + 1 });
+    return true
+  }
+
+  if (message.ID < status.NextID) {
+    return false
+  }
+
+  status.NextID = message.ID + 1;
+  return true
+}
+
+// A rumor pushed by the node. Rumors missed in between are loaded from /message.
+function receiveRumor(message) {
+
+  var status = statuses.find((s) => s.Identifier == message.Origin);
+  var nextID = status == null ? 1 : status.NextID;
+
+  if (message.ID > nextID) {
+    loadNewMessages()
+  } else {
+    enqueueMessages([message])
+  }
+}
+
 function enqueuePrivateMessages(newPrivateMessages) {
 
   newPrivateMessages = newPrivateMessages.filter(function(privateMessage) {
@@ -292,15 +278,36 @@ function enqueueSearchResults(newResults) {
 function loadNewMessages() {
     getMessages(statuses, function(res, err) {
       if (err != null) { return }
-      enqueueMessages(res["Rumors"])
-      statuses = res["Statuses"]
+      enqueueMessages(res.Rumors)
+      statuses = parseSince(res.Next)
     });
 }
 
+// Private messages are loaded by index, so only one request should be in flight at a time
+var loadingPrivateMessages = false;
+var reloadPrivateMessages = false;
+
 function loadNewPrivateMessages() {
+
+  if (loadingPrivateMessages) {
+    reloadPrivateMessages = true;
+    return
+  }
+
+  loadingPrivateMessages = true;
+
   getPrivateMessages(function(res, err) {
-    if (err != null) { return }
-    enqueuePrivateMessages(res)
+
+    loadingPrivateMessages = false;
+
+    if (err == null) {
+      enqueuePrivateMessages(res.Messages)
+    }
+
+    if (reloadPrivateMessages) {
+      reloadPrivateMessages = false;
+      loadNewPrivateMessages()
+    }
   });
 }
 
@@ -350,11 +357,12 @@ var searchResults = [];
 
 $(function(){
 
-  $.get("/id", function(res) {
+  request("GET", "/node", null, function(res, err) {
 
-    var title = JSON.parse(res)
-    name = title
-    $("#node-title").html(title)
+    if (err != null) { return }
+
+    name = res.Name
+    $("#node-title").html(name)
 
     loadNewPeers()
     loadNewMessages()
@@ -363,11 +371,22 @@ $(function(){
     loadUploadedFiles()
     loadSearchResults()
 
-    setInterval(loadNewMessages, 1000)
-    setInterval(loadNewPeers, 1000)
-    setInterval(loadNewUsers, 1000)
-    setInterval(loadNewPrivateMessages, 1000)
-    setInterval(loadSearchResults, 1000)
+    var subscribed = subscribeToEvents({
+      rumor: receiveRumor,
+      privateMessage: (message) => loadNewPrivateMessages(),
+      peer: (peer) => enqueuePeers([peer]),
+      route: (user) => enqueueUsers([user]),
+      searchMatch: (result) => enqueueSearchResults(searchResults.concat([result]))
+    });
+
+    // Fall back to polling on browsers without server-sent events
+    if (!subscribed) {
+      setInterval(loadNewMessages, 1000)
+      setInterval(loadNewPeers, 1000)
+      setInterval(loadNewUsers, 1000)
+      setInterval(loadNewPrivateMessages, 1000)
+      setInterval(loadSearchResults, 1000)
+    }
   });
 
   $("#add-peer").on('click', function(e){
@@ -396,7 +415,7 @@ $(function(){
     var message = $("#message").val()
     if (message == "") { return }
 
-    postMessage(message, statuses, function(res, err) {
+    postMessage(message, function(res, err) {
 
       // If there's an error, alert and exit
       if (err != null) { alert(err); return }
@@ -404,11 +423,8 @@ $(function(){
       // Reset value in field
       $("#message").val("");
 
-      // Enqueue new messages
-      enqueueMessages(res["Rumors"]);
-
-      // Updates status
-      statuses = res["Statuses"];
+      // Load the new rumor, unless it was already pushed
+      loadNewMessages();
     });
   });
 
@@ -428,7 +444,7 @@ $(function(){
       return
     }
 
-    postPrivateMessage(message, to, function(res) { });
+    postPrivateMessage(message, to, function(res) { loadNewPrivateMessages() });
   });
 
   $("#upload-file").on('click', function(e){
@@ -444,7 +460,7 @@ $(function(){
     uploadFile(filename, function(res, err) {
 
       // If there's an error, alert and exit
-      if (err != null) { alert(err.responseText); return }
+      if (err != null) { alert(err); return }
 
       // Add peer to list
       enqueueFiles([res])
@@ -476,10 +492,7 @@ $(function(){
     downloadFilePrivate(filename, hash, destination, function(res, err) {
 
       // If there's an error, alert and exit
-      if (err != null) { alert(err.responseText); return }
-
-      // Add peer to list
-      enqueueFiles([res])
+      if (err != null) { alert(err); return }
     });
   });
 
@@ -512,6 +525,8 @@ $(function(){
       return
     }
 
-    downloadFilePublic(filename, hash)
+    downloadFilePublic(filename, hash, function(res, err) {
+      if (err != null) { alert(err); return }
+    });
   });
 });